@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 実行結果のファイルのチェックサムを書き込むファイルの拡張子
+const RESULT_CHECKSUM_SUFFIX string = ".sha256"
+
+// 実行結果(JSON)のSHA-256を、16進数表記で返す。
+func ResultChecksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// 実行結果のファイルを、共有ディレクトリへ書き込む。
+// 複数のホストのプロセスで重複しないように、ファイル名は result-{ホスト名}-{プロセスID}.json とする。
+// 書き込んだファイルのパスを返す。
+//   checksum : 実行結果のファイルのSHA-256を、sha256sum の形式で {ファイル名}.sha256 に書き込むかどうか
+func WriteResultFile(dir string, result *Result, checksum bool) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	path := filepath.Join(dir, fmt.Sprintf("result-%s-%d.json", hostname, os.Getpid()))
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	// 集計中のプロセスがチェックサムのない実行結果を読まないように、チェックサムを先に書き込む。
+	if checksum {
+		line := fmt.Sprintf("%s  %s\n", ResultChecksum(body), filepath.Base(path))
+		if err := writeFileAtomic(path+RESULT_CHECKSUM_SUFFIX, []byte(line)); err != nil {
+			return "", err
+		}
+	}
+	return path, writeFileAtomic(path, body)
+}
+
+// 集計中のプロセスが書き込み途中のファイルを読まないように、一時ファイルから名前を変更して書き込む。
+func writeFileAtomic(path string, body []byte) error {
+	if err := ioutil.WriteFile(path+".tmp", body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// 実行結果のファイルを、チェックサムのファイルが存在する場合は検証する。
+// チェックサムが一致しない場合は、エラーを返す。
+func verifyResultChecksum(path string, body []byte) error {
+	content, err := ioutil.ReadFile(path + RESULT_CHECKSUM_SUFFIX)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 || fields[0] != ResultChecksum(body) {
+		return fmt.Errorf("%s : checksum mismatch, the file may be corrupted", path)
+	}
+	return nil
+}
+
+// 共有ディレクトリの実行結果のファイル(*.json)を、ファイル名の順に読み込む。
+func ReadResultFiles(dir string) ([]*Result, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var results []*Result
+	for _, path := range paths {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyResultChecksum(path, body); err != nil {
+			return nil, err
+		}
+		result := &Result{}
+		if err := json.Unmarshal(body, result); err != nil {
+			return nil, fmt.Errorf("%s : %s", path, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// 複数のプロセスの実行結果の集計
+type AggregateResult struct {
+	Processes  int           `json:"processes"`         // 実行結果の数（プロセス数）
+	ClientNum  int           `json:"clients"`           // クライアント数の合計
+	TotalCount int           `json:"total_count"`       // 総メッセージ数の合計
+	Duration   int64         `json:"duration_ms"`       // 最も長い実行時間(ms)
+	Throughput float64       `json:"throughput"`        // スループットの合計(messages/sec)
+	Latency    *LatencyStats `json:"latency,omitempty"` // Publishの応答時間
+	Merged     bool          `json:"merged_samples"`    // 応答時間を、全プロセスのサンプルを合わせて算出したかどうか
+}
+
+// 複数のプロセスの実行結果を集計する。
+// スループットは、各プロセスが同時に実行された前提で合計する。
+// 全ての実行結果に応答時間のサンプルが含まれる場合は、サンプルを合わせて応答時間を算出する。
+// それ以外の場合、応答時間はサンプル数による加重平均と最小値、最大値を求め、パーセンタイルは元のサンプルがないため、
+// 各プロセスの値の最大値（実際の値以上となる上限）とする（パーセンタイルの平均は、正しい値とならない）。
+func AggregateResults(results []*Result) *AggregateResult {
+	aggregate := &AggregateResult{}
+	var latency *LatencyStats = nil
+	var weightedAvg float64 = 0
+	for _, r := range results {
+		aggregate.Processes++
+		aggregate.ClientNum += r.ClientNum
+		aggregate.TotalCount += r.TotalCount
+		aggregate.Throughput += r.Throughput
+		if r.Duration > aggregate.Duration {
+			aggregate.Duration = r.Duration
+		}
+
+		if r.Latency == nil || r.Latency.Count == 0 {
+			continue
+		}
+		if latency == nil {
+			latency = &LatencyStats{Min: math.MaxFloat64}
+		}
+		latency.Count += r.Latency.Count
+		weightedAvg += r.Latency.Avg * float64(r.Latency.Count)
+		latency.Min = math.Min(latency.Min, r.Latency.Min)
+		latency.P50 = math.Max(latency.P50, r.Latency.P50)
+		latency.P95 = math.Max(latency.P95, r.Latency.P95)
+		latency.P99 = math.Max(latency.P99, r.Latency.P99)
+		latency.Max = math.Max(latency.Max, r.Latency.Max)
+	}
+	if latency != nil {
+		latency.Avg = weightedAvg / float64(latency.Count)
+		aggregate.Latency = latency
+	}
+
+	if samples, ok := mergeLatencySamples(results); ok {
+		aggregate.Latency = CalcLatencyStats(samples)
+		aggregate.Merged = true
+	}
+	return aggregate
+}
+
+// 全ての実行結果の応答時間のサンプルを合わせて返す。
+// サンプルを含まない（サンプル数が応答時間の件数と一致しない）実行結果がある場合は、false を返す。
+func mergeLatencySamples(results []*Result) ([]time.Duration, bool) {
+	var samples []time.Duration
+	for _, r := range results {
+		count := 0
+		if r.Latency != nil {
+			count = r.Latency.Count
+		}
+		if len(r.LatencySamples) != count {
+			return nil, false
+		}
+		for _, ms := range r.LatencySamples {
+			samples = append(samples, time.Duration(ms*float64(time.Millisecond)))
+		}
+	}
+	return samples, len(samples) > 0
+}
+
+// 応答時間のサンプルを、実行結果のファイルに含めるミリ秒の値に変換する。
+func LatencySamplesMillis(durations []time.Duration) []float64 {
+	samples := make([]float64, len(durations))
+	for i, d := range durations {
+		samples[i] = ToMillis(d)
+	}
+	return samples
+}
+
+// 集計結果を出力する。
+func PrintAggregateResult(aggregate *AggregateResult) {
+	fmt.Printf("Aggregate : processes=%d, clients=%d, totalCount=%d, duration=%dms, throughput=%.2fmessages/sec\n",
+		aggregate.Processes, aggregate.ClientNum, aggregate.TotalCount, aggregate.Duration, aggregate.Throughput)
+	if aggregate.Latency != nil && aggregate.Merged {
+		fmt.Printf("Latency : %s (merged samples)\n", aggregate.Latency)
+	} else if aggregate.Latency != nil {
+		fmt.Printf("Latency : %s (percentiles are the max of the processes)\n", aggregate.Latency)
+	}
+}
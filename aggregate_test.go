@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 実行結果のファイルを、共有ディレクトリへ書き込む。
+func writeResultFixture(t *testing.T, dir string, name string, result *Result) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), body, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAggregateResults(t *testing.T) {
+	dir := t.TempDir()
+	writeResultFixture(t, dir, "result-a.json", &Result{
+		ClientNum: 2, TotalCount: 100, Duration: 1000, Throughput: 100,
+		Latency:        &LatencyStats{Count: 2, Avg: 1.5, Min: 1, P50: 1, P95: 2, P99: 2, Max: 2},
+		LatencySamples: []float64{1, 2}})
+	writeResultFixture(t, dir, "result-b.json", &Result{
+		ClientNum: 3, TotalCount: 300, Duration: 1500, Throughput: 200,
+		Latency:        &LatencyStats{Count: 2, Avg: 3.5, Min: 3, P50: 3, P95: 4, P99: 4, Max: 4},
+		LatencySamples: []float64{3, 4}})
+
+	results, err := ReadResultFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggregate := AggregateResults(results)
+	if aggregate.Processes != 2 || aggregate.ClientNum != 5 || aggregate.TotalCount != 400 ||
+		aggregate.Duration != 1500 || aggregate.Throughput != 300 {
+		t.Errorf("aggregate = %+v", aggregate)
+	}
+	// 全てのサンプルを合わせて、パーセンタイルを算出する。
+	if aggregate.Merged == false || aggregate.Latency.Count != 4 || aggregate.Latency.Avg != 2.5 ||
+		aggregate.Latency.P50 != 2 || aggregate.Latency.Max != 4 {
+		t.Errorf("merged latency = %+v", aggregate.Latency)
+	}
+
+	// サンプルを含まない実行結果がある場合は、加重平均と各プロセスの最大値となる。
+	results[1].LatencySamples = nil
+	results[1].Latency.Count = 6
+	aggregate = AggregateResults(results)
+	if aggregate.Merged || aggregate.Latency.Count != 8 || math.Abs(aggregate.Latency.Avg-(1.5*2+3.5*6)/8) > 1e-9 ||
+		aggregate.Latency.Min != 1 || aggregate.Latency.P99 != 4 || aggregate.Latency.Max != 4 {
+		t.Errorf("weighted latency = %+v", aggregate.Latency)
+	}
+}
+
+func TestAggregatePercentilesOnSkewedDistribution(t *testing.T) {
+	// 900件が1msのプロセスと、100件が1ms - 100msに分散したプロセスの実行結果
+	var fast, slow []time.Duration
+	for i := 0; i < 900; i++ {
+		fast = append(fast, time.Millisecond)
+	}
+	slow = shuffledMillis(1, 100)
+	results := []*Result{
+		{ClientNum: 1, Latency: CalcLatencyStats(fast), LatencySamples: LatencySamplesMillis(fast)},
+		{ClientNum: 1, Latency: CalcLatencyStats(slow), LatencySamples: LatencySamplesMillis(slow)}}
+
+	// 合わせた1000件のうち901件が1ms、以降は2ms - 100msのため、p99(990件目)は90msとなる。
+	aggregate := AggregateResults(results)
+	if aggregate.Merged == false || aggregate.Latency.Count != 1000 || aggregate.Latency.P50 != 1 || aggregate.Latency.P99 != 90 {
+		t.Fatalf("merged latency = %+v", aggregate.Latency)
+	}
+	// プロセス毎のパーセンタイルの平均は、正しい値とならない。
+	averagedP50 := (results[0].Latency.P50 + results[1].Latency.P50) / 2
+	averagedP99 := (results[0].Latency.P99 + results[1].Latency.P99) / 2
+	if averagedP50 == aggregate.Latency.P50 || averagedP99 == aggregate.Latency.P99 {
+		t.Errorf("averaged p50 = %.3f, p99 = %.3f, merged = %+v", averagedP50, averagedP99, aggregate.Latency)
+	}
+	if expected := CalcLatencyStats(append(append([]time.Duration(nil), fast...), slow...)); *aggregate.Latency != *expected {
+		t.Errorf("merged latency = %+v, want %+v", aggregate.Latency, expected)
+	}
+}
+
+func TestResultFileIncludesLatencySamples(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	dir := t.TempDir()
+	opts := testExecOptions(broker.URL)
+	opts.Qos = 1
+	opts.ResultDir = dir
+	opts.ResultSamples = true
+	captureStdout(t, func() {
+		if Execute(PublishAllClient, opts) == nil {
+			t.Fatal("Execute failed")
+		}
+	})
+
+	// ファイルに、応答時間の全てのサンプルが含まれる。
+	results, err := ReadResultFiles(dir)
+	if err != nil || len(results) != 1 {
+		t.Fatalf("results = %v, err = %v", results, err)
+	}
+	if r := results[0]; r.Latency == nil || r.Latency.Count != opts.ClientNum*opts.Count || len(r.LatencySamples) != r.Latency.Count {
+		t.Fatalf("samples = %d, latency = %+v", len(r.LatencySamples), r.Latency)
+	}
+	other := shuffledMillis(1, 10)
+	results = append(results, &Result{ClientNum: 1, Latency: CalcLatencyStats(other), LatencySamples: LatencySamplesMillis(other)})
+	aggregate := AggregateResults(results)
+	if aggregate.Merged == false || aggregate.Latency.Count != opts.ClientNum*opts.Count+len(other) {
+		t.Errorf("aggregate latency = %+v, merged = %t", aggregate.Latency, aggregate.Merged)
+	}
+}
+
+func TestResultFileChecksum(t *testing.T) {
+	if sum := ResultChecksum(nil); sum != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("checksum of empty = %s", sum)
+	}
+
+	dir := t.TempDir()
+	path, err := WriteResultFile(dir, &Result{ClientNum: 1, TotalCount: 10}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sha256sum の形式で、書き込んだファイルのバイト列のSHA-256を出力する。
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := ioutil.ReadFile(path + RESULT_CHECKSUM_SUFFIX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(body)
+	if expected := hex.EncodeToString(sum[:]) + "  " + filepath.Base(path) + "\n"; string(line) != expected {
+		t.Errorf("checksum file = %q, want %q", line, expected)
+	}
+	if results, err := ReadResultFiles(dir); err != nil || len(results) != 1 || results[0].TotalCount != 10 {
+		t.Fatalf("results = %v, err = %v", results, err)
+	}
+
+	// 破損したファイルは、チェックサムの不一致で検出する。
+	if err := ioutil.WriteFile(path, []byte(`{"total_count":11}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadResultFiles(dir); err == nil || strings.Contains(err.Error(), "checksum mismatch") == false {
+		t.Errorf("corrupted file error = %v", err)
+	}
+}
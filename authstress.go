@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 認証の失敗とみなす、接続エラーのメッセージ（CONNACKの戻り値 4 : Bad Username or Password、5 : Not Authorized）
+// pahoは戻り値 4 を "bad user name or password" として返す。
+var AUTH_FAILURE_ERRORS = []string{"user name or password", "username or password", "not authori"}
+
+// 接続と切断を繰り返した結果
+type AuthStats struct {
+	Cycles        int     `json:"cycles"`         // 接続を試行した回数
+	Succeeded     int     `json:"succeeded"`      // 接続（認証）に成功した回数
+	AuthFailures  int     `json:"auth_failures"`  // 認証に失敗した回数
+	OtherFailures int     `json:"other_failures"` // 認証以外の理由で接続に失敗した回数
+	Rate          float64 `json:"rate"`           // 接続（認証）に成功したレート(connects/sec)
+}
+
+// 接続エラーが、認証の失敗によるものかどうかを返す。
+func IsAuthFailure(err error) bool {
+	message := strings.ToLower(err.Error())
+	for _, pattern := range AUTH_FAILURE_ERRORS {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// 全クライアントに対して、Publishせずに接続（認証）と切断を繰り返し、認証の経路に負荷をかける。
+// 各クライアントは、接続済みの接続とは別のClientIDで -count 回の接続と切断を行い、
+// 接続全体のレートは -connect-stress-rate で制限する。接続に成功した回数を返す。
+func AuthStressAllClient(ctx context.Context, clients []MQTT.Client, opts ExecOptions, metrics *Metrics, param ...string) int {
+	var bucket *TokenBucket = nil
+	if opts.ConnectStressRate > 0 {
+		bucket = NewTokenBucket(opts.ConnectStressRate)
+	}
+
+	var cycles, succeeded, authFailures, otherFailures int64
+	start := time.Now()
+
+	wg := new(sync.WaitGroup)
+	for id := 0; id < len(clients); id++ {
+		wg.Add(1)
+		go func(clientId int) {
+			defer wg.Done()
+			for index := 0; index < opts.Count; index++ {
+				if ctx.Err() != nil {
+					return
+				}
+				if bucket != nil {
+					bucket.Take()
+				}
+
+				atomic.AddInt64(&cycles, 1)
+				connectStart := time.Now()
+				client, err := Connect(len(clients)+clientId, opts, nil, nil)
+				metrics.ConnectLatency.Record(opts.Qos, time.Since(connectStart))
+				if err != nil {
+					if IsAuthFailure(err) {
+						atomic.AddInt64(&authFailures, 1)
+					} else {
+						atomic.AddInt64(&otherFailures, 1)
+					}
+					continue
+				}
+				atomic.AddInt64(&succeeded, 1)
+				metrics.AddProgress(1)
+				Disconnect(client)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	stats := &AuthStats{
+		Cycles:        int(cycles),
+		Succeeded:     int(succeeded),
+		AuthFailures:  int(authFailures),
+		OtherFailures: int(otherFailures)}
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		stats.Rate = float64(stats.Succeeded) / elapsed
+	}
+	metrics.Auth = stats
+	if Debug {
+		fmt.Printf("Auth stress : cycles=%d, succeeded=%d\n", stats.Cycles, stats.Succeeded)
+	}
+	return stats.Succeeded
+}
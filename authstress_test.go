@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsAuthFailure(t *testing.T) {
+	if IsAuthFailure(packets.ErrorRefusedBadUsernameOrPassword) == false || IsAuthFailure(packets.ErrorRefusedNotAuthorised) == false ||
+		IsAuthFailure(errors.New("bad user name or password")) == false || IsAuthFailure(errors.New("not Authorized")) == false {
+		t.Error("auth error was not an auth failure")
+	}
+	if IsAuthFailure(errors.New("network Error : EOF")) {
+		t.Error("network error was an auth failure")
+	}
+}
+
+func TestAuthStress(t *testing.T) {
+	var refused int32 = 0
+	broker := startTestBroker(t, &testBroker{
+		Refuse: func(connect testConnect) byte {
+			// 追加の接続のうち、2番目のクライアントは認証の失敗と、それ以外の失敗を交互に返す。
+			if connect.ClientId != CreateClientId(3) {
+				return 0
+			}
+			if atomic.AddInt32(&refused, 1)%2 == 1 {
+				return 0x04 // bad user name or password
+			}
+			return 0x03 // server unavailable
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 2
+	opts.Count = 10
+	opts.ConnectStressRate = 100
+	// 追加の接続でも、DefaultHandlerの処理結果の記録で範囲外にならないこと。
+	opts.UseDefaultHandler = true
+	// 拒否された場合に、pahoがMQTT 3.1で再試行しないように、プロトコルのバージョンを指定する。
+	opts.ConnectOptions = append(opts.ConnectOptions, func(clientOpts *MQTT.ClientOptions) {
+		clientOpts.SetProtocolVersion(4)
+	})
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(AuthStressAllClient, opts)
+	})
+	if result == nil || result.Auth == nil {
+		t.Fatalf("no auth result : %s", output)
+	}
+	auth := result.Auth
+	if auth.Cycles != 20 || auth.Succeeded != 10 || auth.AuthFailures != 5 || auth.OtherFailures != 5 {
+		t.Errorf("auth = %+v", auth)
+	}
+
+	// Publishせずに、接続済みの接続とは別のClientIDで、制限したレートで接続を繰り返す。
+	if published := len(broker.Published()); published != 0 {
+		t.Errorf("published = %d", published)
+	}
+	var first, last time.Time
+	cycles := 0
+	for _, connect := range broker.Connects() {
+		if connect.ClientId != CreateClientId(2) && connect.ClientId != CreateClientId(3) {
+			continue
+		}
+		if cycles == 0 {
+			first = connect.Time
+		}
+		last = connect.Time
+		cycles++
+	}
+	if cycles != auth.Cycles {
+		t.Fatalf("stress connects = %d, want %d", cycles, auth.Cycles)
+	}
+	// 100/s では、20回の接続に少なくとも19間隔(190ms)かかる。
+	if span := last.Sub(first); span < 170*time.Millisecond || span > time.Second {
+		t.Errorf("connect span = %s, want about 190ms", span)
+	}
+}
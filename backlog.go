@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 永続セッションのSubscriberが切断中に送信されたメッセージの、再接続後の配信結果
+type BacklogStats struct {
+	Published int           `json:"published"`         // 切断中に送信したメッセージ数
+	Delivered int           `json:"delivered"`         // 再接続後に受信したメッセージ数
+	Latency   *LatencyStats `json:"latency,omitempty"` // 再接続から各メッセージを受信するまでの時間
+}
+
+// 全クライアントに対して、永続セッションに滞留したメッセージの配信を検証する。
+// Subscribe、切断、別の接続からのPublish、再接続の順に行い、再接続後に受信したメッセージ数を返す。
+func BacklogAllClient(ctx context.Context, clients []MQTT.Client, opts ExecOptions, metrics *Metrics, param ...string) int {
+	latencies := NewLatencyRecorder()
+	var publishedCount int64 = 0
+	var deliveredCount int64 = 0
+
+	waitTime := DEFAULT_PUBSUB_WAIT_TIME
+	if opts.SubscribeTimeout > 0 {
+		waitTime = time.Duration(opts.SubscribeTimeout) * time.Millisecond
+	}
+
+	wg := new(sync.WaitGroup)
+	for id := 0; id < len(clients); id++ {
+		wg.Add(1)
+
+		client := clients[id]
+
+		go func(clientId int) {
+			defer wg.Done()
+
+			qos := ClientQos(opts, clientId)
+			var reconnectedAt int64 = 0 // 再接続した時刻(UnixNano、0の場合は再接続前)
+			var delivered int64 = 0
+			var mutex sync.Mutex
+			stopped := false // 受信待ちを終了した後は、受信したメッセージを数えない
+			var handler MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				at := atomic.LoadInt64(&reconnectedAt)
+				if at == 0 || stopped {
+					return
+				}
+				latencies.Record(msg.Qos(), time.Since(time.Unix(0, at)))
+				atomic.AddInt64(&delivered, 1)
+				atomic.AddInt64(&deliveredCount, 1)
+				metrics.AddProgress(1)
+				if Debug {
+					fmt.Printf("Received from backlog : topic=%s\n", msg.Topic())
+				}
+			}
+
+			// 終了後に受信したメッセージは、集計中の件数を変えないように数えない。
+			// 接続は、Subscriptionの後処理(-subscribe-cleanup-unsubscribe-on-exit)のために切断しない。
+			defer func() {
+				mutex.Lock()
+				stopped = true
+				mutex.Unlock()
+			}()
+
+			// 永続セッションでSubscribeしてから切断し、Broker側にセッションを残す。
+			topic := CreateSubscribeTopic(opts, clientId)
+			token := client.Subscribe(topic, qos, handler)
+			if token.Wait() && token.Error() != nil {
+				fmt.Printf("Subscribe error: %s\n", token.Error())
+				return
+			}
+			metrics.Subscriptions.Record(client, topic)
+			Disconnect(client)
+
+			// 切断中に、別の接続からメッセージを送信する（送信側は、Broker側にセッションを残さない）。
+			publisher, err := Connect(len(clients)+clientId, CleanSessionOptions(opts), nil, nil)
+			if err != nil {
+				return
+			}
+			published := 0
+			for index := 0; index < opts.Count; index++ {
+				if ctx.Err() != nil {
+					break
+				}
+				if err := Publish(publisher, CreateClientTopic(opts, clientId, index), qos, opts.Retain, param[0], opts.PublishTimeout); err == nil {
+					published++
+				}
+			}
+			Disconnect(publisher)
+			atomic.AddInt64(&publishedCount, int64(published))
+
+			// 再接続し、滞留したメッセージを受信するまで待機する。
+			atomic.StoreInt64(&reconnectedAt, time.Now().UnixNano())
+			token = client.Connect()
+			if token.Wait() && token.Error() != nil {
+				fmt.Printf("Reconnect error: %s\n", token.Error())
+				return
+			}
+			deadline := time.Now().Add(waitTime)
+			for ctx.Err() == nil && time.Now().Before(deadline) {
+				if atomic.LoadInt64(&delivered) >= int64(published) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if count := atomic.LoadInt64(&delivered); count < int64(published) {
+				fmt.Printf("Backlog timeout : id=%d, count=%d/%d\n", clientId, count, published)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	delivered := int(atomic.LoadInt64(&deliveredCount))
+	metrics.Backlog = &BacklogStats{
+		Published: int(atomic.LoadInt64(&publishedCount)),
+		Delivered: delivered,
+		Latency:   CalcLatencyStats(latencies.Durations())}
+
+	return delivered
+}
+
+// 追加の接続オプションの最後に、クリーンセッションでの接続を追加した実行オプションを返す。
+func CleanSessionOptions(opts ExecOptions) ExecOptions {
+	connectOptions := append([]ClientOptionSetter{}, opts.ConnectOptions...)
+	opts.ConnectOptions = append(connectOptions, func(clientOpts *MQTT.ClientOptions) {
+		clientOpts.SetCleanSession(true)
+	})
+	return opts
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBacklogDeliveredOnReconnect(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 2
+	opts.Count = 5
+	opts.Qos = 1
+	opts.SubscribeTimeout = 1000
+	// 送信側の追加の接続でも、DefaultHandlerの処理結果の記録で範囲外にならないこと。
+	opts.UseDefaultHandler = true
+	opts.ConnectOptions = append(opts.ConnectOptions, func(clientOpts *MQTT.ClientOptions) {
+		clientOpts.SetCleanSession(false)
+	})
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(BacklogAllClient, opts)
+	})
+	if result == nil || result.Backlog == nil {
+		t.Fatalf("no backlog result : %s", output)
+	}
+	expected := opts.ClientNum * opts.Count
+	if result.Backlog.Published != expected || result.Backlog.Delivered != expected || result.TotalCount != expected {
+		t.Errorf("published = %d, delivered = %d, total = %d, want %d",
+			result.Backlog.Published, result.Backlog.Delivered, result.TotalCount, expected)
+	}
+	if result.Backlog.Latency == nil {
+		t.Error("no backlog latency")
+	}
+
+	// Subscriberは永続セッション、送信側はクリーンセッションで接続する。
+	for _, connect := range broker.Connects() {
+		publisher := connect.ClientId == CreateClientId(2) || connect.ClientId == CreateClientId(3)
+		if connect.CleanSession != publisher {
+			t.Errorf("client %s : clean session = %t", connect.ClientId, connect.CleanSession)
+		}
+	}
+}
+
+func TestBacklogStopsCountingAfterReturn(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.Count = 3
+	opts.Qos = 1
+	opts.SubscribeTimeout = 1000
+	opts.ConnectOptions = append(opts.ConnectOptions, func(clientOpts *MQTT.ClientOptions) {
+		clientOpts.SetCleanSession(false)
+	})
+
+	subscriber, err := Connect(0, opts, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Disconnect(0)
+	metrics := NewMetrics()
+	var delivered int
+	captureStdout(t, func() {
+		delivered = BacklogAllClient(context.Background(), []MQTT.Client{subscriber}, opts, metrics, CreateFixedSizeMessage(opts.MessageSize))
+	})
+	if delivered != opts.Count || metrics.Backlog.Delivered != opts.Count {
+		t.Fatalf("delivered = %d, backlog = %+v", delivered, metrics.Backlog)
+	}
+
+	// 終了後に受信したメッセージは、進捗に数えない（Subscriberは接続したまま）。
+	progress := atomic.LoadInt64(&metrics.Progress)
+	publisher, err := Connect(10, CleanSessionOptions(opts), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Disconnect(0)
+	if err := Publish(publisher, CreateClientTopic(opts, 0, 0), 1, false, "late", 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if subscriber.IsConnected() == false {
+		t.Error("subscriber was disconnected")
+	}
+	if late := atomic.LoadInt64(&metrics.Progress); late != progress {
+		t.Errorf("progress = %d after return, want %d", late, progress)
+	}
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// フェーズ毎の所要時間
+type PhaseDurations struct {
+	Connect  int64 `json:"connect_ms"`  // 接続(ms)
+	Warmup   int64 `json:"warmup_ms"`   // 実行前の待機(ms)
+	Run      int64 `json:"run_ms"`      // 計測対象の実行(ms)
+	Teardown int64 `json:"teardown_ms"` // 切断(ms)
+}
+
+// 1回分のベンチマークの実行
+// Connect、Warmup、Run、Teardownの順にフェーズを実行し、Reportで実行結果を生成する。
+type Benchmark struct {
+	Opts    ExecOptions    // 実行オプション
+	Exec    ExecFunc       // 全クライアントに対して実行する処理
+	Metrics *Metrics       // 実行中に収集する計測情報
+	Phases  PhaseDurations // フェーズ毎の所要時間
+
+	ctx           context.Context
+	cancel        context.CancelFunc
+	message       string                 // 固定サイズのメッセージ
+	watcher       *ConnectionLostWatcher // 計測中の接続断の検知
+	watchdog      *StallWatchdog         // 進捗が止まった実行の検知
+	tracker       *ConnectionTracker     // 接続と接続断の記録
+	sampler       *ThroughputSampler     // スループットの時系列の記録
+	buckets       *SecondBuckets         // 1秒毎のメッセージ数
+	connectRate   *ConnectRateStats      // Brokerの接続の受け付け状況
+	batches       *ConnectBatchStats     // 一定数毎に休止を挟んだ接続の結果
+	fatal         *ConnectError          // 再接続しないエラーで接続断となったクライアントの情報
+	fatalMutex    sync.Mutex
+	connections   []MQTT.Client        // Brokerとの接続
+	clients       []MQTT.Client        // 論理クライアント毎の接続
+	tlsVersion    string               // ネゴシエートされたTLSのバージョン
+	breakdown     *ConnectBreakdown    // 接続の所要時間の内訳
+	resumption    *TlsResumptionStats  // TLSのセッション再開の確認結果
+	qos2Flow      *Qos2FlowStats       // Subscribe側のQoS 2のフローの所要時間
+	shutdown      *ShutdownStats       // シグナルによる中断時の、送信中のメッセージの処理結果
+	confidence    *ConfidenceStopStats // スループットの信頼区間による、実行の終了の結果
+	idleHold      *IdleHoldStats       // 送受信せずに接続を維持した結果
+	holding       int32                // 接続を維持している間かどうか(1 : 維持中、atomicに更新する)
+	holdLost      int64                // 接続を維持している間の接続断の回数（atomicに更新する）
+	connectErrors []ConnectError       // 接続エラーの一覧
+	totalCount    int                  // 処理したメッセージ数
+	startTime     time.Time            // 計測の開始時刻
+	endTime       time.Time            // 計測の終了時刻
+}
+
+// Benchmarkを生成する。
+// 利用後は、Close で後始末を行うこと。
+func NewBenchmark(exec ExecFunc, opts ExecOptions) *Benchmark {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Benchmark{
+		Opts:    opts,
+		Exec:    exec,
+		Metrics: NewMetrics(),
+		ctx:     ctx,
+		cancel:  cancel,
+		message: CreateFixedSizeMessage(opts.MessageSize)}
+
+	// 署名を付与する場合も、メッセージのサイズを変えないように、署名の分だけ短くする。
+	if opts.HmacKey != nil {
+		b.message = CreateFixedSizeMessage(SignedBodySize(opts.MessageSize))
+	}
+
+	// 計測中の接続断で中断する場合は、接続断を検知する。
+	if opts.FailOnConnLost {
+		b.watcher = NewConnectionLostWatcher(cancel)
+	}
+	if opts.ReportConnReuse {
+		b.tracker = NewConnectionTracker()
+	}
+	if opts.TopicLatencyTop > 0 {
+		b.Metrics.TopicLatency = NewTopicLatencyRecorder(TOPIC_LATENCY_MAX_TOPICS)
+	}
+	if opts.ReportBytes {
+		b.Metrics.Bytes = &ByteCounter{}
+	}
+	if opts.ValidateTopicMatch {
+		b.Metrics.TopicMatch = &TopicMatchStats{}
+	}
+	if opts.ReportClientRates {
+		b.Metrics.ClientRates = &ClientRateRecorder{}
+	}
+	if opts.LatencyBackend == LATENCY_BACKEND_HDR {
+		b.Metrics.PublishLatency = NewHdrLatencyRecorder()
+	}
+	if opts.ReportGcPause {
+		b.Metrics.GcImpact = NewGcImpactRecorder()
+	}
+	if opts.OutlierNum > 0 {
+		b.Metrics.Outliers = NewOutlierTracker(opts.OutlierNum)
+	}
+	if opts.UnsubscribeOnExit {
+		b.Metrics.Subscriptions = NewSubscriptionTracker()
+	}
+	return b
+}
+
+// 後始末を行う。
+func (b *Benchmark) Close() {
+	b.cancel()
+}
+
+// 全クライアントをBrokerへ接続する。
+// 接続エラーがあれば、接続済みのクライアントを切断し、falseを返す。
+func (b *Benchmark) Connect() bool {
+	opts := b.Opts
+	phaseStart := time.Now()
+	defer func() { b.Phases.Connect = ElapsedMillis(phaseStart) }()
+
+	// 接続の所要時間の内訳を、ベンチマークの接続毎に記録する。
+	if opts.ReportConnBreakdown {
+		opts.ConnectBreakdown = NewBreakdownRecorder()
+		defer func() { b.breakdown = opts.ConnectBreakdown.Stats() }()
+	}
+
+	var onLost func(id int, err error) = nil
+	var onConnect func(id int) = nil
+	if b.watcher != nil || b.tracker != nil || len(opts.NoRetryOn) > 0 || opts.ReportConnCount || opts.IdleHold > 0 {
+		onLost = func(id int, err error) {
+			if atomic.LoadInt32(&b.holding) == 1 {
+				atomic.AddInt64(&b.holdLost, 1)
+			}
+			if opts.ReportConnCount {
+				atomic.AddInt64(&b.Metrics.Connected, -1)
+			}
+			if b.tracker != nil {
+				b.tracker.OnLost(id, time.Now())
+			}
+			if IsNonRetryableError(err, opts.NoRetryOn) {
+				b.failFast(id, err)
+			}
+			if b.watcher != nil {
+				b.watcher.OnLost(id, err)
+			}
+		}
+	}
+	if b.tracker != nil || opts.ReportConnCount {
+		onConnect = func(id int) {
+			if opts.ReportConnCount {
+				atomic.AddInt64(&b.Metrics.Connected, 1)
+			}
+			if b.tracker != nil {
+				b.tracker.OnConnect(id, time.Now())
+			}
+		}
+	}
+
+	// 配列を初期化
+	DefaultHandlerResults = make([]*SubscribeResult, opts.ClientNum)
+
+	// 複数の論理クライアントで1つの接続を共有する場合は、必要な接続数のみ接続する。
+	connNum := ConnectionNum(opts.ClientNum, opts.ClientsPerConn)
+	b.connections = make([]MQTT.Client, connNum)
+	var connectErrors []ConnectError
+	var observer *ConnectRateObserver = nil
+	if opts.ObserveConnectRate {
+		observer = NewConnectRateObserver(phaseStart)
+	}
+	var batcher *ConnectBatcher = nil
+	if opts.ConnectBatchSize > 0 {
+		batcher = NewConnectBatcher(opts.ConnectBatchSize, opts.ConnectBatchPause)
+	}
+	for i := 0; i < connNum; i++ {
+		if batcher != nil {
+			batcher.Before(i)
+		}
+		SleepConnectJitter(opts.ConnectJitter)
+		connectStart := time.Now()
+		client, err := Connect(i, opts, onLost, onConnect)
+		// 接続時間はQoSに依存しないため、QoS 0として記録する。失敗した接続は含めない。
+		if err == nil {
+			b.Metrics.ConnectLatency.Record(0, time.Since(connectStart))
+		}
+		if observer != nil {
+			observer.Observe(connectStart, time.Since(connectStart), err)
+		}
+		if err != nil {
+			connectErrors = append(connectErrors, ConnectError{
+				ClientIndex: i,
+				ClientId:    CreateClientId(i),
+				Err:         err,
+				Time:        time.Now()})
+			if batcher != nil {
+				batcher.Failed(i)
+			}
+
+			// 詳細や接続の受け付け状況を出力する場合は、全クライアントの接続結果を収集するため、処理を継続する。
+			if opts.ReportConnectErrs == false && observer == nil {
+				break
+			}
+			continue
+		}
+		b.connections[i] = client
+	}
+	if observer != nil {
+		b.connectRate = observer.Stats(time.Now())
+
+		// 接続エラーの場合は実行結果を出力しないため、ここで出力する。
+		if b.connectRate != nil && len(connectErrors) > 0 {
+			fmt.Printf("Connect rate : %s\n", b.connectRate)
+		}
+	}
+	if batcher != nil {
+		b.batches = batcher.Stats()
+		if len(connectErrors) > 0 {
+			fmt.Printf("Connect batches : %s\n", b.batches)
+		}
+	}
+
+	// 接続エラーがあれば、接続済みのクライアントの切断処理を行い、処理を終了する。
+	if len(connectErrors) > 0 {
+		b.connectErrors = connectErrors
+		if opts.ReportConnectErrs {
+			PrintConnectErrors(connectErrors, connNum)
+		}
+		for i := 0; i < len(b.connections); i++ {
+			client := b.connections[i]
+			if client != nil {
+				Disconnect(client)
+			}
+		}
+		return false
+	}
+
+	// 論理クライアントを、接続に割り当てる。
+	b.clients = make([]MQTT.Client, opts.ClientNum)
+	for i := 0; i < opts.ClientNum; i++ {
+		b.clients[i] = b.connections[i/opts.ClientsPerConn]
+	}
+	return true
+}
+
+// プローブ接続で、TLSのバージョン、TLSのセッション再開、QoS 2のフローを確認する。
+// プローブ接続の所要時間を接続のフェーズに含めないように、Connect の後に呼び出す。
+func (b *Benchmark) Probe() {
+	opts := b.Opts
+
+	// ネゴシエートされたTLSのバージョンを確認する。
+	if tlsConfig := CreateTlsConfig(opts); tlsConfig != nil && IsTlsBroker(opts.Broker) {
+		version, err := ProbeTlsVersion(opts.Broker, tlsConfig)
+		if err != nil {
+			fmt.Printf("TLS probe error: %s\n", err)
+		} else {
+			b.tlsVersion = TlsVersionName(version)
+		}
+	}
+
+	// TLSのセッション再開の状況を、プローブ接続で確認する。
+	if opts.TlsResumptionTest {
+		resumption, err := ProbeTlsResumption(opts, TLS_RESUMPTION_PROBES)
+		if err != nil {
+			fmt.Printf("TLS resumption test error: %s\n", err)
+		} else {
+			b.resumption = resumption
+		}
+	}
+
+	// Subscribe側のQoS 2のフローの所要時間を、プローブ接続で計測する。
+	if opts.ReportQos2Flow {
+		qos2Flow, err := ProbeQos2Flow(opts, QOS2_FLOW_MESSAGES)
+		if err != nil {
+			fmt.Printf("QoS 2 flow timing error: %s\n", err)
+		} else {
+			b.qos2Flow = qos2Flow
+		}
+	}
+}
+
+// 再接続しないエラーで接続断となった場合に、自動再接続を止めて実行を中断する。
+func (b *Benchmark) failFast(id int, err error) {
+	b.fatalMutex.Lock()
+	if b.fatal == nil {
+		b.fatal = &ConnectError{
+			ClientIndex: id,
+			ClientId:    CreateClientId(id),
+			Err:         err}
+	}
+	b.fatalMutex.Unlock()
+
+	// 切断することで、paho内の自動再接続を止める。
+	if id < len(b.connections) && b.connections[id] != nil {
+		go Disconnect(b.connections[id])
+	}
+	b.cancel()
+}
+
+// 安定させるために、一定時間待機する。
+// 適応的なウォームアップの場合は、待機せずにスループットが安定するまでPublishし続ける。
+func (b *Benchmark) Warmup() {
+	phaseStart := time.Now()
+	if b.Opts.WarmupThreshold > 0 {
+		WarmupUntilStable(b.ctx, b.clients, b.Opts, b.message)
+	} else {
+		time.Sleep(time.Duration(b.Opts.PreTime) * time.Millisecond)
+	}
+	b.Phases.Warmup = ElapsedMillis(phaseStart)
+}
+
+// 送受信せずに一定時間接続を維持し、接続が切断されないことを確認する。
+// キープアライブを無効にした場合などに、アイドルな接続をBrokerが切断しないかを確認するために利用する。
+func (b *Benchmark) IdleHold() {
+	if b.Opts.IdleHold <= 0 {
+		return
+	}
+	fmt.Printf("%s Hold idle connections for %s\n", time.Now(), b.Opts.IdleHold)
+	atomic.StoreInt32(&b.holding, 1)
+	time.Sleep(b.Opts.IdleHold)
+	atomic.StoreInt32(&b.holding, 0)
+
+	stats := &IdleHoldStats{
+		Hold:        ToMillis(b.Opts.IdleHold),
+		Connections: len(b.connections),
+		Lost:        int(atomic.LoadInt64(&b.holdLost))}
+	for _, client := range b.connections {
+		if client.IsConnected() == false {
+			stats.Disconnected++
+		}
+	}
+	b.idleHold = stats
+	if stats.Lost > 0 || stats.Disconnected > 0 {
+		fmt.Printf("Warning : connections were lost while idle : %s\n", stats)
+	}
+}
+
+// 計測対象の処理を実行する。
+func (b *Benchmark) Run() {
+	opts := b.Opts
+
+	fmt.Printf("%s Start benchmark\n", time.Now())
+
+	if b.watcher != nil {
+		b.watcher.Start()
+	}
+
+	// 進捗が止まった場合の診断情報を出力する。
+	watchdogCtx, stopWatchdog := context.WithCancel(b.ctx)
+	if opts.StallTimeout > 0 {
+		var abort context.CancelFunc = nil
+		if opts.StallAbort {
+			// Tokenの完了を待機したまま止まっているgoroutineも終了させるため、全ての接続を強制的に切断する。
+			abort = func() {
+				b.cancel()
+				for _, client := range b.connections {
+					if client != nil {
+						ForceDisconnect(client)
+					}
+				}
+			}
+		}
+		b.watchdog = NewStallWatchdog(opts.StallTimeout, os.Stderr, abort)
+		go b.watchdog.Watch(watchdogCtx, &b.Metrics.Progress)
+	}
+
+	// スループットの時系列を記録する。ファイルを開けない場合も、計測は継続する。
+	var samplerDone chan struct{} = nil
+	if opts.TimeseriesFile != "" || opts.ReportSampleStats || opts.ReportWindowLatency {
+		b.sampler = NewThroughputSampler(opts.SampleInterval, nil)
+		if opts.ReportErrorRate {
+			b.sampler.Errors = &b.Metrics.Errors
+		}
+		if opts.ReportConnCount {
+			b.sampler.Connected = &b.Metrics.Connected
+		}
+		if opts.ReportWindowLatency {
+			b.sampler.Latency = b.Metrics.PublishLatency
+		}
+
+		var file *os.File = nil
+		if opts.TimeseriesFile != "" {
+			f, err := OpenTimeseriesFile(opts.TimeseriesFile, b.sampler.Header())
+			if err != nil {
+				fmt.Printf("Timeseries file error: %s\n", err)
+			} else {
+				file = f
+				b.sampler.Output = f
+			}
+		}
+
+		samplerDone = make(chan struct{})
+		go func() {
+			defer close(samplerDone)
+			if file != nil {
+				defer file.Close()
+			}
+			b.sampler.Sample(watchdogCtx, &b.Metrics.Progress)
+		}()
+	}
+
+	// 1秒毎のメッセージ数を集計する。
+	var bucketsDone chan struct{} = nil
+	if opts.ReportSecondBuckets {
+		bucketsDone = make(chan struct{})
+		b.buckets = NewSecondBuckets(&b.Metrics.Progress)
+		go func() {
+			defer close(bucketsDone)
+			b.buckets.Collect(watchdogCtx, &b.Metrics.Progress)
+		}()
+	}
+
+	// スループットの信頼区間が目標の幅に収まった時点で、実行を終了させる。
+	var confidenceDone chan struct{} = nil
+	if opts.TargetConfidence > 0 {
+		confidenceDone = make(chan struct{})
+		go func() {
+			defer close(confidenceDone)
+			b.confidence = WatchConfidence(watchdogCtx, &b.Metrics.Progress, opts, b.cancel)
+		}()
+	}
+
+	// 計測中のGCの停止時間を記録する。
+	var gcDone chan struct{} = nil
+	if b.Metrics.GcImpact != nil {
+		gcDone = make(chan struct{})
+		b.Metrics.GcImpact.Start()
+		go func() {
+			defer close(gcDone)
+			b.Metrics.GcImpact.Watch(watchdogCtx)
+		}()
+	}
+
+	b.startTime = time.Now()
+	if opts.DrainOnSignal {
+		b.totalCount, b.shutdown = RunWithGracefulShutdown(b.cancel, &b.Metrics.Inflight, opts.DrainTimeoutOnSignal, func() int {
+			return b.Exec(b.ctx, b.clients, opts, b.Metrics, b.message)
+		})
+	} else {
+		b.totalCount = b.Exec(b.ctx, b.clients, opts, b.Metrics, b.message)
+	}
+	b.endTime = time.Now()
+	b.Phases.Run = b.endTime.Sub(b.startTime).Nanoseconds() / int64(1000000)
+
+	stopWatchdog()
+	if confidenceDone != nil {
+		<-confidenceDone
+	}
+	if gcDone != nil {
+		<-gcDone
+	}
+	if samplerDone != nil {
+		<-samplerDone
+	}
+	if bucketsDone != nil {
+		<-bucketsDone
+	}
+	if b.watcher != nil {
+		b.watcher.Stop()
+	}
+
+	fmt.Printf("%s End benchmark\n", time.Now())
+}
+
+// Brokerとの接続を切断する。
+func (b *Benchmark) Teardown() {
+	phaseStart := time.Now()
+
+	// Broker側にSubscriptionが残らないように、切断する前にUnsubscribeする。
+	if b.Metrics.Subscriptions != nil {
+		unsubscribed, failed := b.Metrics.Subscriptions.UnsubscribeAll()
+		fmt.Printf("Unsubscribed : filters=%d, failed=%d\n", unsubscribed, failed)
+	}
+
+	// 切断に時間がかかるため、非同期で処理を行う。
+	AsyncDisconnect(b.connections, b.Opts.DisconnectTimeout)
+
+	b.Phases.Teardown = ElapsedMillis(phaseStart)
+}
+
+// 接続に失敗した場合の実行結果を生成する。
+// 計測は行っていないため、接続エラーの一覧と、接続の結果のみを含む。
+func (b *Benchmark) ConnectFailedResult() *Result {
+	phases := b.Phases
+	result := Result{
+		SchemaVersion:  RESULT_SCHEMA_VERSION,
+		CorrelationId:  CorrelationId,
+		Broker:         b.Opts.Broker,
+		ClientNum:      b.Opts.ClientNum,
+		MessageSize:    b.Opts.MessageSize,
+		Qos:            b.Opts.Qos,
+		Phases:         &phases,
+		ConnectRate:    b.connectRate,
+		ConnectBatches: b.batches,
+		ConnectErrors:  ConnectErrorRecords(b.connectErrors)}
+	return &result
+}
+
+// 実行結果を生成する。
+// 実行を中断した場合は、その理由を出力して nil を返す。
+func (b *Benchmark) Report() *Result {
+	opts := b.Opts
+	metrics := b.Metrics
+
+	// 進捗が止まったため中断した場合は、失敗として処理を終了する。
+	if b.watchdog != nil && opts.StallAbort && b.watchdog.Stalled() {
+		fmt.Printf("\nBenchmark failed : stalled for %s\n", opts.StallTimeout)
+		return nil
+	}
+
+	// 再接続しないエラーで接続断となった場合は、失敗として処理を終了する。
+	b.fatalMutex.Lock()
+	fatal := b.fatal
+	b.fatalMutex.Unlock()
+	if fatal != nil {
+		fmt.Printf("\nBenchmark failed : connection lost with a non-retryable error : index=%d, clientId=%s, error=%s\n",
+			fatal.ClientIndex, fatal.ClientId, fatal.Err)
+		return nil
+	}
+
+	// 計測中に接続断が発生した場合は、失敗として処理を終了する。
+	if b.watcher != nil && b.watcher.Lost() != nil {
+		lost := b.watcher.Lost()
+		fmt.Printf("\nBenchmark failed : connection lost during the run : index=%d, clientId=%s, error=%s\n",
+			lost.ClientIndex, lost.ClientId, lost.Err)
+		return nil
+	}
+
+	duration := (b.endTime.Sub(b.startTime)).Nanoseconds() / int64(1000000)       // nanosecond -> millisecond
+	throughput := CalcThroughput(int64(b.totalCount), b.endTime.Sub(b.startTime)) // messages/sec
+	result := Result{
+		SchemaVersion: RESULT_SCHEMA_VERSION,
+		CorrelationId: CorrelationId,
+		Broker:        opts.Broker,
+		ClientNum:     opts.ClientNum,
+		MessageSize:   opts.MessageSize,
+		Qos:           opts.Qos,
+		TotalCount:    b.totalCount,
+		Duration:      duration,
+		Throughput:    throughput,
+		TlsVersion:    b.tlsVersion}
+	phases := b.Phases
+	result.Phases = &phases
+	result.Latency = metrics.PublishLatency.Stats()
+	if opts.PublishTimeout > 0 && result.Latency != nil {
+		result.Timeout = metrics.PublishLatency.Threshold(opts.PublishTimeout)
+	}
+	result.Published = metrics.Published
+	result.Duplicates = metrics.Duplicates
+	result.ExactlyOnce = metrics.ExactlyOnce
+	result.Signatures = metrics.Signatures
+	result.Ordering = metrics.Ordering
+	result.Qos0Dropped = metrics.Qos0Dropped
+	// QoS 0の破棄数は、送信数と照合できる -action=both の場合のみ算出し、それ以外は出力しない。
+	if opts.ConsumeRate > 0 && result.Qos0Dropped == nil {
+		fmt.Printf("QoS 0 dropped : N/A (only with -action=both)\n")
+	}
+	result.Backlog = metrics.Backlog
+	result.Auth = metrics.Auth
+	result.Calibration = metrics.Calibration
+	result.TopicMatch = metrics.TopicMatch
+	result.Qos0DropEstimate = metrics.Qos0DropEstimate
+	result.ConnectBreakdown = b.breakdown
+	result.TlsResumption = b.resumption
+	result.Qos2Flow = b.qos2Flow
+	result.Shutdown = b.shutdown
+	result.Confidence = b.confidence
+	result.IdleHold = b.idleHold
+	result.ConnectRate = b.connectRate
+	result.ConnectBatches = b.batches
+	if opts.ReportConnHistogram {
+		result.ConnectHistogram = CalcHistogram(metrics.ConnectLatency.Durations(), HISTOGRAM_BUCKETS)
+	}
+	if metrics.ClientRates != nil {
+		result.ClientHistogram = metrics.ClientRates.Histogram(HISTOGRAM_BUCKETS)
+	}
+	if metrics.Bytes != nil {
+		result.Bytes = metrics.Bytes.Stats()
+	}
+	if b.buckets != nil {
+		result.SecondBuckets = b.buckets.Counts()
+	}
+	if opts.ReportSampleStats && b.sampler != nil {
+		result.WindowThroughput = CalcWindowThroughputStats(b.sampler.Rates())
+	}
+	if opts.ReportWindowLatency && b.sampler != nil {
+		result.WindowLatency = b.sampler.Latencies()
+	}
+	if opts.ReportMaxInflight {
+		result.MaxInflight = metrics.Inflight.Peak()
+	}
+	if opts.ReportEffectiveQos {
+		result.EffectiveQos = metrics.QosGrants.Summary()
+	}
+	result.DroppedClients = int(atomic.LoadInt64(&metrics.DroppedClients))
+	if opts.WarnOnClockSkew || opts.RelativeLatency || opts.ReportE2EHistogram {
+		latencies := metrics.EndToEndLatency.Durations()
+		result.E2ELatency = CalcLatencyStats(latencies)
+		if opts.ReportE2EHistogram {
+			result.E2EHistogram = CalcHistogram(latencies, HISTOGRAM_BUCKETS)
+		}
+		// 相対時間の場合は、負の値も時計のずれを表さないため、検出しない。
+		if opts.WarnOnClockSkew && opts.RelativeLatency == false {
+			result.ClockSkew = DetectClockSkew(latencies)
+		}
+	}
+	if opts.ReportSubLatency {
+		result.ConnectLatency = CalcLatencyStats(metrics.ConnectLatency.Durations())
+		result.SubscribeLatency = CalcLatencyStats(metrics.SubscribeLatency.Durations())
+	}
+	if b.tracker != nil {
+		result.Connections = b.tracker.Stats(len(b.connections), b.endTime)
+	}
+	if opts.ReportJitter {
+		result.Jitter = CalcJitterStats(metrics.Arrivals)
+	}
+	if opts.ReportReceiveGap {
+		result.ReceiveGap = CalcReceiveGap(metrics.Arrivals)
+	}
+	if opts.ReportQosLatency {
+		result.LatencyPerQos = make(map[string]*LatencyStats)
+		for qos, stats := range metrics.PublishLatency.StatsByQos() {
+			result.LatencyPerQos[strconv.Itoa(int(qos))] = stats
+		}
+	}
+	if opts.ReportMad {
+		result.LatencyMad = CalcMedianAbsoluteDeviation(metrics.PublishLatency.Durations())
+	}
+	if len(opts.Percentiles) > 0 {
+		result.Percentiles = metrics.PublishLatency.Percentiles(opts.Percentiles)
+	}
+	if metrics.Outliers != nil {
+		result.Outliers = metrics.Outliers.Outliers()
+	}
+	if metrics.GcImpact != nil {
+		// Publishの応答時間のp99を超えた場合を、応答時間の急増とみなす。
+		var threshold time.Duration = 0
+		if result.Latency != nil {
+			threshold = time.Duration(result.Latency.P99 * float64(time.Millisecond))
+		}
+		result.GcPause = metrics.GcImpact.Stats(threshold)
+	}
+	if metrics.TopicLatency != nil {
+		result.LatencyPerTopic = metrics.TopicLatency.Stats(opts.TopicLatencyTop)
+	}
+	return &result
+}
+
+// メッセージ数と経過時間から、スループット(messages/sec)を算出する。
+// 1ms未満の実行でも算出できるように、ミリ秒に丸めない経過時間で割る（経過時間が0の場合は0）。
+func CalcThroughput(count int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(count) / elapsed.Seconds()
+}
+
+// 開始時刻からの経過時間(ms)を返す。
+func ElapsedMillis(start time.Time) int64 {
+	return time.Since(start).Nanoseconds() / int64(1000000)
+}
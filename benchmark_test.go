@@ -0,0 +1,611 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// テスト用の実行オプションを生成する（フラグのデフォルト値に相当する）。
+func testExecOptions(broker string) ExecOptions {
+	return ExecOptions{
+		Broker:         broker,
+		Topic:          BASE_TOPIC,
+		ClientNum:      2,
+		Count:          10,
+		MessageSize:    16,
+		ClientsPerConn: 1,
+		WildcardDepth:  4,
+		SampleInterval: time.Second,
+		LatencyBackend: LATENCY_BACKEND_EXACT}
+}
+
+func TestConnectReportsFailedClients(t *testing.T) {
+	failed := map[string]bool{CreateClientId(1): true, CreateClientId(3): true}
+	broker := startTestBroker(t, &testBroker{
+		Refuse: func(connect testConnect) byte {
+			if failed[connect.ClientId] {
+				return 0x05 // not authorized
+			}
+			return 0
+		}})
+
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 5
+	opts.ReportConnectErrs = true
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+
+	if b.Connect() {
+		t.Fatal("Connect succeeded with refused clients")
+	}
+	if len(b.connectErrors) != 2 {
+		t.Fatalf("connect errors = %d, want 2", len(b.connectErrors))
+	}
+	records := ConnectErrorRecords(b.connectErrors)
+	for i, index := range []int{1, 3} {
+		if records[i].ClientIndex != index || records[i].ClientId != CreateClientId(index) {
+			t.Errorf("error %d = index %d, clientId %s, want index %d", i, records[i].ClientIndex, records[i].ClientId, index)
+		}
+		if records[i].Error == "" || records[i].Timestamp == "" {
+			t.Errorf("error %d has no detail : %+v", i, records[i])
+		}
+	}
+
+	// 詳細を出力しない場合は、最初の接続エラーで接続を打ち切る。
+	opts.ReportConnectErrs = false
+	b = NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	if b.Connect() || len(b.connectErrors) != 1 || strings.HasSuffix(b.connectErrors[0].ClientId, "-1") == false {
+		t.Errorf("connect errors without the detail = %+v", b.connectErrors)
+	}
+}
+
+func TestConnectErrorsAsJsonArray(t *testing.T) {
+	failed := map[string]bool{CreateClientId(0): true, CreateClientId(2): true}
+	broker := startTestBroker(t, &testBroker{
+		Refuse: func(connect testConnect) byte {
+			if failed[connect.ClientId] {
+				return 0x05 // not authorized
+			}
+			return 0
+		}})
+	var posted Result
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &posted); err != nil {
+			t.Errorf("posted body is not a Result : %s", err)
+		}
+	}))
+	defer server.Close()
+
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 3
+	opts.ReportConnectErrs = true
+	opts.ConnectErrorsJson = true
+	opts.ResultWebhook = server.URL
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PublishAllClient, opts)
+	})
+	if result != nil {
+		t.Fatal("Execute succeeded with refused clients")
+	}
+
+	// 出力の中の、JSON配列の行を取り出す。
+	var array string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "[") {
+			array = line
+		}
+	}
+	var records []map[string]interface{}
+	if err := json.Unmarshal([]byte(array), &records); err != nil {
+		t.Fatalf("no JSON array (%s) : %s", err, output)
+	}
+	if len(records) != 2 {
+		t.Fatalf("records = %v", records)
+	}
+	for i, index := range []int{0, 2} {
+		record := records[i]
+		if record["index"] != float64(index) || record["client_id"] != CreateClientId(index) || record["error"] == "" {
+			t.Errorf("record %d = %v", i, record)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, fmt.Sprint(record["timestamp"])); err != nil {
+			t.Errorf("record %d timestamp : %s", i, err)
+		}
+	}
+	if len(posted.ConnectErrors) != 2 || posted.ConnectErrors[1].ClientId != CreateClientId(2) || posted.ClientNum != opts.ClientNum {
+		t.Errorf("posted result = %+v", posted)
+	}
+}
+
+func TestIdleHoldWithKeepAliveDisabled(t *testing.T) {
+	for _, keepAlive := range []time.Duration{0, time.Second} {
+		broker := startTestBroker(t, &testBroker{})
+		opts := testExecOptions(broker.URL)
+		opts.Count = 1
+		opts.IdleHold = 1500 * time.Millisecond
+		opts.ConnectOptions = []ClientOptionSetter{func(o *MQTT.ClientOptions) { o.SetKeepAlive(keepAlive) }}
+
+		var result *Result
+		output := captureStdout(t, func() {
+			result = Execute(PublishAllClient, opts)
+		})
+		if result == nil || result.IdleHold == nil {
+			t.Fatalf("keepalive = %s : no idle hold result : %s", keepAlive, output)
+		}
+		hold := result.IdleHold
+		if hold.Connections != opts.ClientNum || hold.Lost != 0 || hold.Disconnected != 0 {
+			t.Errorf("keepalive = %s : idle hold = %s", keepAlive, hold)
+		}
+		for _, connect := range broker.Connects() {
+			if time.Duration(connect.KeepAlive)*time.Second != keepAlive {
+				t.Errorf("keepalive = %s : CONNECT keepalive = %ds", keepAlive, connect.KeepAlive)
+			}
+		}
+		// キープアライブを無効にした場合は、アイドルな間もPINGREQを送信しない。
+		if pings := broker.Pings(); (keepAlive == 0) != (pings == 0) {
+			t.Errorf("keepalive = %s : pings = %d", keepAlive, pings)
+		}
+	}
+}
+
+func TestKeepAliveFlag(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	status, output := runMainOutput(t, "-broker="+broker.URL, "-action=pub", "-clients=1", "-count=1", "-pretime=0", "-keepalive=0", "-idle-hold=100")
+	if status != 0 {
+		t.Fatalf("status = %d : %s", status, output)
+	}
+	connects := broker.Connects()
+	if len(connects) == 0 || connects[0].KeepAlive != 0 {
+		t.Errorf("connects = %+v", connects)
+	}
+	if strings.Contains(output, "Idle hold : hold=100ms, connections=1, lost=0, disconnected=0") == false {
+		t.Errorf("output = %s", output)
+	}
+
+	if status, _ := runMainOutput(t, "-broker="+broker.URL, "-action=pub", "-keepalive=-2"); status != 1 {
+		t.Errorf("status with -keepalive=-2 = %d, want 1", status)
+	}
+}
+
+func TestClientsPerConnectionSharesConnections(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 5
+	opts.ClientsPerConn = 2
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+
+	if b.Connect() == false {
+		t.Fatal("Connect failed")
+	}
+	defer b.Teardown()
+	if connects := len(broker.Connects()); connects != 3 {
+		t.Errorf("connects = %d, want 3", connects)
+	}
+	if len(b.clients) != opts.ClientNum {
+		t.Fatalf("logical clients = %d, want %d", len(b.clients), opts.ClientNum)
+	}
+	for i, client := range b.clients {
+		if client != b.connections[i/2] {
+			t.Errorf("logical client %d is not mapped to connection %d", i, i/2)
+		}
+	}
+}
+
+func TestClientsPerConnectionWithDefaultHandler(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 3
+	opts.ClientsPerConn = 2
+	opts.Count = 2
+	opts.UseDefaultHandler = true
+	opts.SubscribeTimeout = 5000
+	b := NewBenchmark(SubscribeAllClient, opts)
+	defer b.Close()
+	if b.Connect() == false {
+		t.Fatal("Connect failed")
+	}
+	defer b.Teardown()
+
+	publisherOpts := opts
+	publisherOpts.UseDefaultHandler = false
+	publisher := connectTestClient(t, publisherOpts, 100)
+	go func() {
+		waitFor(5*time.Second, func() bool {
+			return len(broker.Subscriptions(CreateClientId(0))) == 2 && len(broker.Subscriptions(CreateClientId(1))) == 1
+		})
+		for id := 0; id < opts.ClientNum; id++ {
+			for i := 0; i < opts.Count; i++ {
+				Publish(publisher, CreateClientTopic(opts, id, i), 1, false, "message", 0)
+			}
+		}
+	}()
+
+	b.Run()
+	if b.totalCount != opts.ClientNum*opts.Count {
+		t.Errorf("received = %d, want %d", b.totalCount, opts.ClientNum*opts.Count)
+	}
+}
+
+func TestBenchmarkPhases(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{ConnackDelay: 20 * time.Millisecond})
+	opts := testExecOptions(broker.URL)
+	opts.PreTime = 50
+	opts.IntervalTime = 5
+
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	var result *Result
+	captureStdout(t, func() {
+		if b.Connect() == false {
+			t.Fatal("Connect failed")
+		}
+		connected := time.Now()
+		b.Warmup()
+		b.Run()
+		if b.startTime.Before(connected) {
+			t.Errorf("run started at %s before the connect phase ended at %s", b.startTime, connected)
+		}
+		b.Teardown()
+		result = b.Report()
+	})
+	if result == nil || result.Phases == nil {
+		t.Fatalf("no phases in the result : %+v", result)
+	}
+
+	phases := result.Phases
+	if phases.Connect < 20 || phases.Warmup < 50 || phases.Run < 50 || phases.Teardown < 0 {
+		t.Errorf("phases = %+v", phases)
+	}
+	if phases.Run != result.Duration {
+		t.Errorf("run phase = %dms, duration = %dms", phases.Run, result.Duration)
+	}
+	for _, connect := range broker.Connects() {
+		if connect.Time.After(b.startTime) {
+			t.Errorf("client %s connected at %s after the run started at %s", connect.ClientId, connect.Time, b.startTime)
+		}
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"connect_ms", "warmup_ms", "run_ms", "teardown_ms"} {
+		if strings.Contains(string(body), `"`+key+`"`) == false {
+			t.Errorf("result has no %s : %s", key, body)
+		}
+	}
+}
+
+func TestQos0FlushWaitExtendsMeasuredWindow(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 4
+	opts.Count = 20
+	opts.Qos0FlushWait = true
+
+	// 送信したメッセージは、300ms後にネットワークへの書き込みが完了する（5件に1件は失敗する）。
+	clients := make([]MQTT.Client, opts.ClientNum)
+	for id := range clients {
+		clients[id] = &testClient{OnPublish: func(index int, topic string) MQTT.Token {
+			var err error = nil
+			if index%5 == 0 {
+				err = errors.New("write failed")
+			}
+			return newDelayedTestToken(300*time.Millisecond, err)
+		}}
+	}
+
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	b.clients = clients
+	captureStdout(t, b.Run)
+
+	if window := b.endTime.Sub(b.startTime); window < 300*time.Millisecond {
+		t.Errorf("measured window = %s ended before the buffer was drained", window)
+	}
+	if expected := opts.ClientNum * opts.Count * 4 / 5; b.totalCount != expected {
+		t.Errorf("total count = %d, want %d", b.totalCount, expected)
+	}
+	if inflight := b.Metrics.Inflight.Current(); inflight != 0 {
+		t.Errorf("inflight after the flush = %d", inflight)
+	}
+}
+
+func TestConnectThenSubscribeLatency(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{ConnackDelay: 30 * time.Millisecond})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 3
+	opts.ReportSubLatency = true
+	opts.SubscribeTimeout = 100
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(SubscribeAllClient, opts)
+	})
+	if result == nil || result.ConnectLatency == nil || result.SubscribeLatency == nil {
+		t.Fatalf("no connect or subscribe latency : %s", output)
+	}
+	// CONNACKの遅延は接続時間のみに含まれ、Subscribeの時間には含まれない。
+	if result.ConnectLatency.Count != 3 || result.ConnectLatency.Min < 30 {
+		t.Errorf("connect latency = %s", result.ConnectLatency)
+	}
+	if result.SubscribeLatency.Count != 3 || result.SubscribeLatency.Max >= 30 {
+		t.Errorf("subscribe latency = %s", result.SubscribeLatency)
+	}
+	for _, line := range []string{"Connect latency : count=3", "Subscribe latency : count=3"} {
+		if strings.Contains(output, line) == false {
+			t.Errorf("output has no %q :\n%s", line, output)
+		}
+	}
+}
+
+func TestConnectLatencyExcludesFailedConnects(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{
+		Refuse: func(connect testConnect) byte {
+			if connect.ClientId == CreateClientId(1) {
+				return 0x05 // not authorized
+			}
+			return 0
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 3
+	opts.Qos = 1
+	opts.ReportConnectErrs = true
+
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	captureStdout(t, func() {
+		b.Connect()
+	})
+	durations := b.Metrics.ConnectLatency.DurationsByQos()
+	if len(durations) != 1 || len(durations[0]) != 2 {
+		t.Errorf("connect latencies = %v, want 2 successes recorded as QoS 0", durations)
+	}
+}
+
+func TestReportEffectiveQos(t *testing.T) {
+	// クライアント毎のTopic Filterに、異なるQoSを付与する。
+	granted := map[string]byte{"/0": 2, "/1": 1, "/2": 1, "/3": SUBACK_FAILURE}
+	broker := startTestBroker(t, &testBroker{
+		Grant: func(filter string, qos byte) byte {
+			return granted[strings.TrimPrefix(filter, BASE_TOPIC)]
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 4
+	opts.Qos = 2
+	opts.ReportEffectiveQos = true
+	opts.SubscribeTimeout = 100
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(SubscribeAllClient, opts)
+	})
+	if result == nil {
+		t.Fatalf("Execute failed : %s", output)
+	}
+	expected := []QosGrant{{2, 1, 2}, {2, 2, 1}, {2, SUBACK_FAILURE, 1}}
+	if len(result.EffectiveQos) != len(expected) {
+		t.Fatalf("effective QoS = %+v, want %+v", result.EffectiveQos, expected)
+	}
+	for i := range expected {
+		if result.EffectiveQos[i] != expected[i] {
+			t.Errorf("effective QoS %d = %+v, want %+v", i, result.EffectiveQos[i], expected[i])
+		}
+	}
+	summary := "Effective QoS : requested 2, granted 1 on 2 subs; requested 2, granted 2 on 1 subs; requested 2, granted failure on 1 subs"
+	if strings.Contains(output, summary) == false {
+		t.Errorf("output has no %q :\n%s", summary, output)
+	}
+}
+
+func TestCreateConnectPacket(t *testing.T) {
+	tests := []struct {
+		username string
+		password string
+		flags    byte
+	}{
+		{"", "", 0x02},
+		{"user", "", 0x82},
+		{"user", "pass", 0xc2},
+		// ユーザー名のないパスワードは送信しない。
+		{"", "pass", 0x02}}
+	for _, test := range tests {
+		packet := CreateConnectPacket("id", test.username, test.password)
+		// 固定ヘッダー(2byte)、プロトコル名(6byte)、プロトコルレベルの次が接続フラグとなる。
+		if flags := packet[9]; flags != test.flags {
+			t.Errorf("flags of %q/%q = 0x%02x, want 0x%02x", test.username, test.password, flags, test.flags)
+		}
+		if int(packet[1]) != len(packet)-2 {
+			t.Errorf("remaining length = %d, want %d", packet[1], len(packet)-2)
+		}
+	}
+}
+
+func TestConnectBreakdown(t *testing.T) {
+	cert := newTestCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	tlsBroker := startTestBroker(t, &testBroker{
+		ConnackDelay: 20 * time.Millisecond,
+		TlsConfig:    &tls.Config{Certificates: []tls.Certificate{cert.Certificate}}})
+	tcpBroker := startTestBroker(t, &testBroker{ConnackDelay: 20 * time.Millisecond})
+
+	for _, broker := range []*testBroker{tlsBroker, tcpBroker} {
+		opts := testExecOptions(broker.URL)
+		opts.ClientNum = 3
+		opts.ReportConnBreakdown = true
+		if broker == tlsBroker {
+			opts.CertConfig = ServerCertConfig{ServerCertFile: cert.CertFile}
+		}
+
+		b := NewBenchmark(PublishAllClient, opts)
+		if b.Connect() == false {
+			t.Fatalf("%s : Connect failed", broker.URL)
+		}
+		b.Teardown()
+		b.Close()
+
+		// ベンチマークの接続自体を計測し、プローブ接続は行わない。
+		breakdown := b.breakdown
+		if breakdown == nil || breakdown.Connections != 3 || len(broker.Connects()) != 3 {
+			t.Fatalf("%s : breakdown = %v, connects = %d", broker.URL, breakdown, len(broker.Connects()))
+		}
+		if breakdown.TcpConnect <= 0 || breakdown.MqttConnect < 20 {
+			t.Errorf("%s : breakdown = %s", broker.URL, breakdown)
+		}
+		if handshaked := breakdown.TlsHandshake > 0; handshaked != (broker == tlsBroker) {
+			t.Errorf("%s : TLS handshake = %.3fms", broker.URL, breakdown.TlsHandshake)
+		}
+
+		// 合計は各段階とは別に計測し、各段階の和とおおむね一致する（差は接続を開始するまでのpaho内の処理）。
+		sum := breakdown.TcpConnect + breakdown.TlsHandshake + breakdown.MqttConnect
+		if sum > breakdown.Total || breakdown.Total-sum > 1+breakdown.Total*0.1 {
+			t.Errorf("%s : sum of the steps = %.3fms, total = %.3fms", broker.URL, sum, breakdown.Total)
+		}
+		if latency := b.Metrics.ConnectLatency.Stats(); latency == nil || breakdown.Total > latency.Avg {
+			t.Errorf("%s : total = %.3fms, connect latency = %v", broker.URL, breakdown.Total, latency)
+		}
+	}
+}
+
+func TestTeardownAbandonsBlockedDisconnect(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 2
+	opts.IntervalTime = 1
+	opts.DisconnectTimeout = 100 * time.Millisecond
+
+	// 切断が完了しないクライアント
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	clients := make([]MQTT.Client, opts.ClientNum)
+	for id := range clients {
+		clients[id] = &testClient{OnDisconnect: func() { <-release }}
+	}
+
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	b.clients = clients
+	b.connections = clients
+	var elapsed time.Duration
+	output := captureStdout(t, func() {
+		b.Run()
+		start := time.Now()
+		b.Teardown()
+		elapsed = time.Since(start)
+		if result := b.Report(); result != nil {
+			PrintResult(result)
+		}
+	})
+
+	// 接続毎の切断は並行して行うため、切断の最大待機時間程度で完了する。
+	if elapsed < opts.DisconnectTimeout || elapsed > 5*opts.DisconnectTimeout {
+		t.Errorf("teardown took %s", elapsed)
+	}
+	if strings.Contains(output, "Disconnect timeout : abandoned=2") == false || strings.Contains(output, "Result : ") == false {
+		t.Errorf("output has no abandoned disconnects or result :\n%s", output)
+	}
+}
+
+func TestConnectJitter(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 8
+	opts.ConnectJitter = 30 * time.Millisecond
+
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	if b.Connect() == false {
+		t.Fatal("connect failed")
+	}
+	defer b.Teardown()
+
+	// 接続毎に、0から最大時間までのランダムな時間だけ待機してから接続する。
+	connects := broker.Connects()
+	if len(connects) != opts.ClientNum {
+		t.Fatalf("connects = %d", len(connects))
+	}
+	var minGap, maxGap time.Duration = time.Hour, 0
+	for i := 1; i < len(connects); i++ {
+		gap := connects[i].Time.Sub(connects[i-1].Time)
+		if gap > opts.ConnectJitter+20*time.Millisecond {
+			t.Errorf("gap between connect %d and %d = %s, want within %s", i-1, i, gap, opts.ConnectJitter)
+		}
+		if gap < minGap {
+			minGap = gap
+		}
+		if gap > maxGap {
+			maxGap = gap
+		}
+	}
+	if maxGap-minGap < 2*time.Millisecond {
+		t.Errorf("gaps are not jittered : min=%s, max=%s", minGap, maxGap)
+	}
+}
+
+func TestConnectionCountGauge(t *testing.T) {
+	var refuse int32 = 0
+	broker := startTestBroker(t, &testBroker{
+		Refuse: func(connect testConnect) byte {
+			if atomic.LoadInt32(&refuse) == 1 {
+				return 0x03 // server unavailable
+			}
+			return 0
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 3
+	opts.ReportConnCount = true
+
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	if b.Connect() == false {
+		t.Fatal("connect failed")
+	}
+	defer b.Teardown()
+
+	connected := func(expected int64) func() bool {
+		return func() bool { return atomic.LoadInt64(&b.Metrics.Connected) == expected }
+	}
+	waitUntil(t, 5*time.Second, connected(3))
+	// 接続断で減少し、再接続で元に戻る。
+	broker.DropConnection(CreateClientId(1))
+	waitUntil(t, 5*time.Second, func() bool { return len(broker.Connects()) == 4 })
+	waitUntil(t, 5*time.Second, connected(3))
+
+	// 再接続が拒否される間は、切断された接続は数えない。
+	atomic.StoreInt32(&refuse, 1)
+	broker.DropConnection(CreateClientId(2))
+	waitUntil(t, 5*time.Second, connected(2))
+	broker.DropConnection(CreateClientId(0))
+	waitUntil(t, 5*time.Second, connected(1))
+}
+
+func TestCalcThroughput(t *testing.T) {
+	// 1ms未満の実行も、丸めずに算出する。
+	if throughput := CalcThroughput(10, 500*time.Microsecond); math.Abs(throughput-20000) > 1e-6 {
+		t.Errorf("throughput of 10 messages in 0.5ms = %f, want 20000", throughput)
+	}
+	if throughput := CalcThroughput(100, 2*time.Second); throughput != 50 {
+		t.Errorf("throughput of 100 messages in 2s = %f, want 50", throughput)
+	}
+	// 経過時間が0の場合も、JSONに変換できる値とする。
+	for _, count := range []int64{0, 10} {
+		throughput := CalcThroughput(count, 0)
+		if throughput != 0 {
+			t.Errorf("throughput of %d messages in 0s = %f, want 0", count, throughput)
+		}
+		if _, err := json.Marshal(Result{Throughput: throughput}); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 接続の所要時間の内訳（接続の平均値）
+type ConnectBreakdown struct {
+	Connections  int     `json:"connections"`      // 計測した接続数
+	TcpConnect   float64 `json:"tcp_connect_ms"`   // TCPの接続(ms、WebSocketの場合はハンドシェイクを含む)
+	TlsHandshake float64 `json:"tls_handshake_ms"` // TLSのハンドシェイク(ms、TLSでない場合は0)
+	MqttConnect  float64 `json:"mqtt_connect_ms"`  // 接続(TCP/TLS)の完了から、CONNACKの受信まで(ms)
+	Total        float64 `json:"total_ms"`         // 接続の開始から、CONNACKの受信まで(ms、各段階とは別に計測する)
+}
+
+// 接続の所要時間の内訳を、1行の文字列に整形する。
+func (b *ConnectBreakdown) String() string {
+	return fmt.Sprintf("connections=%d, tcp=%.3fms, tls=%.3fms, mqtt=%.3fms, total=%.3fms",
+		b.Connections, b.TcpConnect, b.TlsHandshake, b.MqttConnect, b.Total)
+}
+
+// ベンチマークの接続毎に、所要時間の内訳を記録する。
+type BreakdownRecorder struct {
+	mutex        sync.Mutex
+	connections  int
+	tcpConnect   time.Duration
+	tlsHandshake time.Duration
+	mqttConnect  time.Duration
+	total        time.Duration
+}
+
+// BreakdownRecorderを生成する。
+func NewBreakdownRecorder() *BreakdownRecorder {
+	return &BreakdownRecorder{}
+}
+
+// 1つの接続の所要時間の内訳を記録する。
+//   timing      : 接続(TCP/TLS)の各段階の所要時間
+//   mqttConnect : 接続の完了から、CONNACKの受信までの時間
+//   total       : 接続の開始から、CONNACKの受信までの時間
+func (r *BreakdownRecorder) Record(timing *ConnectTiming, mqttConnect time.Duration, total time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.connections++
+	r.tcpConnect += timing.TcpConnect
+	r.tlsHandshake += timing.TlsHandshake
+	r.mqttConnect += mqttConnect
+	r.total += total
+}
+
+// 記録した接続の、所要時間の内訳の平均値を返す（記録がない場合は nil を返す）。
+func (r *BreakdownRecorder) Stats() *ConnectBreakdown {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.connections == 0 {
+		return nil
+	}
+	n := time.Duration(r.connections)
+	return &ConnectBreakdown{
+		Connections:  r.connections,
+		TcpConnect:   ToMillis(r.tcpConnect / n),
+		TlsHandshake: ToMillis(r.tlsHandshake / n),
+		MqttConnect:  ToMillis(r.mqttConnect / n),
+		Total:        ToMillis(r.total / n)}
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// テスト用の、MQTT 3.1.1のBroker
+// ループバックアドレスで待ち受け、ベンチマークの処理の検証に必要な範囲のパケットのみを処理する。
+// フックは、startTestBroker を呼び出す前に設定する。
+type testBroker struct {
+	Refuse          func(connect testConnect) byte          // CONNACKのリターンコードを返す（0以外の場合は接続を拒否する）
+	ConnackDelay    time.Duration                           // CONNACKを返すまでの待機時間
+	Grant           func(filter string, qos byte) byte      // SUBACKで付与するQoSを返す（nil の場合は要求されたQoS）
+	Drop            func(topic string, payload []byte) bool // true の場合は、Subscriberに配信しない
+	Duplicate       func(topic string, payload []byte) bool // true の場合は、Subscriberに2回配信する
+	AckDelay        time.Duration                           // PUBACK/PUBRECを返すまでの待機時間
+	RouteDelay      func(topic string) time.Duration        // 受信したメッセージを、Subscriberへ配信するまでの待機時間を返す
+	PerSubscription bool                                    // 重複するSubscriptionに、Subscription毎に配信するかどうか
+	TlsConfig       *tls.Config                             // TLSで待ち受ける場合の設定
+
+	URL string // 接続先のURI
+
+	listener     net.Listener
+	wg           sync.WaitGroup
+	mutex        sync.Mutex
+	closed       bool
+	conns        map[net.Conn]bool
+	sessions     map[string]*testSession
+	retained     map[string]testMessage
+	connects     []testConnect
+	published    []testMessage
+	unsubscribed []string
+	pings        int
+}
+
+// CONNECTの内容
+type testConnect struct {
+	ClientId     string
+	Username     string
+	Password     string
+	KeepAlive    uint16
+	CleanSession bool
+	Time         time.Time
+	Addr         string // 接続元のアドレス
+}
+
+// Brokerが送受信したメッセージ
+type testMessage struct {
+	Topic   string
+	Payload []byte
+	Qos     byte
+	Retain  bool
+}
+
+// クライアント毎のセッション
+type testSession struct {
+	clean  bool
+	conn   *testConn
+	subs   map[string]byte
+	queue  []testMessage
+	nextId uint16
+}
+
+// クライアントとの接続
+// 送信はパケットのキューを経由し、接続毎のgoroutineで書き込む。
+type testConn struct {
+	conn net.Conn
+	out  chan []byte
+}
+
+// Brokerを起動し、テストの終了時に停止する。
+func startTestBroker(t *testing.T, b *testBroker) *testBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme := "tcp"
+	if b.TlsConfig != nil {
+		listener = tls.NewListener(listener, b.TlsConfig)
+		scheme = "ssl"
+	}
+	b.listener = listener
+	b.URL = scheme + "://" + listener.Addr().String()
+	b.conns = make(map[net.Conn]bool)
+	b.sessions = make(map[string]*testSession)
+	b.retained = make(map[string]testMessage)
+
+	b.wg.Add(1)
+	go b.accept()
+	t.Cleanup(b.Close)
+	return b
+}
+
+// Brokerを停止し、全ての接続を切断する。
+func (b *testBroker) Close() {
+	b.mutex.Lock()
+	b.closed = true
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mutex.Unlock()
+	b.listener.Close()
+	b.wg.Wait()
+}
+
+// 受け付けたCONNECTの一覧を返す。
+func (b *testBroker) Connects() []testConnect {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]testConnect(nil), b.connects...)
+}
+
+// 受け付けたPINGREQの数を返す。
+func (b *testBroker) Pings() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.pings
+}
+
+// クライアントからPublishされたメッセージの一覧を返す。
+func (b *testBroker) Published() []testMessage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]testMessage(nil), b.published...)
+}
+
+// UnsubscribeされたTopicFilterの一覧を返す。
+func (b *testBroker) Unsubscribed() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return append([]string(nil), b.unsubscribed...)
+}
+
+// クライアントのSubscriptionの一覧を返す。
+func (b *testBroker) Subscriptions(clientId string) map[string]byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	subs := make(map[string]byte)
+	if session, ok := b.sessions[clientId]; ok {
+		for filter, qos := range session.subs {
+			subs[filter] = qos
+		}
+	}
+	return subs
+}
+
+// 開いているTCP接続の数を返す。
+func (b *testBroker) OpenConnections() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.conns)
+}
+
+// クライアントとの接続を、Broker側から切断する。
+func (b *testBroker) DropConnection(clientId string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	session, ok := b.sessions[clientId]
+	if ok == false || session.conn == nil {
+		return false
+	}
+	session.conn.conn.Close()
+	return true
+}
+
+func (b *testBroker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		b.mutex.Lock()
+		if b.closed {
+			b.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		b.conns[conn] = true
+		b.mutex.Unlock()
+
+		b.wg.Add(1)
+		go b.serve(conn)
+	}
+}
+
+// 1つの接続のパケットを処理する。
+func (b *testBroker) serve(conn net.Conn) {
+	defer b.wg.Done()
+	defer func() {
+		conn.Close()
+		b.mutex.Lock()
+		delete(b.conns, conn)
+		b.mutex.Unlock()
+	}()
+
+	reader := bufio.NewReader(conn)
+	header, body, err := readMqttPacket(reader)
+	if err != nil || header != 0x10 {
+		return
+	}
+	connect, ok := parseTestConnect(body)
+	if ok == false {
+		return
+	}
+	connect.Time = time.Now()
+	connect.Addr = conn.RemoteAddr().String()
+	b.mutex.Lock()
+	b.connects = append(b.connects, connect)
+	b.mutex.Unlock()
+
+	if b.ConnackDelay > 0 {
+		time.Sleep(b.ConnackDelay)
+	}
+	if b.Refuse != nil {
+		if code := b.Refuse(connect); code != 0 {
+			conn.Write([]byte{0x20, 0x02, 0x00, code})
+			return
+		}
+	}
+
+	c := &testConn{conn: conn, out: make(chan []byte, 65536)}
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		for packet := range c.out {
+			conn.Write(packet)
+		}
+	}()
+	defer func() {
+		b.detach(connect.ClientId, c)
+		close(c.out)
+		<-writerDone
+	}()
+	b.attach(connect, c)
+
+	// QoS 2で受信中のパケットID
+	inflight := make(map[uint16]bool)
+	for {
+		header, body, err := readMqttPacket(reader)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 3: // PUBLISH
+			msg, id, ok := parseTestPublish(header, body)
+			if ok == false {
+				return
+			}
+			if msg.Qos > 0 && b.AckDelay > 0 {
+				time.Sleep(b.AckDelay)
+			}
+			if b.RouteDelay != nil {
+				time.Sleep(b.RouteDelay(msg.Topic))
+			}
+			switch msg.Qos {
+			case 0:
+				b.route(msg)
+			case 1:
+				b.route(msg)
+				c.out <- createAckPacket(0x40, id)
+			case 2:
+				if inflight[id] == false {
+					inflight[id] = true
+					b.route(msg)
+				}
+				c.out <- createAckPacket(0x50, id)
+			}
+		case 5: // PUBREC
+			if len(body) >= 2 {
+				c.out <- createAckPacket(0x62, binary.BigEndian.Uint16(body))
+			}
+		case 6: // PUBREL
+			if len(body) >= 2 {
+				id := binary.BigEndian.Uint16(body)
+				delete(inflight, id)
+				c.out <- createAckPacket(0x70, id)
+			}
+		case 8: // SUBSCRIBE
+			b.subscribe(connect.ClientId, c, body)
+		case 10: // UNSUBSCRIBE
+			b.unsubscribe(connect.ClientId, c, body)
+		case 12: // PINGREQ
+			b.mutex.Lock()
+			b.pings++
+			b.mutex.Unlock()
+			c.out <- []byte{0xd0, 0x00}
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// セッションに接続を割り当て、CONNACKと、切断中に保持したメッセージを送信する。
+func (b *testBroker) attach(connect testConnect, c *testConn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	session, present := b.sessions[connect.ClientId]
+	if present && connect.CleanSession {
+		present = false
+	}
+	if present == false {
+		session = &testSession{subs: make(map[string]byte)}
+		b.sessions[connect.ClientId] = session
+	}
+	// 同じClientIDで接続中の場合は、既存の接続を切断する。
+	if session.conn != nil {
+		session.conn.conn.Close()
+	}
+	session.clean = connect.CleanSession
+	session.conn = c
+
+	var sessionPresent byte = 0
+	if present {
+		sessionPresent = 1
+	}
+	c.out <- []byte{0x20, 0x02, sessionPresent, 0x00}
+
+	queue := session.queue
+	session.queue = nil
+	for _, msg := range queue {
+		b.deliver(session, msg, msg.Qos)
+	}
+}
+
+// 接続の終了時に、セッションから接続を外す。
+func (b *testBroker) detach(clientId string, c *testConn) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	session, ok := b.sessions[clientId]
+	if ok == false || session.conn != c {
+		return
+	}
+	session.conn = nil
+	if session.clean {
+		delete(b.sessions, clientId)
+	}
+}
+
+func (b *testBroker) subscribe(clientId string, c *testConn, body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	session := b.sessions[clientId]
+
+	codes := []byte{body[0], body[1]}
+	var filters []string
+	for pos := 2; pos+2 <= len(body); {
+		length := int(binary.BigEndian.Uint16(body[pos:]))
+		if pos+2+length+1 > len(body) {
+			break
+		}
+		filter := string(body[pos+2 : pos+2+length])
+		qos := body[pos+2+length]
+		pos += 2 + length + 1
+
+		granted := qos
+		if b.Grant != nil {
+			granted = b.Grant(filter, qos)
+		}
+		codes = append(codes, granted)
+		if granted != 0x80 && session != nil {
+			session.subs[filter] = granted
+			filters = append(filters, filter)
+		}
+	}
+	c.out <- append(append([]byte{0x90}, encodeRemainingLength(len(codes))...), codes...)
+
+	// 保持されたメッセージを配信する。
+	for _, filter := range filters {
+		for topic, msg := range b.retained {
+			if TopicMatches(filter, topic) {
+				qos := msg.Qos
+				if session.subs[filter] < qos {
+					qos = session.subs[filter]
+				}
+				retained := msg
+				retained.Retain = true
+				b.deliver(session, retained, qos)
+			}
+		}
+	}
+}
+
+func (b *testBroker) unsubscribe(clientId string, c *testConn, body []byte) {
+	if len(body) < 2 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	session := b.sessions[clientId]
+
+	for pos := 2; pos+2 <= len(body); {
+		length := int(binary.BigEndian.Uint16(body[pos:]))
+		if pos+2+length > len(body) {
+			break
+		}
+		filter := string(body[pos+2 : pos+2+length])
+		pos += 2 + length
+		b.unsubscribed = append(b.unsubscribed, filter)
+		if session != nil {
+			delete(session.subs, filter)
+		}
+	}
+	c.out <- []byte{0xb0, 0x02, body[0], body[1]}
+}
+
+// Publishされたメッセージを、一致するSubscriptionを持つセッションに配信する。
+func (b *testBroker) route(msg testMessage) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.published = append(b.published, msg)
+	if msg.Retain {
+		if len(msg.Payload) == 0 {
+			delete(b.retained, msg.Topic)
+		} else {
+			b.retained[msg.Topic] = msg
+		}
+	}
+	if b.Drop != nil && b.Drop(msg.Topic, msg.Payload) {
+		return
+	}
+	copies := 1
+	if b.Duplicate != nil && b.Duplicate(msg.Topic, msg.Payload) {
+		copies = 2
+	}
+
+	msg.Retain = false
+	for _, session := range b.sessions {
+		for _, qos := range b.matchedQos(session, msg.Topic) {
+			if msg.Qos < qos {
+				qos = msg.Qos
+			}
+			for i := 0; i < copies; i++ {
+				b.deliver(session, msg, qos)
+			}
+		}
+	}
+}
+
+// Topicに一致するSubscriptionのQoSを返す。
+// Subscription毎に配信しない場合は、一致したSubscriptionの最大のQoSで1回のみ配信する。
+func (b *testBroker) matchedQos(session *testSession, topic string) []byte {
+	var matched []byte
+	for filter, qos := range session.subs {
+		if TopicMatches(filter, topic) == false {
+			continue
+		}
+		if b.PerSubscription || len(matched) == 0 {
+			matched = append(matched, qos)
+		} else if qos > matched[0] {
+			matched[0] = qos
+		}
+	}
+	return matched
+}
+
+// セッションにメッセージを送信する。切断中の永続セッションの場合は、QoS>0のメッセージを保持する。
+func (b *testBroker) deliver(session *testSession, msg testMessage, qos byte) {
+	if session.conn == nil {
+		if session.clean == false && qos > 0 {
+			msg.Qos = qos
+			session.queue = append(session.queue, msg)
+		}
+		return
+	}
+	var id uint16 = 0
+	if qos > 0 {
+		session.nextId++
+		if session.nextId == 0 {
+			session.nextId = 1
+		}
+		id = session.nextId
+	}
+	session.conn.out <- encodeTestPublish(msg.Topic, qos, id, msg.Payload, msg.Retain)
+}
+
+// CONNECTの可変ヘッダー以降を解析する。
+func parseTestConnect(body []byte) (testConnect, bool) {
+	var connect testConnect
+	reader := &testPacketReader{body: body}
+	reader.string() // プロトコル名
+	reader.byte()   // プロトコルレベル
+	flags := reader.byte()
+	connect.KeepAlive = reader.uint16()
+	connect.CleanSession = flags&0x02 != 0
+	connect.ClientId = reader.string()
+	if flags&0x04 != 0 {
+		reader.string() // Will Topic
+		reader.string() // Will Message
+	}
+	if flags&0x80 != 0 {
+		connect.Username = reader.string()
+	}
+	if flags&0x40 != 0 {
+		connect.Password = reader.string()
+	}
+	return connect, reader.failed == false
+}
+
+// PUBLISHを解析し、メッセージとパケットIDを返す。
+func parseTestPublish(header byte, body []byte) (testMessage, uint16, bool) {
+	msg := testMessage{Qos: (header >> 1) & 0x03, Retain: header&0x01 != 0}
+	reader := &testPacketReader{body: body}
+	msg.Topic = reader.string()
+	var id uint16 = 0
+	if msg.Qos > 0 {
+		id = reader.uint16()
+	}
+	if reader.failed {
+		return msg, 0, false
+	}
+	msg.Payload = append([]byte(nil), body[reader.pos:]...)
+	return msg, id, true
+}
+
+// PUBLISHパケットを生成する。
+func encodeTestPublish(topic string, qos byte, id uint16, payload []byte, retain bool) []byte {
+	header := byte(0x30) | qos<<1
+	if retain {
+		header |= 0x01
+	}
+	body := encodeMqttString(topic)
+	if qos > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	body = append(body, payload...)
+	packet := append([]byte{header}, encodeRemainingLength(len(body))...)
+	return append(packet, body...)
+}
+
+// パケットの可変ヘッダー、ペイロードを先頭から読み込む。
+// 長さが足りない場合は、failed を true にしてゼロ値を返す。
+type testPacketReader struct {
+	body   []byte
+	pos    int
+	failed bool
+}
+
+func (r *testPacketReader) byte() byte {
+	if r.pos+1 > len(r.body) {
+		r.failed = true
+		return 0
+	}
+	r.pos++
+	return r.body[r.pos-1]
+}
+
+func (r *testPacketReader) uint16() uint16 {
+	if r.pos+2 > len(r.body) {
+		r.failed = true
+		return 0
+	}
+	r.pos += 2
+	return binary.BigEndian.Uint16(r.body[r.pos-2:])
+}
+
+func (r *testPacketReader) string() string {
+	length := int(r.uint16())
+	if r.failed || r.pos+length > len(r.body) {
+		r.failed = true
+		return ""
+	}
+	r.pos += length
+	return string(r.body[r.pos-length : r.pos])
+}
+
+// テスト用の、自己署名の証明書
+type testCertificate struct {
+	CertFile    string          // 証明書のファイル(PEM)
+	KeyFile     string          // 秘密鍵のファイル(PEM)
+	Certificate tls.Certificate // TLSの設定に利用する証明書
+}
+
+// 127.0.0.1 に対する、自己署名の証明書を生成する。
+//   notBefore, notAfter : 証明書の有効期間
+func newTestCertificate(t *testing.T, notBefore time.Time, notAfter time.Time) testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "mqtt-bench-test"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	cert := testCertificate{
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem")}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(cert.CertFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cert.KeyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert.Certificate, err = tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// 実行オプションの設定でBrokerへ接続し、テストの終了時に切断する。
+func connectTestClient(t *testing.T, opts ExecOptions, id int) MQTT.Client {
+	t.Helper()
+	client, err := Connect(id, opts, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ForceDisconnect(client) })
+	return client
+}
+
+// 条件が満たされるまで、最大待機時間まで待つ。
+// 条件が満たされた場合は true を返す。
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for condition() == false {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// 条件が満たされるまで待ち、満たされない場合はテストを失敗させる。
+func waitUntil(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	if waitFor(timeout, condition) == false {
+		t.Fatalf("condition was not met within %s", timeout)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// PUBLISHパケットの、ペイロード以外のバイト数を返す（MQTT 3.1.1）。
+// 固定ヘッダー（1byte + 残りの長さ）、Topic名（2byte + Topicの長さ）、QoS>0の場合のパケットIDとなる。
+//   topicLen   : Topicの長さ(byte)
+//   payloadLen : ペイロードの長さ(byte)
+//   qos        : QoS
+func PublishOverhead(topicLen int, payloadLen int, qos byte) int {
+	variableHeader := 2 + topicLen
+	if qos > 0 {
+		variableHeader += 2
+	}
+	return 1 + len(encodeRemainingLength(variableHeader+payloadLen)) + variableHeader
+}
+
+// QoSに応じた、PUBLISH 1メッセージ当たりの確認応答のパケットのバイト数を返す。
+// QoS 1 は PUBACK、QoS 2 は PUBREC、PUBREL、PUBCOMP となり、いずれも4byteのパケットとなる。
+func AckOverhead(qos byte) int {
+	switch qos {
+	case 1:
+		return 4
+	case 2:
+		return 4 * 3
+	default:
+		return 0
+	}
+}
+
+// Publishしたペイロードと、プロトコルのオーバーヘッドのバイト数
+type BytesStats struct {
+	Messages int64   `json:"messages"`       // 記録したメッセージ数
+	Payload  int64   `json:"payload_bytes"`  // ペイロードのバイト数
+	Overhead int64   `json:"overhead_bytes"` // PUBLISHのヘッダーと、確認応答のパケットのバイト数
+	Ratio    float64 `json:"overhead_ratio"` // 全体に占めるオーバーヘッドの割合(%)
+}
+
+// 複数のクライアントから並行して、Publishしたバイト数を記録する。
+type ByteCounter struct {
+	messages int64 // メッセージ数（atomicに更新する）
+	payload  int64 // ペイロードのバイト数（atomicに更新する）
+	overhead int64 // オーバーヘッドのバイト数（atomicに更新する）
+}
+
+// 1メッセージ分のバイト数を記録する（nil の場合は何もしない）。
+func (c *ByteCounter) Record(topic string, payload interface{}, qos byte) {
+	if c == nil {
+		return
+	}
+	size := PayloadSize(payload)
+	atomic.AddInt64(&c.messages, 1)
+	atomic.AddInt64(&c.payload, int64(size))
+	atomic.AddInt64(&c.overhead, int64(PublishOverhead(len(topic), size, qos)+AckOverhead(qos)))
+}
+
+// 記録したバイト数を集計する。
+func (c *ByteCounter) Stats() *BytesStats {
+	stats := &BytesStats{
+		Messages: atomic.LoadInt64(&c.messages),
+		Payload:  atomic.LoadInt64(&c.payload),
+		Overhead: atomic.LoadInt64(&c.overhead)}
+	if total := stats.Payload + stats.Overhead; total > 0 {
+		stats.Ratio = float64(stats.Overhead) / float64(total) * 100
+	}
+	return stats
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"math"
+	"testing"
+)
+
+// pahoでエンコードしたPUBLISHパケットのバイト数を返す。
+func encodedPublishSize(t *testing.T, topic string, payloadLen int, qos byte) int {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = topic
+	publish.Qos = qos
+	publish.MessageID = 1
+	publish.Payload = make([]byte, payloadLen)
+	var buffer bytes.Buffer
+	if err := publish.Write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Len()
+}
+
+func TestPublishOverhead(t *testing.T) {
+	// 残りの長さが1byte(127以下)、2byte(128以上)となる場合の境界を含める。
+	for _, payloadLen := range []int{0, 100, 120, 200, 20000} {
+		for _, qos := range []byte{0, 1, 2} {
+			topic := "mqtt-bench/benchmark/0"
+			expected := encodedPublishSize(t, topic, payloadLen, qos) - payloadLen
+			if overhead := PublishOverhead(len(topic), payloadLen, qos); overhead != expected {
+				t.Errorf("PublishOverhead(%d, %d, %d) = %d, want %d", len(topic), payloadLen, qos, overhead, expected)
+			}
+		}
+	}
+	if overhead := PublishOverhead(3, 100, 1); overhead != 9 {
+		t.Errorf("PublishOverhead(3, 100, 1) = %d, want 9", overhead)
+	}
+
+	var ack bytes.Buffer
+	if err := packets.NewControlPacket(packets.Puback).Write(&ack); err != nil {
+		t.Fatal(err)
+	}
+	for qos, expected := range []int{0, ack.Len(), ack.Len() * 3} {
+		if overhead := AckOverhead(byte(qos)); overhead != expected {
+			t.Errorf("AckOverhead(%d) = %d, want %d", qos, overhead, expected)
+		}
+	}
+}
+
+func TestByteCounter(t *testing.T) {
+	var counter *ByteCounter
+	counter.Record("a/b", []byte("x"), 0) // nil の場合は何もしない
+
+	counter = &ByteCounter{}
+	for i := 0; i < 10; i++ {
+		counter.Record("a/b", make([]byte, 100), 1)
+	}
+	stats := counter.Stats()
+	if stats.Messages != 10 || stats.Payload != 1000 || stats.Overhead != 10*(9+4) {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if expected := 130.0 / 1130.0 * 100; math.Abs(stats.Ratio-expected) > 1e-9 {
+		t.Errorf("ratio = %f, want %f", stats.Ratio, expected)
+	}
+}
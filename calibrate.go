@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 送信したメッセージの受信を待つ最大時間
+const CALIBRATION_RECEIVE_TIMEOUT time.Duration = 10 * time.Second
+
+// 1クライアントでの、Broker経由の折り返しの応答時間
+type CalibrationStats struct {
+	LatencyStats
+	Lost int `json:"lost"` // タイムアウトまでに受信しなかったメッセージ数
+}
+
+// 折り返しの応答時間を、1行の文字列に整形する。
+func (s *CalibrationStats) String() string {
+	return fmt.Sprintf("%s, lost=%d", &s.LatencyStats, s.Lost)
+}
+
+// 最初のクライアントのみで、自身がSubscribeしたTopicに1件ずつPublishし、受信するまでの時間を計測する。
+// クライアント側の並行処理の影響を除いた、Brokerの転送のみの応答時間の基準値となる。
+// 他のクライアントは接続のみで、利用しない。受信したメッセージ数を返す。
+func CalibrateAllClient(ctx context.Context, clients []MQTT.Client, opts ExecOptions, metrics *Metrics, param ...string) int {
+	client := clients[0]
+	topic := opts.Topic + "/calibrate"
+	message := param[0]
+
+	// 連番をペイロードの先頭に付与し、タイムアウトした以前のメッセージと区別する。
+	received := make(chan int, 16)
+	var handler MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		fields := strings.SplitN(string(msg.Payload()), "|", 2)
+		if seq, err := strconv.Atoi(fields[0]); err == nil {
+			// 待機していないメッセージで、pahoの受信処理を止めないようにする。
+			select {
+			case received <- seq:
+			default:
+			}
+		}
+	}
+	token := client.Subscribe(topic, opts.Qos, handler)
+	if token.Wait() && token.Error() != nil {
+		fmt.Printf("Subscribe error: %s\n", token.Error())
+		return 0
+	}
+	defer Unsubscribe(client, []string{topic}, UNSUBSCRIBE_TIMEOUT)
+
+	latencies := NewLatencyRecorder()
+	lost := 0
+	for index := 0; index < opts.Count; index++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		sentAt := time.Now()
+		if err := Publish(client, topic, opts.Qos, false, strconv.Itoa(index)+"|"+message, opts.PublishTimeout); err != nil {
+			lost++
+			continue
+		}
+
+		timeout := time.After(CALIBRATION_RECEIVE_TIMEOUT)
+	wait:
+		for {
+			select {
+			case seq := <-received:
+				if seq == index {
+					latencies.Record(opts.Qos, time.Since(sentAt))
+					metrics.AddProgress(1)
+					break wait
+				}
+			case <-timeout:
+				lost++
+				break wait
+			case <-ctx.Done():
+				break wait
+			}
+		}
+
+		if opts.IntervalTime > 0 {
+			time.Sleep(time.Duration(opts.IntervalTime) * time.Millisecond)
+		}
+	}
+
+	durations := latencies.Durations()
+	stats := &CalibrationStats{Lost: lost}
+	if s := CalcLatencyStats(durations); s != nil {
+		stats.LatencyStats = *s
+	}
+	metrics.Calibration = stats
+	return len(durations)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalibrateLoopbackLatency(t *testing.T) {
+	// Brokerでの転送の遅延が、折り返しの応答時間に含まれることを確認する。
+	broker := startTestBroker(t, &testBroker{
+		RouteDelay: func(topic string) time.Duration { return 5 * time.Millisecond }})
+	opts := testExecOptions(broker.URL)
+	opts.Count = 10
+	opts.Qos = 1
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(CalibrateAllClient, opts)
+	})
+	if result == nil || result.Calibration == nil {
+		t.Fatalf("no calibration result : %s", output)
+	}
+	calibration := result.Calibration
+	if calibration.Count != opts.Count || calibration.Lost != 0 || result.TotalCount != opts.Count {
+		t.Errorf("calibration = %s, total = %d", calibration, result.TotalCount)
+	}
+	if calibration.Min < 5 || calibration.Max < calibration.Min || calibration.Avg < calibration.Min {
+		t.Errorf("calibration latency = %s", calibration)
+	}
+	// 最初のクライアントのみがPublishする。
+	if published := len(broker.Published()); published != opts.Count {
+		t.Errorf("broker received %d, want %d", published, opts.Count)
+	}
+	if strings.Contains(output, "Calibration latency : count=10") == false {
+		t.Errorf("output = %s", output)
+	}
+}
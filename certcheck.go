@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 証明書の有効期限切れを表す、TLSのエラーメッセージ
+const (
+	CERT_EXPIRED_ERROR        string = "certificate has expired" // Brokerの証明書の検証エラー
+	CERT_EXPIRED_REMOTE_ERROR string = "expired certificate"     // Brokerからのアラート（クライアント証明書）
+)
+
+// 証明書ファイルに含まれる全ての証明書について、有効期間内かどうかを検証する。
+//   path : PEM形式の証明書ファイル
+//   now  : 検証する時刻
+func CheckCertificateFile(path string, now time.Time) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid certificate : %s : %s", path, err)
+		}
+		if err := CheckCertificateValidity(cert, now); err != nil {
+			return fmt.Errorf("%s : %s", err, path)
+		}
+	}
+}
+
+// 証明書が有効期間内かどうかを検証する。
+func CheckCertificateValidity(cert *x509.Certificate, now time.Time) error {
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate expired on %s (subject=%s)", cert.NotAfter.Format(time.RFC3339), cert.Subject.CommonName)
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("certificate is not valid until %s (subject=%s)", cert.NotBefore.Format(time.RFC3339), cert.Subject.CommonName)
+	}
+	return nil
+}
+
+// 証明書の設定に含まれる、全ての証明書ファイルを検証する。
+func CheckCertConfig(config CertConfig, now time.Time) []error {
+	var files []string
+	switch c := config.(type) {
+	case ServerCertConfig:
+		files = []string{c.ServerCertFile}
+	case ClientCertConfig:
+		files = []string{c.RootCAFile, c.ClientCertFile}
+	}
+
+	var errs []error
+	for _, file := range files {
+		if err := CheckCertificateFile(file, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// 接続エラーが証明書の有効期限切れによるものであれば、期限の日時を含むエラーに変換する。
+// それ以外のエラーは、そのまま返す。元のエラーメッセージは、変換後のエラーにも含める。
+func DescribeCertificateError(err error, opts ExecOptions) error {
+	if err == nil {
+		return nil
+	}
+
+	// Brokerの証明書が期限切れの場合
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &invalid) && invalid.Reason == x509.Expired && invalid.Cert != nil {
+		return fmt.Errorf("broker certificate expired on %s (subject=%s) : %s",
+			invalid.Cert.NotAfter.Format(time.RFC3339), invalid.Cert.Subject.CommonName, err)
+	}
+	message := err.Error()
+	if strings.Contains(message, CERT_EXPIRED_ERROR) {
+		// エラーに証明書が含まれない場合は、検証せずに接続して期限を確認する。
+		if cert, probeErr := ProbeBrokerCertificate(opts); probeErr == nil {
+			return fmt.Errorf("broker certificate expired on %s (subject=%s) : %s",
+				cert.NotAfter.Format(time.RFC3339), cert.Subject.CommonName, err)
+		}
+		return fmt.Errorf("broker certificate expired : %s", err)
+	}
+
+	// クライアント証明書が期限切れとして、Brokerに拒否された場合
+	if strings.Contains(message, CERT_EXPIRED_REMOTE_ERROR) {
+		if c, ok := opts.CertConfig.(ClientCertConfig); ok {
+			if checkErr := CheckCertificateFile(c.ClientCertFile, time.Now()); checkErr != nil {
+				return fmt.Errorf("client %s : %s", checkErr, err)
+			}
+		}
+		return fmt.Errorf("client certificate rejected as expired by the broker : %s", err)
+	}
+	return err
+}
+
+// Brokerの接続先毎の、証明書の確認結果
+// 接続に失敗したクライアント毎に、Brokerへ接続し直さないようにする。
+type brokerCertificateCache struct {
+	mutex   sync.Mutex
+	results map[string]brokerCertificateResult
+}
+
+type brokerCertificateResult struct {
+	cert *x509.Certificate
+	err  error
+}
+
+var brokerCertificates = &brokerCertificateCache{results: make(map[string]brokerCertificateResult)}
+
+// 証明書を検証せずにBrokerへTLSで接続し、Brokerの証明書を返す。
+// 接続先毎に1回のみ接続し、以降は最初の結果を返す。
+func ProbeBrokerCertificate(opts ExecOptions) (*x509.Certificate, error) {
+	uri, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+	address := BrokerAddress(uri)
+
+	brokerCertificates.mutex.Lock()
+	defer brokerCertificates.mutex.Unlock()
+	if result, ok := brokerCertificates.results[address]; ok {
+		return result.cert, result.err
+	}
+	cert, err := probeBrokerCertificate(address, opts)
+	brokerCertificates.results[address] = brokerCertificateResult{cert: cert, err: err}
+	return cert, err
+}
+
+// 証明書を検証せずに、指定された接続先へTLSで接続し、Brokerの証明書を返す。
+func probeBrokerCertificate(address string, opts ExecOptions) (*x509.Certificate, error) {
+	config := CreateTlsConfig(opts)
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	config.InsecureSkipVerify = true
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("no broker certificate")
+	}
+	return certs[0], nil
+}
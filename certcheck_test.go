@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckCertificateFile(t *testing.T) {
+	now := time.Now()
+	expired := newTestCertificate(t, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	future := newTestCertificate(t, now.Add(time.Hour), now.Add(2*time.Hour))
+	valid := newTestCertificate(t, now.Add(-time.Hour), now.Add(time.Hour))
+
+	leaf, err := x509.ParseCertificate(expired.Certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckCertificateFile(expired.CertFile, now)
+	if expected := "certificate expired on " + leaf.NotAfter.Format(time.RFC3339); err == nil || strings.HasPrefix(err.Error(), expected) == false {
+		t.Errorf("expired = %v, want %s", err, expected)
+	}
+	if err := CheckCertificateFile(future.CertFile, now); err == nil || strings.Contains(err.Error(), "not valid until") == false {
+		t.Errorf("not yet valid = %v", err)
+	}
+	if err := CheckCertificateFile(valid.CertFile, now); err != nil {
+		t.Errorf("valid = %s", err)
+	}
+
+	errs := CheckCertConfig(ClientCertConfig{RootCAFile: valid.CertFile, ClientCertFile: expired.CertFile}, now)
+	if len(errs) != 1 || strings.HasSuffix(errs[0].Error(), expired.CertFile) == false {
+		t.Errorf("config errors = %v", errs)
+	}
+}
+
+func TestExpiredBrokerCertificateReported(t *testing.T) {
+	cert := newTestCertificate(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	var handshakes int64
+	broker := startTestBroker(t, &testBroker{
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert.Certificate},
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				atomic.AddInt64(&handshakes, 1)
+				return nil, nil
+			}}})
+	leaf, err := x509.ParseCertificate(cert.Certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "broker certificate expired on " + leaf.NotAfter.Format(time.RFC3339)
+
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 3
+	opts.ReportConnectErrs = true
+	opts.CertConfig = ServerCertConfig{ServerCertFile: cert.CertFile}
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	captureStdout(t, func() {
+		if b.Connect() {
+			t.Error("connected to a broker with an expired certificate")
+		}
+	})
+	if len(b.connectErrors) != opts.ClientNum {
+		t.Fatalf("connect errors = %+v", b.connectErrors)
+	}
+	for _, e := range b.connectErrors {
+		if strings.HasPrefix(e.Err.Error(), expected) == false {
+			t.Errorf("client %d : error = %s, want %s", e.ClientIndex, e.Err, expected)
+		}
+	}
+
+	// 証明書を含まないエラーの場合は、Brokerへ接続して期限を確認するが、接続先毎に1回のみ接続する。
+	before := atomic.LoadInt64(&handshakes)
+	for i := 0; i < 3; i++ {
+		err := DescribeCertificateError(errors.New("x509: "+CERT_EXPIRED_ERROR+" or is not yet valid"), opts)
+		if strings.HasPrefix(err.Error(), expected) == false {
+			t.Errorf("described error = %s, want %s", err, expected)
+		}
+	}
+	if probes := atomic.LoadInt64(&handshakes) - before; probes != 1 {
+		t.Errorf("probed the broker certificate %d times, want 1", probes)
+	}
+}
+
+func TestExpiredClientCertificateReported(t *testing.T) {
+	server := newTestCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	client := newTestCertificate(t, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	clientCAs := x509.NewCertPool()
+	leaf, err := x509.ParseCertificate(client.Certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs.AddCert(leaf)
+	broker := startTestBroker(t, &testBroker{
+		TlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{server.Certificate},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    clientCAs}})
+
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.CertConfig = ClientCertConfig{RootCAFile: server.CertFile, ClientCertFile: client.CertFile, ClientKeyFile: client.KeyFile}
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	captureStdout(t, func() {
+		if b.Connect() {
+			t.Error("connected with an expired client certificate")
+		}
+	})
+	expected := "client certificate expired on " + leaf.NotAfter.Format(time.RFC3339)
+	if len(b.connectErrors) != 1 || strings.HasPrefix(b.connectErrors[0].Err.Error(), expected) == false {
+		t.Errorf("connect errors = %+v, want %s", b.connectErrors, expected)
+	}
+}
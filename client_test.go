@@ -0,0 +1,205 @@
+package main
+
+import (
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"sync"
+	"time"
+)
+
+// テスト用のToken
+type testToken struct {
+	done chan struct{}
+	err  error
+}
+
+// 完了済みのTokenを生成する。
+func newTestToken(err error) *testToken {
+	t := &testToken{done: make(chan struct{}), err: err}
+	close(t.done)
+	return t
+}
+
+// 指定された時間の経過後に完了する、Tokenを生成する。
+func newDelayedTestToken(delay time.Duration, err error) *testToken {
+	t := &testToken{done: make(chan struct{})}
+	time.AfterFunc(delay, func() { t.complete(err) })
+	return t
+}
+
+// 完了していないTokenを生成する。complete を呼び出すまで完了しない。
+func newPendingTestToken() *testToken {
+	return &testToken{done: make(chan struct{})}
+}
+
+func (t *testToken) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *testToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *testToken) WaitTimeout(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *testToken) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *testToken) Error() error {
+	return t.err
+}
+
+// テスト用のMQTTクライアント
+// Brokerへは接続せず、送信したメッセージと呼び出しを記録する。
+type testClient struct {
+	OnPublish    func(index int, topic string) MQTT.Token // Publishの都度、返すTokenを生成する（nil の場合は完了済み）
+	OnDisconnect func()                                   // 切断の際に呼び出す（切断が完了しない場合のテストに利用する）
+
+	mutex        sync.Mutex
+	disconnected bool
+	topics       []string
+	payloads     [][]byte
+	times        []time.Time
+	subscribed   []string
+	unsubscribed []string
+}
+
+func (c *testClient) IsConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.disconnected == false
+}
+
+func (c *testClient) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+func (c *testClient) Connect() MQTT.Token {
+	return newTestToken(nil)
+}
+
+func (c *testClient) Disconnect(quiesce uint) {
+	if c.OnDisconnect != nil {
+		c.OnDisconnect()
+	}
+	c.mutex.Lock()
+	c.disconnected = true
+	c.mutex.Unlock()
+}
+
+func (c *testClient) Publish(topic string, qos byte, retained bool, payload interface{}) MQTT.Token {
+	c.mutex.Lock()
+	index := len(c.topics)
+	c.topics = append(c.topics, topic)
+	c.payloads = append(c.payloads, append([]byte(nil), PayloadBytes(payload)...))
+	c.times = append(c.times, time.Now())
+	c.mutex.Unlock()
+
+	if c.OnPublish != nil {
+		return c.OnPublish(index, topic)
+	}
+	return newTestToken(nil)
+}
+
+func (c *testClient) Subscribe(topic string, qos byte, callback MQTT.MessageHandler) MQTT.Token {
+	c.mutex.Lock()
+	c.subscribed = append(c.subscribed, topic)
+	c.mutex.Unlock()
+	return newTestToken(nil)
+}
+
+func (c *testClient) SubscribeMultiple(filters map[string]byte, callback MQTT.MessageHandler) MQTT.Token {
+	c.mutex.Lock()
+	for filter := range filters {
+		c.subscribed = append(c.subscribed, filter)
+	}
+	c.mutex.Unlock()
+	return newTestToken(nil)
+}
+
+func (c *testClient) Unsubscribe(topics ...string) MQTT.Token {
+	c.mutex.Lock()
+	c.unsubscribed = append(c.unsubscribed, topics...)
+	c.mutex.Unlock()
+	return newTestToken(nil)
+}
+
+func (c *testClient) AddRoute(topic string, callback MQTT.MessageHandler) {
+}
+
+func (c *testClient) OptionsReader() MQTT.ClientOptionsReader {
+	return MQTT.ClientOptionsReader{}
+}
+
+// Publishされたメッセージの、Topicの一覧を返す。
+func (c *testClient) Topics() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.topics...)
+}
+
+// Publishされたメッセージの、ペイロードの一覧を返す。
+func (c *testClient) Payloads() [][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([][]byte(nil), c.payloads...)
+}
+
+// Publishを呼び出した時刻の一覧を返す。
+func (c *testClient) Times() []time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]time.Time(nil), c.times...)
+}
+
+// Unsubscribeされた、Topic Filterの一覧を返す。
+func (c *testClient) Unsubscribed() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.unsubscribed...)
+}
+
+// テスト用の受信メッセージ
+type testMqttMessage struct {
+	topic   string
+	qos     byte
+	payload []byte
+}
+
+func (m *testMqttMessage) Duplicate() bool {
+	return false
+}
+
+func (m *testMqttMessage) Qos() byte {
+	return m.qos
+}
+
+func (m *testMqttMessage) Retained() bool {
+	return false
+}
+
+func (m *testMqttMessage) Topic() string {
+	return m.topic
+}
+
+func (m *testMqttMessage) MessageID() uint16 {
+	return 0
+}
+
+func (m *testMqttMessage) Payload() []byte {
+	return m.payload
+}
+
+func (m *testMqttMessage) Ack() {
+}
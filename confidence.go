@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// 目標の信頼区間に達したかを判定する、最小の間隔の数
+const CONFIDENCE_MIN_WINDOWS int = 5
+
+// スループットの信頼区間による、実行の終了の結果
+type ConfidenceStopStats struct {
+	Target  float64 `json:"target"`     // 目標とする、平均に対する信頼区間の半値幅の比率
+	Width   float64 `json:"width"`      // 終了時点の、平均に対する信頼区間の半値幅の比率
+	Windows int     `json:"windows"`    // 終了時点の間隔の数
+	Reached bool    `json:"reached"`    // 目標に達したかどうか（最大時間や、送信の終了で終わった場合は false）
+	Elapsed int64   `json:"elapsed_ms"` // 計測の開始から終了までの時間(ms)
+}
+
+// 結果を、1行の文字列に整形する。
+func (s *ConfidenceStopStats) String() string {
+	status := "reached"
+	if s.Reached == false {
+		status = "not reached"
+	}
+	return fmt.Sprintf("%s, width=±%.2f%% (target ±%.2f%%), windows=%d, elapsed=%dms",
+		status, s.Width*100, s.Target*100, s.Windows, s.Elapsed)
+}
+
+// 間隔毎のスループットの95%信頼区間の幅から、計測を終了してよいかを判定する。
+type ConfidenceDetector struct {
+	Target float64   // 目標とする、平均に対する信頼区間の半値幅の比率（例 : 0.02 = ±2%）
+	rates  []float64 // 間隔毎のスループット(messages/sec)
+	width  float64   // 直近の判定での、平均に対する信頼区間の半値幅の比率
+}
+
+// 間隔のスループットを追加し、信頼区間が目標の幅に収まったかどうかを返す。
+// 間隔の数が CONFIDENCE_MIN_WINDOWS に満たない場合や、平均が0の場合は、収まっていないとみなす。
+func (d *ConfidenceDetector) Observe(rate float64) bool {
+	d.rates = append(d.rates, rate)
+	stats := CalcWindowThroughputStats(d.rates)
+	if stats == nil || stats.Mean <= 0 {
+		return false
+	}
+	d.width = (stats.CIHigh - stats.CILow) / 2 / stats.Mean
+	return len(d.rates) >= CONFIDENCE_MIN_WINDOWS && d.width <= d.Target
+}
+
+// 直近の判定での、平均に対する信頼区間の半値幅の比率を返す。
+func (d *ConfidenceDetector) Width() float64 {
+	return d.width
+}
+
+// 進捗のカウンターを一定間隔で読み取り、スループットの信頼区間が目標の幅に収まるか、
+// 最大時間が経過した時点で cancel を呼び出して実行を終了させる。
+// ctx がキャンセルされた場合（送信が先に終了した場合を含む）も、その時点の結果を返す。
+//   progress : 進捗のカウンター
+//   opts     : 実行オプション（TargetConfidence、TargetConfidenceMaxTime、SampleInterval）
+//   cancel   : 実行を終了させる関数
+func WatchConfidence(ctx context.Context, progress *int64, opts ExecOptions, cancel context.CancelFunc) *ConfidenceStopStats {
+	detector := &ConfidenceDetector{Target: opts.TargetConfidence}
+	ticker := time.NewTicker(opts.SampleInterval)
+	defer ticker.Stop()
+	deadline := time.After(opts.TargetConfidenceMaxTime)
+
+	start := time.Now()
+	lastTime := start
+	lastCount := atomic.LoadInt64(progress)
+	reached := false
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-deadline:
+			cancel()
+			break loop
+		case now := <-ticker.C:
+			count := atomic.LoadInt64(progress)
+			rate := float64(count-lastCount) / now.Sub(lastTime).Seconds()
+			lastTime = now
+			lastCount = count
+			if detector.Observe(rate) {
+				reached = true
+				cancel()
+				break loop
+			}
+		}
+	}
+
+	return &ConfidenceStopStats{
+		Target:  opts.TargetConfidence,
+		Width:   detector.Width(),
+		Windows: len(detector.rates),
+		Reached: reached,
+		Elapsed: ElapsedMillis(start)}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConfidenceDetector(t *testing.T) {
+	// 変動が大きい間隔の後に、安定した間隔が続くと、信頼区間の幅が狭まって終了する。
+	detector := &ConfidenceDetector{Target: 0.02}
+	rates := []float64{500, 1500, 800, 1200}
+	for i := 0; i < 100; i++ {
+		rates = append(rates, 1000+float64(i%3-1)*5)
+	}
+	reachedAt := -1
+	lastWidth := 0.0
+	for i, rate := range rates {
+		if detector.Observe(rate) {
+			reachedAt = i
+			break
+		}
+		lastWidth = detector.Width()
+	}
+	if reachedAt < 0 {
+		t.Fatalf("target not reached : width = %f", detector.Width())
+	}
+	if detector.Width() > 0.02 || lastWidth <= 0.02 {
+		t.Errorf("reached at %d : width = %f, previous width = %f", reachedAt, detector.Width(), lastWidth)
+	}
+
+	// 間隔の数が最小数に満たない場合は、幅が0でも終了しない。
+	detector = &ConfidenceDetector{Target: 0.02}
+	for i := 1; i <= CONFIDENCE_MIN_WINDOWS; i++ {
+		if reached := detector.Observe(1000); reached != (i == CONFIDENCE_MIN_WINDOWS) {
+			t.Errorf("window %d : reached = %t", i, reached)
+		}
+	}
+
+	// スループットが0の場合は、終了しない。
+	detector = &ConfidenceDetector{Target: 0.02}
+	for i := 0; i < 10; i++ {
+		if detector.Observe(0) {
+			t.Fatal("reached with no throughput")
+		}
+	}
+}
+
+func TestWatchConfidence(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.SampleInterval = 20 * time.Millisecond
+	opts.TargetConfidence = 0.5
+	opts.TargetConfidenceMaxTime = 5 * time.Second
+
+	// 一定のペースで進捗する場合は、目標の幅に収まった時点で実行を終了させる。
+	var progress int64
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				atomic.AddInt64(&progress, 10)
+			}
+		}
+	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	stats := WatchConfidence(ctx, &progress, opts, cancel)
+	if ctx.Err() == nil || stats.Reached == false || stats.Windows < CONFIDENCE_MIN_WINDOWS || stats.Width > opts.TargetConfidence {
+		t.Errorf("stats = %s", stats)
+	}
+	if stats.Elapsed >= opts.TargetConfidenceMaxTime.Milliseconds() {
+		t.Errorf("stopped at the max time : %s", stats)
+	}
+
+	// 目標に達しない場合は、最大時間で実行を終了させる。
+	var idle int64
+	opts.TargetConfidenceMaxTime = 150 * time.Millisecond
+	ctx, cancel = context.WithCancel(context.Background())
+	stats = WatchConfidence(ctx, &idle, opts, cancel)
+	if ctx.Err() == nil || stats.Reached || stats.Elapsed < 150 {
+		t.Errorf("stats at the max time = %s", stats)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// 接続の所要時間が、最初の接続の中央値のこの倍数を超えた場合に、接続が制限され始めたとみなす
+const CONNECT_THROTTLE_FACTOR float64 = 3.0
+
+// 接続の所要時間の基準値とする、最初の接続数
+const CONNECT_BASELINE_SAMPLES int = 10
+
+// Brokerの接続の受け付け状況
+type ConnectRateStats struct {
+	Attempts       int     `json:"attempts"`                  // 接続の試行数
+	Accepted       int     `json:"accepted"`                  // 接続できた数
+	Rejected       int     `json:"rejected"`                  // 接続できなかった数
+	AcceptRate     float64 `json:"accept_rate"`               // 接続フェーズ全体での接続の受け付けレート(connects/sec)
+	ThrottledAfter *int    `json:"throttled_after,omitempty"` // 制限され始めた接続の連番（検出されない場合は nil）
+	PreThrottle    float64 `json:"pre_throttle_rate"`         // 制限され始めるまでの接続の受け付けレート(connects/sec)
+	Baseline       float64 `json:"baseline_ms"`               // 最初の接続の所要時間の中央値(ms)
+}
+
+// 接続の受け付け状況を、1行の文字列に整形する。
+func (s *ConnectRateStats) String() string {
+	text := fmt.Sprintf("attempts=%d, accepted=%d, rejected=%d, rate=%.2f/s, baseline=%.3fms",
+		s.Attempts, s.Accepted, s.Rejected, s.AcceptRate, s.Baseline)
+	if s.ThrottledAfter != nil {
+		text += fmt.Sprintf(", throttled after %d connects (%.2f/s before)", *s.ThrottledAfter, s.PreThrottle)
+	} else {
+		text += ", no throttling detected"
+	}
+	return text
+}
+
+// 1回分の接続の結果
+type connectSample struct {
+	at       time.Duration // 接続フェーズの開始から、接続を開始するまでの時間
+	latency  time.Duration // 接続の所要時間
+	accepted bool          // 接続できたかどうか
+}
+
+// 接続フェーズ中の接続の結果を記録し、Brokerの接続の受け付けレートを求める。
+// 接続は順に行うため、排他制御は行わない。
+type ConnectRateObserver struct {
+	start   time.Time
+	samples []connectSample
+}
+
+// ConnectRateObserverを生成する。
+//   start : 接続フェーズの開始時刻
+func NewConnectRateObserver(start time.Time) *ConnectRateObserver {
+	return &ConnectRateObserver{start: start}
+}
+
+// 1回分の接続の結果を記録する。
+//   connectStart : 接続の開始時刻
+//   latency      : 接続の所要時間
+//   err          : 接続エラー（接続できた場合は nil）
+func (o *ConnectRateObserver) Observe(connectStart time.Time, latency time.Duration, err error) {
+	o.samples = append(o.samples, connectSample{
+		at:       connectStart.Sub(o.start),
+		latency:  latency,
+		accepted: err == nil})
+}
+
+// 記録した接続の結果から、受け付け状況を集計する。
+// 最初の接続の所要時間の中央値を基準とし、接続が拒否されるか、所要時間が基準の一定倍を超えた
+// 最初の接続を、制限され始めた位置とする。
+//   end : 接続フェーズの終了時刻
+func (o *ConnectRateObserver) Stats(end time.Time) *ConnectRateStats {
+	if len(o.samples) == 0 {
+		return nil
+	}
+
+	stats := &ConnectRateStats{Attempts: len(o.samples)}
+	for _, s := range o.samples {
+		if s.accepted {
+			stats.Accepted++
+		} else {
+			stats.Rejected++
+		}
+	}
+	if elapsed := end.Sub(o.start).Seconds(); elapsed > 0 {
+		stats.AcceptRate = float64(stats.Accepted) / elapsed
+	}
+
+	var baseline []time.Duration
+	for _, s := range o.samples {
+		if s.accepted && len(baseline) < CONNECT_BASELINE_SAMPLES {
+			baseline = append(baseline, s.latency)
+		}
+	}
+	sort.Slice(baseline, func(i, j int) bool { return baseline[i] < baseline[j] })
+	median := Percentile(baseline, 50)
+	stats.Baseline = ToMillis(median)
+
+	threshold := time.Duration(float64(median) * CONNECT_THROTTLE_FACTOR)
+	for i, s := range o.samples {
+		if s.accepted && (median == 0 || s.latency <= threshold) {
+			continue
+		}
+		throttledAfter := i
+		stats.ThrottledAfter = &throttledAfter
+		if s.at > 0 {
+			stats.PreThrottle = float64(i) / s.at.Seconds()
+		}
+		break
+	}
+	return stats
+}
+
+// 一定数毎に休止を挟んだ接続の結果
+type ConnectBatchStats struct {
+	Size        int     `json:"batch_size"`             // 1回に連続して接続する数
+	Pause       float64 `json:"pause_ms"`               // 休止する時間(ms)
+	Batches     int     `json:"batches"`                // 接続を開始した回数
+	FailedBatch *int    `json:"failed_batch,omitempty"` // 最初に接続エラーとなった回(1から数える、エラーがない場合は nil)
+	FailedAt    *int    `json:"failed_at,omitempty"`    // 最初に接続エラーとなった接続の連番（エラーがない場合は nil）
+}
+
+// 結果を、1行の文字列に整形する。
+func (s *ConnectBatchStats) String() string {
+	text := fmt.Sprintf("size=%d, pause=%.0fms, batches=%d", s.Size, s.Pause, s.Batches)
+	if s.FailedBatch != nil {
+		text += fmt.Sprintf(", failures began at batch %d (connection %d)", *s.FailedBatch, *s.FailedAt)
+	} else {
+		text += ", no failures"
+	}
+	return text
+}
+
+// 一定数の接続毎に休止を挟み、接続エラーとなり始めた回を記録する。
+type ConnectBatcher struct {
+	stats ConnectBatchStats
+	pause time.Duration
+}
+
+// ConnectBatcherを生成する。
+//   size  : 1回に連続して接続する数
+//   pause : 休止する時間
+func NewConnectBatcher(size int, pause time.Duration) *ConnectBatcher {
+	return &ConnectBatcher{
+		stats: ConnectBatchStats{Size: size, Pause: ToMillis(pause)},
+		pause: pause}
+}
+
+// 接続の前に呼び出す。回の区切りでは、休止してから次の回を開始する。
+//   i : 接続の連番
+func (c *ConnectBatcher) Before(i int) {
+	if i%c.stats.Size != 0 {
+		return
+	}
+	if i > 0 {
+		time.Sleep(c.pause)
+	}
+	c.stats.Batches++
+}
+
+// 接続エラーを記録する。最初のエラーの回のみを保持する。
+//   i : 接続の連番
+func (c *ConnectBatcher) Failed(i int) {
+	if c.stats.FailedBatch != nil {
+		return
+	}
+	batch := i/c.stats.Size + 1
+	c.stats.FailedBatch = &batch
+	c.stats.FailedAt = &i
+}
+
+// 結果を返す。
+func (c *ConnectBatcher) Stats() *ConnectBatchStats {
+	stats := c.stats
+	return &stats
+}
+
+// 送受信せずに接続を維持した結果
+type IdleHoldStats struct {
+	Hold         float64 `json:"hold_ms"`      // 接続を維持した時間(ms)
+	Connections  int     `json:"connections"`  // 接続数
+	Lost         int     `json:"lost"`         // 維持している間の接続断の回数
+	Disconnected int     `json:"disconnected"` // 維持した後に、接続していなかった接続数
+}
+
+// 結果を、1行の文字列に整形する。
+func (s *IdleHoldStats) String() string {
+	return fmt.Sprintf("hold=%.0fms, connections=%d, lost=%d, disconnected=%d", s.Hold, s.Connections, s.Lost, s.Disconnected)
+}
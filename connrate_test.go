@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectRateObserverLatencyThrottling(t *testing.T) {
+	start := time.Now()
+	observer := NewConnectRateObserver(start)
+	// 10ms毎に接続を開始し、12回目以降は所要時間が基準の3倍を超える。
+	for i := 0; i < 20; i++ {
+		latency := time.Millisecond
+		if i >= 12 {
+			latency = 5 * time.Millisecond
+		}
+		observer.Observe(start.Add(time.Duration(i)*10*time.Millisecond), latency, nil)
+	}
+	stats := observer.Stats(start.Add(200 * time.Millisecond))
+	if stats.Attempts != 20 || stats.Accepted != 20 || stats.Rejected != 0 || stats.AcceptRate != 100 || stats.Baseline != 1 {
+		t.Errorf("stats = %s", stats)
+	}
+	if stats.ThrottledAfter == nil || *stats.ThrottledAfter != 12 || stats.PreThrottle != 100 {
+		t.Errorf("stats = %s, want throttled after 12 connects at 100/s", stats)
+	}
+}
+
+func TestObserveConnectRate(t *testing.T) {
+	// 一定数を超えた接続は、Server unavailable で拒否する。
+	// 所要時間の揺らぎで制限とみなさないように、CONNACKを遅延させる。
+	const limit int = 5
+	var mutex sync.Mutex
+	accepted := 0
+	broker := startTestBroker(t, &testBroker{
+		ConnackDelay: 10 * time.Millisecond,
+		Refuse: func(connect testConnect) byte {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if accepted >= limit {
+				return 0x03
+			}
+			accepted++
+			return 0
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 10
+	opts.ObserveConnectRate = true
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PublishAllClient, opts)
+	})
+	if result != nil {
+		t.Fatalf("Execute succeeded with refused connects : %+v", result)
+	}
+	// 接続エラーの場合も、全ての接続を試行して受け付け状況を出力する。
+	expected := "Connect rate : attempts=10, accepted=5, rejected=5"
+	if strings.Contains(output, expected) == false || strings.Contains(output, "throttled after 5 connects") == false {
+		t.Errorf("output has no %q :\n%s", expected, output)
+	}
+}
+
+func TestConnectBatcher(t *testing.T) {
+	batcher := NewConnectBatcher(4, 10*time.Millisecond)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		batcher.Before(i)
+		if i >= 6 {
+			batcher.Failed(i)
+		}
+	}
+	// 4接続毎に、2回休止する。
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("elapsed = %s, want >= 20ms", elapsed)
+	}
+	stats := batcher.Stats()
+	if stats.Batches != 3 || stats.FailedBatch == nil || *stats.FailedBatch != 2 || *stats.FailedAt != 6 {
+		t.Errorf("stats = %s", stats)
+	}
+	if stats := NewConnectBatcher(4, 0).Stats(); stats.FailedBatch != nil || strings.HasSuffix(stats.String(), "no failures") == false {
+		t.Errorf("stats without failures = %s", stats)
+	}
+}
+
+func TestConnectInBatches(t *testing.T) {
+	// 累計で一定数を超えた接続は、Server unavailable で拒否する。
+	const limit int = 7
+	var mutex sync.Mutex
+	accepted := 0
+	broker := startTestBroker(t, &testBroker{
+		Refuse: func(connect testConnect) byte {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if accepted >= limit {
+				return 0x03
+			}
+			accepted++
+			return 0
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 10
+	opts.ConnectBatchSize = 3
+	opts.ConnectBatchPause = 30 * time.Millisecond
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PublishAllClient, opts)
+	})
+	if result != nil {
+		t.Fatalf("Execute succeeded with refused connects : %+v", result)
+	}
+	// 8番目の接続（連番7）は、3回目の接続の途中で拒否される。
+	expected := "Connect batches : size=3, pause=30ms, batches=3, failures began at batch 3 (connection 7)"
+	if strings.Contains(output, expected) == false {
+		t.Errorf("output has no %q :\n%s", expected, output)
+	}
+
+	// 回の区切りでのみ、休止を挟む。
+	connects := broker.Connects()
+	for i := 1; i < limit; i++ {
+		gap := connects[i].Time.Sub(connects[i-1].Time)
+		if pause := i%opts.ConnectBatchSize == 0; pause != (gap >= opts.ConnectBatchPause) {
+			t.Errorf("gap before connect %d = %s", i, gap)
+		}
+	}
+}
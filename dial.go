@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 接続(TCP/TLS)の各段階の所要時間
+type ConnectTiming struct {
+	TcpConnect   time.Duration // TCPの接続(WebSocketの場合はハンドシェイクを含む)
+	TlsHandshake time.Duration // TLSのハンドシェイク(TLSでない場合は0)
+	Dialed       time.Time     // 接続(TCP/TLS)が完了した時刻
+}
+
+// 接続(TCP/TLS)の完了を通知する、pahoの接続関数を返す。
+// pahoは接続の完了を通知しないため、pahoと同様の接続を自身で行い、最初に接続が完了した時点で dialed を閉じる。
+// CONNACKのタイムアウトを接続の完了から数えることと、接続の所要時間の内訳の計測に利用する。
+//   dialTimeout : 接続(TCP/TLS、WebSocketの場合はハンドシェイクを含む)のタイムアウト
+//   dialed      : 接続の完了時に閉じるチャネル
+//   timing      : 最初に完了した接続の、各段階の所要時間の記録先（nil の場合は記録しない）
+func NewDialNotifier(dialTimeout time.Duration, dialed chan struct{}, timing *ConnectTiming) MQTT.OpenConnectionFunc {
+	var once sync.Once
+	return func(uri *url.URL, options MQTT.ClientOptions) (net.Conn, error) {
+		attempt := &ConnectTiming{}
+		conn, err := OpenConnection(uri, options, dialTimeout, attempt)
+		if err == nil {
+			once.Do(func() {
+				if timing != nil {
+					*timing = *attempt
+				}
+				close(dialed)
+			})
+		}
+		return conn, err
+	}
+}
+
+// pahoと同様に、URLのスキームに応じてBrokerへ接続する（プロキシの環境変数も同様に参照する）。
+// ClientOptions の ConnectTimeout の代わりに、指定されたタイムアウトで接続する。
+// TLSの場合は、TCPの接続とハンドシェイクを分けて行い、それぞれの所要時間を記録する。
+//   uri     : BrokerのURL
+//   options : pahoの接続オプション（Dialer、TLSConfig、WebSocketの設定を参照する）
+//   timeout : 接続のタイムアウト
+//   timing  : 各段階の所要時間の記録先（nil の場合は記録しない）
+func OpenConnection(uri *url.URL, options MQTT.ClientOptions, timeout time.Duration, timing *ConnectTiming) (net.Conn, error) {
+	if timing == nil {
+		timing = &ConnectTiming{}
+	}
+	dialer := &net.Dialer{}
+	if options.Dialer != nil {
+		copied := *options.Dialer
+		dialer = &copied
+	}
+	dialer.Timeout = timeout
+
+	start := time.Now()
+	var conn net.Conn = nil
+	var err error = nil
+	switch uri.Scheme {
+	case "ws", "wss":
+		dialURI := *uri // pahoと同様に、ユーザー情報を含むURLは指定しない
+		dialURI.User = nil
+		var tlsConfig *tls.Config = nil
+		if uri.Scheme == "wss" {
+			tlsConfig = options.TLSConfig
+		}
+		conn, err = MQTT.NewWebsocket(dialURI.String(), tlsConfig, timeout, options.HTTPHeaders, options.WebsocketOptions)
+	case "mqtt", "tcp":
+		conn, err = proxy.FromEnvironmentUsing(dialer).Dial("tcp", uri.Host)
+	case "unix":
+		if len(uri.Host) > 0 {
+			conn, err = dialer.Dial("unix", uri.Host)
+		} else {
+			conn, err = dialer.Dial("unix", uri.Path)
+		}
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps":
+		if os.Getenv("all_proxy") == "" {
+			conn, err = dialer.Dial("tcp", uri.Host)
+		} else {
+			conn, err = proxy.FromEnvironmentUsing(dialer).Dial("tcp", uri.Host)
+		}
+		if err != nil {
+			return nil, err
+		}
+		timing.TcpConnect = time.Since(start)
+
+		// tls.DialWithDialer と同様に、ハンドシェイクまでを接続のタイムアウトに含め、ServerNameを補う。
+		handshakeStart := time.Now()
+		if timeout > 0 {
+			conn.SetDeadline(start.Add(timeout))
+		}
+		config := options.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" && config.InsecureSkipVerify == false {
+			config = config.Clone()
+			config.ServerName = uri.Hostname()
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		timing.TlsHandshake = time.Since(handshakeStart)
+		timing.Dialed = time.Now()
+		return tlsConn, nil
+	default:
+		return nil, errors.New("unknown protocol")
+	}
+	if err != nil {
+		return nil, err
+	}
+	timing.TcpConnect = time.Since(start)
+	timing.Dialed = time.Now()
+	return conn, nil
+}
+
+// クライアントの接続元のポートの範囲
+type PortRange struct {
+	Low  int // 最小のポート番号
+	High int // 最大のポート番号
+}
+
+// lo-hi 形式の、接続元のポートの範囲を解析する。
+func ParsePortRange(text string) (*PortRange, error) {
+	values := strings.Split(text, "-")
+	if len(values) != 2 {
+		return nil, errors.New("port range must be lo-hi")
+	}
+	low, err := strconv.Atoi(strings.TrimSpace(values[0]))
+	if err != nil {
+		return nil, err
+	}
+	high, err := strconv.Atoi(strings.TrimSpace(values[1]))
+	if err != nil {
+		return nil, err
+	}
+	if low < 1 || high > 65535 || low > high {
+		return nil, errors.New("port range must be within 1-65535 and lo <= hi")
+	}
+	return &PortRange{Low: low, High: high}, nil
+}
+
+// クライアントの連番に対応する、接続元のポート番号を返す。
+// 範囲のポートを順に割り当て、範囲を超えた場合は先頭に戻る。
+//   id : クライアントの連番
+func (r *PortRange) Port(id int) int {
+	return r.Low + id%(r.High-r.Low+1)
+}
+
+// ポートの範囲を、lo-hi 形式で返す。
+func (r *PortRange) String() string {
+	return strconv.Itoa(r.Low) + "-" + strconv.Itoa(r.High)
+}
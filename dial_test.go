@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 接続(TCP/TLS)とCONNACKのタイムアウトを、フラグと同様に実行オプションへ設定する。
+func setConnectTimeouts(opts *ExecOptions, dialTimeout time.Duration, mqttConnectTimeout time.Duration) {
+	opts.DialTimeout = dialTimeout
+	opts.MqttConnectTimeout = mqttConnectTimeout
+}
+
+// 接続を受け付けるが、何も応答しない待ち受けを開始する（TLSのハンドシェイクが完了しない）。
+func startSilentListener(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestSlowDialTimesOutByDialTimeout(t *testing.T) {
+	opts := testExecOptions("ssl://" + startSilentListener(t))
+	opts.CertConfig = ServerCertConfig{ServerCertFile: newTestCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)).CertFile}
+	setConnectTimeouts(&opts, 200*time.Millisecond, 5*time.Second)
+
+	start := time.Now()
+	var err error
+	captureStdout(t, func() {
+		_, err = Connect(0, opts, nil, nil)
+	})
+	elapsed := time.Since(start)
+	// 接続のタイムアウトで、CONNACKのタイムアウトとは異なる接続のエラーとなる。
+	if err == nil || errors.Is(err, ErrConnackTimeout) {
+		t.Fatalf("error = %v, want a dial error", err)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("failed after %s, want about the 200ms dial timeout", elapsed)
+	}
+}
+
+func TestSlowConnackTimesOutByMqttConnectTimeout(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{ConnackDelay: 500 * time.Millisecond})
+	opts := testExecOptions(broker.URL)
+	setConnectTimeouts(&opts, 2*time.Second, 100*time.Millisecond)
+
+	start := time.Now()
+	var err error
+	captureStdout(t, func() {
+		_, err = Connect(0, opts, nil, nil)
+	})
+	elapsed := time.Since(start)
+	// CONNACKのタイムアウトは、接続のタイムアウトを待たずに、接続の完了から数える。
+	if errors.Is(err, ErrConnackTimeout) == false {
+		t.Fatalf("error = %v, want %s", err, ErrConnackTimeout)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("failed after %s, want about the 100ms CONNACK timeout", elapsed)
+	}
+	// 待機を打ち切った接続は、CONNACKの受信後に切断する。
+	if open := broker.OpenConnections(); open != 1 {
+		t.Errorf("open connections before the CONNACK = %d, want 1", open)
+	}
+	if waitFor(5*time.Second, func() bool { return broker.OpenConnections() == 0 }) == false {
+		t.Error("connection remains after the CONNACK timeout")
+	}
+}
+
+func TestDialTimeoutDoesNotLimitConnack(t *testing.T) {
+	// 接続のタイムアウトより遅いCONNACKも、CONNACKのタイムアウト以内であれば接続できる。
+	broker := startTestBroker(t, &testBroker{ConnackDelay: 200 * time.Millisecond})
+	opts := testExecOptions(broker.URL)
+	setConnectTimeouts(&opts, 50*time.Millisecond, time.Second)
+
+	var client MQTT.Client
+	var err error
+	captureStdout(t, func() {
+		client, err = Connect(0, opts, nil, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ForceDisconnect(client)
+}
+
+func TestDialTimeoutAloneDoesNotLimitConnack(t *testing.T) {
+	// CONNACKのタイムアウトがない場合は、接続のタイムアウトより遅いCONNACKも、完了まで待つ。
+	broker := startTestBroker(t, &testBroker{ConnackDelay: 300 * time.Millisecond})
+	opts := testExecOptions(broker.URL)
+	setConnectTimeouts(&opts, 100*time.Millisecond, 0)
+
+	var client MQTT.Client
+	var err error
+	captureStdout(t, func() {
+		client, err = Connect(0, opts, nil, nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ForceDisconnect(client)
+}
+
+func TestParsePortRange(t *testing.T) {
+	portRange, err := ParsePortRange("40000-40002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 範囲のポートを順に割り当て、範囲を超えた場合は先頭に戻る。
+	for id, expected := range []int{40000, 40001, 40002, 40000} {
+		if port := portRange.Port(id); port != expected {
+			t.Errorf("Port(%d) = %d, want %d", id, port, expected)
+		}
+	}
+	if portRange.String() != "40000-40002" {
+		t.Errorf("String() = %s", portRange)
+	}
+
+	for _, text := range []string{"40000", "a-b", "0-10", "10-65536", "200-100", "1-2-3"} {
+		if _, err := ParsePortRange(text); err == nil {
+			t.Errorf("ParsePortRange(%q) succeeded", text)
+		}
+	}
+}
+
+func TestLocalPortRange(t *testing.T) {
+	// 空いているポートから始まる範囲を、接続元のポートとする。
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	low := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	if low > 65535-2 {
+		t.Skipf("no room for the range from %d", low)
+	}
+
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.LocalPortRange = &PortRange{Low: low, High: low + 2}
+	var dialers []net.Dialer
+	opts.ConnectOptions = []ClientOptionSetter{func(o *MQTT.ClientOptions) {
+		// 他の接続オプションで置き換えられても、接続元のポートは設定する。
+		o.SetDialer(&net.Dialer{Timeout: 5 * time.Second})
+	}}
+	opts.ConnectOptions = append(opts.ConnectOptions, func(o *MQTT.ClientOptions) {
+		o.SetCustomOpenConnectionFn(func(uri *url.URL, options MQTT.ClientOptions) (net.Conn, error) {
+			dialers = append(dialers, *options.Dialer)
+			return OpenConnection(uri, options, options.Dialer.Timeout, nil)
+		})
+	})
+
+	for id := 0; id < 3; id++ {
+		client, err := Connect(id, opts, nil, nil)
+		if err != nil {
+			t.Fatalf("client %d : %s", id, err)
+		}
+		defer client.Disconnect(0)
+	}
+	if len(dialers) != 3 {
+		t.Fatalf("dialed %d, want 3", len(dialers))
+	}
+	for id, dialer := range dialers {
+		addr, ok := dialer.LocalAddr.(*net.TCPAddr)
+		if ok == false || addr.Port != low+id {
+			t.Errorf("client %d : LocalAddr = %v, want port %d", id, dialer.LocalAddr, low+id)
+		}
+	}
+	// Brokerからも、範囲内のポートからの接続として見える。
+	for id, connect := range broker.Connects() {
+		_, port, _ := net.SplitHostPort(connect.Addr)
+		if expected := strconv.Itoa(low + id); port != expected {
+			t.Errorf("client %d connected from %s, want port %s", id, connect.Addr, expected)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ペイロードのエンコード方式
+const (
+	PAYLOAD_ENCODING_RAW      string = "raw"      // テンプレートの出力のまま
+	PAYLOAD_ENCODING_CBOR     string = "cbor"     // CBOR(RFC 8949)
+	PAYLOAD_ENCODING_PROTOBUF string = "protobuf" // Protocol Buffers（google.protobuf.Struct / Value）
+)
+
+// JSON形式のペイロードを、指定された方式でエンコードする。
+// raw の場合は、そのままのペイロードを返す。
+//   payload  : JSON形式のペイロード（テンプレートの出力）
+//   encoding : エンコード方式
+func EncodePayload(payload string, encoding string) ([]byte, error) {
+	if encoding == PAYLOAD_ENCODING_RAW {
+		return []byte(payload), nil
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(payload)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("payload is not a valid JSON : %s", err)
+	}
+
+	var buffer bytes.Buffer
+	switch encoding {
+	case PAYLOAD_ENCODING_CBOR:
+		if err := encodeCbor(&buffer, value); err != nil {
+			return nil, err
+		}
+	case PAYLOAD_ENCODING_PROTOBUF:
+		// オブジェクトは Struct、それ以外は Value としてエンコードする。
+		if object, ok := value.(map[string]interface{}); ok {
+			encodeProtobufStruct(&buffer, object)
+		} else {
+			encodeProtobufValue(&buffer, value)
+		}
+	default:
+		return nil, fmt.Errorf("unknown payload encoding : %s", encoding)
+	}
+	return buffer.Bytes(), nil
+}
+
+// JSONの値を、CBORでエンコードする。
+// 整数は整数、小数は倍精度浮動小数点数とし、オブジェクトのキーは実行毎に変わらないように昇順に並べる。
+func encodeCbor(buffer *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buffer.WriteByte(0xf6)
+	case bool:
+		if v {
+			buffer.WriteByte(0xf5)
+		} else {
+			buffer.WriteByte(0xf4)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i >= 0 {
+				writeCborHead(buffer, 0, uint64(i))
+			} else {
+				writeCborHead(buffer, 1, uint64(-1-i))
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buffer.WriteByte(0xfb)
+		binary.Write(buffer, binary.BigEndian, math.Float64bits(f))
+	case string:
+		writeCborHead(buffer, 3, uint64(len(v)))
+		buffer.WriteString(v)
+	case []interface{}:
+		writeCborHead(buffer, 4, uint64(len(v)))
+		for _, item := range v {
+			if err := encodeCbor(buffer, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeCborHead(buffer, 5, uint64(len(v)))
+		for _, key := range sortedKeys(v) {
+			writeCborHead(buffer, 3, uint64(len(key)))
+			buffer.WriteString(key)
+			if err := encodeCbor(buffer, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported value : %v", v)
+	}
+	return nil
+}
+
+// CBORの先頭のバイト（メジャータイプと、値または長さ）を出力する。
+func writeCborHead(buffer *bytes.Buffer, major byte, n uint64) {
+	head := major << 5
+	switch {
+	case n < 24:
+		buffer.WriteByte(head | byte(n))
+	case n <= math.MaxUint8:
+		buffer.WriteByte(head | 24)
+		buffer.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buffer.WriteByte(head | 25)
+		binary.Write(buffer, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buffer.WriteByte(head | 26)
+		binary.Write(buffer, binary.BigEndian, uint32(n))
+	default:
+		buffer.WriteByte(head | 27)
+		binary.Write(buffer, binary.BigEndian, n)
+	}
+}
+
+// JSONのオブジェクトを、google.protobuf.Struct としてエンコードする。
+//   message Struct { map<string, Value> fields = 1; }
+func encodeProtobufStruct(buffer *bytes.Buffer, object map[string]interface{}) {
+	for _, key := range sortedKeys(object) {
+		var entry bytes.Buffer
+		writeProtobufBytes(&entry, 1, []byte(key))
+		var value bytes.Buffer
+		encodeProtobufValue(&value, object[key])
+		writeProtobufBytes(&entry, 2, value.Bytes())
+		writeProtobufBytes(buffer, 1, entry.Bytes())
+	}
+}
+
+// JSONの値を、google.protobuf.Value としてエンコードする。
+//   message Value { oneof kind { NullValue null_value = 1; double number_value = 2; string string_value = 3;
+//                                bool bool_value = 4; Struct struct_value = 5; ListValue list_value = 6; } }
+func encodeProtobufValue(buffer *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		writeProtobufVarint(buffer, 1<<3|0)
+		writeProtobufVarint(buffer, 0)
+	case json.Number:
+		f, _ := v.Float64()
+		writeProtobufVarint(buffer, 2<<3|1)
+		binary.Write(buffer, binary.LittleEndian, math.Float64bits(f))
+	case string:
+		writeProtobufBytes(buffer, 3, []byte(v))
+	case bool:
+		writeProtobufVarint(buffer, 4<<3|0)
+		if v {
+			writeProtobufVarint(buffer, 1)
+		} else {
+			writeProtobufVarint(buffer, 0)
+		}
+	case map[string]interface{}:
+		var object bytes.Buffer
+		encodeProtobufStruct(&object, v)
+		writeProtobufBytes(buffer, 5, object.Bytes())
+	case []interface{}:
+		// message ListValue { repeated Value values = 1; }
+		var list bytes.Buffer
+		for _, item := range v {
+			var element bytes.Buffer
+			encodeProtobufValue(&element, item)
+			writeProtobufBytes(&list, 1, element.Bytes())
+		}
+		writeProtobufBytes(buffer, 6, list.Bytes())
+	}
+}
+
+// Protocol Buffersの可変長整数を出力する。
+func writeProtobufVarint(buffer *bytes.Buffer, n uint64) {
+	for n >= 0x80 {
+		buffer.WriteByte(byte(n) | 0x80)
+		n >>= 7
+	}
+	buffer.WriteByte(byte(n))
+}
+
+// Protocol Buffersの長さ付きのフィールド（文字列、バイト列、メッセージ）を出力する。
+func writeProtobufBytes(buffer *bytes.Buffer, field uint64, data []byte) {
+	writeProtobufVarint(buffer, field<<3|2)
+	writeProtobufVarint(buffer, uint64(len(data)))
+	buffer.Write(data)
+}
+
+// オブジェクトのキーを、昇順に並べて返す。
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
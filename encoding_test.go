@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// テスト用のCBORのデコーダー。数値は、JSONと比較できるように float64 とする。
+func decodeTestCbor(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("unexpected end")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		case 27:
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+		}
+		return nil, nil, fmt.Errorf("unsupported simple value : %d", info)
+	}
+	n := uint64(info)
+	switch info {
+	case 24:
+		n, data = uint64(data[0]), data[1:]
+	case 25:
+		n, data = uint64(binary.BigEndian.Uint16(data)), data[2:]
+	case 26:
+		n, data = uint64(binary.BigEndian.Uint32(data)), data[4:]
+	case 27:
+		n, data = binary.BigEndian.Uint64(data), data[8:]
+	}
+	switch major {
+	case 0:
+		return float64(n), data, nil
+	case 1:
+		return -1 - float64(n), data, nil
+	case 3:
+		return string(data[:n]), data[n:], nil
+	case 4:
+		list := []interface{}{}
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			var err error
+			if item, data, err = decodeTestCbor(data); err != nil {
+				return nil, nil, err
+			}
+			list = append(list, item)
+		}
+		return list, data, nil
+	case 5:
+		object := map[string]interface{}{}
+		for i := uint64(0); i < n; i++ {
+			key, rest, err := decodeTestCbor(data)
+			if err != nil {
+				return nil, nil, err
+			}
+			if object[key.(string)], data, err = decodeTestCbor(rest); err != nil {
+				return nil, nil, err
+			}
+		}
+		return object, data, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported major type : %d", major)
+}
+
+// Protocol Buffersの1つのフィールドを読み取る。
+func readTestProtobufField(data []byte) (field uint64, wireType uint64, value []byte, rest []byte) {
+	readVarint := func() uint64 {
+		n, size := binary.Uvarint(data)
+		data = data[size:]
+		return n
+	}
+	key := readVarint()
+	field, wireType = key>>3, key&0x7
+	switch wireType {
+	case 0:
+		n := readVarint()
+		return field, wireType, []byte{byte(n)}, data
+	case 1:
+		return field, wireType, data[:8], data[8:]
+	default:
+		n := readVarint()
+		return field, wireType, data[:n], data[n:]
+	}
+}
+
+// テスト用の google.protobuf.Struct のデコーダー
+func decodeTestProtobufStruct(data []byte) map[string]interface{} {
+	object := map[string]interface{}{}
+	for len(data) > 0 {
+		var entry []byte
+		_, _, entry, data = readTestProtobufField(data)
+		_, _, key, rest := readTestProtobufField(entry)
+		_, _, value, _ := readTestProtobufField(rest)
+		object[string(key)] = decodeTestProtobufValue(value)
+	}
+	return object
+}
+
+// テスト用の google.protobuf.Value のデコーダー
+func decodeTestProtobufValue(data []byte) interface{} {
+	field, _, value, _ := readTestProtobufField(data)
+	switch field {
+	case 2:
+		return math.Float64frombits(binary.LittleEndian.Uint64(value))
+	case 3:
+		return string(value)
+	case 4:
+		return value[0] == 1
+	case 5:
+		return decodeTestProtobufStruct(value)
+	case 6:
+		list := []interface{}{}
+		for len(value) > 0 {
+			var element []byte
+			_, _, element, value = readTestProtobufField(value)
+			list = append(list, decodeTestProtobufValue(element))
+		}
+		return list
+	}
+	return nil
+}
+
+func TestEncodePayloadKnownBytes(t *testing.T) {
+	tests := []struct {
+		payload  string
+		encoding string
+		expected []byte
+	}{
+		{`{"a":1}`, PAYLOAD_ENCODING_CBOR, []byte{0xa1, 0x61, 'a', 0x01}},
+		{`[-1,true,null]`, PAYLOAD_ENCODING_CBOR, []byte{0x83, 0x20, 0xf5, 0xf6}},
+		{`500`, PAYLOAD_ENCODING_CBOR, []byte{0x19, 0x01, 0xf4}},
+		{`"a"`, PAYLOAD_ENCODING_PROTOBUF, []byte{0x1a, 0x01, 'a'}},
+		{`{"a":true}`, PAYLOAD_ENCODING_PROTOBUF, []byte{0x0a, 0x07, 0x0a, 0x01, 'a', 0x12, 0x02, 0x20, 0x01}},
+		{`{"a":1}`, PAYLOAD_ENCODING_RAW, []byte(`{"a":1}`)}}
+	for _, test := range tests {
+		encoded, err := EncodePayload(test.payload, test.encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(encoded, test.expected) == false {
+			t.Errorf("EncodePayload(%s, %s) = % x, want % x", test.payload, test.encoding, encoded, test.expected)
+		}
+	}
+
+	if _, err := EncodePayload(`{"a":`, PAYLOAD_ENCODING_CBOR); err == nil {
+		t.Error("invalid JSON was encoded")
+	}
+	if _, err := EncodePayload(`{}`, "xml"); err == nil {
+		t.Error("unknown encoding was accepted")
+	}
+}
+
+func TestEncodedPayloadDecodesToTemplate(t *testing.T) {
+	tmpl, err := ParsePayloadTemplate(`{"device":"dev-{{.ClientId}}","seq":{{.Seq}},"temp":21.5,"offset":-300,"on":true,"none":null,"tags":["a",{"b":70000}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, encoding := range []string{PAYLOAD_ENCODING_CBOR, PAYLOAD_ENCODING_PROTOBUF} {
+		opts := testExecOptions("tcp://127.0.0.1:1883")
+		opts.ClientNum = 1
+		opts.Count = 3
+		opts.PayloadTemplate = tmpl
+		opts.PayloadEncoding = encoding
+
+		// テンプレートの出力を、エンコードしてからPublishする。
+		client := &testClient{}
+		PublishAllClient(context.Background(), []MQTT.Client{client}, opts, NewMetrics(), "")
+		payloads := client.Payloads()
+		if len(payloads) != opts.Count {
+			t.Fatalf("%s : published %d, want %d", encoding, len(payloads), opts.Count)
+		}
+		for seq, payload := range payloads {
+			rendered, err := RenderPayload(tmpl, 0, seq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected interface{}
+			if err := json.Unmarshal([]byte(rendered), &expected); err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded interface{}
+			if encoding == PAYLOAD_ENCODING_CBOR {
+				var rest []byte
+				if decoded, rest, err = decodeTestCbor(payload); err != nil || len(rest) != 0 {
+					t.Fatalf("cbor : %v, rest = % x", err, rest)
+				}
+			} else {
+				decoded = decodeTestProtobufStruct(payload)
+			}
+			if reflect.DeepEqual(decoded, expected) == false {
+				t.Errorf("%s : decoded = %v, want %v", encoding, decoded, expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 非推奨のフラグ名と、その代わりに利用するフラグ名
+var DeprecatedFlags = map[string]string{
+	"size": "message-size",
+}
+
+// 明示的に指定された非推奨のフラグについて警告を出力し、その値を代わりのフラグに反映する。
+// 代わりのフラグも明示的に指定されている場合は、代わりのフラグの値を優先する。
+// flag.Parse の後に呼び出すこと。
+//   flags  : フラグの定義
+//   output : 警告の出力先
+func ApplyDeprecatedFlags(flags *flag.FlagSet, output io.Writer) error {
+	explicit := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	for name, replacement := range DeprecatedFlags {
+		value, ok := explicit[name]
+		if ok == false {
+			continue
+		}
+		fmt.Fprintf(output, "Warning : -%s is deprecated, use -%s instead\n", name, replacement)
+		if _, ok := explicit[replacement]; ok {
+			continue
+		}
+		if err := flags.Set(replacement, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 繰り返し指定できる、key:value 形式のHTTPヘッダーのフラグ
+// 同じヘッダー名を複数回指定した場合は、全ての値を送信する。
+type HeaderFlag struct {
+	Header http.Header // 指定されたHTTPヘッダー（未指定の場合は nil）
+}
+
+// 指定されたHTTPヘッダーを、key:value 形式で返す。
+func (f *HeaderFlag) String() string {
+	var values []string
+	for key, list := range f.Header {
+		for _, value := range list {
+			values = append(values, key+":"+value)
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+// key:value 形式のHTTPヘッダーを追加する。
+// 値の前後の空白は取り除く。
+func (f *HeaderFlag) Set(value string) error {
+	index := strings.Index(value, ":")
+	if index < 0 {
+		return errors.New("header must be key:value")
+	}
+	key := strings.TrimSpace(value[:index])
+	if key == "" {
+		return errors.New("header name must not be empty")
+	}
+	if f.Header == nil {
+		f.Header = make(http.Header)
+	}
+	f.Header.Add(key, strings.TrimSpace(value[index+1:]))
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMessageSizeFlags(t *testing.T) {
+	tests := []struct {
+		flag       string
+		deprecated bool
+	}{
+		{"-message-size=100", false},
+		{"-size=100", true}}
+	for _, test := range tests {
+		broker := startTestBroker(t, &testBroker{})
+		// 終了する前にBrokerが受信するように、QoS 1で送信する。
+		status, output := runMainOutput(t, "-broker="+broker.URL, "-action=pub", "-clients=1", "-count=3", "-qos=1", "-pretime=0", test.flag)
+		if status != 0 {
+			t.Fatalf("%s : exit status = %d :\n%s", test.flag, status, output)
+		}
+		published := broker.Published()
+		if len(published) != 3 {
+			t.Fatalf("%s : published %d, want 3", test.flag, len(published))
+		}
+		for _, msg := range published {
+			if len(msg.Payload) != 100 {
+				t.Errorf("%s : payload size = %d, want 100", test.flag, len(msg.Payload))
+			}
+		}
+		warned := strings.Contains(output, "Warning : -size is deprecated, use -message-size instead")
+		if warned != test.deprecated {
+			t.Errorf("%s : warned = %t :\n%s", test.flag, warned, output)
+		}
+	}
+}
+
+func TestHeaderFlag(t *testing.T) {
+	var headers HeaderFlag
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Var(&headers, "ws-header", "")
+	err := flags.Parse([]string{"-ws-header=Authorization: Bearer abc", "-ws-header=X-Tag:a", "-ws-header=x-tag:b:c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.Header.Get("Authorization") != "Bearer abc" {
+		t.Errorf("Authorization = %q", headers.Header.Get("Authorization"))
+	}
+	// 同じヘッダー名の値は全て保持し、値に含まれる ':' はそのまま残す。
+	if tags := headers.Header.Values("X-Tag"); strings.Join(tags, ",") != "a,b:c" {
+		t.Errorf("X-Tag = %v", tags)
+	}
+
+	for _, value := range []string{"Authorization", ":value"} {
+		if err := headers.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded", value)
+		}
+	}
+}
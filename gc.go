@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// GCの停止時間を取得する間隔
+// runtime.MemStats は直近256回分の停止時間しか保持しないため、それより短い間隔で取得する。
+const GC_POLL_INTERVAL time.Duration = 1 * time.Second
+
+// GCの停止と、Publishの応答時間の急増を照合する区間の長さ
+const GC_IMPACT_WINDOW time.Duration = 100 * time.Millisecond
+
+// GCの停止時間と、応答時間の急増との相関
+type GcPauseStats struct {
+	NumGC          int     `json:"num_gc"`             // 計測中のGCの回数
+	Missed         int     `json:"missed"`             // 履歴から消えたため、停止時間を取得できなかったGCの回数
+	TotalPause     float64 `json:"total_pause_ms"`     // 停止時間の合計(ms)
+	MaxPause       float64 `json:"max_pause_ms"`       // 停止時間の最大値(ms)
+	PausePercent   float64 `json:"pause_percent"`      // 計測時間に対する停止時間の割合(%)
+	SpikeThreshold float64 `json:"spike_threshold_ms"` // 応答時間の急増とみなす閾値(ms、Publishの応答時間のp99)
+	Windows        int     `json:"windows"`            // Publishが完了した区間数
+	GcWindows      int     `json:"gc_windows"`         // そのうち、GCの停止を含む区間数
+	SpikeWindows   int     `json:"spike_windows"`      // 応答時間が閾値を超えたPublishを含む区間数
+	SpikeGcWindows int     `json:"spike_gc_windows"`   // そのうち、GCの停止を含む区間数
+}
+
+// GCの停止時間と相関を、1行の文字列に整形する。
+func (s *GcPauseStats) String() string {
+	return fmt.Sprintf("gc=%d, pause total=%.3fms, max=%.3fms (%.3f%% of run), spike windows with gc=%d/%d (%.1f%%), all windows with gc=%d/%d (%.1f%%)",
+		s.NumGC, s.TotalPause, s.MaxPause, s.PausePercent,
+		s.SpikeGcWindows, s.SpikeWindows, percentOf(s.SpikeGcWindows, s.SpikeWindows),
+		s.GcWindows, s.Windows, percentOf(s.GcWindows, s.Windows))
+}
+
+// 全体に対する割合(%)を返す（全体が0の場合は0）。
+func percentOf(count int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total) * 100
+}
+
+// GCの1回の停止
+type gcPause struct {
+	end   time.Time     // 停止の終了時刻
+	pause time.Duration // 停止時間
+}
+
+// 計測中のGCの停止時間と、区間毎のPublishの最大の応答時間を記録する。
+// 区間毎の最大値のみを保持するため、メッセージ数に関わらずメモリを抑えられる。
+type GcImpactRecorder struct {
+	mutex   sync.Mutex
+	start   time.Time       // 計測の開始時刻（ゼロ値の場合は記録しない）
+	end     time.Time       // 計測の終了時刻
+	numGC   uint32          // 最後に停止時間を取得した時点のGCの回数
+	missed  int             // 停止時間を取得できなかったGCの回数
+	pauses  []gcPause       // 計測中のGCの停止
+	windows []time.Duration // 区間毎の最大の応答時間（-1 の場合は、Publishが完了していない）
+}
+
+// GcImpactRecorderを生成する。
+func NewGcImpactRecorder() *GcImpactRecorder {
+	return &GcImpactRecorder{}
+}
+
+// 計測を開始する。これより前のGCは記録しない。
+func (r *GcImpactRecorder) Start() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.start = time.Now()
+	r.numGC = stats.NumGC
+}
+
+// Publishの応答時間を記録する（nil の場合や、計測の開始前は何もしない）。
+// 完了した時刻の区間の、最大の応答時間を更新する。
+func (r *GcImpactRecorder) Record(latency time.Duration) {
+	if r == nil {
+		return
+	}
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.start.IsZero() || now.Before(r.start) {
+		return
+	}
+	index := int(now.Sub(r.start) / GC_IMPACT_WINDOW)
+	for len(r.windows) <= index {
+		r.windows = append(r.windows, -1)
+	}
+	if latency > r.windows[index] {
+		r.windows[index] = latency
+	}
+}
+
+// 前回の取得以降のGCの停止時間を取得する。
+func (r *GcImpactRecorder) collect() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	count := int(stats.NumGC - r.numGC)
+	if count > len(stats.PauseNs) {
+		r.missed += count - len(stats.PauseNs)
+		count = len(stats.PauseNs)
+	}
+	// n回目のGCの停止時間は、PauseNs[(n+255)%256] に格納される。
+	for i := 0; i < count; i++ {
+		n := stats.NumGC - uint32(i)
+		index := (n + uint32(len(stats.PauseNs)) - 1) % uint32(len(stats.PauseNs))
+		r.pauses = append(r.pauses, gcPause{
+			end:   time.Unix(0, int64(stats.PauseEnd[index])),
+			pause: time.Duration(stats.PauseNs[index])})
+	}
+	r.numGC = stats.NumGC
+}
+
+// 処理が終了するまで、一定間隔でGCの停止時間を取得する。
+// 終了時に最後の取得を行い、計測の終了時刻を記録する。
+func (r *GcImpactRecorder) Watch(ctx context.Context) {
+	ticker := time.NewTicker(GC_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.collect()
+			r.mutex.Lock()
+			r.end = time.Now()
+			r.mutex.Unlock()
+			return
+		case <-ticker.C:
+			r.collect()
+		}
+	}
+}
+
+// 停止時間の統計と、応答時間の急増との相関を算出する。
+//   threshold : 応答時間の急増とみなす閾値
+func (r *GcImpactRecorder) Stats(threshold time.Duration) *GcPauseStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := &GcPauseStats{
+		NumGC:          len(r.pauses) + r.missed,
+		Missed:         r.missed,
+		SpikeThreshold: ToMillis(threshold)}
+
+	// 停止の開始と終了を含む区間を、GCの停止を含む区間とする。
+	gcWindows := make(map[int]bool)
+	var total, max time.Duration = 0, 0
+	for _, p := range r.pauses {
+		total += p.pause
+		if p.pause > max {
+			max = p.pause
+		}
+		gcWindows[int(p.end.Add(-p.pause).Sub(r.start)/GC_IMPACT_WINDOW)] = true
+		gcWindows[int(p.end.Sub(r.start)/GC_IMPACT_WINDOW)] = true
+	}
+	stats.TotalPause = ToMillis(total)
+	stats.MaxPause = ToMillis(max)
+	if elapsed := r.end.Sub(r.start); elapsed > 0 {
+		stats.PausePercent = float64(total) / float64(elapsed) * 100
+	}
+
+	for i, latency := range r.windows {
+		if latency < 0 {
+			continue
+		}
+		stats.Windows++
+		spike := latency > threshold
+		if spike {
+			stats.SpikeWindows++
+		}
+		if gcWindows[i] {
+			stats.GcWindows++
+			if spike {
+				stats.SpikeGcWindows++
+			}
+		}
+	}
+	return stats
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGcImpactRecorderCollectsPauses(t *testing.T) {
+	recorder := NewGcImpactRecorder()
+	recorder.Start()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		recorder.Watch(ctx)
+	}()
+	for i := 0; i < 3; i++ {
+		runtime.GC()
+		recorder.Record(time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	stats := recorder.Stats(time.Second)
+	if stats.NumGC < 3 || stats.Missed != 0 || stats.TotalPause <= 0 || stats.MaxPause <= 0 || stats.MaxPause > stats.TotalPause {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.Windows == 0 || stats.SpikeWindows != 0 {
+		t.Errorf("windows = %+v", stats)
+	}
+
+	// 計測の開始前の記録は無視する。
+	var disabled *GcImpactRecorder
+	disabled.Record(time.Second)
+	NewGcImpactRecorder().Record(time.Second)
+}
+
+func TestGcImpactCorrelation(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	// 4区間のうち、0番目と2番目がGCの停止を含み、急増は2番目と3番目の区間とする。
+	recorder := &GcImpactRecorder{
+		start: start,
+		end:   at(400),
+		pauses: []gcPause{
+			{end: at(50), pause: 2 * time.Millisecond},
+			{end: at(250), pause: 6 * time.Millisecond}},
+		windows: []time.Duration{time.Millisecond, 2 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond, -1}}
+
+	stats := recorder.Stats(10 * time.Millisecond)
+	if stats.NumGC != 2 || stats.TotalPause != 8 || stats.MaxPause != 6 || stats.PausePercent != 2 {
+		t.Errorf("pauses = %+v", stats)
+	}
+	if stats.Windows != 4 || stats.GcWindows != 2 || stats.SpikeWindows != 2 || stats.SpikeGcWindows != 1 {
+		t.Errorf("windows = %+v", stats)
+	}
+	if text := stats.String(); strings.Contains(text, "spike windows with gc=1/2 (50.0%), all windows with gc=2/4 (50.0%)") == false {
+		t.Errorf("text = %s", text)
+	}
+}
+
+func TestReportGcPause(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.Count = 50
+	opts.Qos = 1
+	opts.IntervalTime = 4
+	opts.ReportGcPause = true
+
+	// 計測中にGCを発生させる。
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				runtime.GC()
+			}
+		}
+	}()
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PublishAllClient, opts)
+	})
+	if result == nil || result.GcPause == nil {
+		t.Fatalf("no GC pause result : %s", output)
+	}
+	if result.GcPause.NumGC == 0 || result.GcPause.Windows == 0 || result.GcPause.SpikeThreshold != result.Latency.P99 {
+		t.Errorf("GC pause = %+v", result.GcPause)
+	}
+	if strings.Contains(output, "GC pause : gc=") == false {
+		t.Errorf("output = %s", output)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// HDRヒストグラムの各桁(2のべき乗の範囲)を分割する数のビット数
+// 256分割のため、各バケットの幅は値の 1/128 以下となり、
+// バケットの中央値を代表値とするパーセンタイルの相対誤差は約0.4%以内となる。
+const HDR_SUB_BUCKET_BITS uint = 8
+
+// HDR_SUB_BUCKET_BITS に対応する分割数と、その半分
+const (
+	HDR_SUB_BUCKET_COUNT int = 1 << HDR_SUB_BUCKET_BITS
+	HDR_SUB_BUCKET_HALF  int = HDR_SUB_BUCKET_COUNT / 2
+)
+
+// 値(ns)を対数的な幅のバケットに計数するヒストグラム（HDRヒストグラム）
+// 件数に関わらず、メモリ使用量はバケット数（最大でも数千）で一定となる。
+// 件数・合計・最小値・最大値は正確に記録する。
+type HdrHistogram struct {
+	counts []int64
+	total  int
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// HdrHistogramを生成する。
+func NewHdrHistogram() *HdrHistogram {
+	return &HdrHistogram{}
+}
+
+// 値に対応するバケットの位置を返す。
+// 256未満の値は幅1のバケット、それ以上は上位8bitが同じ値を1つのバケットとする。
+func hdrBucketIndex(value int64) int {
+	if value < int64(HDR_SUB_BUCKET_COUNT) {
+		return int(value)
+	}
+	shift := uint(bits.Len64(uint64(value))) - HDR_SUB_BUCKET_BITS
+	sub := int(value >> shift)
+	return HDR_SUB_BUCKET_COUNT + int(shift-1)*HDR_SUB_BUCKET_HALF + (sub - HDR_SUB_BUCKET_HALF)
+}
+
+// バケットの下限値と幅を返す。
+func hdrBucketRange(index int) (int64, int64) {
+	if index < HDR_SUB_BUCKET_COUNT {
+		return int64(index), 1
+	}
+	k := index - HDR_SUB_BUCKET_COUNT
+	shift := uint(k/HDR_SUB_BUCKET_HALF) + 1
+	sub := int64(k%HDR_SUB_BUCKET_HALF + HDR_SUB_BUCKET_HALF)
+	return sub << shift, int64(1) << shift
+}
+
+// 値を記録する（負の値は0として記録する）。
+func (h *HdrHistogram) Record(duration time.Duration) {
+	if duration < 0 {
+		duration = 0
+	}
+	index := hdrBucketIndex(int64(duration))
+	if index >= len(h.counts) {
+		counts := make([]int64, index+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[index]++
+
+	if h.total == 0 || duration < h.min {
+		h.min = duration
+	}
+	if duration > h.max {
+		h.max = duration
+	}
+	h.total++
+	h.sum += duration
+}
+
+// 他のヒストグラムの計数を加える。
+func (h *HdrHistogram) Merge(other *HdrHistogram) {
+	if other.total == 0 {
+		return
+	}
+	if len(other.counts) > len(h.counts) {
+		counts := make([]int64, len(other.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+
+	if h.total == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.total += other.total
+	h.sum += other.sum
+}
+
+// 記録した件数を返す。
+func (h *HdrHistogram) Count() int {
+	return h.total
+}
+
+// 指定されたパーセンタイルの値を返す（nearest-rank法）。
+// 値は該当するバケットの中央値とし、記録した最小値・最大値の範囲に収める。
+//   percentile : パーセンタイル(0-100、99.9 のような小数も可)
+func (h *HdrHistogram) ValueAtPercentile(percentile float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+
+	// 順位の算出は、サンプルを保持する場合の Percentile と同じとする。
+	rank := int64(math.Ceil(percentile/100*float64(h.total) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > int64(h.total) {
+		rank = int64(h.total)
+	}
+
+	var cumulative int64 = 0
+	for i, count := range h.counts {
+		cumulative += count
+		if cumulative < rank {
+			continue
+		}
+		low, width := hdrBucketRange(i)
+		value := time.Duration(low + (width-1)/2)
+		if value < h.min {
+			value = h.min
+		}
+		if value > h.max {
+			value = h.max
+		}
+		return value
+	}
+	return h.max
+}
+
+// 閾値を超えた件数を返す。
+// 閾値を含むバケットは、バケットの下限値が閾値を超える場合のみ数えるため、
+// バケットの幅の分だけ少なく数える場合がある。
+func (h *HdrHistogram) CountAbove(threshold time.Duration) int {
+	exceeded := 0
+	for i, count := range h.counts {
+		if low, _ := hdrBucketRange(i); time.Duration(low) > threshold {
+			exceeded += int(count)
+		}
+	}
+	return exceeded
+}
+
+// 統計値を算出する。
+// 記録がない場合は nil を返す。
+func (h *HdrHistogram) Stats() *LatencyStats {
+	if h.total == 0 {
+		return nil
+	}
+	return &LatencyStats{
+		Count: h.total,
+		Min:   ToMillis(h.min),
+		Avg:   ToMillis(h.sum / time.Duration(h.total)),
+		P50:   ToMillis(h.ValueAtPercentile(50)),
+		P95:   ToMillis(h.ValueAtPercentile(95)),
+		P99:   ToMillis(h.ValueAtPercentile(99)),
+		Max:   ToMillis(h.max)}
+}
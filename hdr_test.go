@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// HDRヒストグラムのパーセンタイルの、許容する相対誤差
+const hdrTestTolerance = 0.005
+
+func TestHdrBucketRange(t *testing.T) {
+	for _, value := range []int64{0, 1, 255, 256, 257, 511, 512, 1000, 123456, 987654321, int64(time.Minute)} {
+		low, width := hdrBucketRange(hdrBucketIndex(value))
+		if value < low || value >= low+width {
+			t.Errorf("value %d is out of the bucket [%d, %d)", value, low, low+width)
+		}
+		// バケットの幅は、値の 1/128 以下となる。
+		if value >= int64(HDR_SUB_BUCKET_COUNT) && float64(width)/float64(low) > 1.0/128 {
+			t.Errorf("bucket of %d : width %d is too wide for %d", value, width, low)
+		}
+	}
+}
+
+func TestHdrHistogramPercentiles(t *testing.T) {
+	// 100µs - 数秒に広がる、裾の長い対数正規分布
+	random := rand.New(rand.NewSource(1))
+	histogram := NewHdrHistogram()
+	exact := make([]time.Duration, 0, 1000000)
+	for i := 0; i < 1000000; i++ {
+		d := time.Duration(math.Exp(random.NormFloat64()*1.5) * float64(2*time.Millisecond))
+		histogram.Record(d)
+		exact = append(exact, d)
+	}
+	sort.Slice(exact, func(i, j int) bool { return exact[i] < exact[j] })
+
+	for _, p := range []float64{1, 50, 90, 99, 99.9, 99.99, 100} {
+		expected := Percentile(exact, p)
+		value := histogram.ValueAtPercentile(p)
+		if math.Abs(float64(value-expected))/float64(expected) > hdrTestTolerance {
+			t.Errorf("p%v = %s, exact %s", p, value, expected)
+		}
+	}
+	stats := histogram.Stats()
+	if histogram.Count() != len(exact) || stats.Min != ToMillis(exact[0]) || stats.Max != ToMillis(exact[len(exact)-1]) {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// 件数に関わらず、バケット数は値の範囲のみで決まる。
+	if buckets := len(histogram.counts); buckets > (64-int(HDR_SUB_BUCKET_BITS)+2)*HDR_SUB_BUCKET_HALF {
+		t.Errorf("buckets = %d", buckets)
+	}
+	if allocs := testing.AllocsPerRun(1000, func() { histogram.Record(3 * time.Millisecond) }); allocs != 0 {
+		t.Errorf("allocs per record = %v, want 0", allocs)
+	}
+}
+
+func TestHdrHistogramMerge(t *testing.T) {
+	first, second, all := NewHdrHistogram(), NewHdrHistogram(), NewHdrHistogram()
+	for i, d := range shuffledMillis(1, 1000) {
+		if i%2 == 0 {
+			first.Record(d)
+		} else {
+			second.Record(d)
+		}
+		all.Record(d)
+	}
+	first.Merge(second)
+	first.Merge(NewHdrHistogram())
+	if *first.Stats() != *all.Stats() || first.ValueAtPercentile(99.9) != all.ValueAtPercentile(99.9) {
+		t.Errorf("merged = %+v, want %+v", first.Stats(), all.Stats())
+	}
+}
+
+func TestHdrLatencyRecorder(t *testing.T) {
+	exact, hdr := NewLatencyRecorder(), NewHdrLatencyRecorder()
+	for i, d := range shuffledMillis(1, 5000) {
+		qos := byte(i % 3)
+		exact.Record(qos, d)
+		hdr.Record(qos, d)
+	}
+
+	// サンプルは保持せず、パーセンタイルはヒストグラムから算出する。
+	if durations := hdr.Durations(); len(durations) != 0 {
+		t.Errorf("hdr recorder kept %d samples", len(durations))
+	}
+	percentiles := []float64{50, 99, 99.9}
+	expected, values := exact.Percentiles(percentiles), hdr.Percentiles(percentiles)
+	for i := range percentiles {
+		if math.Abs(values[i].Value-expected[i].Value)/expected[i].Value > hdrTestTolerance {
+			t.Errorf("p%v = %.3fms, exact %.3fms", percentiles[i], values[i].Value, expected[i].Value)
+		}
+	}
+	stats := hdr.Stats()
+	if stats.Count != 5000 || stats.Min != 1 || stats.Max != 5000 || math.Abs(stats.Avg-2500.5) > 1e-6 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if byQos := hdr.StatsByQos(); len(byQos) != 3 || byQos[0].Count+byQos[1].Count+byQos[2].Count != 5000 {
+		t.Errorf("stats by QoS = %+v", byQos)
+	}
+	if threshold := hdr.Threshold(4000 * time.Millisecond); threshold.Exceeded < 990 || threshold.Exceeded > 1000 || threshold.Total != 5000 {
+		t.Errorf("threshold = %+v", threshold)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// ヒストグラムの区間の数
+const HISTOGRAM_BUCKETS int = 10
+
+// ヒストグラムの最大の棒の長さ(文字数)
+const HISTOGRAM_BAR_WIDTH int = 40
+
+// ヒストグラムの1区間
+type HistogramBucket struct {
+	Low   float64 `json:"low"`   // 区間の下限(この値を含む)
+	High  float64 `json:"high"`  // 区間の上限(最後の区間のみこの値を含む)
+	Count int     `json:"count"` // 区間に含まれるサンプル数
+}
+
+// 所要時間のサンプルから、ミリ秒単位のヒストグラムを作成する。
+//   durations : サンプル
+//   buckets   : 区間の数
+func CalcHistogram(durations []time.Duration, buckets int) []HistogramBucket {
+	values := make([]float64, len(durations))
+	for i, d := range durations {
+		values[i] = ToMillis(d)
+	}
+	return CalcValueHistogram(values, buckets)
+}
+
+// 最小値から最大値までを等分した区間で、ヒストグラムを作成する。
+// 全てのサンプルが同じ値の場合は、1区間のみとなる。サンプルが存在しない場合は nil を返す。
+//   values  : サンプル
+//   buckets : 区間の数
+func CalcValueHistogram(values []float64, buckets int) []HistogramBucket {
+	if len(values) == 0 || buckets < 1 {
+		return nil
+	}
+
+	min, max := values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	if min == max {
+		return []HistogramBucket{{Low: min, High: max, Count: len(values)}}
+	}
+
+	width := (max - min) / float64(buckets)
+	histogram := make([]HistogramBucket, buckets)
+	for i := range histogram {
+		histogram[i].Low = min + width*float64(i)
+		histogram[i].High = min + width*float64(i+1)
+	}
+	histogram[buckets-1].High = max
+
+	for _, v := range values {
+		i := int((v - min) / width)
+		if i >= buckets {
+			i = buckets - 1
+		}
+		histogram[i].Count++
+	}
+	return histogram
+}
+
+// ヒストグラムを、区間毎の棒グラフの形式で出力する。
+// 棒の長さは、最もサンプル数の多い区間を最大の長さとした比率となる。
+//   unit : 区間の値の単位（例 : ms）
+func RenderHistogram(w io.Writer, histogram []HistogramBucket, unit string) {
+	peak := 0
+	for _, b := range histogram {
+		if b.Count > peak {
+			peak = b.Count
+		}
+	}
+
+	for _, b := range histogram {
+		bar := 0
+		if peak > 0 {
+			bar = b.Count * HISTOGRAM_BAR_WIDTH / peak
+		}
+		if b.Count > 0 && bar == 0 {
+			bar = 1
+		}
+		fmt.Fprintf(w, "  %10.3f - %10.3f %s | %-*s %d\n", b.Low, b.High, unit, HISTOGRAM_BAR_WIDTH, strings.Repeat("#", bar), b.Count)
+	}
+}
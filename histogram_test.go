@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCalcHistogram(t *testing.T) {
+	// TLSの再開(約10ms)と、フルハンドシェイク(約50ms)の2峰性の分布
+	var durations []time.Duration
+	for _, ms := range []int{10, 10, 11, 12, 10, 50, 52, 50, 60} {
+		durations = append(durations, time.Duration(ms)*time.Millisecond)
+	}
+	histogram := CalcHistogram(durations, 5)
+	expected := []HistogramBucket{
+		{Low: 10, High: 20, Count: 5},
+		{Low: 20, High: 30, Count: 0},
+		{Low: 30, High: 40, Count: 0},
+		{Low: 40, High: 50, Count: 0},
+		{Low: 50, High: 60, Count: 4}} // 最後の区間のみ上限を含む
+	if len(histogram) != len(expected) {
+		t.Fatalf("buckets = %d, want %d", len(histogram), len(expected))
+	}
+	for i := range expected {
+		if histogram[i] != expected[i] {
+			t.Errorf("bucket %d = %+v, want %+v", i, histogram[i], expected[i])
+		}
+	}
+
+	same := CalcHistogram([]time.Duration{time.Millisecond, time.Millisecond}, 5)
+	if len(same) != 1 || same[0].Count != 2 {
+		t.Errorf("same samples = %+v", same)
+	}
+	if CalcHistogram(nil, 5) != nil {
+		t.Error("empty samples returned a histogram")
+	}
+
+	var output bytes.Buffer
+	RenderHistogram(&output, histogram, "ms")
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("lines = %d : %s", len(lines), output.String())
+	}
+	// 最もサンプル数の多い区間が、最大の長さの棒となる。
+	if bars := strings.Count(lines[0], "#"); bars != HISTOGRAM_BAR_WIDTH {
+		t.Errorf("peak bar = %d, want %d", bars, HISTOGRAM_BAR_WIDTH)
+	}
+	if bars := strings.Count(lines[4], "#"); bars != 4*HISTOGRAM_BAR_WIDTH/5 {
+		t.Errorf("bar = %d, want %d", bars, 4*HISTOGRAM_BAR_WIDTH/5)
+	}
+	if strings.Contains(lines[1], "#") {
+		t.Errorf("empty bucket has a bar : %s", lines[1])
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// 実行結果の出力形式
+const (
+	OUTPUT_TEXT     string = "text"     // テキスト（デフォルト）
+	OUTPUT_MARKDOWN string = "markdown" // テキストに加えて、Markdownの表を出力する
+)
+
+// Markdownの表の1行を出力する。
+// 表の区切りとなる '|' は、エスケープする。
+func writeMarkdownRow(w io.Writer, cells ...string) {
+	escaped := make([]string, len(cells))
+	for i, cell := range cells {
+		escaped[i] = strings.Replace(cell, "|", "\\|", -1)
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(escaped, " | "))
+}
+
+// Markdownの表のヘッダー行と、区切り行を出力する。
+func writeMarkdownHeader(w io.Writer, headers ...string) {
+	writeMarkdownRow(w, headers...)
+	separators := make([]string, len(headers))
+	for i := range separators {
+		separators[i] = "---"
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(separators, " | "))
+}
+
+// 応答時間の統計値を、p50/p95/p99 の文字列に整形する（統計値がない場合は "-"）。
+func markdownLatency(stats *LatencyStats) string {
+	if stats == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f / %.3f / %.3f", stats.P50, stats.P95, stats.P99)
+}
+
+// 実行結果を、Markdownの表で出力する。
+func WriteMarkdownResult(w io.Writer, result *Result) {
+	fmt.Fprintf(w, "\n")
+	writeMarkdownHeader(w, "Metric", "Value")
+	writeMarkdownRow(w, "Broker", result.Broker)
+	writeMarkdownRow(w, "Clients", fmt.Sprint(result.ClientNum))
+	writeMarkdownRow(w, "Total count", fmt.Sprint(result.TotalCount))
+	writeMarkdownRow(w, "Duration (ms)", fmt.Sprint(result.Duration))
+	writeMarkdownRow(w, "Throughput (msg/sec)", fmt.Sprintf("%.2f", result.Throughput))
+	if result.Latency != nil {
+		writeMarkdownRow(w, "Latency p50 / p95 / p99 (ms)", markdownLatency(result.Latency))
+	}
+	if result.E2ELatency != nil {
+		writeMarkdownRow(w, "End-to-end latency p50 / p95 / p99 (ms)", markdownLatency(result.E2ELatency))
+	}
+	if result.Published > 0 {
+		writeMarkdownRow(w, "Published", fmt.Sprint(result.Published))
+	}
+	if result.TlsVersion != "" {
+		writeMarkdownRow(w, "TLS", result.TlsVersion)
+	}
+}
+
+// 組み合わせ条件毎の実行結果を、Markdownの表で出力する。
+func WriteMarkdownMatrix(w io.Writer, rows []MatrixRow) {
+	fmt.Fprintf(w, "\n")
+	writeMarkdownHeader(w, "clients", "size", "qos", "totalCount", "duration(ms)", "throughput(msg/sec)", "p50 / p95 / p99 (ms)")
+	for _, row := range rows {
+		if row.Result == nil {
+			writeMarkdownRow(w, fmt.Sprint(row.ClientNum), fmt.Sprint(row.MessageSize), fmt.Sprint(row.Qos), "-", "-", "connect error", "-")
+			continue
+		}
+		writeMarkdownRow(w, fmt.Sprint(row.ClientNum), fmt.Sprint(row.MessageSize), fmt.Sprint(row.Qos),
+			fmt.Sprint(row.Result.TotalCount), fmt.Sprint(row.Result.Duration),
+			fmt.Sprintf("%.2f", row.Result.Throughput), markdownLatency(row.Result.Latency))
+	}
+}
+
+// Broker毎の実行結果を、Markdownの比較表で出力する。
+func WriteMarkdownCompare(w io.Writer, brokers []string, results []*Result) {
+	fmt.Fprintf(w, "\n")
+	writeMarkdownHeader(w, "broker", "throughput(msg/sec)", "p50 / p95 / p99 (ms)")
+	for i, result := range results {
+		if result == nil {
+			writeMarkdownRow(w, brokers[i], "connect error", "-")
+			continue
+		}
+		writeMarkdownRow(w, brokers[i], fmt.Sprintf("%.2f", result.Throughput), markdownLatency(result.Latency))
+	}
+}
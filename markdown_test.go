@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Markdownの表の行を、セルの一覧に分割する。表の行でない場合は nil を返す。
+func parseMarkdownRow(line string) []string {
+	if strings.HasPrefix(line, "| ") == false || strings.HasSuffix(line, " |") == false {
+		return nil
+	}
+	return strings.Split(line[2:len(line)-2], " | ")
+}
+
+// 出力が、ヘッダー行、区切り行、列数の揃ったデータ行からなる1つの表であることを確認し、セルを返す。
+func parseMarkdownTable(t *testing.T, output string) [][]string {
+	t.Helper()
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("not a table :\n%s", output)
+	}
+	var rows [][]string
+	for i, line := range lines {
+		cells := parseMarkdownRow(line)
+		if cells == nil || (len(rows) > 0 && len(cells) != len(rows[0])) {
+			t.Fatalf("invalid row %d : %q", i, line)
+		}
+		if i == 1 {
+			for _, cell := range cells {
+				if cell != "---" {
+					t.Fatalf("invalid separator : %q", line)
+				}
+			}
+			continue
+		}
+		rows = append(rows, cells)
+	}
+	return rows
+}
+
+func TestWriteMarkdownResult(t *testing.T) {
+	result := &Result{
+		Broker:     "tcp://a|b:1883",
+		ClientNum:  10,
+		TotalCount: 1000,
+		Duration:   500,
+		Throughput: 2000,
+		Latency:    &LatencyStats{P50: 1.5, P95: 2.25, P99: 3}}
+	var output bytes.Buffer
+	WriteMarkdownResult(&output, result)
+
+	rows := parseMarkdownTable(t, output.String())
+	expected := [][]string{
+		{"Metric", "Value"},
+		{"Broker", "tcp://a\\|b:1883"},
+		{"Clients", "10"},
+		{"Total count", "1000"},
+		{"Duration (ms)", "500"},
+		{"Throughput (msg/sec)", "2000.00"},
+		{"Latency p50 / p95 / p99 (ms)", "1.500 / 2.250 / 3.000"}}
+	if len(rows) != len(expected) {
+		t.Fatalf("rows = %q, want %q", rows, expected)
+	}
+	for i := range expected {
+		if strings.Join(rows[i], ",") != strings.Join(expected[i], ",") {
+			t.Errorf("row %d = %q, want %q", i, rows[i], expected[i])
+		}
+	}
+}
+
+func TestWriteMarkdownMatrix(t *testing.T) {
+	var output bytes.Buffer
+	WriteMarkdownMatrix(&output, []MatrixRow{
+		{ClientNum: 1, MessageSize: 100, Qos: 0, Result: &Result{TotalCount: 10, Duration: 20, Throughput: 500}},
+		{ClientNum: 2, MessageSize: 100, Qos: 1}})
+
+	rows := parseMarkdownTable(t, output.String())
+	if len(rows) != 3 || rows[0][0] != "clients" || rows[0][5] != "throughput(msg/sec)" {
+		t.Fatalf("rows = %q", rows)
+	}
+	if strings.Join(rows[1], ",") != "1,100,0,10,20,500.00,-" {
+		t.Errorf("row = %q", rows[1])
+	}
+	if rows[2][5] != "connect error" {
+		t.Errorf("row of a connect error = %q", rows[2])
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ベンチマークの組み合わせ条件
+// 指定されていない項目は、実行オプションの値のみを利用する。
+type Matrix struct {
+	ClientNums   []int  // クライアント数の一覧
+	MessageSizes []int  // メッセージサイズの一覧
+	Qoss         []byte // QoSの一覧
+}
+
+// 組み合わせ条件が1つも指定されていないかどうかを返す。
+func (m Matrix) IsEmpty() bool {
+	return len(m.ClientNums) == 0 && len(m.MessageSizes) == 0 && len(m.Qoss) == 0
+}
+
+// 組み合わせ条件の1行分の実行結果
+type MatrixRow struct {
+	ClientNum   int     // クライアント数
+	MessageSize int     // メッセージサイズ
+	Qos         byte    // QoS
+	Result      *Result // 実行結果（接続エラーの場合は nil）
+}
+
+// カンマ区切りの組み合わせ条件を解析する。
+//   clientsList : クライアント数の一覧
+//   sizeList    : メッセージサイズの一覧
+//   qosList     : QoSの一覧
+func ParseMatrix(clientsList string, sizeList string, qosList string) (Matrix, error) {
+	matrix := Matrix{}
+
+	clientNums, err := ParseIntList(clientsList, 1, -1)
+	if err != nil {
+		return matrix, fmt.Errorf("-clients-list -> %s", clientsList)
+	}
+	sizes, err := ParseIntList(sizeList, 0, -1)
+	if err != nil {
+		return matrix, fmt.Errorf("-size-list -> %s", sizeList)
+	}
+	qoss, err := ParseIntList(qosList, 0, 2)
+	if err != nil {
+		return matrix, fmt.Errorf("-qos-list -> %s", qosList)
+	}
+
+	matrix.ClientNums = clientNums
+	matrix.MessageSizes = sizes
+	for _, q := range qoss {
+		matrix.Qoss = append(matrix.Qoss, byte(q))
+	}
+	return matrix, nil
+}
+
+// カンマ区切りの整数の一覧を解析する。
+//   list : カンマ区切りの整数の一覧（空の場合は空の一覧を返す）
+//   min  : 許容する最小値
+//   max  : 許容する最大値（負数の場合は上限なし）
+func ParseIntList(list string, min int, max int) ([]int, error) {
+	var values []int
+	if list == "" {
+		return values, nil
+	}
+
+	for _, v := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		if n < min || (max >= 0 && n > max) {
+			return nil, fmt.Errorf("out of range : %d", n)
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+// 組み合わせ条件の全ての組み合わせについて、順に実行する。
+func RunMatrix(exec ExecFunc, opts ExecOptions, matrix Matrix) []MatrixRow {
+	clientNums := matrix.ClientNums
+	if len(clientNums) == 0 {
+		clientNums = []int{opts.ClientNum}
+	}
+	sizes := matrix.MessageSizes
+	if len(sizes) == 0 {
+		sizes = []int{opts.MessageSize}
+	}
+	qoss := matrix.Qoss
+	if len(qoss) == 0 {
+		qoss = []byte{opts.Qos}
+	}
+
+	var rows []MatrixRow
+	for _, clientNum := range clientNums {
+		for _, size := range sizes {
+			for _, qos := range qoss {
+				fmt.Printf("\n=== Matrix : clients=%d, size=%d, qos=%d\n", clientNum, size, qos)
+
+				runOpts := opts
+				runOpts.ClientNum = clientNum
+				runOpts.MessageSize = size
+				runOpts.Qos = qos
+
+				rows = append(rows, MatrixRow{
+					ClientNum:   clientNum,
+					MessageSize: size,
+					Qos:         qos,
+					Result:      Execute(exec, runOpts)})
+			}
+		}
+	}
+	return rows
+}
+
+// 組み合わせ条件毎の実行結果を、表形式で出力する。
+func PrintMatrix(rows []MatrixRow) {
+	fmt.Printf("\nMatrix :\n")
+	fmt.Printf("%8s %8s %4s %12s %12s %20s\n", "clients", "size", "qos", "totalCount", "duration(ms)", "throughput(msg/sec)")
+	for _, row := range rows {
+		if row.Result == nil {
+			fmt.Printf("%8d %8d %4d %12s %12s %20s\n", row.ClientNum, row.MessageSize, row.Qos, "-", "-", "connect error")
+			continue
+		}
+		fmt.Printf("%8d %8d %4d %12d %12d %20.2f\n", row.ClientNum, row.MessageSize, row.Qos,
+			row.Result.TotalCount, row.Result.Duration, row.Result.Throughput)
+	}
+}
+
+// 組み合わせ条件毎の実行結果を、JSON Lines形式でファイルへ出力する。
+// 接続エラーとなった組み合わせは出力しない。
+func WriteMatrixJsonl(filePath string, rows []MatrixRow) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, row := range rows {
+		if row.Result == nil {
+			continue
+		}
+		if err := encoder.Encode(row.Result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 2つのBrokerに対して、同じ条件で順に実行し、実行結果を返す。
+// 接続エラーとなったBrokerの実行結果は nil となる。
+func RunCompare(exec ExecFunc, opts ExecOptions, brokers []string) []*Result {
+	results := make([]*Result, len(brokers))
+	for i, broker := range brokers {
+		fmt.Printf("\n=== Compare : broker=%s\n", broker)
+
+		runOpts := opts
+		runOpts.Broker = broker
+		results[i] = Execute(exec, runOpts)
+	}
+	return results
+}
+
+// Broker毎の実行結果を、比較表の形式で出力する。
+func PrintCompare(brokers []string, results []*Result) {
+	fmt.Printf("\nCompare :\n")
+	fmt.Printf("%-32s %20s %10s %10s %10s\n", "broker", "throughput(msg/sec)", "p50(ms)", "p95(ms)", "p99(ms)")
+	for i, result := range results {
+		if result == nil {
+			fmt.Printf("%-32s %20s %10s %10s %10s\n", brokers[i], "connect error", "-", "-", "-")
+			continue
+		}
+		if result.Latency == nil {
+			fmt.Printf("%-32s %20.2f %10s %10s %10s\n", brokers[i], result.Throughput, "-", "-", "-")
+			continue
+		}
+		fmt.Printf("%-32s %20.2f %10.3f %10.3f %10.3f\n", brokers[i], result.Throughput,
+			result.Latency.P50, result.Latency.P95, result.Latency.P99)
+	}
+}
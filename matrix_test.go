@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunMatrixRows(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	matrix, err := ParseMatrix("1,3", "10,100", "0,1,2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 接続されたクライアント数と、実行時の条件を記録する。
+	type run struct {
+		clients int
+		size    int
+		qos     byte
+	}
+	var runs []run
+	exec := func(ctx context.Context, clients []MQTT.Client, opts ExecOptions, metrics *Metrics, param ...string) int {
+		runs = append(runs, run{len(clients), opts.MessageSize, opts.Qos})
+		return len(clients)
+	}
+
+	rows := RunMatrix(exec, testExecOptions(broker.URL), matrix)
+	if len(rows) != 2*2*3 || len(runs) != len(rows) {
+		t.Fatalf("rows = %d, runs = %d, want %d", len(rows), len(runs), 2*2*3)
+	}
+	i := 0
+	for _, clientNum := range matrix.ClientNums {
+		for _, size := range matrix.MessageSizes {
+			for _, qos := range matrix.Qoss {
+				row := rows[i]
+				if row.ClientNum != clientNum || row.MessageSize != size || row.Qos != qos {
+					t.Errorf("row %d = %d/%d/%d, want %d/%d/%d", i, row.ClientNum, row.MessageSize, row.Qos, clientNum, size, qos)
+				}
+				if row.Result == nil || row.Result.ClientNum != clientNum || row.Result.MessageSize != size || row.Result.Qos != qos {
+					t.Errorf("row %d result = %+v", i, row.Result)
+				} else if row.Result.TotalCount != clientNum {
+					t.Errorf("row %d total = %d, want %d", i, row.Result.TotalCount, clientNum)
+				}
+				if runs[i] != (run{clientNum, size, qos}) {
+					t.Errorf("run %d = %+v", i, runs[i])
+				}
+				i++
+			}
+		}
+	}
+}
+
+func TestRunCompareTable(t *testing.T) {
+	brokers := []string{
+		startTestBroker(t, &testBroker{}).URL,
+		startTestBroker(t, &testBroker{AckDelay: time.Millisecond}).URL}
+	opts := testExecOptions(brokers[0])
+	opts.Qos = 1
+
+	results := RunCompare(PublishAllClient, opts, brokers)
+	if len(results) != 2 {
+		t.Fatalf("results = %d, want 2", len(results))
+	}
+	for i, result := range results {
+		if result == nil || result.Broker != brokers[i] || result.Latency == nil {
+			t.Fatalf("result %d = %+v", i, result)
+		}
+	}
+
+	output := captureStdout(t, func() { PrintCompare(brokers, results) })
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 4 || strings.Contains(lines[1], "p99(ms)") == false {
+		t.Fatalf("compare table = %q", output)
+	}
+	for i, result := range results {
+		fields := strings.Fields(lines[2+i])
+		expected := []string{
+			brokers[i],
+			fmt.Sprintf("%.2f", result.Throughput),
+			fmt.Sprintf("%.3f", result.Latency.P50),
+			fmt.Sprintf("%.3f", result.Latency.P95),
+			fmt.Sprintf("%.3f", result.Latency.P99)}
+		if reflect.DeepEqual(fields, expected) == false {
+			t.Errorf("row %d = %v, want %v", i, fields, expected)
+		}
+	}
+}
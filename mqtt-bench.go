@@ -2,16 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -19,24 +30,191 @@ const BASE_TOPIC string = "/mqtt-bench/benchmark"
 
 var Debug bool = false
 
+// Broker側のログと照合するために、ClientIDに埋め込む実行毎のID（空の場合は埋め込まない）
+var CorrelationId string = ""
+
 // Apollo用に、Subscribe時のDefaultHandlerの処理結果を保持できるようにする。
 var DefaultHandlerResults []*SubscribeResult
 
 // 実行オプション
 type ExecOptions struct {
-	Broker            string     // Broker URI
-	Qos               byte       // QoS(0|1|2)
-	Retain            bool       // Retain
-	Topic             string     // Topicのルート
-	Username          string     // ユーザID
-	Password          string     // パスワード
-	CertConfig        CertConfig // 認証定義
-	ClientNum         int        // クライアントの同時実行数
-	Count             int        // 1クライアント当たりのメッセージ数
-	MessageSize       int        // 1メッセージのサイズ(byte)
-	UseDefaultHandler bool       // Subscriber個別ではなく、デフォルトのMessageHandlerを利用するかどうか
-	PreTime           int        // 実行前の待機時間(ms)
-	IntervalTime      int        // メッセージ毎の実行間隔時間(ms)
+	Broker                  string               // Broker URI
+	Qos                     byte                 // QoS(0|1|2)
+	Retain                  bool                 // Retain
+	Topic                   string               // Topicのルート
+	Username                string               // ユーザID
+	Password                string               // パスワード
+	CertConfig              CertConfig           // 認証定義
+	ClientNum               int                  // クライアントの同時実行数
+	Count                   int                  // 1クライアント当たりのメッセージ数
+	MessageSize             int                  // 1メッセージのサイズ(byte)
+	UseDefaultHandler       bool                 // Subscriber個別ではなく、デフォルトのMessageHandlerを利用するかどうか
+	PreTime                 int                  // 実行前の待機時間(ms)
+	IntervalTime            int                  // メッセージ毎の実行間隔時間(ms)
+	ReportConnectErrs       bool                 // 接続エラーとなったクライアントの詳細を出力するかどうか
+	ThrottleLatency         int                  // Publishの応答時間がこの値を超えた場合に送信間隔を広げる閾値(ms)
+	UniqueTopicSuffix       bool                 // メッセージ毎に一意なサフィックスをTopicに付与するかどうか
+	ResultWebhook           string               // 実行結果をPOSTするURL
+	SubscribeTimeout        int                  // Subscribe時のメッセージ受信待ちの最大時間(ms)
+	ClientsPerConn          int                  // 1接続当たりに割り当てる論理クライアント数
+	QosMix                  []byte               // クライアント毎に順に割り当てるQoSの一覧
+	ReportQosLatency        bool                 // QoS毎の応答時間を出力するかどうか
+	TlsMinVersion           uint16               // TLSの最小バージョン(0の場合はGoのデフォルト)
+	PayloadTemplate         *template.Template   // ペイロードのテンプレート
+	PayloadEncoding         string               // テンプレートの出力に適用するエンコード方式(raw/cbor/protobuf)
+	TopicFromJson           string               // Topicに利用する、ペイロード(JSON)のフィールドのパス
+	PublishTimeout          time.Duration        // Publishの完了待ちのタイムアウト（応答時間の閾値としても利用する）
+	SizeMin                 int                  // 可変サイズのメッセージの最小サイズ(byte)
+	SizeMax                 int                  // 可変サイズのメッセージの最大サイズ(byte、0の場合は固定サイズ)
+	UsePayloadPool          bool                 // 可変サイズのメッセージのバッファを再利用するかどうか
+	SizeStart               int                  // メッセージ毎に大きくするメッセージの、最初のサイズ(byte)
+	SizeStep                int                  // メッセージ毎に大きくするサイズ(byte、0の場合はランダムな可変サイズ)
+	ConnectOptions          []ClientOptionSetter // 接続時に追加で反映するClientOptionsの設定
+	FailOnConnLost          bool                 // 計測中に接続断が発生した場合に、実行を中断して失敗とするかどうか
+	ReportJitter            bool                 // Subscribeでのメッセージの到着間隔のばらつきを出力するかどうか
+	IdleHold                time.Duration        // 接続後に、送受信せずに接続を維持する時間（0の場合は維持しない）
+	ReportReceiveGap        bool                 // Subscribeでのメッセージの最大の到着間隔を出力するかどうか
+	DuplicateKeyRatio       float64              // Publish/Subscribeを同時に行う場合に、冪等性キーを重複させるメッセージの割合(0-1)
+	StoreDir                string               // メッセージを永続化するファイルストアのディレクトリ（空の場合はメモリストア）
+	StallTimeout            time.Duration        // 進捗が止まったとみなし、goroutineのスタックを出力するまでの時間
+	StallAbort              bool                 // 進捗が止まった場合に、実行を中断するかどうか
+	VerifyExactlyOnce       bool                 // QoS 2のメッセージを1度だけ受信したことを検証するかどうか
+	DrainTimeout            time.Duration        // 受信終了後に、バッファされたメッセージを処理するまでの最大待機時間
+	TopicsPerClient         int                  // クライアント毎に順に切り替えるTopic数（0の場合はクライアント毎に1つ）
+	Qos0FlushWait           bool                 // QoS 0のPublishを完了待ちせずに送信し、計測の終了前に全ての送信完了を待つかどうか
+	ReportConnReuse         bool                 // 再接続の回数や接続時間などの、接続の安定性を出力するかどうか
+	PubRate                 float64              // Publish/Subscribeを同時に行う場合の、1クライアント当たりの送信レート(messages/sec、0の場合は制限なし)
+	ConsumerDelay           int                  // Publish/Subscribeを同時に行う場合の、受信メッセージ毎の処理時間(ms)
+	WarnOnClockSkew         bool                 // 送信から受信までの時間を計測し、時計のずれを検出した場合に警告するかどうか
+	RelativeLatency         bool                 // 送信から受信までの時間を、送信元毎の最初のメッセージからの相対時間で計測するかどうか
+	GlobalRate              float64              // 全クライアント合計の送信レート(messages/sec、0の場合は制限なし)
+	ReportSubLatency        bool                 // 接続とSubscribeの所要時間を、それぞれ出力するかどうか
+	HmacKey                 []byte               // メッセージに署名を付与し、受信時に検証する共有鍵（nil の場合は署名しない）
+	TimeseriesFile          string               // スループットの時系列を追記するファイル(CSV)
+	SampleInterval          time.Duration        // スループットの時系列を記録する間隔
+	DisconnectErrs          int                  // クライアント毎のPublishのエラー数がこの値を超えた場合に、そのクライアントを切り離す閾値（0の場合は切り離さない）
+	PasswordProvider        PasswordProvider     // 接続の都度、パスワードを取得する関数（nil の場合は Password を利用する）
+	VerifyOrdering          bool                 // Publish/Subscribeを同時に行う場合に、送信の途中で再接続し、再接続をまたいだ順序を検証するかどうか
+	ReportEffectiveQos      bool                 // Subscribe時に要求したQoSと、SUBACKで付与されたQoSの内訳を出力するかどうか
+	ConsumeRate             float64              // Subscriber毎の受信メッセージの処理レート(messages/sec、0の場合は制限なし)
+	ReportMaxInflight       bool                 // 送信中（完了待ち）のメッセージ数の最大値を出力するかどうか
+	WildcardFilters         int                  // Publish/Subscribeを同時に行う場合に、クライアント毎にSubscribeする '+' を含むTopic Filter数（0の場合は利用しない）
+	WildcardDepth           int                  // ワイルドカードの負荷試験で利用する、Topicの階層の深さ
+	ReportQos0Drops         bool                 // Publish/Subscribeを同時に行う場合に、QoS 0のメッセージの破棄の推定値を出力するかどうか
+	ReportSampleStats       bool                 // 間隔毎のスループットの平均、標準偏差と95%信頼区間を出力するかどうか
+	NoRetryOn               []string             // 接続断の際に、再接続せずに実行を失敗とするエラーの部分文字列の一覧
+	BinaryPayload           []byte               // 送信するバイナリのペイロード（nil の場合は固定サイズのメッセージ）
+	ReportConnBreakdown     bool                 // 接続の所要時間を、TCPの接続、TLSのハンドシェイク、MQTTのCONNECTに分けて出力するかどうか
+	ConnectBreakdown        *BreakdownRecorder   // 接続の所要時間の内訳の記録先（nil の場合は記録しない）
+	QosPerSubscription      bool                 // 複数のTopic FilterをSubscribeする場合に、Subscription毎にQoSを0,1,2の順に割り当てるかどうか
+	ReportSecondBuckets     bool                 // 1秒毎のメッセージ数を、実行結果(JSON)に含めるかどうか
+	ReportWindowLatency     bool                 // 間隔毎のPublishの応答時間のパーセンタイルを出力するかどうか
+	ObserveConnectRate      bool                 // 接続フェーズで、Brokerの接続の受け付けレートと制限の開始を観測するかどうか
+	ConnectBatchSize        int                  // 休止を挟まずに連続して接続する数（0の場合は休止しない）
+	ConnectBatchPause       time.Duration        // 連続して接続する毎に休止する時間
+	TopicLatencyTop         int                  // Topic毎の応答時間を出力する、送信数の多い上位のTopic数（0の場合は出力しない）
+	DisconnectTimeout       time.Duration        // 終了時の接続毎の切断の最大待機時間（0の場合は完了まで待つ）
+	ReportErrorRate         bool                 // スループットの時系列に、間隔毎のPublishのエラー数を出力するかどうか
+	OrderingKeys            int                  // Publish/Subscribeを同時に行う場合に、メッセージに順に割り当てる順序キーの数（0の場合は利用しない）
+	ConnectJitter           time.Duration        // 接続毎に、接続前にランダムに待機する最大時間（0の場合は待機しない）
+	ReportBytes             bool                 // Publishしたペイロードと、プロトコルのオーバーヘッドのバイト数を出力するかどうか
+	UnsubscribeOnExit       bool                 // 終了時に、切断する前にSubscribeした全てのTopic FilterをUnsubscribeするかどうか
+	ReportConnHistogram     bool                 // 接続の所要時間のヒストグラムを出力するかどうか
+	ReportClientRates       bool                 // クライアント毎の送受信レートのヒストグラムを出力するかどうか
+	ConnectErrorsJson       bool                 // 接続に失敗した場合に、接続エラーの一覧をJSON形式で出力するかどうか
+	ResultSamples           bool                 // 実行結果のファイルに、応答時間の全てのサンプルを含めるかどうか
+	DrainOnSignal           bool                 // SIGINT/SIGTERMで、送信中のメッセージの完了を待ってから終了するかどうか
+	DrainTimeoutOnSignal    time.Duration        // シグナルの受信後に、送信中のメッセージの完了を待つ最大時間
+	ReportE2EHistogram      bool                 // Publish/Subscribeを同時に行う場合に、送信から受信までの時間のヒストグラムを出力するかどうか
+	TlsResumptionTest       bool                 // プローブ接続で、TLSのセッション再開の状況を確認するかどうか
+	Percentiles             []float64            // Publishの応答時間について、追加で出力するパーセンタイルの一覧
+	ReportMad               bool                 // Publishの応答時間の中央絶対偏差を出力するかどうか
+	WarmupThreshold         float64              // スループットの変動係数がこの値を下回るまでウォームアップする閾値（0の場合は固定時間の待機）
+	WarmupMaxTime           time.Duration        // 適応的なウォームアップの最大時間
+	TargetConfidence        float64              // スループットの95%信頼区間の半値幅が、平均に対してこの比率以下になった時点で終了する（0の場合は終了しない）
+	TargetConfidenceMaxTime time.Duration        // 信頼区間による終了を待つ最大時間
+	ReportConnCount         bool                 // スループットの時系列に、接続中の接続数を出力するかどうか
+	RandomSuffix            int                  // ペイロードの末尾をランダムな英数字にするバイト数（0の場合はランダムにしない）
+	ResultDir               string               // 実行結果のファイルを書き込む共有ディレクトリ（空の場合は書き込まない）
+	ConnectStressRate       float64              // 接続と切断を繰り返す場合の、全クライアント合計の接続レート(connects/sec、0の場合は制限なし)
+	OutlierNum              int                  // 出力する、応答時間の遅い上位のPublishの数（0の場合は出力しない）
+	ValidateTopicMatch      bool                 // 受信したメッセージのTopicが、Subscribeした Topic Filter に一致するかを検証するかどうか
+	LatencyBackend          string               // Publishの応答時間の記録方式（exact または hdr）
+	ReportGcPause           bool                 // GCの停止時間と、Publishの応答時間の急増との相関を出力するかどうか
+	ResultChecksum          bool                 // 実行結果のファイルとWebhookに、実行結果(JSON)のSHA-256を付与するかどうか
+	ReportQos2Flow          bool                 // プローブ接続で、Subscribe側のQoS 2のフローの所要時間を計測するかどうか
+	DialTimeout             time.Duration        // BrokerへのTCP接続（TLSの場合はハンドシェイクを含む）のタイムアウト（0の場合はpahoのデフォルト）
+	MqttConnectTimeout      time.Duration        // CONNECTの送信後、CONNACKを待つタイムアウト（0の場合は完了まで待つ）
+	WsHeaders               http.Header          // WebSocketのハンドシェイクで送信する、追加のHTTPヘッダー（ws/wssのBrokerのみ）
+	LocalPortRange          *PortRange           // クライアントの接続元のポートの範囲（nil の場合はOSが割り当てる）
+}
+
+// 実行結果(JSON)のスキーマのバージョン
+// フィールドの削除や意味の変更など、互換性のない変更を行う場合に、インクリメントする。
+const RESULT_SCHEMA_VERSION int = 1
+
+// 実行結果
+type Result struct {
+	SchemaVersion int    `json:"schema_version"`           // 実行結果(JSON)のスキーマのバージョン
+	CorrelationId string `json:"correlation_id,omitempty"` // ClientIDに埋め込んだ相関ID
+
+	Broker      string  `json:"broker"`      // Broker URI
+	ClientNum   int     `json:"clients"`     // クライアント数
+	MessageSize int     `json:"size"`        // 1メッセージのサイズ(byte)
+	Qos         byte    `json:"qos"`         // QoS
+	TotalCount  int     `json:"total_count"` // 総メッセージ数
+	Duration    int64   `json:"duration_ms"` // 実行時間(ms)
+	Throughput  float64 `json:"throughput"`  // スループット(messages/sec)
+
+	Latency          *LatencyStats            `json:"latency,omitempty"`                     // Publishの応答時間
+	LatencyPerQos    map[string]*LatencyStats `json:"latency_per_qos,omitempty"`             // QoS毎のPublishの応答時間
+	Percentiles      []PercentileValue        `json:"latency_percentiles,omitempty"`         // 指定されたパーセンタイルのPublishの応答時間
+	LatencyMad       *MadStats                `json:"latency_mad,omitempty"`                 // Publishの応答時間の中央絶対偏差
+	LatencyPerTopic  []TopicLatencyStats      `json:"latency_per_topic,omitempty"`           // 送信数の多い上位のTopic毎のPublishの応答時間
+	Outliers         []LatencyOutlier         `json:"latency_outliers,omitempty"`            // 応答時間の遅い上位のPublish
+	TlsVersion       string                   `json:"tls_version,omitempty"`                 // ネゴシエートされたTLSのバージョン
+	Timeout          *ThresholdStats          `json:"publish_timeout,omitempty"`             // Publishの応答時間がタイムアウトを超えた件数
+	Jitter           *JitterStats             `json:"jitter,omitempty"`                      // Subscribeでのメッセージの到着間隔のばらつき
+	ReceiveGap       *ReceiveGapStats         `json:"receive_gap,omitempty"`                 // Subscribeでのメッセージの最大の到着間隔
+	IdleHold         *IdleHoldStats           `json:"idle_hold,omitempty"`                   // 送受信せずに接続を維持した結果
+	Published        int                      `json:"published,omitempty"`                   // Publish/Subscribeを同時に行う場合の、送信メッセージ数
+	Duplicates       *DuplicateStats          `json:"duplicates,omitempty"`                  // 冪等性キーの重複の検証結果
+	Phases           *PhaseDurations          `json:"phases,omitempty"`                      // フェーズ毎の所要時間
+	ExactlyOnce      *ExactlyOnceStats        `json:"exactly_once,omitempty"`                // QoS 2のexactly-onceの検証結果
+	Connections      *ConnectionStats         `json:"connections,omitempty"`                 // 接続の安定性
+	E2ELatency       *LatencyStats            `json:"e2e_latency,omitempty"`                 // 送信から受信までの時間
+	ClockSkew        *ClockSkewStats          `json:"clock_skew,omitempty"`                  // 時計のずれの検出結果
+	ConnectLatency   *LatencyStats            `json:"connect_latency,omitempty"`             // 接続毎の接続(CONNACK)までの時間
+	SubscribeLatency *LatencyStats            `json:"subscribe_latency,omitempty"`           // クライアント毎のSubscribe(SUBACK)までの時間
+	Signatures       *SignatureStats          `json:"signatures,omitempty"`                  // 受信したメッセージの署名の検証結果
+	DroppedClients   int                      `json:"dropped_clients,omitempty"`             // エラーが閾値を超えたため切り離したクライアント数
+	Ordering         *OrderingStats           `json:"ordering,omitempty"`                    // 再接続をまたいだメッセージの順序の検証結果
+	Qos0Dropped      *int                     `json:"qos0_dropped,omitempty"`                // Publish/Subscribeを同時に行う場合の、受信しなかったQoS 0のメッセージ数
+	MaxInflight      int64                    `json:"max_inflight,omitempty"`                // 送信中（完了待ち）のメッセージ数の最大値
+	Backlog          *BacklogStats            `json:"backlog,omitempty"`                     // 永続セッションに滞留したメッセージの、再接続後の配信結果
+	Qos0DropEstimate *DropEstimate            `json:"qos0_drop_estimate,omitempty"`          // 送信と受信の連番の照合による、QoS 0のメッセージの破棄の推定値
+	WindowThroughput *WindowThroughputStats   `json:"window_throughput,omitempty"`           // 間隔毎のスループットの統計値
+	SecondBuckets    []int64                  `json:"throughput_per_second,omitempty"`       // 1秒毎のメッセージ数
+	WindowLatency    []WindowLatency          `json:"window_latency,omitempty"`              // 間隔毎の応答時間のパーセンタイル
+	Bytes            *BytesStats              `json:"bytes,omitempty"`                       // Publishしたペイロードと、プロトコルのオーバーヘッドのバイト数
+	ConnectHistogram []HistogramBucket        `json:"connect_histogram,omitempty"`           // 接続の所要時間のヒストグラム
+	ClientHistogram  []HistogramBucket        `json:"client_throughput_histogram,omitempty"` // クライアント毎の送受信レートのヒストグラム
+	E2EHistogram     []HistogramBucket        `json:"e2e_histogram,omitempty"`               // 送信から受信までの時間のヒストグラム
+	Auth             *AuthStats               `json:"auth,omitempty"`                        // Publishせずに接続と切断を繰り返した結果
+	Calibration      *CalibrationStats        `json:"calibration,omitempty"`                 // 1クライアントでの、Broker経由の折り返しの応答時間
+	ConnectErrors    []ConnectErrorRecord     `json:"connect_errors,omitempty"`              // 接続エラーの一覧（接続に失敗した場合のみ）
+	LatencySamples   []float64                `json:"latency_samples_ms,omitempty"`          // Publishの応答時間の全てのサンプル(ms、実行結果のファイルのみ)
+	TopicMatch       *TopicMatchStats         `json:"topic_match,omitempty"`                 // 受信したメッセージのTopicと、Topic Filterの照合結果
+	ConnectRate      *ConnectRateStats        `json:"connect_rate,omitempty"`                // Brokerの接続の受け付け状況
+	ConnectBatches   *ConnectBatchStats       `json:"connect_batches,omitempty"`             // 一定数毎に休止を挟んだ接続の結果
+	ConnectBreakdown *ConnectBreakdown        `json:"connect_breakdown,omitempty"`           // 接続の所要時間の内訳
+	TlsResumption    *TlsResumptionStats      `json:"tls_resumption,omitempty"`              // TLSのセッション再開の確認結果
+	Shutdown         *ShutdownStats           `json:"shutdown,omitempty"`                    // シグナルによる中断時の、送信中のメッセージの処理結果
+	Confidence       *ConfidenceStopStats     `json:"confidence_stop,omitempty"`             // スループットの信頼区間による、実行の終了の結果
+	EffectiveQos     []QosGrant               `json:"effective_qos,omitempty"`               // Subscribe時に要求したQoSと、付与されたQoSの内訳
+	GcPause          *GcPauseStats            `json:"gc_pause,omitempty"`                    // GCの停止時間と、Publishの応答時間の急増との相関
+	Qos2Flow         *Qos2FlowStats           `json:"qos2_flow,omitempty"`                   // Subscribe側のQoS 2のフローの所要時間
+	Topology         *TopologyStats           `json:"topology,omitempty"`                    // トポロジーでの配信の検証結果
 }
 
 // 認証設定
@@ -99,64 +277,545 @@ func CreateClientTlsConfig(rootCAFile string, clientCertFile string, clientKeyFi
 	}
 }
 
-// 実行する。
-func Execute(exec func(clients []*MQTT.Client, opts ExecOptions, param ...string) int, opts ExecOptions) {
-	message := CreateFixedSizeMessage(opts.MessageSize)
+// TLSのバージョン名とバージョン値の対応
+var TlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
 
-	// 配列を初期化
-	DefaultHandlerResults = make([]*SubscribeResult, opts.ClientNum)
+// TLSのバージョン値から、バージョン名を返す。
+func TlsVersionName(version uint16) string {
+	for name, v := range TlsVersions {
+		if v == version {
+			return "TLS" + name
+		}
+	}
+	return fmt.Sprintf("unknown(0x%04x)", version)
+}
 
-	clients := make([]*MQTT.Client, opts.ClientNum)
-	hasErr := false
-	for i := 0; i < opts.ClientNum; i++ {
-		client := Connect(i, opts)
-		if client == nil {
-			hasErr = true
-			break
+// 実行オプションから、接続に利用するTLS設定を生成する。
+// TLSを利用しない場合は nil を返す。
+func CreateTlsConfig(execOpts ExecOptions) *tls.Config {
+	var tlsConfig *tls.Config = nil
+	switch c := execOpts.CertConfig.(type) {
+	case ServerCertConfig:
+		tlsConfig = CreateServerTlsConfig(c.ServerCertFile)
+	case ClientCertConfig:
+		tlsConfig = CreateClientTlsConfig(c.RootCAFile, c.ClientCertFile, c.ClientKeyFile)
+	default:
+		// do nothing.
+	}
+
+	if execOpts.TlsMinVersion != 0 {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
 		}
-		clients[i] = client
+		tlsConfig.MinVersion = execOpts.TlsMinVersion
+	}
+
+	return tlsConfig
+}
+
+// WebSocketで接続するBroker URIかどうかを返す。
+func IsWebsocketBroker(broker string) bool {
+	uri, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	return uri.Scheme == "ws" || uri.Scheme == "wss"
+}
+
+// TLSで接続するBroker URIかどうかを返す。
+func IsTlsBroker(broker string) bool {
+	uri, err := url.Parse(broker)
+	if err != nil {
+		return false
+	}
+	switch uri.Scheme {
+	case "ssl", "tls", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// Broker URIから、接続先のアドレス(host:port)を返す。
+// ポートが省略されている場合は、スキームのデフォルトのポート(TCP : 1883、TLS : 8883、ws : 80、wss : 443)を補う。
+func BrokerAddress(uri *url.URL) string {
+	if uri.Port() != "" {
+		return uri.Host
+	}
+	port := "1883"
+	switch uri.Scheme {
+	case "ssl", "tls", "tcps", "mqtts":
+		port = "8883"
+	case "ws":
+		port = "80"
+	case "wss":
+		port = "443"
+	}
+	return net.JoinHostPort(uri.Hostname(), port)
+}
+
+// Brokerに対してTLSのハンドシェイクのみを行い、ネゴシエートされたTLSのバージョンを返す。
+// MQTTクライアントからは接続状態を参照できないため、別の接続で確認する。
+func ProbeTlsVersion(broker string, tlsConfig *tls.Config) (uint16, error) {
+	uri, err := url.Parse(broker)
+	if err != nil {
+		return 0, err
+	}
+
+	config := tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = uri.Hostname()
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", BrokerAddress(uri), config)
+	if err != nil {
+		return 0, err
 	}
+	defer conn.Close()
 
-	// 接続エラーがあれば、接続済みのクライアントの切断処理を行い、処理を終了する。
-	if hasErr {
-		for i := 0; i < len(clients); i++ {
-			client := clients[i]
-			if client != nil {
-				Disconnect(client)
+	return conn.ConnectionState().Version, nil
+}
+
+// 全クライアントに対して実行する処理
+// 実行中に ctx がキャンセルされた場合は、処理を中断する。
+// 処理したメッセージ数を返す。
+type ExecFunc func(ctx context.Context, clients []MQTT.Client, opts ExecOptions, metrics *Metrics, param ...string) int
+
+// 計測中の接続断を検知し、実行を中断する。
+type ConnectionLostWatcher struct {
+	cancel   context.CancelFunc // 実行を中断する関数
+	watching int32              // 検知中かどうか(1 : 検知中)
+	mutex    sync.Mutex
+	lost     *ConnectError // 最初に接続断となったクライアントの情報
+}
+
+// ConnectionLostWatcherを生成する。
+//   cancel : 接続断を検知した場合に、実行を中断する関数
+func NewConnectionLostWatcher(cancel context.CancelFunc) *ConnectionLostWatcher {
+	return &ConnectionLostWatcher{cancel: cancel}
+}
+
+// 接続断の検知を開始する。
+func (w *ConnectionLostWatcher) Start() {
+	atomic.StoreInt32(&w.watching, 1)
+}
+
+// 接続断の検知を終了する。切断処理による接続断は検知しない。
+func (w *ConnectionLostWatcher) Stop() {
+	atomic.StoreInt32(&w.watching, 0)
+}
+
+// 接続断の発生を通知する。検知中の場合は、実行を中断する。
+func (w *ConnectionLostWatcher) OnLost(id int, err error) {
+	if atomic.LoadInt32(&w.watching) == 0 {
+		return
+	}
+
+	w.mutex.Lock()
+	if w.lost == nil {
+		w.lost = &ConnectError{
+			ClientIndex: id,
+			ClientId:    CreateClientId(id),
+			Err:         err}
+	}
+	w.mutex.Unlock()
+
+	w.cancel()
+}
+
+// エラーが、再接続しない（即座に失敗とする）エラーかどうかを返す。
+// エラーのメッセージに、いずれかの部分文字列が含まれるかを、大文字小文字を区別せずに判定する。
+//   err      : 接続断のエラー
+//   patterns : 再接続しないエラーの部分文字列の一覧
+func IsNonRetryableError(err error, patterns []string) bool {
+	if err == nil {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	for _, pattern := range patterns {
+		if pattern != "" && strings.Contains(message, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 再接続しないエラーで接続断となった接続の、pahoの自動再接続を止める。
+// pahoは、接続断のハンドラと自動再接続を並行して開始するため、再接続の開始時に接続断のエラーの判定を待ち、
+// 再接続しないエラーの場合は、TCP接続の前に再接続を失敗させる（WebSocketの接続は止められない）。
+type ReconnectGate struct {
+	patterns []string // 再接続しないエラーの部分文字列の一覧
+	mutex    sync.Mutex
+	lost     int  // 判定済みの接続断の回数
+	started  int  // 開始した再接続の回数
+	blocked  bool // 再接続しないエラーで接続断となったかどうか
+}
+
+// ReconnectGateを生成する。
+//   patterns : 再接続しないエラーの部分文字列の一覧
+func NewReconnectGate(patterns []string) *ReconnectGate {
+	return &ReconnectGate{patterns: patterns}
+}
+
+// 接続の状態の通知を受け取る。ClientOptions.SetConnectionNotificationHandler に指定する。
+func (g *ReconnectGate) Notify(client MQTT.Client, notification MQTT.ConnectionNotification) {
+	switch n := notification.(type) {
+	case MQTT.ConnectionNotificationLost:
+		g.mutex.Lock()
+		g.lost++
+		if IsNonRetryableError(n.Reason, g.patterns) {
+			g.blocked = true
+		}
+		g.mutex.Unlock()
+	case MQTT.ConnectionNotificationConnecting:
+		if n.IsReconnect == false || n.Attempt > 0 {
+			return
+		}
+		g.mutex.Lock()
+		g.started++
+		started := g.started
+		g.mutex.Unlock()
+
+		// 再接続は、接続断の判定の直前に開始されるため、判定されるまで待機する。
+		deadline := time.Now().Add(RECONNECT_DISCONNECT_WAIT)
+		for time.Now().Before(deadline) {
+			g.mutex.Lock()
+			decided := g.lost >= started
+			g.mutex.Unlock()
+			if decided {
+				return
 			}
+			time.Sleep(time.Millisecond)
 		}
-		return
 	}
+}
 
-	// 安定させるために、一定時間待機する。
-	time.Sleep(time.Duration(opts.PreTime) * time.Millisecond)
+// 再接続しないエラーで接続断となった場合は、TCP接続を失敗させる。net.Dialer.Control に指定する。
+func (g *ReconnectGate) Control(network string, address string, c syscall.RawConn) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.blocked {
+		return errors.New("reconnect is disabled by -no-retry-on")
+	}
+	return nil
+}
 
-	fmt.Printf("%s Start benchmark\n", time.Now())
+// 最初に接続断となったクライアントの情報を返す（接続断がない場合は nil を返す）。
+func (w *ConnectionLostWatcher) Lost() *ConnectError {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.lost
+}
 
-	startTime := time.Now()
-	totalCount := exec(clients, opts, message)
-	endTime := time.Now()
+// 実行する。
+// 実行結果を返す（接続エラーの場合や、実行を中断した場合は nil を返す）。
+func Execute(exec ExecFunc, opts ExecOptions) *Result {
+	benchmark := NewBenchmark(exec, opts)
+	defer benchmark.Close()
+
+	if benchmark.Connect() == false {
+		// 接続エラーの一覧を、後処理で解析できるようにJSON形式で出力し、Webhookへも送信する。
+		if opts.ConnectErrorsJson {
+			result := benchmark.ConnectFailedResult()
+			if body, err := json.Marshal(result.ConnectErrors); err == nil {
+				fmt.Printf("%s\n", body)
+			}
+			if opts.ResultWebhook != "" {
+				if err := PostResult(opts.ResultWebhook, *result, opts.ResultChecksum); err != nil {
+					fmt.Printf("Result webhook error: %s\n", err)
+				}
+			}
+		}
+		return nil
+	}
+	benchmark.Probe()
+	benchmark.IdleHold()
+	benchmark.Warmup()
+	benchmark.Run()
+	benchmark.Teardown()
+
+	result := benchmark.Report()
+	if result == nil {
+		return nil
+	}
+	PrintResult(result)
+
+	// 複数のプロセスの実行結果を集計できるように、共有ディレクトリへ書き込む。
+	if opts.ResultDir != "" {
+		// 集計時に正しいパーセンタイルを算出できるように、ファイルにのみ応答時間のサンプルを含める。
+		fileResult := *result
+		if opts.ResultSamples {
+			fileResult.LatencySamples = LatencySamplesMillis(benchmark.Metrics.PublishLatency.Durations())
+		}
+		if path, err := WriteResultFile(opts.ResultDir, &fileResult, opts.ResultChecksum); err != nil {
+			fmt.Printf("Result file error: %s\n", err)
+		} else {
+			fmt.Printf("Result file : %s\n", path)
+			if opts.ResultChecksum {
+				fmt.Printf("Result checksum file : %s%s\n", path, RESULT_CHECKSUM_SUFFIX)
+			}
+		}
+	}
 
-	fmt.Printf("%s End benchmark\n", time.Now())
+	// 実行結果をWebhookへ送信する。送信に失敗しても、ベンチマーク自体は失敗扱いとしない。
+	if opts.ResultWebhook != "" {
+		if err := PostResult(opts.ResultWebhook, *result, opts.ResultChecksum); err != nil {
+			fmt.Printf("Result webhook error: %s\n", err)
+		}
+	}
 
-	// 切断に時間がかかるため、非同期で処理を行う。
-	AsyncDisconnect(clients)
+	return result
+}
 
-	// 処理結果を出力する。
-	duration := (endTime.Sub(startTime)).Nanoseconds() / int64(1000000) // nanosecond -> millisecond
-	throughput := float64(totalCount) / float64(duration) * 1000        // messages/sec
+// 実行結果を出力する。
+func PrintResult(result *Result) {
 	fmt.Printf("\nResult : broker=%s, clients=%d, totalCount=%d, duration=%dms, throughput=%.2fmessages/sec\n",
-		opts.Broker, opts.ClientNum, totalCount, duration, throughput)
+		result.Broker, result.ClientNum, result.TotalCount, result.Duration, result.Throughput)
+	if result.WindowThroughput != nil {
+		fmt.Printf("Window throughput : %s\n", result.WindowThroughput)
+	}
+	if len(result.WindowLatency) > 0 {
+		fmt.Printf("Window latency :\n")
+		for _, w := range result.WindowLatency {
+			fmt.Printf("  %8dms : count=%d, p50=%.3fms, p95=%.3fms, p99=%.3fms\n", w.Elapsed, w.Count, w.P50, w.P95, w.P99)
+		}
+	}
+	if result.Phases != nil {
+		fmt.Printf("Phases : connect=%dms, warmup=%dms, run=%dms, teardown=%dms\n",
+			result.Phases.Connect, result.Phases.Warmup, result.Phases.Run, result.Phases.Teardown)
+	}
+	if result.DroppedClients > 0 {
+		fmt.Printf("Dropped clients : count=%d/%d\n", result.DroppedClients, result.ClientNum)
+	}
+	if result.Published > 0 {
+		fmt.Printf("Published : count=%d, received=%d\n", result.Published, result.TotalCount)
+	}
+	if result.Qos0Dropped != nil {
+		fmt.Printf("QoS 0 dropped : count=%d\n", *result.Qos0Dropped)
+	}
+	if result.Qos0DropEstimate != nil {
+		fmt.Printf("QoS 0 drop estimate : sent=%d, received=%d, dropped=%d (%.2f%%)\n",
+			result.Qos0DropEstimate.Sent, result.Qos0DropEstimate.Received, result.Qos0DropEstimate.Dropped, result.Qos0DropEstimate.Rate)
+	}
+	if result.Backlog != nil {
+		fmt.Printf("Backlog : published=%d, delivered=%d\n", result.Backlog.Published, result.Backlog.Delivered)
+		if result.Backlog.Latency != nil {
+			fmt.Printf("Backlog latency : %s\n", result.Backlog.Latency)
+		}
+	}
+	if result.Duplicates != nil {
+		fmt.Printf("Duplicates : sent=%d, received=%d, suppressed=%d\n",
+			result.Duplicates.Sent, result.Duplicates.Received, result.Duplicates.Sent-result.Duplicates.Received)
+	}
+	if result.ExactlyOnce != nil {
+		status := "OK"
+		if result.ExactlyOnce.Violated() {
+			status = "VIOLATED"
+		}
+		fmt.Printf("Exactly-once(QoS2) : clients=%d, published=%d, duplicated=%d, missing=%d, %s\n",
+			result.ExactlyOnce.Clients, result.ExactlyOnce.Published, result.ExactlyOnce.Duplicated, result.ExactlyOnce.Missing, status)
+	}
+	if result.Ordering != nil {
+		status := "OK"
+		if result.Ordering.Violated() {
+			status = "VIOLATED"
+		}
+		keys := ""
+		if result.Ordering.Keys > 0 {
+			keys = fmt.Sprintf("keys=%d, ", result.Ordering.Keys)
+		}
+		fmt.Printf("Ordering : reconnects=%d, %sreceived=%d, outOfOrder=%d, %s\n",
+			result.Ordering.Reconnects, keys, result.Ordering.Received, result.Ordering.OutOfOrder, status)
+	}
+	if result.TlsVersion != "" {
+		fmt.Printf("TLS : version=%s\n", result.TlsVersion)
+	}
+	if len(result.EffectiveQos) > 0 {
+		fmt.Printf("Effective QoS : %s\n", FormatQosGrants(result.EffectiveQos))
+	}
+	if result.Signatures != nil {
+		fmt.Printf("Signatures : verified=%d, invalid=%d\n", result.Signatures.Verified, result.Signatures.Invalid)
+	}
+	if result.Connections != nil {
+		fmt.Printf("Connections : %s\n", result.Connections)
+	}
+	if result.Latency != nil {
+		fmt.Printf("Latency : %s\n", result.Latency)
+	}
+	if result.MaxInflight > 0 {
+		fmt.Printf("Max inflight : %d\n", result.MaxInflight)
+	}
+	if result.Timeout != nil {
+		fmt.Printf("Publish timeout : %s\n", result.Timeout)
+	}
+	if len(result.SecondBuckets) > 0 {
+		fmt.Printf("Throughput buckets : %d seconds (included in JSON)\n", len(result.SecondBuckets))
+	}
+	if result.Bytes != nil {
+		fmt.Printf("Bytes : messages=%d, payload=%d, overhead=%d (%.2f%%)\n",
+			result.Bytes.Messages, result.Bytes.Payload, result.Bytes.Overhead, result.Bytes.Ratio)
+	}
+	if len(result.ConnectHistogram) > 0 {
+		fmt.Printf("Connect histogram :\n")
+		RenderHistogram(os.Stdout, result.ConnectHistogram, "ms")
+	}
+	if len(result.ClientHistogram) > 0 {
+		fmt.Printf("Client throughput histogram :\n")
+		RenderHistogram(os.Stdout, result.ClientHistogram, "msg/s")
+	}
+	if result.TopicMatch != nil {
+		status := "OK"
+		if result.TopicMatch.Mismatched > 0 {
+			status = "MISMATCHED (e.g. " + result.TopicMatch.Example + ")"
+		}
+		fmt.Printf("Topic match : checked=%d, mismatched=%d, %s\n", result.TopicMatch.Checked, result.TopicMatch.Mismatched, status)
+	}
+	if result.Calibration != nil {
+		fmt.Printf("Calibration latency : %s\n", result.Calibration)
+	}
+	if result.Auth != nil {
+		fmt.Printf("Auth : cycles=%d, succeeded=%d, authFailures=%d, otherFailures=%d, rate=%.2f/s\n",
+			result.Auth.Cycles, result.Auth.Succeeded, result.Auth.AuthFailures, result.Auth.OtherFailures, result.Auth.Rate)
+	}
+	if result.ConnectRate != nil {
+		fmt.Printf("Connect rate : %s\n", result.ConnectRate)
+	}
+	if result.ConnectBatches != nil {
+		fmt.Printf("Connect batches : %s\n", result.ConnectBatches)
+	}
+	if result.ConnectBreakdown != nil {
+		fmt.Printf("Connect breakdown : %s\n", result.ConnectBreakdown)
+	}
+	if result.TlsResumption != nil {
+		fmt.Printf("TLS resumption : %s\n", result.TlsResumption)
+	}
+	if result.Qos2Flow != nil {
+		fmt.Printf("QoS 2 flow : %s\n", result.Qos2Flow)
+	}
+	if result.Shutdown != nil {
+		fmt.Printf("Interrupted : %s\n", result.Shutdown)
+	}
+	if result.Confidence != nil {
+		fmt.Printf("Confidence stop : %s\n", result.Confidence)
+	}
+	if result.ConnectLatency != nil {
+		fmt.Printf("Connect latency : %s\n", result.ConnectLatency)
+	}
+	if result.SubscribeLatency != nil {
+		fmt.Printf("Subscribe latency : %s\n", result.SubscribeLatency)
+	}
+	if result.E2ELatency != nil {
+		fmt.Printf("End-to-end latency : %s\n", result.E2ELatency)
+	}
+	if len(result.E2EHistogram) > 0 {
+		fmt.Printf("End-to-end latency histogram :\n")
+		RenderHistogram(os.Stdout, result.E2EHistogram, "ms")
+	}
+	if result.ClockSkew != nil {
+		fmt.Printf("Warning : clock skew detected, %d negative latencies (min=%.3fms). Use -relative-latency for cross-host runs.\n",
+			result.ClockSkew.Negative, result.ClockSkew.Min)
+	}
+	if result.Jitter != nil {
+		fmt.Printf("Jitter : %s\n", result.Jitter)
+	}
+	if result.IdleHold != nil {
+		fmt.Printf("Idle hold : %s\n", result.IdleHold)
+	}
+	if result.ReceiveGap != nil {
+		fmt.Printf("Receive gap : %s\n", result.ReceiveGap)
+	}
+	for qos := 0; qos <= 2; qos++ {
+		if stats, ok := result.LatencyPerQos[strconv.Itoa(qos)]; ok {
+			fmt.Printf("Latency(QoS%d) : %s\n", qos, stats)
+		}
+	}
+	if result.LatencyMad != nil {
+		fmt.Printf("Latency MAD : %s\n", result.LatencyMad)
+	}
+	if result.GcPause != nil {
+		fmt.Printf("GC pause : %s\n", result.GcPause)
+	}
+	if len(result.Percentiles) > 0 {
+		fmt.Printf("Latency percentiles : %s\n", FormatPercentiles(result.Percentiles))
+	}
+	for _, stats := range result.LatencyPerTopic {
+		fmt.Printf("Latency(%s) : %s\n", stats.Topic, &stats.LatencyStats)
+	}
+	if len(result.Outliers) > 0 {
+		fmt.Printf("Latency outliers :\n")
+		for _, outlier := range result.Outliers {
+			fmt.Printf("  %s\n", outlier)
+		}
+	}
+}
+
+// Webhookの送信タイムアウト
+const RESULT_WEBHOOK_TIMEOUT time.Duration = 10 * time.Second
+
+// 実行結果のSHA-256を付与する、Webhookのリクエストヘッダー
+const RESULT_CHECKSUM_HEADER string = "X-Result-Checksum"
+
+// 実行結果をJSON形式で、指定されたURLへPOSTする。
+//   url      : 送信先のURL
+//   result   : 実行結果
+//   checksum : 送信するJSONのSHA-256を、X-Result-Checksum ヘッダー(sha256=...)に付与するかどうか
+func PostResult(url string, result Result, checksum bool) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if checksum {
+		request.Header.Set(RESULT_CHECKSUM_HEADER, "sha256="+ResultChecksum(body))
+	}
+
+	client := &http.Client{Timeout: RESULT_WEBHOOK_TIMEOUT}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status : %s", resp.Status)
+	}
+	return nil
 }
 
 // 全クライアントに対して、publishの処理を行う。
 // 送信したメッセージ数を返す（原則、クライアント数分となる）。
-func PublishAllClient(clients []*MQTT.Client, opts ExecOptions, param ...string) int {
+func PublishAllClient(ctx context.Context, clients []MQTT.Client, opts ExecOptions, metrics *Metrics, param ...string) int {
 	message := param[0]
 
 	wg := new(sync.WaitGroup)
 
-	totalCount := 0
+	var pool *PayloadPool = nil
+	if opts.SizeMax > 0 && opts.UsePayloadPool {
+		pool = NewPayloadPool(opts.SizeMax)
+	}
+	// 末尾をランダムにしたペイロードは、Publish毎に確保しないように、別のプールのバッファへ書き込む。
+	var suffixPool *PayloadPool = nil
+	if opts.RandomSuffix > 0 {
+		suffixPool = NewPayloadPool(0)
+	}
+
+	// 全クライアント合計の送信レートを制限する。
+	var bucket *TokenBucket = nil
+	if opts.GlobalRate > 0 {
+		bucket = NewTokenBucket(opts.GlobalRate)
+	}
+
+	var totalCount int64 = 0
 	for id := 0; id < len(clients); id++ {
 		wg.Add(1)
 
@@ -165,66 +824,430 @@ func PublishAllClient(clients []*MQTT.Client, opts ExecOptions, param ...string)
 		go func(clientId int) {
 			defer wg.Done()
 
+			// クライアント毎の送信レートを記録する。
+			published := 0
+			clientStart := time.Now()
+			defer func() {
+				metrics.ClientRates.Record(published, time.Since(clientStart))
+			}()
+
+			qos := ClientQos(opts, clientId)
+
+			var pacer *AdaptivePacer = nil
+			if opts.ThrottleLatency > 0 {
+				pacer = NewAdaptivePacer(time.Duration(opts.ThrottleLatency) * time.Millisecond)
+			}
+
+			errorCount := 0
+
+			// QoS 0の送信完了待ちを終了時にまとめて行う場合は、送信中のTokenを保持する。
+			flush := qos == 0 && opts.Qos0FlushWait
+			var pending []MQTT.Token = nil
+			defer func() {
+				if len(pending) > 0 {
+					atomic.AddInt64(&totalCount, -int64(FlushPublished(pending, opts.PublishTimeout)))
+					metrics.Inflight.Done(int64(len(pending)))
+				}
+			}()
+
 			for index := 0; index < opts.Count; index++ {
-				topic := fmt.Sprintf(opts.Topic+"/%d", clientId)
+				// 実行が中断された場合は、送信を終了する。
+				if ctx.Err() != nil {
+					return
+				}
+				if bucket != nil {
+					bucket.Take()
+				}
+
+				var payload interface{} = message
+				var buffer *[]byte = nil
+				var suffixBuffer *[]byte = nil
+				if opts.BinaryPayload != nil {
+					payload = opts.BinaryPayload
+				} else if opts.PayloadTemplate != nil {
+					rendered, err := RenderPayload(opts.PayloadTemplate, clientId, index)
+					if err != nil {
+						fmt.Printf("Payload error: %s\n", err)
+						continue
+					}
+					payload = rendered
+				} else if opts.SizeMax > 0 {
+					size := opts.SizeMin + rand.Intn(opts.SizeMax-opts.SizeMin+1)
+					if opts.SizeStep > 0 {
+						size = IncrementalSize(opts, index)
+					}
+					if opts.HmacKey != nil {
+						size = SignedBodySize(size)
+					}
+					if pool != nil {
+						buffer = pool.Get()
+						payload = (*buffer)[:size]
+					} else {
+						payload = CreateVariableSizePayload(size)
+					}
+				}
+
+				topic, err := CreatePublishTopic(opts, clientId, index, payload)
+				if err != nil {
+					fmt.Printf("Topic error: %s\n", err)
+					continue
+				}
+
+				// Topicの導出後に、テンプレートの出力をエンコードする。
+				if opts.PayloadTemplate != nil && opts.PayloadEncoding != PAYLOAD_ENCODING_RAW {
+					encoded, err := EncodePayload(payload.(string), opts.PayloadEncoding)
+					if err != nil {
+						fmt.Printf("Payload error: %s\n", err)
+						continue
+					}
+					payload = encoded
+				}
+
+				// 同じペイロードの重複排除を避けるため、末尾をランダムにする。
+				if opts.RandomSuffix > 0 {
+					suffixBuffer = suffixPool.Get()
+					payload = RandomizeSuffix(suffixBuffer, payload, opts.RandomSuffix)
+				}
+
+				// Topicの導出後に署名するため、署名はTopicに影響しない。
+				if opts.HmacKey != nil {
+					payload = SignPayload(PayloadBytes(payload), opts.HmacKey)
+				}
 
 				if Debug {
 					fmt.Printf("Publish : id=%d, count=%d, topic=%s\n", clientId, index, topic)
 				}
-				Publish(client, topic, opts.Qos, opts.Retain, message)
-				totalCount++
+
+				metrics.Bytes.Record(topic, payload, qos)
+
+				// 送信完了を待たないため、応答時間は記録せず、バッファも返却しない。
+				if flush {
+					metrics.Inflight.Add(1)
+					pending = append(pending, client.Publish(topic, qos, opts.Retain, payload))
+					metrics.AddProgress(1)
+					atomic.AddInt64(&totalCount, 1)
+
+					if opts.IntervalTime > 0 {
+						time.Sleep(time.Duration(opts.IntervalTime) * time.Millisecond)
+					}
+					continue
+				}
+
+				publishStart := time.Now()
+				metrics.Inflight.Add(1)
+				err = Publish(client, topic, qos, opts.Retain, payload, opts.PublishTimeout)
+				metrics.Inflight.Done(1)
+				latency := time.Since(publishStart)
+
+				// タイムアウトした場合は、送信中のバッファを参照され続ける可能性があるため、返却しない。
+				if err != ErrPublishTimeout {
+					if buffer != nil {
+						pool.Put(buffer)
+					}
+					if suffixBuffer != nil {
+						suffixPool.Put(suffixBuffer)
+					}
+				}
+				metrics.PublishLatency.Record(qos, latency)
+				metrics.TopicLatency.Record(topic, latency)
+				metrics.Outliers.Record(topic, clientId, index, latency)
+				metrics.GcImpact.Record(latency)
+				metrics.AddProgress(1)
+				atomic.AddInt64(&totalCount, 1)
+				published++
+				if err != nil {
+					metrics.AddErrors(1)
+				}
+
+				// エラーが閾値を超えたクライアントは、他のクライアントに影響しないように切り離す。
+				if err != nil && opts.DisconnectErrs > 0 {
+					errorCount++
+					if errorCount > opts.DisconnectErrs {
+						DropClient(client, clientId, errorCount, opts, metrics)
+						return
+					}
+				}
 
 				if opts.IntervalTime > 0 {
 					time.Sleep(time.Duration(opts.IntervalTime) * time.Millisecond)
 				}
+
+				// Brokerの応答が遅延している場合は、送信間隔を調整する。
+				if pacer != nil {
+					pacer.Observe(latency)
+					if delay := pacer.Delay(); delay > 0 {
+						time.Sleep(delay)
+					}
+				}
 			}
 		}(id)
 	}
 
 	wg.Wait()
 
-	return totalCount
+	return int(totalCount)
 }
 
+// クライアントの連番に対応するQoSを返す。
+// QoSの一覧が指定されている場合は、クライアント毎に順に割り当てる。
+func ClientQos(opts ExecOptions, id int) byte {
+	if len(opts.QosMix) > 0 {
+		return opts.QosMix[id%len(opts.QosMix)]
+	}
+	return opts.Qos
+}
+
+// クライアント内のSubscriptionの連番に対応するQoSを返す。
+// Subscription毎の割り当てが指定されている場合は 0,1,2,0,... の順に割り当て、
+// それ以外はクライアントのQoSとなる。
+func SubscriptionQos(opts ExecOptions, id int, index int) byte {
+	if opts.QosPerSubscription {
+		return byte(index % 3)
+	}
+	return ClientQos(opts, id)
+}
+
+// Topicのサフィックスに利用する、プロセス内で単調増加する連番
+var topicSequence uint64 = 0
+
+// Broker側でのTopicのキャッシュ効果を避けるため、Topicに一意なサフィックスを付与する。
+// サフィックスは <タイムスタンプ(ナノ秒)>-<プロセス内の連番> の形式となる。
+func AppendUniqueTopicSuffix(topic string) string {
+	seq := atomic.AddUint64(&topicSequence, 1)
+	return fmt.Sprintf("%s/%d-%d", topic, time.Now().UnixNano(), seq)
+}
+
+// Publishの応答時間に応じて、送信間隔を調整する。
+// 応答時間の移動平均が閾値を超えている間は送信間隔を広げ（倍増）、
+// 閾値を下回ったら徐々に狭める（半減）。
+type AdaptivePacer struct {
+	Threshold time.Duration // 応答時間の閾値
+	Average   time.Duration // 応答時間の移動平均
+	delay     time.Duration // 現在の送信間隔
+	observed  bool          // 応答時間を1度でも計測したかどうか
+}
+
+const (
+	PACER_MIN_DELAY time.Duration = time.Millisecond // 送信間隔を広げる際の最小値
+	PACER_MAX_DELAY time.Duration = time.Second      // 送信間隔の上限
+)
+
+// AdaptivePacerを生成する。
+//   threshold : 送信間隔を広げる応答時間の閾値
+func NewAdaptivePacer(threshold time.Duration) *AdaptivePacer {
+	return &AdaptivePacer{Threshold: threshold}
+}
+
+// 計測した応答時間を反映し、送信間隔を更新する。
+func (p *AdaptivePacer) Observe(latency time.Duration) {
+	// 指数移動平均(α=0.2)で、直近の応答時間の傾向を保持する。
+	if p.observed == false {
+		p.Average = latency
+		p.observed = true
+	} else {
+		p.Average = (p.Average*4 + latency) / 5
+	}
+
+	if p.Average > p.Threshold {
+		if p.delay < PACER_MIN_DELAY {
+			p.delay = PACER_MIN_DELAY
+		} else {
+			p.delay *= 2
+		}
+		if p.delay > PACER_MAX_DELAY {
+			p.delay = PACER_MAX_DELAY
+		}
+	} else {
+		p.delay /= 2
+		if p.delay < PACER_MIN_DELAY {
+			p.delay = 0
+		}
+	}
+}
+
+// 現在の送信間隔を返す。
+func (p *AdaptivePacer) Delay() time.Duration {
+	return p.delay
+}
+
+// 一定の送信レートとなるように、送信間隔を調整する。
+// 開始時刻からの予定時刻で待機するため、送信処理の時間は送信間隔に含まれる。
+type RatePacer struct {
+	interval time.Duration // 1メッセージ当たりの送信間隔
+	next     time.Time     // 次の送信の予定時刻
+}
+
+// RatePacerを生成する。
+//   rate : 送信レート(messages/sec)
+func NewRatePacer(rate float64) *RatePacer {
+	return &RatePacer{
+		interval: time.Duration(float64(time.Second) / rate),
+		next:     time.Now()}
+}
+
+// 次の送信の予定時刻まで待機する。
+// 予定時刻を過ぎている場合は、待機しない（遅れは、以降の送信で取り戻す）。
+func (p *RatePacer) Wait() {
+	p.next = p.next.Add(p.interval)
+	if delay := time.Until(p.next); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// 複数のクライアントで共有する、送信レートを制限するトークンバケット
+// トークンが不足している場合は、先に予約してから補充されるまで待機するため、
+// 全クライアント合計の送信レートが、指定されたレートに保たれる。
+type TokenBucket struct {
+	mutex    sync.Mutex
+	rate     float64   // トークンの補充レート(tokens/sec)
+	capacity float64   // バケットの容量（バースト可能なトークン数）
+	tokens   float64   // 現在のトークン数（予約済みの場合は負の値となる）
+	last     time.Time // 最後にトークンを補充した時刻
+}
+
+// TokenBucketを生成する。
+//   rate : 送信レート(messages/sec)
+func NewTokenBucket(rate float64) *TokenBucket {
+	return &TokenBucket{
+		rate:     rate,
+		capacity: 1,
+		tokens:   1,
+		last:     time.Now()}
+}
+
+// トークンを1つ取得する。トークンが補充されるまで待機する。
+func (b *TokenBucket) Take() {
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	b.tokens--
+	var wait time.Duration = 0
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mutex.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Publishのタイムアウトエラー
+var ErrPublishTimeout = errors.New("publish timeout")
+
 // メッセージを送信する。
-func Publish(client *MQTT.Client, topic string, qos byte, retain bool, message string) {
+// 送信に失敗した場合は、エラー内容を返す。
+//   timeout : 送信完了の最大待機時間（0の場合は完了まで待機する）
+//   message : 送信するメッセージ（string または []byte）
+func Publish(client MQTT.Client, topic string, qos byte, retain bool, message interface{}, timeout time.Duration) error {
 	token := client.Publish(topic, qos, retain, message)
 
-	if token.Wait() && token.Error() != nil {
+	if timeout > 0 {
+		if token.WaitTimeout(timeout) == false {
+			fmt.Printf("Publish error: %s\n", ErrPublishTimeout)
+			return ErrPublishTimeout
+		}
+	} else {
+		token.Wait()
+	}
+
+	if token.Error() != nil {
 		fmt.Printf("Publish error: %s\n", token.Error())
+		return token.Error()
+	}
+	return nil
+}
+
+// 送信中のメッセージが、全てネットワークへ書き込まれる（Tokenが完了する）まで待機する。
+// 送信に失敗したメッセージ数を返す。
+//   tokens  : 送信中のメッセージのToken
+//   timeout : 1メッセージ当たりの完了待ちのタイムアウト（0の場合はタイムアウトしない）
+func FlushPublished(tokens []MQTT.Token, timeout time.Duration) int {
+	failed := 0
+	for _, token := range tokens {
+		if timeout > 0 {
+			if token.WaitTimeout(timeout) == false {
+				fmt.Printf("Publish error: %s\n", ErrPublishTimeout)
+				failed++
+				continue
+			}
+		} else {
+			token.Wait()
+		}
+
+		if token.Error() != nil {
+			fmt.Printf("Publish error: %s\n", token.Error())
+			failed++
+		}
 	}
+	return failed
 }
 
 // 全クライアントに対して、subscribeの処理を行う。
 // 指定されたカウント数分、メッセージを受信待ちする（メッセージが取得できない場合はカウントされない）。
 // この処理では、Publishし続けながら、Subscribeの処理を行う。
-func SubscribeAllClient(clients []*MQTT.Client, opts ExecOptions, param ...string) int {
+func SubscribeAllClient(ctx context.Context, clients []MQTT.Client, opts ExecOptions, metrics *Metrics, param ...string) int {
 	wg := new(sync.WaitGroup)
+	startTime := time.Now()
 
 	results := make([]*SubscribeResult, len(clients))
 	for id := 0; id < len(clients); id++ {
 		wg.Add(1)
 
 		client := clients[id]
-		topic := fmt.Sprintf(opts.Topic+"/%d", id)
+		topic := CreateSubscribeTopic(opts, id)
 
-		results[id] = Subscribe(client, topic, opts.Qos)
+		subscribeStart := time.Now()
+		results[id] = Subscribe(client, topic, ClientQos(opts, id), opts)
+		metrics.Subscriptions.Record(client, topic)
+		for _, granted := range results[id].Granted {
+			metrics.QosGrants.Record(ClientQos(opts, id), granted)
+		}
+		metrics.SubscribeLatency.Record(ClientQos(opts, id), time.Since(subscribeStart))
 
 		// DefaultHandlerを利用する場合は、Subscribe個別のHandlerではなく、
 		// DefaultHandlerの処理結果を参照する。
+		// DefaultHandlerは接続毎のため、接続を共有する論理クライアントの受信待ちは、接続の先頭の論理クライアントでまとめて行う。
+		expected := opts.Count
 		if opts.UseDefaultHandler == true {
-			results[id] = DefaultHandlerResults[id]
+			results[id] = DefaultHandlerResults[id/opts.ClientsPerConn]
+			if SharesDefaultHandler(opts, id) {
+				wg.Done()
+				continue
+			}
+			if shared := len(clients) - id; shared < opts.ClientsPerConn {
+				expected = opts.Count * shared
+			} else {
+				expected = opts.Count * opts.ClientsPerConn
+			}
 		}
 
-		go func(clientId int) {
+		go func(clientId int, expected int) {
 			defer wg.Done()
 
 			var loop int = 0
-			for results[clientId].Count < opts.Count {
+			waitStart := time.Now()
+			var lastCount int64 = 0
+			for atomic.LoadInt64(&results[clientId].Count) < int64(expected) {
 				loop++
 
+				// 受信したメッセージ数を、進捗に反映する。
+				if count := atomic.LoadInt64(&results[clientId].Count); count != lastCount {
+					metrics.AddProgress(count - lastCount)
+					lastCount = count
+				}
+
+				// 実行が中断された場合は、受信待ちを終了する。
+				if ctx.Err() != nil {
+					return
+				}
+
 				if Debug {
-					fmt.Printf("Subscribe : id=%d, count=%d, topic=%s\n", clientId, results[clientId].Count, topic)
+					fmt.Printf("Subscribe : id=%d, count=%d, topic=%s\n", clientId, atomic.LoadInt64(&results[clientId].Count), topic)
 				}
 
 				if opts.IntervalTime > 0 {
@@ -234,49 +1257,182 @@ func SubscribeAllClient(clients []*MQTT.Client, opts ExecOptions, param ...strin
 					time.Sleep(1000 * time.Nanosecond)
 				}
 
+				// タイムアウトが指定されている場合は、その時間で受信待ちを打ち切り、受信済みの件数で終了する。
+				if opts.SubscribeTimeout > 0 {
+					if time.Since(waitStart) >= time.Duration(opts.SubscribeTimeout)*time.Millisecond {
+						fmt.Printf("Subscribe timeout : id=%d, count=%d/%d\n", clientId, atomic.LoadInt64(&results[clientId].Count), expected)
+						break
+					}
+					continue
+				}
+
 				// 無限ループを避けるため、指定されたCountの100倍に達したら、エラーで終了する。
-				if loop >= opts.Count*100 {
+				if loop >= expected*100 {
 					panic("Subscribe error : Not finished in the max count. It may not be received the message.")
 				}
 			}
-		}(id)
+		}(id, expected)
 	}
 
 	wg.Wait()
 
+	// paho内にバッファされた未処理のメッセージを、受信メッセージ数に反映する。
+	if opts.DrainTimeout > 0 {
+		DrainReceived(func() int {
+			count := 0
+			for id := 0; id < len(results); id++ {
+				if SharesDefaultHandler(opts, id) == false {
+					count += int(atomic.LoadInt64(&results[id].Count))
+				}
+			}
+			return count
+		}, opts.DrainTimeout)
+	}
+
 	// 受信メッセージ数をカウント
 	totalCount := 0
+	signatures := SignatureStats{}
 	for id := 0; id < len(results); id++ {
-		totalCount += results[id].Count
+		// 接続を共有する論理クライアントの処理結果は、接続の先頭の論理クライアントで集計済みとなる。
+		if SharesDefaultHandler(opts, id) {
+			continue
+		}
+		count := int(atomic.LoadInt64(&results[id].Count))
+		totalCount += count
+		signatures.Verified += results[id].Signatures.Verified
+		signatures.Invalid += results[id].Signatures.Invalid
+		metrics.Arrivals = append(metrics.Arrivals, &results[id].Arrivals)
+		metrics.ClientRates.Record(count, time.Since(startTime))
+		if metrics.TopicMatch != nil {
+			metrics.TopicMatch.Add(&results[id].Match)
+		}
+	}
+	if opts.HmacKey != nil {
+		metrics.Signatures = &signatures
 	}
 
 	return totalCount
 }
 
+// DefaultHandlerの処理結果を、接続の先頭の論理クライアントと共有するかどうかを返す。
+func SharesDefaultHandler(opts ExecOptions, id int) bool {
+	return opts.UseDefaultHandler && id%opts.ClientsPerConn != 0
+}
+
+// 受信メッセージ数が変化しなくなったとみなす時間
+const DRAIN_QUIET_PERIOD time.Duration = 100 * time.Millisecond
+
+// バッファされた未処理のメッセージが処理されるまで待機する。
+// 受信メッセージ数が一定時間変化しなくなるか、タイムアウトするまで待機し、
+// 待機中に増加した受信メッセージ数を返す。
+//   count   : 現在の受信メッセージ数を返す関数
+//   timeout : 最大待機時間
+func DrainReceived(count func() int, timeout time.Duration) int {
+	start := count()
+	last := start
+	lastChanged := time.Now()
+	deadline := lastChanged.Add(timeout)
+	for time.Now().Before(deadline) && time.Since(lastChanged) < DRAIN_QUIET_PERIOD {
+		time.Sleep(10 * time.Millisecond)
+		if current := count(); current != last {
+			last = current
+			lastChanged = time.Now()
+		}
+	}
+
+	if Debug {
+		fmt.Printf("Drained : count=%d\n", last-start)
+	}
+	return last - start
+}
+
 // Subscribeの処理結果
 type SubscribeResult struct {
-	Count int // 受信メッセージ数
+	Count      int64           // 受信メッセージ数（pahoのgoroutineから更新されるため、atomicで読み書きする）
+	Arrivals   ArrivalTracker  // メッセージの到着間隔
+	Signatures SignatureStats  // 署名の検証結果
+	Granted    []byte          // SUBACKで付与されたQoS
+	Match      TopicMatchStats // 受信したメッセージのTopicと、Topic Filterの照合結果
+}
+
+// 受信したメッセージの署名を検証する（共有鍵が nil の場合は検証しない）。
+func (r *SubscribeResult) VerifySignature(payload []byte, key []byte) {
+	if key == nil {
+		return
+	}
+	if VerifyPayload(payload, key) {
+		r.Signatures.Verified++
+	} else {
+		r.Signatures.Invalid++
+	}
 }
 
 // メッセージを受信する。
-func Subscribe(client *MQTT.Client, topic string, qos byte) *SubscribeResult {
+// 署名の検証(HmacKey)と、処理レートの制限(ConsumeRate)は、実行オプションに従う。
+func Subscribe(client MQTT.Client, topic string, qos byte, opts ExecOptions) *SubscribeResult {
 	var result *SubscribeResult = &SubscribeResult{}
 	result.Count = 0
 
-	var handler MQTT.MessageHandler = func(client *MQTT.Client, msg MQTT.Message) {
-		result.Count++
+	var bucket *TokenBucket = nil
+	if opts.ConsumeRate > 0 {
+		bucket = NewTokenBucket(opts.ConsumeRate)
+	}
+
+	var handler MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+		// 処理レートを超える場合は、受信の処理を遅らせる（paho内のバッファとBroker側のキューに滞留する）。
+		if bucket != nil {
+			bucket.Take()
+		}
+		atomic.AddInt64(&result.Count, 1)
+		result.Arrivals.Observe(time.Now())
+		result.VerifySignature(msg.Payload(), opts.HmacKey)
+		if opts.ValidateTopicMatch {
+			result.Match.Check([]string{topic}, msg.Topic())
+		}
 		if Debug {
 			fmt.Printf("Received message : topic=%s, message=%s\n", msg.Topic(), msg.Payload())
 		}
 	}
 
+	// DefaultHandlerを利用する場合は、個別のHandlerを登録しない（登録すると、DefaultHandlerが呼び出されない）。
+	if opts.UseDefaultHandler {
+		handler = nil
+	}
 	token := client.Subscribe(topic, qos, handler)
 
 	if token.Wait() && token.Error() != nil {
 		fmt.Printf("Subscribe error: %s\n", token.Error())
 	}
+	result.Granted = GrantedQos(token)
+
+	return result
+}
+
+// SUBACKで付与されたQoSを、Topic Filter毎に要求したQoSと組み合わせて記録する。
+//   filters : Subscribeした Topic Filter と、要求したQoS
+func RecordGrantedQos(recorder *QosGrantRecorder, token MQTT.Token, filters map[string]byte) {
+	subscribeToken, ok := token.(*MQTT.SubscribeToken)
+	if ok == false {
+		return
+	}
+	for filter, granted := range subscribeToken.Result() {
+		if requested, ok := filters[filter]; ok {
+			recorder.Record(requested, granted)
+		}
+	}
+}
 
-	return result
+// SUBACKで付与されたQoSを返す。
+func GrantedQos(token MQTT.Token) []byte {
+	subscribeToken, ok := token.(*MQTT.SubscribeToken)
+	if ok == false {
+		return nil
+	}
+	var granted []byte = nil
+	for _, qos := range subscribeToken.Result() {
+		granted = append(granted, qos)
+	}
+	return granted
 }
 
 // 固定サイズのメッセージを生成する。
@@ -290,15 +1446,95 @@ func CreateFixedSizeMessage(size int) string {
 	return message
 }
 
-// 指定されたBrokerへ接続し、そのMQTTクライアントを返す。
-// 接続に失敗した場合は nil を返す。
-func Connect(id int, execOpts ExecOptions) *MQTT.Client {
+// メッセージ毎に大きくする場合の、メッセージの連番に対応するサイズを返す。
+// 最初のサイズからメッセージ毎に増分ずつ大きくし、最大サイズで頭打ちとする。
+func IncrementalSize(opts ExecOptions, index int) int {
+	size := opts.SizeStart + index*opts.SizeStep
+	if size > opts.SizeMax || size < opts.SizeStart {
+		return opts.SizeMax
+	}
+	return size
+}
+
+// 接続の集中を避けるため、0から最大時間までのランダムな時間だけ待機する。
+//   jitter : 最大の待機時間（0の場合は待機しない）
+func SleepConnectJitter(jitter time.Duration) {
+	if jitter <= 0 {
+		return
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(jitter))))
+}
+
+// 論理クライアント数と1接続当たりのクライアント数から、必要な接続数を返す。
+func ConnectionNum(clientNum int, clientsPerConn int) int {
+	return (clientNum + clientsPerConn - 1) / clientsPerConn
+}
+
+// 接続エラーの情報
+type ConnectError struct {
+	ClientIndex int       // クライアントの連番
+	ClientId    string    // ClientID
+	Err         error     // エラー内容
+	Time        time.Time // エラーとなった時刻
+}
+
+// 実行結果(JSON)に出力する、接続エラーの情報
+type ConnectErrorRecord struct {
+	ClientIndex int    `json:"index"`     // クライアントの連番
+	ClientId    string `json:"client_id"` // ClientID
+	Error       string `json:"error"`     // エラー内容
+	Timestamp   string `json:"timestamp"` // エラーとなった時刻(RFC3339)
+}
+
+// 接続エラーの一覧を、実行結果(JSON)に出力する形式に変換する。
+func ConnectErrorRecords(connectErrors []ConnectError) []ConnectErrorRecord {
+	records := make([]ConnectErrorRecord, len(connectErrors))
+	for i, e := range connectErrors {
+		records[i] = ConnectErrorRecord{
+			ClientIndex: e.ClientIndex,
+			ClientId:    e.ClientId,
+			Error:       e.Err.Error(),
+			Timestamp:   e.Time.Format(time.RFC3339Nano)}
+	}
+	return records
+}
+
+// 接続エラーとなったクライアントの一覧を出力する。
+func PrintConnectErrors(connectErrors []ConnectError, clientNum int) {
+	fmt.Printf("\nConnection errors : failed=%d, clients=%d\n", len(connectErrors), clientNum)
+	for _, e := range connectErrors {
+		fmt.Printf("  index=%d, clientId=%s, error=%s\n", e.ClientIndex, e.ClientId, e.Err)
+	}
+}
+
+// ClientIDに埋め込める相関IDかどうかを返す（英数字、-、_ のみ）。
+func IsValidCorrelationId(id string) bool {
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
 
+// クライアントの連番から、ClientIDを生成する。
+func CreateClientId(id int) string {
 	// 複数プロセスで、ClientIDが重複すると、Broker側で問題となるため、
 	// プロセスIDを利用して、IDを割り振る。
 	// mqttbench<プロセスIDの16進数値>-<クライアントの連番>
+	// 相関IDを指定した場合は、mqttbench<プロセスIDの16進数値>-<相関ID>-<クライアントの連番>
 	pid := strconv.FormatInt(int64(os.Getpid()), 16)
-	clientId := fmt.Sprintf("mqttbench%s-%d", pid, id)
+	if CorrelationId != "" {
+		return fmt.Sprintf("mqttbench%s-%s-%d", pid, CorrelationId, id)
+	}
+	return fmt.Sprintf("mqttbench%s-%d", pid, id)
+}
+
+// 指定されたBrokerへ接続し、そのMQTTクライアントを返す。
+// 接続に失敗した場合は nil とエラー内容を返す。
+//   onLost : 接続断が発生した場合に呼び出す関数（nil の場合は呼び出さない）
+func Connect(id int, execOpts ExecOptions, onLost func(id int, err error), onConnect func(id int)) (MQTT.Client, error) {
+	clientId := CreateClientId(id)
 
 	opts := MQTT.NewClientOptions()
 	opts.AddBroker(execOpts.Broker)
@@ -310,18 +1546,79 @@ func Connect(id int, execOpts ExecOptions) *MQTT.Client {
 	if execOpts.Password != "" {
 		opts.SetPassword(execOpts.Password)
 	}
+	if execOpts.PasswordProvider != nil {
+		password, err := execOpts.PasswordProvider(id)
+		if err != nil {
+			fmt.Printf("Password error: %s\n", err)
+			return nil, err
+		}
+		opts.SetPassword(password)
+
+		// 再接続の際も、新しいパスワードを取得する（最初の接続は、取得済みのパスワードを利用する）。
+		// 取得に失敗した場合は、直前のパスワードで再接続する。
+		var mutex sync.Mutex
+		first := true
+		opts.SetCredentialsProvider(func() (string, string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if first {
+				first = false
+				return execOpts.Username, password
+			}
+			if refreshed, err := execOpts.PasswordProvider(id); err != nil {
+				fmt.Printf("Password error: %s\n", err)
+			} else {
+				password = refreshed
+			}
+			return execOpts.Username, password
+		})
+	}
 
 	// TLSの設定
-	certConfig := execOpts.CertConfig
-	switch c := certConfig.(type) {
-	case ServerCertConfig:
-		tlsConfig := CreateServerTlsConfig(c.ServerCertFile)
-		opts.SetTLSConfig(tlsConfig)
-	case ClientCertConfig:
-		tlsConfig := CreateClientTlsConfig(c.RootCAFile, c.ClientCertFile, c.ClientKeyFile)
+	if tlsConfig := CreateTlsConfig(execOpts); tlsConfig != nil {
 		opts.SetTLSConfig(tlsConfig)
-	default:
-		// do nothing.
+	}
+
+	// WebSocketのハンドシェイクで、追加のHTTPヘッダーを送信する（認証プロキシ向けの Authorization、Host など）。
+	if len(execOpts.WsHeaders) > 0 && IsWebsocketBroker(execOpts.Broker) {
+		opts.SetHTTPHeaders(execOpts.WsHeaders)
+	}
+
+	// QoS>0のメッセージを永続化する場合は、クライアント毎のディレクトリにファイルストアを作成する。
+	if execOpts.StoreDir != "" {
+		storeDir := filepath.Join(execOpts.StoreDir, clientId)
+		if err := os.MkdirAll(storeDir, 0755); err != nil {
+			fmt.Printf("Store error: %s\n", err)
+			return nil, err
+		}
+		opts.SetStore(MQTT.NewFileStore(storeDir))
+	}
+
+	if onLost != nil {
+		opts.SetConnectionLostHandler(func(client MQTT.Client, err error) {
+			onLost(id, err)
+		})
+	}
+	if onConnect != nil {
+		opts.SetOnConnectHandler(func(client MQTT.Client) {
+			onConnect(id)
+		})
+	}
+
+	// 追加の接続オプションを反映する。
+	for _, setter := range execOpts.ConnectOptions {
+		setter(opts)
+	}
+
+	if len(execOpts.NoRetryOn) > 0 {
+		gate := NewReconnectGate(execOpts.NoRetryOn)
+		opts.SetConnectionNotificationHandler(gate.Notify)
+		opts.Dialer.Control = gate.Control
+	}
+
+	// 接続元のポートを、範囲内でクライアント毎に順に割り当てる（再接続も同じポートから接続する）。
+	if execOpts.LocalPortRange != nil {
+		opts.Dialer.LocalAddr = &net.TCPAddr{Port: execOpts.LocalPortRange.Port(id)}
 	}
 
 	if execOpts.UseDefaultHandler == true {
@@ -330,48 +1627,186 @@ func Connect(id int, execOpts ExecOptions) *MQTT.Client {
 		var result *SubscribeResult = &SubscribeResult{}
 		result.Count = 0
 
-		var handler MQTT.MessageHandler = func(client *MQTT.Client, msg MQTT.Message) {
-			result.Count++
+		var handler MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+			atomic.AddInt64(&result.Count, 1)
+			result.Arrivals.Observe(time.Now())
+			result.VerifySignature(msg.Payload(), execOpts.HmacKey)
 			if Debug {
 				fmt.Printf("Received at defaultHandler : topic=%s, message=%s\n", msg.Topic(), msg.Payload())
 			}
 		}
 		opts.SetDefaultPublishHandler(handler)
 
-		DefaultHandlerResults[id] = result
+		// ベンチマークの対象外の追加の接続（連番が -clients 以上）の処理結果は、集計しないため記録しない。
+		if id < len(DefaultHandlerResults) {
+			DefaultHandlerResults[id] = result
+		}
+	}
+
+	// 接続(TCP/TLS)のタイムアウトと、CONNACKのタイムアウトは独立に適用し、CONNACKのタイムアウトは接続の完了から数える。
+	// pahoは ConnectTimeout を接続の開始からCONNACKの受信までの期限とするため、接続自体のタイムアウトは接続関数で適用し、
+	// pahoの期限は、CONNACKのタイムアウトがある場合は接続のタイムアウトに加えた時間、ない場合は期限なしとする。
+	// 接続の所要時間の内訳を記録する場合も、接続の各段階の所要時間を接続関数で計測する。
+	dialTimeout := opts.ConnectTimeout
+	if execOpts.DialTimeout > 0 {
+		dialTimeout = execOpts.DialTimeout
+	}
+	var dialed chan struct{} = nil
+	var timing *ConnectTiming = nil
+	var attemptTimeout time.Duration = 0
+	if execOpts.ConnectBreakdown != nil {
+		timing = &ConnectTiming{}
+	}
+	if execOpts.DialTimeout > 0 || execOpts.MqttConnectTimeout > 0 || timing != nil {
+		dialed = make(chan struct{})
+		opts.SetCustomOpenConnectionFn(NewDialNotifier(dialTimeout, dialed, timing))
+	}
+	if execOpts.MqttConnectTimeout > 0 {
+		attemptTimeout = dialTimeout + execOpts.MqttConnectTimeout
+		opts.ConnectTimeout = attemptTimeout
+	} else if execOpts.DialTimeout > 0 {
+		opts.ConnectTimeout = NO_CONNACK_DEADLINE
 	}
 
 	client := MQTT.NewClient(opts)
+	connectStart := time.Now()
 	token := client.Connect()
 
+	if execOpts.MqttConnectTimeout > 0 && WaitConnack(token, dialed, execOpts.MqttConnectTimeout) == false {
+		// 待機を打ち切った後にCONNACKを受信した場合は、接続が残らないように切断する。
+		// pahoの接続の試行は attemptTimeout で終了するため、このgoroutineもそれまでに終了する。
+		go func() {
+			if token.WaitTimeout(attemptTimeout) == false || client.IsConnected() {
+				ForceDisconnect(client)
+			}
+		}()
+		fmt.Printf("Connected error: %s\n", ErrConnackTimeout)
+		return nil, ErrConnackTimeout
+	}
 	if token.Wait() && token.Error() != nil {
-		fmt.Printf("Connected error: %s\n", token.Error())
-		return nil
+		err := DescribeCertificateError(token.Error(), execOpts)
+		fmt.Printf("Connected error: %s\n", err)
+		return nil, err
+	}
+	if timing != nil {
+		// 合計は各段階の和ではなく、接続の開始からCONNACKの受信まで別に計測する。
+		connackAt := time.Now()
+		execOpts.ConnectBreakdown.Record(timing, connackAt.Sub(timing.Dialed), connackAt.Sub(connectStart))
 	}
 
-	return client
+	return client, nil
+}
+
+// CONNACKのタイムアウトがない場合の、pahoの接続の試行の期限（期限なしの代わり）
+const NO_CONNACK_DEADLINE time.Duration = 365 * 24 * time.Hour
+
+// CONNACKを待つタイムアウトのエラー
+var ErrConnackTimeout = errors.New("mqtt connect timeout (no CONNACK)")
+
+// 接続(TCP/TLS)の完了を待ってから、CONNACKの受信を timeout まで待つ。
+// 接続がエラーとなった場合は、pahoの接続の結果を返すため、接続のエラーとCONNACKのタイムアウトは区別される。
+// CONNACKがタイムアウトした場合は false を返す。
+//   token   : pahoの接続のToken
+//   dialed  : 接続の完了時に閉じられるチャネル
+//   timeout : CONNACKのタイムアウト
+func WaitConnack(token MQTT.Token, dialed <-chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-dialed:
+		return token.WaitTimeout(timeout)
+	case <-token.Done():
+		return true
+	}
 }
 
 // 非同期でBrokerとの接続を切断する。
-func AsyncDisconnect(clients []*MQTT.Client) {
+// タイムアウトが指定されている場合は、時間内に切断が完了しなかった接続を強制切断に切り替えて、
+// その完了は待たずに処理を終える。時間内に切断できなかった接続数を返す。
+//   timeout : 接続毎の切断の最大待機時間（0の場合は完了まで待つ）
+func AsyncDisconnect(clients []MQTT.Client, timeout time.Duration) int {
 	wg := new(sync.WaitGroup)
+	var abandoned int64 = 0
 
 	for _, client := range clients {
+		if client == nil {
+			continue
+		}
 		wg.Add(1)
-		go func() {
+		go func(client MQTT.Client) {
 			defer wg.Done()
-			Disconnect(client)
-		}()
+			if DisconnectWithTimeout(client, timeout) == false {
+				atomic.AddInt64(&abandoned, 1)
+			}
+		}(client)
 	}
 
 	wg.Wait()
+	if abandoned > 0 {
+		fmt.Printf("Disconnect timeout : abandoned=%d, timeout=%s\n", abandoned, timeout)
+	}
+	return int(abandoned)
+}
+
+// 最大待機時間までBrokerとの接続の切断を待ち、完了しない場合は強制切断に切り替える。
+// 強制切断も完了しない可能性があるため、その完了は待たずに接続を放棄する。
+// 時間内に切断できた場合は true を返す。
+//   timeout : 切断の最大待機時間（0の場合は完了まで待つ）
+func DisconnectWithTimeout(client MQTT.Client, timeout time.Duration) bool {
+	if timeout <= 0 {
+		Disconnect(client)
+		return true
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Disconnect(client)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		go ForceDisconnect(client)
+		return false
+	}
+}
+
+// エラーが閾値を超えたクライアントを切り離す。
+// 接続を他の論理クライアントと共有している場合は、切断せずに送信のみ終了する。
+func DropClient(client MQTT.Client, clientId int, errorCount int, opts ExecOptions, metrics *Metrics) {
+	fmt.Printf("Client dropped : id=%d, errors=%d\n", clientId, errorCount)
+	atomic.AddInt64(&metrics.DroppedClients, 1)
+	if opts.ClientsPerConn <= 1 {
+		Disconnect(client)
+	}
 }
 
 // Brokerとの接続を切断する。
-func Disconnect(client *MQTT.Client) {
+func Disconnect(client MQTT.Client) {
 	client.Disconnect(10)
 }
 
+// 処理中の送受信の完了を待たずに、Brokerとの接続を切断する。
+func ForceDisconnect(client MQTT.Client) {
+	client.Disconnect(0)
+}
+
+// 再接続の前に切断を完了させるための、最大待機時間
+const RECONNECT_DISCONNECT_WAIT time.Duration = 5 * time.Second
+
+// 切断が完了するまで待機する（pahoの切断は、待機時間が0の場合は非同期で完了する）。
+// 最大待機時間までに切断が完了した場合は true を返す。
+func WaitDisconnected(client MQTT.Client, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for client.IsConnectionOpen() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
 // ファイルの存在チェックを行う。
 // ファイルが存在する場合はtrue、存在しない場合はfalseを返す。
 //   filePath : 存在をチェックするファイルのパス
@@ -382,19 +1817,132 @@ func FileExists(filePath string) bool {
 
 func main() {
 	broker := flag.String("broker", "tcp://{host}:{port}", "URI of MQTT broker (required)")
-	action := flag.String("action", "p|pub or s|sub", "Publish or Subscribe or Subscribe(with publishing) (required)")
+	action := flag.String("action", "p|pub or s|sub or b|both", "Publish or Subscribe or Subscribe(with publishing) or backlog delivery test (required)")
 	qos := flag.Int("qos", 0, "MQTT QoS(0|1|2)")
 	retain := flag.Bool("retain", false, "MQTT Retain")
 	topic := flag.String("topic", BASE_TOPIC, "Base topic")
 	username := flag.String("broker-username", "", "Username for connecting to the MQTT broker")
 	password := flag.String("broker-password", "", "Password for connecting to the MQTT broker")
+	tlsMinVersion := flag.String("tls-min-version", "", "Minimum TLS version (1.0|1.1|1.2|1.3)")
 	tls := flag.String("tls", "", "TLS mode. 'server:certFile' or 'client:rootCAFile,clientCertFile,clientKeyFile'")
 	clients := flag.Int("clients", 10, "Number of clients")
 	count := flag.Int("count", 100, "Number of loops per client")
-	size := flag.Int("size", 1024, "Message size per publish (byte)")
+	messageSize := flag.Int("message-size", 1024, "Message size per publish (byte)")
+	flag.Int("size", 1024, "Deprecated, use -message-size")
 	useDefaultHandler := flag.Bool("support-unknown-received", false, "Using default messageHandler for a message that does not match any known subscriptions")
 	preTime := flag.Int("pretime", 3000, "Pre wait time (ms)")
 	intervalTime := flag.Int("intervaltime", 0, "Interval time per message (ms)")
+	qosMix := flag.String("qos-mix", "", "Comma separated QoS list assigned to clients in turn (e.g. '0,1,2'), overrides -qos")
+	reportQosLatency := flag.Bool("report-latency-per-qos", false, "Report the publish latency for each QoS")
+	clientsPerConn := flag.Int("clients-per-connection", 1, "Number of logical clients sharing one connection")
+	subscribeTimeout := flag.Int("subscribe-timeout", 0, "Max wait time for receiving messages per subscriber (ms, 0 = until the max loop count)")
+	resultWebhook := flag.String("result-webhook", "", "URL to POST the result as JSON after the run")
+	uniqueTopicSuffix := flag.Bool("per-message-topic-suffix", false, "Append a unique timestamp/sequence suffix to the topic of every message to defeat topic caching")
+	throttleLatency := flag.Int("throttle-latency", 0, "Slow down publishing while the average publish latency exceeds this threshold (ms, 0 = disabled)")
+	reportConnectErrs := flag.Bool("report-connection-errors-detail", false, "Report which clients failed to connect and why")
+	payloadTemplate := flag.String("payload-template", "", "Payload template in text/template format ({{.ClientId}}, {{.Seq}}, {{.Timestamp}}), overrides -message-size")
+	clientsList := flag.String("clients-list", "", "Comma separated client counts for the benchmark matrix (e.g. '1,10,100')")
+	sizeList := flag.String("size-list", "", "Comma separated message sizes for the benchmark matrix (e.g. '64,1024')")
+	qosList := flag.String("qos-list", "", "Comma separated QoS levels for the benchmark matrix (e.g. '0,1,2')")
+	matrixJsonl := flag.String("matrix-jsonl", "", "File to write the benchmark matrix results as JSON Lines")
+	topicFromJson := flag.String("topic-from-json", "", "JSON field path in the payload (e.g. 'device.id') whose value is used as the topic under the base topic")
+	publishTimeout := flag.Int("publish-timeout", 0, "Timeout for waiting the publish completion, also reported as the latency threshold (ms, 0 = no timeout)")
+	sizeMin := flag.Int("size-min", 0, "Min message size for variable size publishing (byte)")
+	sizeMax := flag.Int("size-max", 0, "Max message size for variable size publishing (byte, 0 = fixed size by -message-size)")
+	sizeStart := flag.Int("size-start", 0, "First message size when growing the size by -size-step every message up to -size-max (byte)")
+	sizeStep := flag.Int("size-step", 0, "Size added to every message up to -size-max (byte, 0 = random size between -size-min and -size-max)")
+	payloadPool := flag.Bool("reuse-payload-buffer-pool", false, "Reuse payload buffers with sync.Pool for variable size publishing")
+	topicValidation := flag.Bool("topic-validation", false, "Validate the generated topics against the MQTT topic rules before connecting")
+	compareBrokers := flag.String("compare-brokers", "", "Two comma separated broker URIs to run the same workload against and compare (e.g. 'tcp://a:1883,tcp://b:1883')")
+	connectOptionsJson := flag.String("connect-options-json", "", "Additional paho client options in JSON (e.g. '{\"keepAlive\":30,\"cleanSession\":false}')")
+	failOnConnLost := flag.Bool("fail-on-connection-lost", false, "Abort the run and fail if any connection is lost during the measured window")
+	topologyFile := flag.String("topology-file", "", "JSON file defining the publish/subscribe topology to execute (-action is not required)")
+	reportJitter := flag.Bool("report-jitter", false, "Report the mean and standard deviation (jitter) of the message inter-arrival times on subscribe")
+	duplicateKeyRatio := flag.Float64("duplicate-key-ratio", 0, "Ratio of messages reusing the previous idempotency key on -action=both (0-1)")
+	storeDir := flag.String("store-dir", "", "Directory for the paho file store to persist QoS>0 messages (default: in-memory store)")
+	stallTimeout := flag.Int("stall-timeout", 0, "Dump all goroutine stacks to stderr when no message progresses for this time (ms, 0 = disabled)")
+	stallAbort := flag.Bool("stall-abort", false, "Abort the run when a stall is detected by -stall-timeout")
+	verifyExactlyOnce := flag.Bool("verify-exactly-once", false, "Verify every QoS 2 message is received exactly once on -action=both")
+	drainTimeout := flag.Int("drain-timeout", 0, "Max wait time to count the buffered messages after subscribing finished (ms, 0 = disabled)")
+	profile := flag.String("profile", "", "Preset of the options (smoke|standard|soak), explicitly specified options override it")
+	topicsPerClient := flag.Int("topics-per-client", 0, "Number of topics each client rotates through by sequence ({topic}/{client}/{n}, 0 = single topic per client)")
+	qos0FlushWait := flag.Bool("qos0-flush-wait", false, "On QoS 0, publish without waiting each message and stop the clock after all of them are written to the network")
+	reportConnReuse := flag.Bool("report-connection-reuse-ratio", false, "Report the connection stability (reconnects, drops, reuse ratio and mean connection lifetime) for auto-reconnect runs")
+	pubRate := flag.Float64("pub-rate", 0, "Publish rate per client on -action=both (messages/sec, 0 = unlimited)")
+	consumerDelay := flag.Int("consumer-delay", 0, "Processing time per received message on -action=both, to model slow consumers (ms)")
+	warnOnClockSkew := flag.Bool("warn-on-clock-skew", false, "Measure the end-to-end latency on -action=both and warn if negative latencies indicate a clock skew")
+	relativeLatency := flag.Bool("relative-latency", false, "Measure the end-to-end latency relative to the first message of each publisher, to cancel a clock skew")
+	globalRate := flag.Float64("global-rate", 0, "Total publish rate across all clients, shared by a token bucket (messages/sec, 0 = unlimited)")
+	reportSubLatency := flag.Bool("connect-then-subscribe-latency", false, "Report the connect (CONNACK) and subscribe (SUBACK) latencies separately on subscribe")
+	hmacKey := flag.String("hmac-key", "", "Shared key to sign every message with HMAC-SHA256 and verify the signature on subscribe")
+	timeseriesFile := flag.String("timeseries-file", "", "File to append the throughput time series as CSV (timestamp,elapsed_ms,count,throughput)")
+	sampleInterval := flag.Int("sample-interval", 1000, "Interval to sample the throughput time series (ms)")
+	disconnectErrs := flag.Int("disconnect-on-error-threshold", 0, "Disconnect and stop a client once its publish errors exceed this count, while others continue (0 = disabled)")
+	passwordCommand := flag.String("password-command", "", "Command to fetch a fresh password (e.g. a short-lived JWT) on each connect, overrides -password")
+	verifyOrdering := flag.Bool("verify-ordering-across-reconnect", false, "Force a reconnect of every client in the middle of publishing on -action=both, and verify the message order across it")
+	reportEffectiveQos := flag.Bool("report-effective-qos", false, "Report the breakdown of the requested and granted (SUBACK) QoS of the subscriptions")
+	correlationId := flag.String("correlation-id", "", "Run ID embedded in every ClientID (mqttbench{pid}-{id}-{n}) to filter the broker logs by this run ([0-9A-Za-z_-])")
+	consumeRate := flag.Float64("consume-rate", 0, "Consumption rate of each subscriber, limited by a token bucket in the receive handler (messages/sec, 0 = unlimited)")
+	reportMaxInflight := flag.Bool("report-max-inflight-observed", false, "Report the max number of simultaneously outstanding (sent but not completed) publishes")
+	wildcardFilters := flag.Int("wildcard-filters", 0, "Number of topic filters with '+' at various levels each client subscribes on -action=both, to stress the wildcard matching (0 = disabled)")
+	wildcardDepth := flag.Int("wildcard-depth", 4, "Depth of the topic hierarchy for -wildcard-filters")
+	reportQos0Drops := flag.Bool("report-dropped-qos0-estimate", false, "Estimate the dropped QoS 0 messages on -action=both by reconciling the sent and received sequence numbers")
+	reportSampleStats := flag.Bool("report-sample-stddev", false, "Report the mean, standard deviation and 95% confidence interval of the throughput per -sample-interval window")
+	noRetryOn := flag.String("no-retry-on", "", "Comma separated error substrings (e.g. 'not authorized,bad user name') on which a lost connection is not reconnected and the run fails fast")
+	payloadBase64File := flag.String("payload-base64-file", "", "File of a base64 encoded binary payload to publish the decoded bytes, overrides -message-size")
+	reportConnBreakdown := flag.Bool("report-first-byte-latency", false, "Report the connect time of the benchmark connections broken into TCP connect, TLS handshake and MQTT CONNECT")
+	qosPerSubscription := flag.Bool("subscribe-qos-per-subscription-cycle", false, "Assign QoS 0,1,2 in turn to the subscriptions of each client on -wildcard-filters, overrides -qos and -qos-mix for the subscriptions")
+	reportSecondBuckets := flag.Bool("report-throughput-per-second-buckets", false, "Include the per-second message counts of the run in the JSON result")
+	observeConnectRate := flag.Bool("max-connections-per-second-on-broker-side", false, "Observe the connection acceptance rate of the broker and the onset of throttling (rising connect latency or refused connects) in the connect phase")
+	topicLatencyTop := flag.Int("report-latency-by-topic", 0, "Report the publish latency for each of the top N topics by traffic (0 = disabled)")
+	disconnectTimeout := flag.Int("graceful-context-timeout", 0, "Timeout of each disconnect at the end (ms), falls back to a forced disconnect and abandons the connection (0 = wait for completion)")
+	reportErrorRate := flag.Bool("report-error-rate-over-time", false, "Add the publish error count of each interval to -timeseries-file as the errors column")
+	orderingKeys := flag.Int("ordering-key-count", 0, "Number of ordering keys assigned to messages in turn on -action=both, routed by the topic level key{n} and verified per key at the subscriber (0 = disabled)")
+	output := flag.String("output", OUTPUT_TEXT, "Output format of the result : text or markdown (adds Markdown tables of the result, matrix or compare for PR comments)")
+	connectJitter := flag.Int("connect-jitter", 0, "Max random sleep before each connect to desynchronize the connect burst (ms, 0 = disabled)")
+	reportBytes := flag.Bool("report-bytes-breakdown", false, "Report the published payload bytes and the estimated MQTT protocol overhead bytes (PUBLISH header and acknowledgements)")
+	unsubscribeOnExit := flag.Bool("subscribe-cleanup-unsubscribe-on-exit", false, "Unsubscribe all subscribed filters before disconnecting at the end, not to leave subscriptions on the broker")
+	reportConnHistogram := flag.Bool("report-connection-establishment-histogram", false, "Report the histogram of the connect times to spot bimodal behavior (e.g. TLS resumption vs full handshake)")
+	percentileList := flag.String("percentiles", "", "Comma separated percentiles of the publish latency to report in addition (e.g. '50,90,99,99.9')")
+	warmupThreshold := flag.Float64("warmup-until-stable", 0, "Publish discarded messages instead of -pretime until the coefficient of variation of the throughput over 5 -sample-interval windows drops below this value (e.g. 0.05, 0 = disabled)")
+	warmupMaxTime := flag.Int("warmup-max-time", 60000, "Max time of -warmup-until-stable (ms)")
+	reportConnCount := flag.Bool("report-connection-count-timeseries", false, "Add the number of currently connected connections of each interval to -timeseries-file as the connected column")
+	randomSuffix := flag.Int("publish-payload-suffix-random-fill", 0, "Number of trailing bytes of every payload replaced with random alphanumerics within the size, to defeat payload dedup (0 = disabled)")
+	resultDir := flag.String("result-dir", "", "Shared directory to write the result of this process as result-{host}-{pid}.json, for -aggregate")
+	aggregateDir := flag.String("aggregate", "", "Read the result files in the directory written by -result-dir, print the combined summary and exit (no benchmark is run)")
+	connectStress := flag.Bool("connect-without-publish-stress", false, "Repeat connect (with auth) and disconnect -count times per client without publishing, to stress the auth path of the broker")
+	connectStressRate := flag.Float64("connect-stress-rate", 0, "Total connect rate of -connect-without-publish-stress (connects/sec, 0 = unlimited)")
+	outlierNum := flag.Int("report-latency-outliers", 0, "Report the N slowest publishes with their topic, client and sequence (0 = disabled)")
+	validateTopicMatch := flag.Bool("subscribe-match-validation", false, "Verify the topic of every received message matches the subscribed filters by the MQTT matching rules, and report spurious deliveries")
+	reportClientRates := flag.Bool("report-throughput-by-client-histogram", false, "Report the histogram of the message rate of each client to spot stragglers and hot clients")
+	tlsResumptionTest := flag.Bool("connect-tls-renegotiation-test", false, "Check the TLS session resumption of the broker by separate probe connections sharing a session cache (not the benchmark connections), and report whether each probe resumed")
+	validateJson := flag.Bool("payload-validate-json", false, "Validate the first rendered payload of -payload-template is a valid JSON before connecting")
+	jsonSchemaFile := flag.String("payload-json-schema", "", "JSON schema file (type, properties, required, items and enum) the first rendered payload of -payload-template is validated against, implies -payload-validate-json")
+	reportWindowLatency := flag.Bool("report-interval-latency", false, "Report the p50/p95/p99 of the publish latency per -sample-interval window (also added to -timeseries-file)")
+	connectBatchSize := flag.Int("connect-batch-size", 0, "Connect in batches of this many connections with -connect-batch-pause between them, and report the batch at which connects began failing (0 = disabled)")
+	connectBatchPause := flag.Int("connect-batch-pause", 1000, "Pause between the batches of -connect-batch-size (ms)")
+	reportE2EHistogram := flag.Bool("report-end-to-end-latency-histogram", false, "Report the histogram of the end-to-end (publish to receive) latencies on -action=both")
+	drainOnSignal := flag.Bool("graceful-shutdown-drain-publishers", false, "On SIGINT/SIGTERM, stop publishing new messages and wait for the inflight ones (up to -graceful-shutdown-drain-timeout) before disconnecting and reporting")
+	drainTimeoutOnSignal := flag.Int("graceful-shutdown-drain-timeout", 10000, "Max time to wait for the inflight messages on -graceful-shutdown-drain-publishers (ms)")
+	reportMad := flag.Bool("report-median-absolute-deviation", false, "Report the median absolute deviation (MAD) of the publish latency, a spread robust to tail outliers")
+	calibrate := flag.Bool("topic-subscribe-then-publish-latency", false, "Calibration mode : the first client publishes -count messages one by one to a topic it subscribes, and reports the loopback latency through the broker as a baseline")
+	connectErrorsJson := flag.Bool("report-connection-errors-as-json-array", false, "On connect failure, print the connection errors (index, client_id, error, timestamp) as a JSON array and post them to -result-webhook as connect_errors of the result")
+	payloadEncoding := flag.String("payload-encoding", PAYLOAD_ENCODING_RAW, "Encoding of the JSON rendered by -payload-template : raw, cbor or protobuf (google.protobuf.Struct)")
+	targetConfidence := flag.Float64("target-confidence", 0, "Stop the run when the 95% confidence interval of the throughput per -sample-interval window is within this ratio of the mean (e.g. 0.02 = ±2%, 0 = disabled)")
+	targetConfidenceMaxTime := flag.Int("target-confidence-max-time", 300000, "Max run time of -target-confidence (ms)")
+	reportReceiveGap := flag.Bool("report-subscribe-receive-gap", false, "Report the longest gap between consecutive message arrivals of a subscriber (a delivery stall) with its time")
+	keepAlive := flag.Int("keepalive", -1, "Keep alive interval (sec, 0 = disabled, no PINGREQ is sent, -1 = paho default)")
+	idleHold := flag.Int("idle-hold", 0, "Hold the connections idle for this time after connecting, and verify they stay up (e.g. with -keepalive=0) (ms, 0 = disabled)")
+	resultSamples := flag.Bool("report-aggregate-percentiles-from-merged-samples", false, "Include all publish latency samples in the -result-dir file, so that -aggregate computes the true percentiles from the merged samples")
+	latencyBackend := flag.String("latency-backend", LATENCY_BACKEND_EXACT, "Recording of the publish latency : exact (keep all samples) or hdr (count in a HDR histogram, constant memory, percentiles within about 0.4%)")
+	reportGcPause := flag.Bool("report-gc-pause-impact", false, "Report the GC pauses of this tool during the run, and how many publish latency spikes (> p99) coincide with them")
+	dialTimeout := flag.Int("dial-timeout", 0, "Timeout of the TCP connect (and the TLS handshake) to the broker (ms, 0 = paho default of 30 sec)")
+	mqttConnectTimeout := flag.Int("mqtt-connect-timeout", 0, "Timeout of waiting for the CONNACK after the TCP connect (ms, 0 = wait for completion)")
+	resultChecksum := flag.Bool("result-checksum", false, "Write the SHA-256 of the -result-dir file to {file}.sha256 (verified by -aggregate), and send it in the X-Result-Checksum header of -result-webhook")
+	reportQos2Flow := flag.Bool("subscribe-qos2-flow-completion-timing", false, "Report the QoS 2 delivery time and flow completion time (PUBLISH to PUBREL) of a subscriber, measured by separate probe connections (not the benchmark clients)")
+	localPortRange := flag.String("local-port-range", "", "Range of the source ports of the clients as lo-hi (e.g. '40000-49999'), assigned to the clients in turn (default = OS ephemeral ports)")
+	var wsHeaders HeaderFlag
+	flag.Var(&wsHeaders, "ws-header", "HTTP header sent in the WebSocket handshake of ws/wss brokers as key:value (e.g. 'Authorization:Bearer xxx', repeatable)")
 	debug := flag.Bool("x", false, "Debug mode")
 
 	flag.Parse()
@@ -404,10 +1952,57 @@ func main() {
 		return
 	}
 
+	// apply deprecated flags
+	if err := ApplyDeprecatedFlags(flag.CommandLine, os.Stdout); err != nil {
+		fmt.Printf("Invalid argument : %s\n", err)
+		os.Exit(1)
+	}
+
+	// apply "profile"
+	if err := ValidateProfiles(flag.CommandLine); err != nil {
+		fmt.Printf("Profile error: %s\n", err)
+		os.Exit(1)
+	}
+	if *profile != "" {
+		if err := ApplyProfile(flag.CommandLine, *profile); err != nil {
+			fmt.Printf("Invalid argument : -profile -> %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// 複数のプロセスの実行結果を集計する場合は、ベンチマークを実行しない。
+	if *aggregateDir != "" {
+		results, err := ReadResultFiles(*aggregateDir)
+		if err != nil {
+			fmt.Printf("Aggregate error: %s\n", err)
+			os.Exit(1)
+		}
+		if len(results) == 0 {
+			fmt.Printf("Aggregate error: no result files in %s\n", *aggregateDir)
+			os.Exit(1)
+		}
+		PrintAggregateResult(AggregateResults(results))
+		return
+	}
+
+	// parse "compare-brokers"
+	var brokers []string = nil
+	if *compareBrokers != "" {
+		for _, b := range strings.Split(*compareBrokers, ",") {
+			brokers = append(brokers, strings.TrimSpace(b))
+		}
+		if len(brokers) != 2 || brokers[0] == "" || brokers[1] == "" {
+			fmt.Printf("Invalid argument : -compare-brokers -> %s\n", *compareBrokers)
+			os.Exit(1)
+		}
+		// 比較時は -broker の指定を不要とする。
+		*broker = brokers[0]
+	}
+
 	// validate "broker"
 	if broker == nil || *broker == "" || *broker == "tcp://{host}:{port}" {
 		fmt.Printf("Invalid argument : -broker -> %s\n", *broker)
-		return
+		os.Exit(1)
 	}
 
 	// validate "action"
@@ -416,11 +2011,270 @@ func main() {
 		method = "pub"
 	} else if *action == "s" || *action == "sub" {
 		method = "sub"
+	} else if *action == "b" || *action == "both" {
+		method = "both"
+	} else if *action == "backlog" {
+		method = "backlog"
+	}
+
+	if *topologyFile != "" {
+		method = "topology"
+	}
+	if *connectStress {
+		method = "auth"
+	}
+	if *calibrate {
+		method = "calibrate"
 	}
 
-	if method != "pub" && method != "sub" {
+	if method != "pub" && method != "sub" && method != "both" && method != "backlog" && method != "topology" && method != "auth" && method != "calibrate" {
 		fmt.Printf("Invalid argument : -action -> %s\n", *action)
-		return
+		os.Exit(1)
+	}
+
+	// validate "duplicate-key-ratio"
+	if *duplicateKeyRatio < 0 || *duplicateKeyRatio > 1 {
+		fmt.Printf("Invalid argument : -duplicate-key-ratio -> %f\n", *duplicateKeyRatio)
+		os.Exit(1)
+	}
+
+	// validate "pub-rate", "consumer-delay"
+	if *pubRate < 0 {
+		fmt.Printf("Invalid argument : -pub-rate -> %f\n", *pubRate)
+		os.Exit(1)
+	}
+	if *consumerDelay < 0 {
+		fmt.Printf("Invalid argument : -consumer-delay -> %d\n", *consumerDelay)
+		os.Exit(1)
+	}
+
+	// validate "global-rate"
+	if *globalRate < 0 {
+		fmt.Printf("Invalid argument : -global-rate -> %f\n", *globalRate)
+		os.Exit(1)
+	}
+
+	// validate "sample-interval"
+	if (*timeseriesFile != "" || *reportSampleStats || *reportWindowLatency) && *sampleInterval <= 0 {
+		fmt.Printf("Invalid argument : -sample-interval -> %d\n", *sampleInterval)
+		os.Exit(1)
+	}
+
+	// validate "consume-rate"
+	if *consumeRate < 0 {
+		fmt.Printf("Invalid argument : -consume-rate -> %f\n", *consumeRate)
+		os.Exit(1)
+	}
+
+	// validate "wildcard-filters", "wildcard-depth"
+	if *wildcardFilters > 0 {
+		if method != "both" {
+			fmt.Printf("Invalid argument : -wildcard-filters requires -action=both\n")
+			os.Exit(1)
+		}
+		if *wildcardDepth < 1 || *wildcardFilters > MaxWildcardFilters(*wildcardDepth) {
+			fmt.Printf("Invalid argument : -wildcard-filters -> %d, -wildcard-depth -> %d (max filters = 2^depth-1)\n", *wildcardFilters, *wildcardDepth)
+			os.Exit(1)
+		}
+		if *topicsPerClient > 0 {
+			fmt.Printf("Invalid argument : -wildcard-filters can't be used with -topics-per-client\n")
+			os.Exit(1)
+		}
+	}
+	if *qosPerSubscription && *wildcardFilters == 0 {
+		fmt.Printf("Invalid argument : -subscribe-qos-per-subscription-cycle requires -wildcard-filters\n")
+		os.Exit(1)
+	}
+	// validate "warmup-until-stable"
+	if *warmupThreshold < 0 || (*warmupThreshold > 0 && (*warmupMaxTime <= 0 || *sampleInterval <= 0)) {
+		fmt.Printf("Invalid argument : -warmup-until-stable -> %f, -warmup-max-time -> %d, -sample-interval -> %d\n", *warmupThreshold, *warmupMaxTime, *sampleInterval)
+		os.Exit(1)
+	}
+
+	// parse "percentiles"
+	var percentiles []float64 = nil
+	if *percentileList != "" {
+		list, err := ParsePercentiles(*percentileList)
+		if err != nil {
+			fmt.Printf("Invalid argument : -percentiles -> %s\n", *percentileList)
+			os.Exit(1)
+		}
+		percentiles = list
+	}
+
+	// validate "output"
+	if *output != OUTPUT_TEXT && *output != OUTPUT_MARKDOWN {
+		fmt.Printf("Invalid argument : -output -> %s\n", *output)
+		os.Exit(1)
+	}
+
+	// validate "ordering-key-count"
+	if *orderingKeys < 0 {
+		fmt.Printf("Invalid argument : -ordering-key-count -> %d\n", *orderingKeys)
+		os.Exit(1)
+	}
+	if *reportE2EHistogram && method != "both" {
+		fmt.Printf("Invalid argument : -report-end-to-end-latency-histogram requires -action=both\n")
+		os.Exit(1)
+	}
+	if *orderingKeys > 0 {
+		if method != "both" {
+			fmt.Printf("Invalid argument : -ordering-key-count requires -action=both\n")
+			os.Exit(1)
+		}
+		if *topicsPerClient > 0 || *wildcardFilters > 0 {
+			fmt.Printf("Invalid argument : -ordering-key-count can't be used with -topics-per-client or -wildcard-filters\n")
+			os.Exit(1)
+		}
+	}
+
+	if *reportErrorRate && *timeseriesFile == "" {
+		fmt.Printf("Invalid argument : -report-error-rate-over-time requires -timeseries-file\n")
+		os.Exit(1)
+	}
+	if *connectStressRate < 0 {
+		fmt.Printf("Invalid argument : -connect-stress-rate -> %f\n", *connectStressRate)
+		os.Exit(1)
+	}
+	if *randomSuffix < 0 {
+		fmt.Printf("Invalid argument : -publish-payload-suffix-random-fill -> %d\n", *randomSuffix)
+		os.Exit(1)
+	}
+	if *randomSuffix > 0 && *payloadTemplate != "" {
+		fmt.Printf("Invalid argument : -publish-payload-suffix-random-fill can't be used with -payload-template\n")
+		os.Exit(1)
+	}
+	if *reportConnCount && *timeseriesFile == "" {
+		fmt.Printf("Invalid argument : -report-connection-count-timeseries requires -timeseries-file\n")
+		os.Exit(1)
+	}
+	if *connectJitter < 0 {
+		fmt.Printf("Invalid argument : -connect-jitter -> %d\n", *connectJitter)
+		os.Exit(1)
+	}
+	if *targetConfidence < 0 || (*targetConfidence > 0 && (*targetConfidenceMaxTime <= 0 || *sampleInterval <= 0)) {
+		fmt.Printf("Invalid argument : -target-confidence -> %f, -target-confidence-max-time -> %d, -sample-interval -> %d\n", *targetConfidence, *targetConfidenceMaxTime, *sampleInterval)
+		os.Exit(1)
+	}
+	if *resultSamples && *resultDir == "" {
+		fmt.Printf("Invalid argument : -report-aggregate-percentiles-from-merged-samples requires -result-dir\n")
+		os.Exit(1)
+	}
+	if *keepAlive < -1 {
+		fmt.Printf("Invalid argument : -keepalive -> %d\n", *keepAlive)
+		os.Exit(1)
+	}
+	if *resultChecksum && *resultDir == "" && *resultWebhook == "" {
+		fmt.Printf("Invalid argument : -result-checksum requires -result-dir or -result-webhook\n")
+		os.Exit(1)
+	}
+	if *dialTimeout < 0 || *mqttConnectTimeout < 0 {
+		fmt.Printf("Invalid argument : -dial-timeout -> %d, -mqtt-connect-timeout -> %d\n", *dialTimeout, *mqttConnectTimeout)
+		os.Exit(1)
+	}
+	if *latencyBackend != LATENCY_BACKEND_EXACT && *latencyBackend != LATENCY_BACKEND_HDR {
+		fmt.Printf("Invalid argument : -latency-backend -> %s\n", *latencyBackend)
+		os.Exit(1)
+	}
+	// HDRヒストグラムはサンプルを保持しないため、サンプルが必要な出力とは併用できない。
+	if *latencyBackend == LATENCY_BACKEND_HDR && (*reportMad || *reportWindowLatency || *resultSamples) {
+		fmt.Printf("Invalid argument : -latency-backend=hdr cannot be used with -report-median-absolute-deviation, -report-interval-latency and -report-aggregate-percentiles-from-merged-samples\n")
+		os.Exit(1)
+	}
+	if *idleHold < 0 {
+		fmt.Printf("Invalid argument : -idle-hold -> %d\n", *idleHold)
+		os.Exit(1)
+	}
+	if *drainTimeoutOnSignal < 0 {
+		fmt.Printf("Invalid argument : -graceful-shutdown-drain-timeout -> %d\n", *drainTimeoutOnSignal)
+		os.Exit(1)
+	}
+	if *connectBatchSize < 0 || *connectBatchPause < 0 {
+		fmt.Printf("Invalid argument : -connect-batch-size -> %d, -connect-batch-pause -> %d\n", *connectBatchSize, *connectBatchPause)
+		os.Exit(1)
+	}
+	if *disconnectTimeout < 0 {
+		fmt.Printf("Invalid argument : -graceful-context-timeout -> %d\n", *disconnectTimeout)
+		os.Exit(1)
+	}
+	if *outlierNum < 0 {
+		fmt.Printf("Invalid argument : -report-latency-outliers -> %d\n", *outlierNum)
+		os.Exit(1)
+	}
+	if *topicLatencyTop < 0 {
+		fmt.Printf("Invalid argument : -report-latency-by-topic -> %d\n", *topicLatencyTop)
+		os.Exit(1)
+	}
+	if *wildcardFilters < 0 {
+		fmt.Printf("Invalid argument : -wildcard-filters -> %d\n", *wildcardFilters)
+		os.Exit(1)
+	}
+
+	// validate "backlog"
+	if method == "backlog" {
+		// QoS 0のメッセージは、切断中のセッションに滞留しない。
+		if *qos == 0 && *qosMix == "" {
+			fmt.Printf("Invalid argument : -action=backlog requires -qos=1 or 2\n")
+			os.Exit(1)
+		}
+		if *clientsPerConn > 1 {
+			fmt.Printf("Invalid argument : -action=backlog can't be used with -clients-per-connection\n")
+			os.Exit(1)
+		}
+	}
+
+	// validate "correlation-id"
+	if IsValidCorrelationId(*correlationId) == false {
+		fmt.Printf("Invalid argument : -correlation-id -> %s\n", *correlationId)
+		os.Exit(1)
+	}
+
+	// validate "topics-per-client"
+	if *topicsPerClient < 0 {
+		fmt.Printf("Invalid argument : -topics-per-client -> %d\n", *topicsPerClient)
+		os.Exit(1)
+	}
+
+	// validate "clients-per-connection"
+	if *clientsPerConn < 1 {
+		fmt.Printf("Invalid argument : -clients-per-connection -> %d\n", *clientsPerConn)
+		os.Exit(1)
+	}
+	// 再接続は接続単位で行うため、接続を共有する場合は順序を検証できない。
+	if *verifyOrdering && *clientsPerConn > 1 {
+		fmt.Printf("Invalid argument : -verify-ordering-across-reconnect can't be used with -clients-per-connection\n")
+		os.Exit(1)
+	}
+
+	// validate "tls-min-version"
+	var minVersion uint16 = 0
+	if *tlsMinVersion != "" {
+		v, ok := TlsVersions[*tlsMinVersion]
+		if ok == false {
+			fmt.Printf("Invalid argument : -tls-min-version -> %s\n", *tlsMinVersion)
+			os.Exit(1)
+		}
+		minVersion = v
+	}
+
+	// parse benchmark matrix
+	matrix, err := ParseMatrix(*clientsList, *sizeList, *qosList)
+	if err != nil {
+		fmt.Printf("Invalid argument : %s\n", err)
+		os.Exit(1)
+	}
+
+	// parse "qos-mix"
+	var mixList []byte = nil
+	if *qosMix != "" {
+		for _, v := range strings.Split(*qosMix, ",") {
+			q, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || q < 0 || q > 2 {
+				fmt.Printf("Invalid argument : -qos-mix -> %s\n", *qosMix)
+				os.Exit(1)
+			}
+			mixList = append(mixList, byte(q))
+		}
 	}
 
 	// parse TLS mode
@@ -432,7 +2286,7 @@ func main() {
 		serverCertFile := strings.TrimSpace(strArray[1])
 		if FileExists(serverCertFile) == false {
 			fmt.Printf("File is not found. : certFile -> %s\n", serverCertFile)
-			return
+			os.Exit(1)
 		}
 
 		certConfig = ServerCertConfig{
@@ -445,15 +2299,15 @@ func main() {
 		clientKeyFile := strings.TrimSpace(configArray[2])
 		if FileExists(rootCAFile) == false {
 			fmt.Printf("File is not found. : rootCAFile -> %s\n", rootCAFile)
-			return
+			os.Exit(1)
 		}
 		if FileExists(clientCertFile) == false {
 			fmt.Printf("File is not found. : clientCertFile -> %s\n", clientCertFile)
-			return
+			os.Exit(1)
 		}
 		if FileExists(clientKeyFile) == false {
 			fmt.Printf("File is not found. : clientKeyFile -> %s\n", clientKeyFile)
-			return
+			os.Exit(1)
 		}
 
 		certConfig = ClientCertConfig{
@@ -464,6 +2318,123 @@ func main() {
 		// nil
 	}
 
+	// validate "size-min", "size-max"
+	if *sizeMax > 0 && (*sizeMin < 0 || *sizeMin > *sizeMax) {
+		fmt.Printf("Invalid argument : -size-min -> %d, -size-max -> %d\n", *sizeMin, *sizeMax)
+		os.Exit(1)
+	}
+
+	// validate "size-start", "size-step"
+	if *sizeStep < 0 {
+		fmt.Printf("Invalid argument : -size-step -> %d\n", *sizeStep)
+		os.Exit(1)
+	}
+	if *sizeStep > 0 && (*sizeMax == 0 || *sizeStart < 0 || *sizeStart > *sizeMax) {
+		fmt.Printf("Invalid argument : -size-start -> %d, -size-step -> %d, -size-max -> %d (requires 0 <= -size-start <= -size-max)\n", *sizeStart, *sizeStep, *sizeMax)
+		os.Exit(1)
+	}
+
+	// parse "payload-template"
+	var payloadTmpl *template.Template = nil
+	if *payloadTemplate != "" {
+		t, err := ParsePayloadTemplate(*payloadTemplate)
+		if err != nil {
+			fmt.Printf("Invalid argument : -payload-template -> %s\n", err)
+			os.Exit(1)
+		}
+		payloadTmpl = t
+	}
+
+	// validate "payload-encoding"
+	if *payloadEncoding != PAYLOAD_ENCODING_RAW {
+		if *payloadEncoding != PAYLOAD_ENCODING_CBOR && *payloadEncoding != PAYLOAD_ENCODING_PROTOBUF {
+			fmt.Printf("Invalid argument : -payload-encoding -> %s\n", *payloadEncoding)
+			os.Exit(1)
+		}
+		if payloadTmpl == nil {
+			fmt.Printf("Invalid argument : -payload-encoding requires -payload-template\n")
+			os.Exit(1)
+		}
+		// 接続前に、最初のペイロードをエンコードできることを確認する。
+		payload, err := RenderPayload(payloadTmpl, 0, 0)
+		if err == nil {
+			_, err = EncodePayload(payload, *payloadEncoding)
+		}
+		if err != nil {
+			fmt.Printf("Invalid payload : %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// validate "payload-validate-json"
+	if *validateJson || *jsonSchemaFile != "" {
+		if payloadTmpl == nil {
+			fmt.Printf("Invalid argument : -payload-validate-json and -payload-json-schema require -payload-template\n")
+			os.Exit(1)
+		}
+		var schema JsonSchema = nil
+		if *jsonSchemaFile != "" {
+			s, err := LoadJsonSchema(*jsonSchemaFile)
+			if err != nil {
+				fmt.Printf("Invalid argument : -payload-json-schema -> %s\n", err)
+				os.Exit(1)
+			}
+			schema = s
+		}
+		// 接続前に、最初のペイロードがJSONとして正しいことを確認する。
+		payload, err := RenderPayload(payloadTmpl, 0, 0)
+		if err == nil {
+			err = ValidateJsonPayload(payload, schema)
+		}
+		if err != nil {
+			fmt.Printf("Invalid payload : %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// validate "topic-from-json"
+	if *topicFromJson != "" {
+		if payloadTmpl == nil {
+			fmt.Printf("Invalid argument : -topic-from-json requires -payload-template\n")
+			os.Exit(1)
+		}
+		// 接続前に、最初のペイロードからTopicを導出できることを確認する。
+		payload, err := RenderPayload(payloadTmpl, 0, 0)
+		if err == nil {
+			_, err = JsonFieldValue(payload, *topicFromJson)
+		}
+		if err != nil {
+			fmt.Printf("Invalid argument : -topic-from-json -> %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// load "payload-base64-file"
+	var binaryPayload []byte = nil
+	if *payloadBase64File != "" {
+		if *payloadTemplate != "" || *sizeMax > 0 {
+			fmt.Printf("Invalid argument : -payload-base64-file can't be used with -payload-template or -size-max\n")
+			os.Exit(1)
+		}
+		payload, err := LoadBase64Payload(*payloadBase64File)
+		if err != nil {
+			fmt.Printf("Invalid argument : -payload-base64-file -> %s\n", err)
+			os.Exit(1)
+		}
+		binaryPayload = payload
+	}
+
+	// parse "connect-options-json"
+	var connectOptions []ClientOptionSetter = nil
+	if *connectOptionsJson != "" {
+		setters, err := ParseConnectOptionsJson(*connectOptionsJson)
+		if err != nil {
+			fmt.Printf("Invalid argument : -connect-options-json -> %s\n", err)
+			os.Exit(1)
+		}
+		connectOptions = setters
+	}
+
 	execOpts := ExecOptions{}
 	execOpts.Broker = *broker
 	execOpts.Qos = byte(*qos)
@@ -472,19 +2443,224 @@ func main() {
 	execOpts.Username = *username
 	execOpts.Password = *password
 	execOpts.CertConfig = certConfig
+	// 期限切れの証明書は接続時に分かりにくいエラーとなるため、接続前に警告する。
+	for _, err := range CheckCertConfig(certConfig, time.Now()) {
+		fmt.Printf("Warning : %s\n", err)
+	}
 	execOpts.ClientNum = *clients
 	execOpts.Count = *count
-	execOpts.MessageSize = *size
+	execOpts.MessageSize = *messageSize
+	if binaryPayload != nil {
+		execOpts.BinaryPayload = binaryPayload
+		execOpts.MessageSize = len(binaryPayload)
+	}
 	execOpts.UseDefaultHandler = *useDefaultHandler
 	execOpts.PreTime = *preTime
 	execOpts.IntervalTime = *intervalTime
+	execOpts.ReportConnectErrs = *reportConnectErrs
+	execOpts.ThrottleLatency = *throttleLatency
+	execOpts.UniqueTopicSuffix = *uniqueTopicSuffix
+	execOpts.ResultWebhook = *resultWebhook
+	execOpts.SubscribeTimeout = *subscribeTimeout
+	execOpts.ClientsPerConn = *clientsPerConn
+	execOpts.QosMix = mixList
+	execOpts.ReportQosLatency = *reportQosLatency
+	execOpts.TlsMinVersion = minVersion
+	execOpts.PayloadTemplate = payloadTmpl
+	execOpts.PayloadEncoding = *payloadEncoding
+	execOpts.TopicFromJson = *topicFromJson
+	execOpts.PublishTimeout = time.Duration(*publishTimeout) * time.Millisecond
+	execOpts.SizeMin = *sizeMin
+	execOpts.SizeMax = *sizeMax
+	execOpts.UsePayloadPool = *payloadPool
+	execOpts.SizeStart = *sizeStart
+	execOpts.SizeStep = *sizeStep
+	execOpts.ConnectOptions = connectOptions
+	execOpts.FailOnConnLost = *failOnConnLost
+	execOpts.ReportJitter = *reportJitter
+	execOpts.IdleHold = time.Duration(*idleHold) * time.Millisecond
+	execOpts.ReportReceiveGap = *reportReceiveGap
+	execOpts.DuplicateKeyRatio = *duplicateKeyRatio
+	execOpts.StoreDir = *storeDir
+	execOpts.StallTimeout = time.Duration(*stallTimeout) * time.Millisecond
+	execOpts.StallAbort = *stallAbort
+	execOpts.VerifyExactlyOnce = *verifyExactlyOnce
+	execOpts.DrainTimeout = time.Duration(*drainTimeout) * time.Millisecond
+	execOpts.TopicsPerClient = *topicsPerClient
+	execOpts.Qos0FlushWait = *qos0FlushWait
+	execOpts.ReportConnReuse = *reportConnReuse
+	execOpts.PubRate = *pubRate
+	execOpts.ConsumerDelay = *consumerDelay
+	execOpts.WarnOnClockSkew = *warnOnClockSkew
+	execOpts.RelativeLatency = *relativeLatency
+	execOpts.GlobalRate = *globalRate
+	execOpts.ReportSubLatency = *reportSubLatency
+	if *hmacKey != "" {
+		execOpts.HmacKey = []byte(*hmacKey)
+	}
+	execOpts.TimeseriesFile = *timeseriesFile
+	execOpts.SampleInterval = time.Duration(*sampleInterval) * time.Millisecond
+	execOpts.DisconnectErrs = *disconnectErrs
+	execOpts.VerifyOrdering = *verifyOrdering
+	execOpts.ReportEffectiveQos = *reportEffectiveQos
+	execOpts.ConsumeRate = *consumeRate
+	execOpts.ReportMaxInflight = *reportMaxInflight
+	execOpts.WildcardFilters = *wildcardFilters
+	execOpts.WildcardDepth = *wildcardDepth
+	execOpts.ReportQos0Drops = *reportQos0Drops
+	execOpts.ReportSampleStats = *reportSampleStats
+	execOpts.ReportConnBreakdown = *reportConnBreakdown
+	execOpts.QosPerSubscription = *qosPerSubscription
+	execOpts.ReportSecondBuckets = *reportSecondBuckets
+	execOpts.ReportWindowLatency = *reportWindowLatency
+	execOpts.ObserveConnectRate = *observeConnectRate
+	execOpts.ConnectBatchSize = *connectBatchSize
+	execOpts.ConnectBatchPause = time.Duration(*connectBatchPause) * time.Millisecond
+	execOpts.TopicLatencyTop = *topicLatencyTop
+	execOpts.DisconnectTimeout = time.Duration(*disconnectTimeout) * time.Millisecond
+	execOpts.ReportErrorRate = *reportErrorRate
+	execOpts.OrderingKeys = *orderingKeys
+	execOpts.ConnectJitter = time.Duration(*connectJitter) * time.Millisecond
+	execOpts.ReportBytes = *reportBytes
+	execOpts.UnsubscribeOnExit = *unsubscribeOnExit
+	execOpts.ReportConnHistogram = *reportConnHistogram
+	execOpts.ReportClientRates = *reportClientRates
+	execOpts.ConnectErrorsJson = *connectErrorsJson
+	execOpts.ResultSamples = *resultSamples
+	execOpts.DrainOnSignal = *drainOnSignal
+	execOpts.DrainTimeoutOnSignal = time.Duration(*drainTimeoutOnSignal) * time.Millisecond
+	execOpts.ReportE2EHistogram = *reportE2EHistogram
+	execOpts.TlsResumptionTest = *tlsResumptionTest
+	execOpts.Percentiles = percentiles
+	execOpts.ReportMad = *reportMad
+	execOpts.WarmupThreshold = *warmupThreshold
+	execOpts.WarmupMaxTime = time.Duration(*warmupMaxTime) * time.Millisecond
+	execOpts.TargetConfidence = *targetConfidence
+	execOpts.TargetConfidenceMaxTime = time.Duration(*targetConfidenceMaxTime) * time.Millisecond
+	execOpts.ReportConnCount = *reportConnCount
+	execOpts.RandomSuffix = *randomSuffix
+	execOpts.ResultDir = *resultDir
+	execOpts.ConnectStressRate = *connectStressRate
+	execOpts.OutlierNum = *outlierNum
+	execOpts.ValidateTopicMatch = *validateTopicMatch
+	execOpts.LatencyBackend = *latencyBackend
+	execOpts.ReportGcPause = *reportGcPause
+	execOpts.ResultChecksum = *resultChecksum
+	execOpts.ReportQos2Flow = *reportQos2Flow
+	execOpts.DialTimeout = time.Duration(*dialTimeout) * time.Millisecond
+	execOpts.MqttConnectTimeout = time.Duration(*mqttConnectTimeout) * time.Millisecond
+	execOpts.WsHeaders = wsHeaders.Header
+	if *localPortRange != "" {
+		portRange, err := ParsePortRange(*localPortRange)
+		if err != nil {
+			fmt.Printf("Invalid argument : -local-port-range -> %s\n", err)
+			os.Exit(1)
+		}
+		execOpts.LocalPortRange = portRange
+	}
+	if *noRetryOn != "" {
+		for _, pattern := range strings.Split(*noRetryOn, ",") {
+			execOpts.NoRetryOn = append(execOpts.NoRetryOn, strings.TrimSpace(pattern))
+		}
+	}
+	if *passwordCommand != "" {
+		execOpts.PasswordProvider = NewCommandPasswordProvider(*passwordCommand)
+	}
+	// 切断中のメッセージをBroker側に滞留させるため、永続セッションで接続する。
+	if method == "backlog" {
+		execOpts.ConnectOptions = append(execOpts.ConnectOptions, func(opts *MQTT.ClientOptions) {
+			opts.SetCleanSession(false)
+		})
+	}
+	// キープアライブの間隔を指定する（0の場合、pahoはPINGREQを送信しない）。
+	if *keepAlive >= 0 {
+		keepAliveInterval := time.Duration(*keepAlive) * time.Second
+		execOpts.ConnectOptions = append(execOpts.ConnectOptions, func(opts *MQTT.ClientOptions) {
+			opts.SetKeepAlive(keepAliveInterval)
+		})
+	}
 
 	Debug = *debug
+	CorrelationId = *correlationId
+
+	if method == "topology" {
+		topology, err := LoadTopology(*topologyFile)
+		if err != nil {
+			fmt.Printf("Invalid argument : -topology-file -> %s\n", err)
+			os.Exit(1)
+		}
+		// 接続エラーの場合や、配信を検証できなかった場合は失敗とする。
+		if result := ExecuteTopology(execOpts, topology); result == nil || result.Topology.Delivered == false {
+			os.Exit(1)
+		}
+		return
+	}
 
+	if *topicValidation {
+		message := CreateFixedSizeMessage(execOpts.MessageSize)
+		if err := ValidateClientTopics(execOpts, method == "sub", message); err != nil {
+			fmt.Printf("Invalid topic : %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var exec ExecFunc
 	switch method {
 	case "pub":
-		Execute(PublishAllClient, execOpts)
+		exec = PublishAllClient
 	case "sub":
-		Execute(SubscribeAllClient, execOpts)
+		exec = SubscribeAllClient
+	case "both":
+		exec = PubSubAllClient
+	case "backlog":
+		exec = BacklogAllClient
+	case "auth":
+		exec = AuthStressAllClient
+	case "calibrate":
+		exec = CalibrateAllClient
+	}
+
+	if brokers != nil {
+		results := RunCompare(exec, execOpts, brokers)
+		PrintCompare(brokers, results)
+		if *output == OUTPUT_MARKDOWN {
+			WriteMarkdownCompare(os.Stdout, brokers, results)
+		}
+		// 接続エラーや中断で、実行結果のないBrokerがあれば失敗とする。
+		for _, result := range results {
+			if result == nil {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	if matrix.IsEmpty() == false {
+		results := RunMatrix(exec, execOpts, matrix)
+		PrintMatrix(results)
+		if *output == OUTPUT_MARKDOWN {
+			WriteMarkdownMatrix(os.Stdout, results)
+		}
+		if *matrixJsonl != "" {
+			if err := WriteMatrixJsonl(*matrixJsonl, results); err != nil {
+				fmt.Printf("Matrix output error: %s\n", err)
+			}
+		}
+		// 接続エラーや中断で、実行結果のない組み合わせがあれば失敗とする。
+		for _, row := range results {
+			if row.Result == nil {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	// 接続エラーや、実行を中断した場合は失敗とする。
+	result := Execute(exec, execOpts)
+	if result == nil {
+		os.Exit(1)
+	}
+	if *output == OUTPUT_MARKDOWN {
+		WriteMarkdownResult(os.Stdout, result)
 	}
 }
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 標準出力に出力された内容を返す。
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		output <- string(content)
+	}()
+
+	defer func() {
+		os.Stdout = stdout
+	}()
+	f()
+	writer.Close()
+	return <-output
+}
+
+func TestAdaptivePacerBacksOffDuringLatencySpike(t *testing.T) {
+	pacer := NewAdaptivePacer(10 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		pacer.Observe(time.Millisecond)
+	}
+	if pacer.Delay() != 0 {
+		t.Fatalf("delay before the spike = %s, want 0", pacer.Delay())
+	}
+
+	// 応答時間が急増している間は、送信間隔が広がり続ける。
+	previous := pacer.Delay()
+	for i := 0; i < 5; i++ {
+		pacer.Observe(100 * time.Millisecond)
+		if pacer.Delay() <= previous {
+			t.Fatalf("delay during the spike = %s, want more than %s", pacer.Delay(), previous)
+		}
+		previous = pacer.Delay()
+	}
+	for i := 0; i < 20; i++ {
+		pacer.Observe(100 * time.Millisecond)
+	}
+	if pacer.Delay() != PACER_MAX_DELAY {
+		t.Errorf("delay = %s, want the cap %s", pacer.Delay(), PACER_MAX_DELAY)
+	}
+
+	// 回復後は、送信間隔が元に戻る。
+	for i := 0; i < 50; i++ {
+		pacer.Observe(time.Millisecond)
+	}
+	if pacer.Delay() != 0 {
+		t.Errorf("delay after the spike = %s, want 0", pacer.Delay())
+	}
+}
+
+func TestPublishThrottlesOnLatencySpike(t *testing.T) {
+	const spikeStart, spikeEnd = 10, 20
+	client := &testClient{OnPublish: func(index int, topic string) MQTT.Token {
+		if index >= spikeStart && index < spikeEnd {
+			return newDelayedTestToken(20*time.Millisecond, nil)
+		}
+		return newTestToken(nil)
+	}}
+
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 1
+	opts.Count = spikeEnd
+	opts.Qos = 1
+	opts.ThrottleLatency = 5
+	PublishAllClient(context.Background(), []MQTT.Client{client}, opts, NewMetrics(), CreateFixedSizeMessage(opts.MessageSize))
+
+	times := client.Times()
+	if len(times) != spikeEnd {
+		t.Fatalf("published = %d, want %d", len(times), spikeEnd)
+	}
+	interval := func(from, to int) time.Duration {
+		return times[to].Sub(times[from]) / time.Duration(to-from)
+	}
+	before := interval(0, spikeStart-1)
+	during := interval(spikeStart+5, spikeEnd-1)
+
+	// 急増した応答時間に加えて送信間隔を広げるため、送信レートは応答時間のみの場合より低くなる。
+	if during <= 20*time.Millisecond+PACER_MIN_DELAY {
+		t.Errorf("interval during the spike = %s, want more than the latency with a back-off", during)
+	}
+	if before >= during/10 {
+		t.Errorf("interval before the spike = %s, during = %s", before, during)
+	}
+}
+
+func TestUniqueTopicSuffixPerMessage(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 3
+	opts.Count = 50
+	opts.UniqueTopicSuffix = true
+
+	clients := []*testClient{{}, {}, {}}
+	PublishAllClient(context.Background(), []MQTT.Client{clients[0], clients[1], clients[2]}, opts, NewMetrics(), CreateFixedSizeMessage(opts.MessageSize))
+
+	seen := make(map[string]bool)
+	for _, client := range clients {
+		for _, topic := range client.Topics() {
+			if seen[topic] {
+				t.Fatalf("topic %s was published twice", topic)
+			}
+			seen[topic] = true
+		}
+	}
+	if len(seen) != opts.ClientNum*opts.Count {
+		t.Errorf("distinct topics = %d, want %d", len(seen), opts.ClientNum*opts.Count)
+	}
+}
+
+func TestPostResult(t *testing.T) {
+	var received Result
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Errorf("posted body is not a Result : %s", err)
+		}
+	}))
+	defer server.Close()
+
+	result := Result{
+		SchemaVersion: RESULT_SCHEMA_VERSION,
+		Broker:        "tcp://127.0.0.1:1883",
+		ClientNum:     10,
+		MessageSize:   100,
+		Qos:           1,
+		TotalCount:    1000,
+		Duration:      2000,
+		Throughput:    500,
+		Latency:       &LatencyStats{Count: 1000, Min: 0.1, Avg: 1.5, P50: 1, P95: 3, P99: 5, Max: 10}}
+	if err := PostResult(server.URL, result, false); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("Content-Type = %s", contentType)
+	}
+	if reflect.DeepEqual(received, result) == false {
+		t.Errorf("posted result = %+v, want %+v", received, result)
+	}
+}
+
+func TestPostResultChecksum(t *testing.T) {
+	var body []byte
+	var header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(RESULT_CHECKSUM_HEADER)
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	if err := PostResult(server.URL, Result{ClientNum: 1, TotalCount: 10}, true); err != nil {
+		t.Fatal(err)
+	}
+	// 送信したJSONのバイト列から、チェックサムを再計算して照合する。
+	sum := sha256.Sum256(body)
+	if expected := "sha256=" + hex.EncodeToString(sum[:]); header != expected {
+		t.Errorf("%s = %s, want %s", RESULT_CHECKSUM_HEADER, header, expected)
+	}
+
+	if err := PostResult(server.URL, Result{}, false); err != nil || header != "" {
+		t.Errorf("header without -result-checksum = %q, err = %v", header, err)
+	}
+}
+
+func TestPostResultFailsOnErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if err := PostResult(server.URL, Result{}, false); err == nil {
+		t.Error("PostResult succeeded on status 500")
+	}
+}
+
+func TestSubscribeTimeoutReturnsPartialCount(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.Count = 10
+	opts.SubscribeTimeout = 300
+
+	subscriber := connectTestClient(t, opts, 0)
+	publisher := connectTestClient(t, opts, 1)
+	go func() {
+		waitFor(5*time.Second, func() bool { return len(broker.Subscriptions(CreateClientId(0))) > 0 })
+		for i := 0; i < 3; i++ {
+			Publish(publisher, CreateClientTopic(opts, 0, i), 1, false, "message", 0)
+		}
+	}()
+
+	start := time.Now()
+	count := SubscribeAllClient(context.Background(), []MQTT.Client{subscriber}, opts, NewMetrics())
+	elapsed := time.Since(start)
+
+	if count != 3 {
+		t.Errorf("received = %d, want the partial count 3", count)
+	}
+	if elapsed < 300*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("subscribe returned after %s, want about the 300ms timeout", elapsed)
+	}
+}
+
+func TestSubscribeReceiveGap(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.Count = 6
+	opts.SubscribeTimeout = 5000
+
+	subscriber := connectTestClient(t, opts, 0)
+	publisher := connectTestClient(t, opts, 1)
+	go func() {
+		waitFor(5*time.Second, func() bool { return len(broker.Subscriptions(CreateClientId(0))) > 0 })
+		// 3件毎の間に、200msの停滞を入れる。
+		for i := 0; i < opts.Count; i++ {
+			if i == 3 {
+				time.Sleep(200 * time.Millisecond)
+			}
+			Publish(publisher, CreateClientTopic(opts, 0, i), 1, false, "message", 0)
+		}
+	}()
+
+	metrics := NewMetrics()
+	if count := SubscribeAllClient(context.Background(), []MQTT.Client{subscriber}, opts, metrics); count != opts.Count {
+		t.Fatalf("received = %d, want %d", count, opts.Count)
+	}
+	gap := CalcReceiveGap(metrics.Arrivals)
+	if gap == nil || gap.Gap < 200 || gap.Gap > 1000 || gap.Subscriber != 0 {
+		t.Errorf("gap = %+v", gap)
+	}
+}
+
+func TestTlsMinVersion(t *testing.T) {
+	cert := newTestCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	broker := startTestBroker(t, &testBroker{TlsConfig: &tls.Config{Certificates: []tls.Certificate{cert.Certificate}}})
+
+	opts := testExecOptions(broker.URL)
+	opts.CertConfig = ServerCertConfig{ServerCertFile: cert.CertFile}
+	opts.TlsMinVersion = tls.VersionTLS13
+	if config := CreateTlsConfig(opts); config == nil || config.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("TLS config = %+v, want MinVersion TLS1.3", config)
+	}
+
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	if b.Connect() == false {
+		t.Fatal("Connect failed")
+	}
+	defer b.Teardown()
+	b.Probe()
+	if b.tlsVersion != "TLS1.3" {
+		t.Errorf("negotiated version = %s, want TLS1.3", b.tlsVersion)
+	}
+}
+
+func TestTlsMinVersionRejectsOlderBroker(t *testing.T) {
+	cert := newTestCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	broker := startTestBroker(t, &testBroker{TlsConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert.Certificate},
+		MaxVersion:   tls.VersionTLS12}})
+
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.CertConfig = ServerCertConfig{ServerCertFile: cert.CertFile}
+	opts.TlsMinVersion = tls.VersionTLS13
+	if _, err := Connect(0, opts, nil, nil); err == nil {
+		t.Error("Connect succeeded to a TLS1.2 broker")
+	}
+}
+
+func TestBrokerAddress(t *testing.T) {
+	tests := map[string]string{
+		"tcp://localhost":       "localhost:1883",
+		"tcp://localhost:11883": "localhost:11883",
+		"ssl://localhost":       "localhost:8883",
+		"mqtts://localhost":     "localhost:8883",
+		"ws://localhost":        "localhost:80",
+		"wss://localhost":       "localhost:443",
+		"tcp://[::1]":           "[::1]:1883"}
+	for broker, expected := range tests {
+		uri, err := url.Parse(broker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address := BrokerAddress(uri); address != expected {
+			t.Errorf("BrokerAddress(%s) = %s, want %s", broker, address, expected)
+		}
+	}
+}
+
+// 子プロセスで main を実行する場合に、コマンドライン引数を渡す環境変数
+const testMainArgsEnv string = "MQTT_BENCH_TEST_MAIN_ARGS"
+
+// 子プロセスで実行された場合に、環境変数のコマンドライン引数で main を実行する。
+func TestMainProcess(t *testing.T) {
+	args := os.Getenv(testMainArgsEnv)
+	if args == "" {
+		t.Skip("run only as a child process")
+	}
+	os.Args = append([]string{"mqtt-bench"}, strings.Split(args, " ")...)
+	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	main()
+	os.Exit(0)
+}
+
+// 子プロセスで main を実行し、終了コードを返す。
+func runMain(t *testing.T, args ...string) int {
+	t.Helper()
+	status, _ := runMainOutput(t, args...)
+	return status
+}
+
+// 子プロセスで main を実行し、終了コードと出力を返す。
+func runMainOutput(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMainProcess$")
+	cmd.Env = append(os.Environ(), testMainArgsEnv+"="+strings.Join(args, " "))
+	output, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), string(output)
+	}
+	if err != nil {
+		t.Fatalf("%s : %s", err, output)
+	}
+	return 0, string(output)
+}
+
+func TestMainExitStatus(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	refusing := startTestBroker(t, &testBroker{Refuse: func(connect testConnect) byte { return 0x05 }})
+
+	tests := []struct {
+		args     []string
+		expected int
+	}{
+		{[]string{"-broker=" + broker.URL, "-action=pub", "-clients=2", "-count=5", "-pretime=0"}, 0},
+		{[]string{"-broker=" + broker.URL, "-action=pub", "-profile=smoke"}, 0},
+		{[]string{"-broker=" + broker.URL, "-action=pub", "-profile=unknown"}, 1},
+		{[]string{"-broker=" + broker.URL, "-action=pub", "-qos-mix=0,5"}, 1},
+		{[]string{"-broker=" + broker.URL, "-action=pub", "-local-port-range=50010-50000"}, 1},
+		{[]string{"-broker=" + broker.URL, "-action=unknown"}, 1},
+		{[]string{"-broker=" + refusing.URL, "-action=pub", "-clients=2", "-count=5"}, 1}}
+	for _, test := range tests {
+		if status := runMain(t, test.args...); status != test.expected {
+			t.Errorf("exit status of %v = %d, want %d", test.args, status, test.expected)
+		}
+	}
+}
+
+func TestFailOnConnectionLost(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 2
+	opts.Count = 1000
+	opts.IntervalTime = 10
+	opts.FailOnConnLost = true
+
+	go func() {
+		waitFor(5*time.Second, func() bool { return len(broker.Published()) > 5 })
+		broker.DropConnection(CreateClientId(1))
+	}()
+	start := time.Now()
+	if result := Execute(PublishAllClient, opts); result != nil {
+		t.Errorf("Execute returned a result after a lost connection : %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the run was not aborted : %s", elapsed)
+	}
+}
+
+func TestStoreDirUsesFileStore(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{AckDelay: 500 * time.Millisecond})
+	opts := testExecOptions(broker.URL)
+	opts.StoreDir = filepath.Join(t.TempDir(), "store")
+
+	client := connectTestClient(t, opts, 0)
+	storeDir := filepath.Join(opts.StoreDir, CreateClientId(0))
+	if info, err := os.Stat(storeDir); err != nil || info.IsDir() == false {
+		t.Fatalf("store directory is not created : %v", err)
+	}
+
+	// PUBACKを受信するまでは、QoS 1のメッセージがファイルに保持される。
+	token := client.Publish(opts.Topic+"/store", 1, false, "message")
+	stored := func() bool {
+		files, _ := filepath.Glob(filepath.Join(storeDir, "*.msg"))
+		return len(files) > 0
+	}
+	waitUntil(t, time.Second, stored)
+	if token.WaitTimeout(5*time.Second) == false || token.Error() != nil {
+		t.Fatalf("publish failed : %v", token.Error())
+	}
+	waitUntil(t, time.Second, func() bool { return stored() == false })
+
+	// 指定しない場合は、メモリストアとなりディレクトリを作成しない。
+	opts.StoreDir = ""
+	connectTestClient(t, opts, 1)
+	if _, err := os.Stat(filepath.Join(filepath.Dir(storeDir), CreateClientId(1))); err == nil {
+		t.Error("store directory is created without -store-dir")
+	}
+}
+
+func TestDrainReceivedCountsBufferedMessages(t *testing.T) {
+	// バッファされた30件のメッセージが、5ms毎に処理される。
+	var received int64 = 0
+	buffered := make(chan struct{}, 30)
+	for i := 0; i < 30; i++ {
+		buffered <- struct{}{}
+	}
+	close(buffered)
+	go func() {
+		for range buffered {
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt64(&received, 1)
+		}
+	}()
+	count := func() int { return int(atomic.LoadInt64(&received)) }
+
+	if drained := DrainReceived(count, 5*time.Second); drained != 30 || count() != 30 {
+		t.Errorf("drained = %d, received = %d, want 30", drained, count())
+	}
+
+	// 処理が続く場合も、最大待機時間で打ち切る。
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+				atomic.AddInt64(&received, 1)
+			}
+		}
+	}()
+	start := time.Now()
+	if drained := DrainReceived(count, 200*time.Millisecond); drained == 0 {
+		t.Error("no message drained")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain exceeded the timeout : %s", elapsed)
+	}
+}
+
+func TestGlobalRateCapsAggregatePublishRate(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 4
+	opts.Count = 15
+	opts.GlobalRate = 100
+
+	clients := make([]*testClient, opts.ClientNum)
+	mqttClients := make([]MQTT.Client, opts.ClientNum)
+	for id := range clients {
+		clients[id] = &testClient{}
+		mqttClients[id] = clients[id]
+	}
+	PublishAllClient(context.Background(), mqttClients, opts, NewMetrics(), CreateFixedSizeMessage(opts.MessageSize))
+
+	var first, last time.Time
+	count := 0
+	for _, client := range clients {
+		for _, at := range client.Times() {
+			if first.IsZero() || at.Before(first) {
+				first = at
+			}
+			if at.After(last) {
+				last = at
+			}
+			count++
+		}
+	}
+	if count != opts.ClientNum*opts.Count {
+		t.Fatalf("published = %d, want %d", count, opts.ClientNum*opts.Count)
+	}
+	// 最初の1件はバケットに保持されたトークンで送信するため、残りの件数で送信レートを求める。
+	rate := float64(count-1) / last.Sub(first).Seconds()
+	if rate < 80 || rate > 110 {
+		t.Errorf("aggregate rate = %.2f messages/sec, want about %.0f", rate, opts.GlobalRate)
+	}
+}
+
+func TestResultSchemaVersion(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	var result *Result
+	captureStdout(t, func() {
+		result = Execute(PublishAllClient, testExecOptions(broker.URL))
+	})
+	if result == nil {
+		t.Fatal("Execute failed")
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if version, ok := fields["schema_version"].(float64); ok == false || int(version) != RESULT_SCHEMA_VERSION || RESULT_SCHEMA_VERSION != 1 {
+		t.Errorf("schema_version = %v, want %d", fields["schema_version"], RESULT_SCHEMA_VERSION)
+	}
+
+	// 接続に失敗した場合の実行結果にも含める。
+	b := NewBenchmark(PublishAllClient, testExecOptions(broker.URL))
+	defer b.Close()
+	if failed := b.ConnectFailedResult(); failed.SchemaVersion != RESULT_SCHEMA_VERSION {
+		t.Errorf("schema_version of the connect failed result = %d", failed.SchemaVersion)
+	}
+}
+
+func TestDisconnectOnErrorThreshold(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 3
+	opts.Count = 20
+	opts.DisconnectErrs = 3
+
+	// クライアント1のPublishは、常に失敗する。
+	clients := []*testClient{{}, {OnPublish: func(index int, topic string) MQTT.Token {
+		return newTestToken(errors.New("publish failed"))
+	}}, {}}
+	metrics := NewMetrics()
+	var total int
+	captureStdout(t, func() {
+		total = PublishAllClient(context.Background(), []MQTT.Client{clients[0], clients[1], clients[2]}, opts, metrics, CreateFixedSizeMessage(opts.MessageSize))
+	})
+
+	if published := len(clients[1].Topics()); published != opts.DisconnectErrs+1 {
+		t.Errorf("failing client published %d, want %d", published, opts.DisconnectErrs+1)
+	}
+	if clients[1].IsConnected() {
+		t.Error("failing client is not disconnected")
+	}
+	for _, id := range []int{0, 2} {
+		if published := len(clients[id].Topics()); published != opts.Count || clients[id].IsConnected() == false {
+			t.Errorf("client %d published %d (connected=%t), want %d", id, published, clients[id].IsConnected(), opts.Count)
+		}
+	}
+	if dropped := atomic.LoadInt64(&metrics.DroppedClients); dropped != 1 {
+		t.Errorf("dropped clients = %d, want 1", dropped)
+	}
+	if expected := 2*opts.Count + opts.DisconnectErrs + 1; total != expected {
+		t.Errorf("total count = %d, want %d", total, expected)
+	}
+}
+
+func TestCorrelationIdInClientIds(t *testing.T) {
+	defer func(id string) { CorrelationId = id }(CorrelationId)
+	CorrelationId = "run-42"
+
+	broker := startTestBroker(t, &testBroker{})
+	var result *Result
+	captureStdout(t, func() {
+		result = Execute(PublishAllClient, testExecOptions(broker.URL))
+	})
+	if result == nil || result.CorrelationId != "run-42" {
+		t.Fatalf("result = %+v", result)
+	}
+	connects := broker.Connects()
+	if len(connects) != 2 {
+		t.Fatalf("connects = %d, want 2", len(connects))
+	}
+	for _, connect := range connects {
+		if strings.Contains(connect.ClientId, "-run-42-") == false {
+			t.Errorf("ClientID %s has no correlation id", connect.ClientId)
+		}
+	}
+
+	for id, valid := range map[string]bool{"": true, "Run_1-a": true, "run 1": false, "run/1": false, "ラン": false} {
+		if IsValidCorrelationId(id) != valid {
+			t.Errorf("IsValidCorrelationId(%q) = %t, want %t", id, !valid, valid)
+		}
+	}
+}
+
+func TestMaxInflightObserved(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 3
+	opts.Count = 4
+	opts.Qos = 1
+
+	// PUBACKを50ms保留するため、全クライアントの送信が同時に完了待ちとなる。
+	newClients := func(token func() MQTT.Token) []MQTT.Client {
+		clients := make([]MQTT.Client, opts.ClientNum)
+		for id := range clients {
+			clients[id] = &testClient{OnPublish: func(index int, topic string) MQTT.Token { return token() }}
+		}
+		return clients
+	}
+	metrics := NewMetrics()
+	PublishAllClient(context.Background(), newClients(func() MQTT.Token {
+		return newDelayedTestToken(50*time.Millisecond, nil)
+	}), opts, metrics, CreateFixedSizeMessage(opts.MessageSize))
+	if peak := metrics.Inflight.Peak(); peak != int64(opts.ClientNum) {
+		t.Errorf("peak inflight = %d, want %d", peak, opts.ClientNum)
+	}
+	if current := metrics.Inflight.Current(); current != 0 {
+		t.Errorf("inflight after the run = %d", current)
+	}
+
+	// 完了を待たずに送信する場合は、全てのメッセージが同時に完了待ちとなる。
+	opts.Qos = 0
+	opts.Qos0FlushWait = true
+	var mutex sync.Mutex
+	var tokens []*testToken
+	metrics = NewMetrics()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		PublishAllClient(context.Background(), newClients(func() MQTT.Token {
+			mutex.Lock()
+			defer mutex.Unlock()
+			token := newPendingTestToken()
+			tokens = append(tokens, token)
+			return token
+		}), opts, metrics, CreateFixedSizeMessage(opts.MessageSize))
+	}()
+	waitUntil(t, 5*time.Second, func() bool { return metrics.Inflight.Current() == int64(opts.ClientNum*opts.Count) })
+	mutex.Lock()
+	for _, token := range tokens {
+		token.complete(nil)
+	}
+	mutex.Unlock()
+	<-done
+	if peak := metrics.Inflight.Peak(); peak != int64(opts.ClientNum*opts.Count) {
+		t.Errorf("peak inflight with the flush wait = %d, want %d", peak, opts.ClientNum*opts.Count)
+	}
+}
+
+func TestIsNonRetryableError(t *testing.T) {
+	patterns := []string{"not authorized", "bad user name"}
+	if IsNonRetryableError(errors.New("Connection Refused: Not Authorized"), patterns) == false {
+		t.Error("auth error was retryable")
+	}
+	if IsNonRetryableError(errors.New("EOF"), patterns) || IsNonRetryableError(nil, patterns) {
+		t.Error("transient error was not retryable")
+	}
+}
+
+func TestNoRetryOn(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		fail     bool
+	}{
+		// 一致するエラーの接続断は、再接続せずに直ちに失敗とする。
+		// Brokerからの切断は、タイミングによりEOFとconnection resetのいずれかとなる。
+		{[]string{"eof", "connection reset"}, true},
+		// 一致しないエラーの接続断は、再接続して処理を継続する。
+		{[]string{"not authorized"}, false}}
+	for _, test := range tests {
+		broker := startTestBroker(t, &testBroker{})
+		opts := testExecOptions(broker.URL)
+		opts.ClientNum = 1
+		opts.Count = 50
+		opts.IntervalTime = 10
+		opts.NoRetryOn = test.patterns
+
+		go func() {
+			waitFor(5*time.Second, func() bool { return len(broker.Published()) > 5 })
+			broker.DropConnection(CreateClientId(0))
+		}()
+		var result *Result
+		captureStdout(t, func() {
+			result = Execute(PublishAllClient, opts)
+		})
+		if failed := result == nil; failed != test.fail {
+			t.Errorf("%v : failed = %t, want %t", test.patterns, failed, test.fail)
+		}
+		// 再接続した場合は、同じClientIDで2回接続する。
+		if connects := len(broker.Connects()); (connects == 1) != test.fail {
+			t.Errorf("%v : connects = %d", test.patterns, connects)
+		}
+	}
+}
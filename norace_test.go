@@ -0,0 +1,6 @@
+//go:build !race
+
+package main
+
+// race detector を有効にしてビルドしたかどうか
+const raceEnabled = false
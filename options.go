@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ClientOptionsへ設定を反映する関数
+type ClientOptionSetter func(opts *MQTT.ClientOptions)
+
+// -connect-options-json で指定できるキーと、その値からClientOptionsへの設定を生成する関数
+// 時間の値は、keepAliveのみ秒、それ以外はミリ秒で指定する。
+// pahoには送信中のメッセージ数の一般的な上限がないため、maxInflight は、セッションの再開時に再送する
+// 送信中のメッセージの同時送信数(SetMaxResumePubInFlight)に対応させる。
+var connectOptionParsers = map[string]func(value json.RawMessage) (ClientOptionSetter, error){
+	"keepAlive": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var sec int
+		err := json.Unmarshal(value, &sec)
+		return func(opts *MQTT.ClientOptions) { opts.SetKeepAlive(time.Duration(sec) * time.Second) }, err
+	},
+	"pingTimeout": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var ms int
+		err := json.Unmarshal(value, &ms)
+		return func(opts *MQTT.ClientOptions) { opts.SetPingTimeout(time.Duration(ms) * time.Millisecond) }, err
+	},
+	"connectTimeout": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var ms int
+		err := json.Unmarshal(value, &ms)
+		return func(opts *MQTT.ClientOptions) { opts.SetConnectTimeout(time.Duration(ms) * time.Millisecond) }, err
+	},
+	"writeTimeout": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var ms int
+		err := json.Unmarshal(value, &ms)
+		return func(opts *MQTT.ClientOptions) { opts.SetWriteTimeout(time.Duration(ms) * time.Millisecond) }, err
+	},
+	"maxReconnectInterval": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var ms int
+		err := json.Unmarshal(value, &ms)
+		return func(opts *MQTT.ClientOptions) { opts.SetMaxReconnectInterval(time.Duration(ms) * time.Millisecond) }, err
+	},
+	"cleanSession": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var b bool
+		err := json.Unmarshal(value, &b)
+		return func(opts *MQTT.ClientOptions) { opts.SetCleanSession(b) }, err
+	},
+	"orderMatters": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var b bool
+		err := json.Unmarshal(value, &b)
+		return func(opts *MQTT.ClientOptions) { opts.SetOrderMatters(b) }, err
+	},
+	"autoReconnect": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var b bool
+		err := json.Unmarshal(value, &b)
+		return func(opts *MQTT.ClientOptions) { opts.SetAutoReconnect(b) }, err
+	},
+	"messageChannelDepth": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var n uint
+		err := json.Unmarshal(value, &n)
+		return func(opts *MQTT.ClientOptions) { opts.SetMessageChannelDepth(n) }, err
+	},
+	"maxInflight": func(value json.RawMessage) (ClientOptionSetter, error) {
+		var n int
+		err := json.Unmarshal(value, &n)
+		return func(opts *MQTT.ClientOptions) { opts.SetMaxResumePubInFlight(n) }, err
+	},
+}
+
+// 指定できるキーの一覧を返す。
+func ConnectOptionKeys() []string {
+	keys := make([]string, 0, len(connectOptionParsers))
+	for key := range connectOptionParsers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// JSON形式の接続オプションを解析し、ClientOptionsへの設定の一覧を返す。
+// 未対応のキーや、型の異なる値が含まれる場合はエラーを返す。
+//   text : JSON形式の接続オプション（例 : {"keepAlive":30,"cleanSession":false}）
+func ParseConnectOptionsJson(text string) ([]ClientOptionSetter, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(text), &values); err != nil {
+		return nil, err
+	}
+
+	// エラー内容を安定させるため、キーの順に処理する。
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var setters []ClientOptionSetter
+	for _, key := range keys {
+		parser, ok := connectOptionParsers[key]
+		if ok == false {
+			return nil, fmt.Errorf("unknown key : %s (supported : %s)", key, strings.Join(ConnectOptionKeys(), ", "))
+		}
+		setter, err := parser(values[key])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value : %s -> %s", key, values[key])
+		}
+		setters = append(setters, setter)
+	}
+	return setters, nil
+}
+
+// 接続毎に、接続時のパスワードを返す関数
+//   id : クライアントの連番
+type PasswordProvider func(id int) (string, error)
+
+// コマンドを実行し、その標準出力をパスワードとして返すPasswordProviderを生成する。
+// 有効期限の短いトークン(JWTなど)を、接続の都度取得するために利用する。
+// コマンドには、環境変数 MQTT_BENCH_CLIENT_ID でクライアントIDを渡す。
+//   command : シェルで実行するコマンド
+func NewCommandPasswordProvider(command string) PasswordProvider {
+	return func(id int) (string, error) {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), "MQTT_BENCH_CLIENT_ID="+CreateClientId(id))
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("password command failed : %s", err)
+		}
+		return strings.TrimSpace(string(output)), nil
+	}
+}
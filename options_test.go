@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseConnectOptionsJson(t *testing.T) {
+	setters, err := ParseConnectOptionsJson(`{
+		"keepAlive": 30,
+		"pingTimeout": 1500,
+		"connectTimeout": 2500,
+		"writeTimeout": 3500,
+		"maxReconnectInterval": 4500,
+		"cleanSession": false,
+		"orderMatters": false,
+		"autoReconnect": false,
+		"messageChannelDepth": 500,
+		"maxInflight": 20}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(setters) != len(connectOptionParsers) {
+		t.Errorf("setters = %d, want every supported key (%d)", len(setters), len(connectOptionParsers))
+	}
+
+	opts := MQTT.NewClientOptions()
+	for _, setter := range setters {
+		setter(opts)
+	}
+	if opts.KeepAlive != 30 {
+		t.Errorf("KeepAlive = %d", opts.KeepAlive)
+	}
+	if opts.PingTimeout != 1500*time.Millisecond || opts.ConnectTimeout != 2500*time.Millisecond ||
+		opts.WriteTimeout != 3500*time.Millisecond || opts.MaxReconnectInterval != 4500*time.Millisecond {
+		t.Errorf("timeouts = %s, %s, %s, %s", opts.PingTimeout, opts.ConnectTimeout, opts.WriteTimeout, opts.MaxReconnectInterval)
+	}
+	if opts.CleanSession || opts.Order || opts.AutoReconnect {
+		t.Errorf("flags = cleanSession %t, orderMatters %t, autoReconnect %t", opts.CleanSession, opts.Order, opts.AutoReconnect)
+	}
+	if opts.MessageChannelDepth != 500 || opts.MaxResumePubInFlight != 20 {
+		t.Errorf("messageChannelDepth = %d, maxInflight = %d", opts.MessageChannelDepth, opts.MaxResumePubInFlight)
+	}
+}
+
+func TestParseConnectOptionsJsonErrors(t *testing.T) {
+	tests := map[string]string{
+		`{"keepAlive":30,"unknown":1}`: "unknown key : unknown",
+		`{"cleanSession":"yes"}`:       "invalid value : cleanSession",
+		`{"keepAlive":`:                "unexpected end of JSON input"}
+	for text, message := range tests {
+		_, err := ParseConnectOptionsJson(text)
+		if err == nil || strings.Contains(err.Error(), message) == false {
+			t.Errorf("ParseConnectOptionsJson(%s) = %v, want %q", text, err, message)
+		}
+	}
+}
+
+func TestPasswordProviderOnEachConnect(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.Username = "user"
+	var mutex sync.Mutex
+	calls := 0
+	opts.PasswordProvider = func(id int) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls++
+		return fmt.Sprintf("token-%d-%d", id, calls), nil
+	}
+
+	// 自動再接続の際も、新しいパスワードで接続する。
+	connectTestClient(t, opts, 0)
+	broker.DropConnection(CreateClientId(0))
+	waitUntil(t, 5*time.Second, func() bool { return len(broker.Connects()) >= 2 })
+
+	connects := broker.Connects()
+	for i, expected := range []string{"token-0-1", "token-0-2"} {
+		if connects[i].Username != "user" || connects[i].Password != expected {
+			t.Errorf("connect %d = username %s, password %s, want %s", i, connects[i].Username, connects[i].Password, expected)
+		}
+	}
+}
+
+func TestCommandPasswordProvider(t *testing.T) {
+	provider := NewCommandPasswordProvider("echo token-$MQTT_BENCH_CLIENT_ID")
+	if password, err := provider(3); err != nil || password != "token-"+CreateClientId(3) {
+		t.Errorf("password = %s, %v", password, err)
+	}
+	if _, err := NewCommandPasswordProvider("exit 1")(0); err == nil {
+		t.Error("failed command returned a password")
+	}
+}
+
+func TestWsHeadersAppliedToWebsocketBroker(t *testing.T) {
+	// WebSocketのハンドシェイクの要求を記録し、接続は拒否する。
+	requests := make(chan *http.Request, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	headers := make(http.Header)
+	headers.Set("Authorization", "Bearer abc")
+	headers.Set("Host", "mqtt.example.com")
+	var applied http.Header
+	opts := testExecOptions("ws://" + server.Listener.Addr().String() + "/mqtt")
+	opts.WsHeaders = headers
+	opts.ConnectOptions = []ClientOptionSetter{func(o *MQTT.ClientOptions) { applied = o.HTTPHeaders }}
+
+	captureStdout(t, func() {
+		if _, err := Connect(0, opts, nil, nil); err == nil {
+			t.Error("Connect succeeded")
+		}
+	})
+	if applied.Get("Authorization") != "Bearer abc" || applied.Get("Host") != "mqtt.example.com" {
+		t.Errorf("ClientOptions headers = %v", applied)
+	}
+	select {
+	case r := <-requests:
+		if r.Header.Get("Authorization") != "Bearer abc" || r.Host != "mqtt.example.com" {
+			t.Errorf("handshake headers = %v, host = %s", r.Header, r.Host)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no websocket handshake")
+	}
+
+	// ws/wss以外のBrokerには反映しない。
+	broker := startTestBroker(t, &testBroker{})
+	opts.Broker = broker.URL
+	client, err := Connect(0, opts, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(0)
+	if len(applied) != 0 {
+		t.Errorf("headers applied to %s : %v", broker.URL, applied)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 応答時間の遅いメッセージ
+type LatencyOutlier struct {
+	Topic    string  `json:"topic"`      // Topic
+	ClientId int     `json:"client"`     // クライアントの連番
+	Seq      int     `json:"seq"`        // クライアント内のメッセージの連番
+	Latency  float64 `json:"latency_ms"` // 応答時間(ms)
+}
+
+// 応答時間の昇順のヒープ（先頭が、保持している中で最も速いメッセージとなる）
+type outlierHeap []LatencyOutlier
+
+func (h outlierHeap) Len() int            { return len(h) }
+func (h outlierHeap) Less(i, j int) bool  { return h[i].Latency < h[j].Latency }
+func (h outlierHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *outlierHeap) Push(x interface{}) { *h = append(*h, x.(LatencyOutlier)) }
+func (h *outlierHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// 複数のクライアントから並行して、応答時間の遅い上位のメッセージを記録する。
+// 保持するメッセージ数を上限とするヒープで、記録するメモリを抑える。
+type OutlierTracker struct {
+	mutex sync.Mutex
+	size  int         // 保持するメッセージ数
+	heap  outlierHeap // 保持しているメッセージ
+}
+
+// OutlierTrackerを生成する。
+//   size : 保持するメッセージ数
+func NewOutlierTracker(size int) *OutlierTracker {
+	return &OutlierTracker{size: size}
+}
+
+// メッセージの応答時間を記録する（nil の場合は何もしない）。
+func (t *OutlierTracker) Record(topic string, clientId int, seq int, latency time.Duration) {
+	if t == nil {
+		return
+	}
+	outlier := LatencyOutlier{Topic: topic, ClientId: clientId, Seq: seq, Latency: ToMillis(latency)}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.heap) < t.size {
+		heap.Push(&t.heap, outlier)
+		return
+	}
+	if outlier.Latency > t.heap[0].Latency {
+		t.heap[0] = outlier
+		heap.Fix(&t.heap, 0)
+	}
+}
+
+// 応答時間の遅い順に、保持しているメッセージを返す。
+func (t *OutlierTracker) Outliers() []LatencyOutlier {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	outliers := make([]LatencyOutlier, len(t.heap))
+	copy(outliers, t.heap)
+	sort.Slice(outliers, func(i, j int) bool { return outliers[i].Latency > outliers[j].Latency })
+	return outliers
+}
+
+// 応答時間の遅いメッセージを、1行の文字列に整形する。
+func (o LatencyOutlier) String() string {
+	return fmt.Sprintf("latency=%.3fms, client=%d, seq=%d, topic=%s", o.Latency, o.ClientId, o.Seq, o.Topic)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+	"time"
+)
+
+func TestOutlierTracker(t *testing.T) {
+	var tracker *OutlierTracker
+	tracker.Record("a", 0, 0, time.Second) // nil の場合は何もしない
+
+	tracker = NewOutlierTracker(5)
+	for _, d := range shuffledMillis(1, 200) {
+		ms := int(d / time.Millisecond)
+		tracker.Record(fmt.Sprintf("t/%d", ms), ms%4, ms, d)
+	}
+	outliers := tracker.Outliers()
+	if len(outliers) != 5 {
+		t.Fatalf("outliers = %v", outliers)
+	}
+	// 遅い順に、上位5件の応答時間と、そのメッセージの情報を返す。
+	for i, outlier := range outliers {
+		ms := 200 - i
+		expected := LatencyOutlier{Topic: fmt.Sprintf("t/%d", ms), ClientId: ms % 4, Seq: ms, Latency: float64(ms)}
+		if outlier != expected {
+			t.Errorf("outlier %d = %+v, want %+v", i, outlier, expected)
+		}
+	}
+}
+
+func TestPublishReportsOutliers(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 2
+	opts.Count = 10
+	opts.OutlierNum = 2
+
+	// 各クライアントの特定のメッセージのみ、応答を遅延させる（クライアント1の方が遅い）。
+	delays := []time.Duration{30 * time.Millisecond, 60 * time.Millisecond}
+	clients := []*testClient{{}, {}}
+	for id, client := range clients {
+		delay, seq := delays[id], 3*(id+1)
+		client.OnPublish = func(index int, topic string) MQTT.Token {
+			if index == seq {
+				return newDelayedTestToken(delay, nil)
+			}
+			return newTestToken(nil)
+		}
+	}
+	metrics := NewMetrics()
+	metrics.Outliers = NewOutlierTracker(opts.OutlierNum)
+	PublishAllClient(context.Background(), []MQTT.Client{clients[0], clients[1]}, opts, metrics, CreateFixedSizeMessage(opts.MessageSize))
+
+	outliers := metrics.Outliers.Outliers()
+	if len(outliers) != 2 {
+		t.Fatalf("outliers = %v", outliers)
+	}
+	for i, outlier := range outliers {
+		id := 1 - i
+		if outlier.ClientId != id || outlier.Seq != 3*(id+1) || outlier.Topic != CreateClientTopic(opts, id, 3*(id+1)) {
+			t.Errorf("outlier %d = %+v", i, outlier)
+		}
+		if outlier.Latency < ToMillis(delays[id]) {
+			t.Errorf("outlier %d latency = %.3fms, want >= %s", i, outlier.Latency, delays[id])
+		}
+	}
+}
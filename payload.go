@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ペイロードのテンプレートに渡す値
+type PayloadData struct {
+	ClientId  int   // クライアントの連番
+	Seq       int   // クライアント内のメッセージの連番
+	Timestamp int64 // 生成時刻(UnixNano)
+}
+
+// ペイロードのテンプレートを解析する。
+//   text : text/template形式のテンプレート（例 : {"device":"dev-{{.ClientId}}","seq":{{.Seq}}}）
+func ParsePayloadTemplate(text string) (*template.Template, error) {
+	return template.New("payload").Parse(text)
+}
+
+// テンプレートから、ペイロードを生成する。
+func RenderPayload(tmpl *template.Template, clientId int, seq int) (string, error) {
+	var buffer bytes.Buffer
+	data := PayloadData{
+		ClientId:  clientId,
+		Seq:       seq,
+		Timestamp: time.Now().UnixNano()}
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// JSON形式のペイロードから、指定されたフィールドの値を文字列で返す。
+//   payload : JSON形式のペイロード
+//   path    : フィールドのパス（ネストしたフィールドは "device.id" のように . で区切る）
+func JsonFieldValue(payload string, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		return "", err
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if ok == false {
+			return "", fmt.Errorf("field is not an object : %s", path)
+		}
+		value, ok = object[key]
+		if ok == false {
+			return "", fmt.Errorf("field is not found : %s", path)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("field is not a scalar value : %s", path)
+	}
+}
+
+// 可変サイズのペイロードを生成する。
+// 内容は固定サイズのメッセージと同様に、0-9の数字の繰り返しとなる。
+func CreateVariableSizePayload(size int) []byte {
+	payload := make([]byte, size)
+	FillPayload(payload)
+	return payload
+}
+
+// バッファを0-9の数字の繰り返しで埋める。
+func FillPayload(buffer []byte) {
+	for i := range buffer {
+		buffer[i] = byte('0' + i%10)
+	}
+}
+
+// 可変サイズのペイロード用のバッファを再利用するためのプール
+// バッファは最大サイズで確保し、内容は生成時に埋めておくため、
+// 必要なサイズに切り出すだけで利用できる（バッファの内容は変更しないこと）。
+type PayloadPool struct {
+	pool sync.Pool
+}
+
+// PayloadPoolを生成する。
+//   maxSize : ペイロードの最大サイズ(byte)
+func NewPayloadPool(maxSize int) *PayloadPool {
+	p := &PayloadPool{}
+	p.pool.New = func() interface{} {
+		buffer := CreateVariableSizePayload(maxSize)
+		return &buffer
+	}
+	return p
+}
+
+// プールからバッファを取得する。
+// 利用後は、Put で返却すること。
+func (p *PayloadPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// バッファをプールへ返却する。
+func (p *PayloadPool) Put(buffer *[]byte) {
+	p.pool.Put(buffer)
+}
+
+// ペイロードの先頭に埋め込むヘッダーの識別子
+const MESSAGE_HEADER_PREFIX string = "mqttbench"
+
+// 送受信を照合するために、ペイロードの先頭に埋め込む情報
+type MessageHeader struct {
+	ClientId int    // 送信したクライアントの連番
+	Seq      int    // クライアント内のメッセージの連番
+	Key      string // 冪等性キー
+	SentAt   int64  // 送信時刻(UnixNano)
+}
+
+// ヘッダーを埋め込んだペイロードを生成する。
+// ヘッダーの後ろは、全体が指定されたサイズになるまで0-9の数字で埋める
+// （ヘッダーがサイズを超える場合は、ヘッダーのみとなる）。
+func CreateHeaderPayload(header MessageHeader, size int) []byte {
+	text := fmt.Sprintf("%s|%d|%d|%s|%d|", MESSAGE_HEADER_PREFIX, header.ClientId, header.Seq, header.Key, header.SentAt)
+	if len(text) >= size {
+		return []byte(text)
+	}
+
+	payload := make([]byte, size)
+	copy(payload, text)
+	FillPayload(payload[len(text):])
+	return payload
+}
+
+// ペイロードの先頭に埋め込まれたヘッダーを解析する。
+func ParseMessageHeader(payload []byte) (MessageHeader, error) {
+	header := MessageHeader{}
+	fields := strings.SplitN(string(payload), "|", 6)
+	if len(fields) < 6 || fields[0] != MESSAGE_HEADER_PREFIX {
+		return header, fmt.Errorf("message header is not found")
+	}
+
+	var err error
+	if header.ClientId, err = strconv.Atoi(fields[1]); err != nil {
+		return header, fmt.Errorf("invalid client id : %s", fields[1])
+	}
+	if header.Seq, err = strconv.Atoi(fields[2]); err != nil {
+		return header, fmt.Errorf("invalid sequence : %s", fields[2])
+	}
+	header.Key = fields[3]
+	if header.SentAt, err = strconv.ParseInt(fields[4], 10, 64); err != nil {
+		return header, fmt.Errorf("invalid timestamp : %s", fields[4])
+	}
+	return header, nil
+}
+
+// ペイロードの末尾に付与する署名の長さ（区切り文字 | と、HMAC-SHA256の16進数表記）
+const PAYLOAD_SIGNATURE_LENGTH int = 1 + sha256.Size*2
+
+// 署名を付与した場合に、全体が指定されたサイズとなる署名前のペイロードのサイズを返す。
+func SignedBodySize(size int) int {
+	if size < PAYLOAD_SIGNATURE_LENGTH {
+		return 0
+	}
+	return size - PAYLOAD_SIGNATURE_LENGTH
+}
+
+// ペイロードの末尾に、共有鍵によるHMAC-SHA256の署名を付与する。
+//   payload : 署名前のペイロード
+//   key     : 共有鍵
+func SignPayload(payload []byte, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	signed := make([]byte, 0, len(payload)+PAYLOAD_SIGNATURE_LENGTH)
+	signed = append(signed, payload...)
+	signed = append(signed, '|')
+	signed = append(signed, hex.EncodeToString(mac.Sum(nil))...)
+	return signed
+}
+
+// ペイロードの末尾の署名を検証する。
+// 署名がない場合や、ペイロードが改ざんされている場合は false を返す。
+func VerifyPayload(payload []byte, key []byte) bool {
+	if len(payload) < PAYLOAD_SIGNATURE_LENGTH {
+		return false
+	}
+	bodyLen := len(payload) - PAYLOAD_SIGNATURE_LENGTH
+	if payload[bodyLen] != '|' {
+		return false
+	}
+	signature, err := hex.DecodeString(string(payload[bodyLen+1:]))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload[:bodyLen])
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// string または []byte のペイロードを、[]byte で返す。
+func PayloadBytes(payload interface{}) []byte {
+	switch p := payload.(type) {
+	case []byte:
+		return p
+	case string:
+		return []byte(p)
+	default:
+		return []byte(fmt.Sprint(p))
+	}
+}
+
+// string または []byte のペイロードのサイズ(byte)を返す。
+func PayloadSize(payload interface{}) int {
+	switch p := payload.(type) {
+	case []byte:
+		return len(p)
+	case string:
+		return len(p)
+	default:
+		return len(PayloadBytes(p))
+	}
+}
+
+// ランダムな末尾に利用する文字
+const RANDOM_SUFFIX_CHARS string = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// ペイロードの末尾の指定されたバイト数を、ランダムな英数字に置き換えたペイロードを、バッファへ書き込んで返す。
+// サイズは変えず、それ以外の部分は元のペイロードのままとなる（元のペイロードは変更しない）。
+// Publish毎に確保しないように、バッファはプールから取得したものを再利用し、容量が足りない場合のみ拡張する。
+//   buffer  : 書き込み先のバッファ
+//   payload : 元のペイロード（string または []byte）
+//   n       : ランダムにする末尾のバイト数（ペイロードより長い場合は全体）
+func RandomizeSuffix(buffer *[]byte, payload interface{}, n int) []byte {
+	size := PayloadSize(payload)
+	if cap(*buffer) < size {
+		*buffer = make([]byte, size)
+	}
+	randomized := (*buffer)[:size]
+	if s, ok := payload.(string); ok {
+		copy(randomized, s)
+	} else {
+		copy(randomized, PayloadBytes(payload))
+	}
+	if n > len(randomized) {
+		n = len(randomized)
+	}
+
+	suffix := randomized[len(randomized)-n:]
+	rand.Read(suffix)
+	for i, b := range suffix {
+		suffix[i] = RANDOM_SUFFIX_CHARS[int(b)%len(RANDOM_SUFFIX_CHARS)]
+	}
+	return randomized
+}
+
+// 署名の検証結果
+type SignatureStats struct {
+	Verified int `json:"verified"` // 署名の検証に成功したメッセージ数
+	Invalid  int `json:"invalid"`  // 署名の検証に失敗したメッセージ数
+}
+
+// Base64でエンコードされたファイルを読み込み、デコードしたバイナリのペイロードを返す。
+// 改行などの空白文字は無視する。
+func LoadBase64Payload(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(content)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 content : %s", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ベンチマークで、可変サイズのペイロードの最小・最大サイズ(byte)
+const (
+	benchmarkSizeMin int = 64
+	benchmarkSizeMax int = 65536
+)
+
+// 生成したペイロードを、コンパイラの最適化で除去されないように保持する。
+var payloadSink interface{}
+
+// プールを利用せずに、メッセージ毎に可変サイズのペイロードを生成する。
+func BenchmarkVariableSizePayload(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		size := benchmarkSizeMin + rand.Intn(benchmarkSizeMax-benchmarkSizeMin+1)
+		var payload interface{} = CreateVariableSizePayload(size)
+		payloadSink = payload
+	}
+}
+
+// プールのバッファを切り出して、可変サイズのペイロードを生成する。
+func BenchmarkVariableSizePayloadPool(b *testing.B) {
+	pool := NewPayloadPool(benchmarkSizeMax)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		size := benchmarkSizeMin + rand.Intn(benchmarkSizeMax-benchmarkSizeMin+1)
+		buffer := pool.Get()
+		var payload interface{} = (*buffer)[:size]
+		payloadSink = payload
+		pool.Put(buffer)
+	}
+}
+
+func TestPayloadPoolReducesAllocations(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skip benchmarks in short mode")
+	}
+	if raceEnabled {
+		t.Skip("sync.Pool drops items randomly with the race detector")
+	}
+	plain := testing.Benchmark(BenchmarkVariableSizePayload)
+	pooled := testing.Benchmark(BenchmarkVariableSizePayloadPool)
+
+	// プールを利用する場合は、バッファを確保しないため、確保するバイト数が大幅に減る。
+	if pooled.AllocedBytesPerOp()*100 > plain.AllocedBytesPerOp() {
+		t.Errorf("allocated bytes/op = %d with the pool, %d without", pooled.AllocedBytesPerOp(), plain.AllocedBytesPerOp())
+	}
+	if pooled.AllocsPerOp() >= plain.AllocsPerOp() {
+		t.Errorf("allocs/op = %d with the pool, %d without", pooled.AllocsPerOp(), plain.AllocsPerOp())
+	}
+}
+
+func TestPayloadPoolBufferContent(t *testing.T) {
+	pool := NewPayloadPool(100)
+	buffer := pool.Get()
+	if len(*buffer) != 100 || string((*buffer)[:12]) != "012345678901" {
+		t.Errorf("pooled buffer = %q", *buffer)
+	}
+	pool.Put(buffer)
+}
+
+func TestSignPayload(t *testing.T) {
+	key := []byte("secret")
+	body := CreateFixedSizeMessage(SignedBodySize(128))
+	signed := SignPayload([]byte(body), key)
+	if len(signed) != 128 {
+		t.Errorf("signed size = %d, want 128", len(signed))
+	}
+	if VerifyPayload(signed, key) == false {
+		t.Error("signed payload is not verified")
+	}
+
+	tampered := append([]byte(nil), signed...)
+	tampered[0] ^= 1
+	if VerifyPayload(tampered, key) {
+		t.Error("tampered payload is verified")
+	}
+	if VerifyPayload(signed, []byte("other")) {
+		t.Error("payload is verified with another key")
+	}
+	if VerifyPayload([]byte(body), key) || VerifyPayload(signed[:len(signed)-1], key) {
+		t.Error("payload without a valid signature is verified")
+	}
+	if SignedBodySize(PAYLOAD_SIGNATURE_LENGTH-1) != 0 {
+		t.Errorf("body size smaller than the signature = %d", SignedBodySize(PAYLOAD_SIGNATURE_LENGTH-1))
+	}
+}
+
+func TestPubSubVerifiesSignatures(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.MessageSize = 128
+	opts.HmacKey = []byte("secret")
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil || result.Signatures == nil {
+		t.Fatalf("no signature result : %s", output)
+	}
+	if result.Signatures.Verified != 20 || result.Signatures.Invalid != 0 {
+		t.Errorf("signatures = %+v, want 20 verified", result.Signatures)
+	}
+	for _, msg := range broker.Published() {
+		if len(msg.Payload) != opts.MessageSize {
+			t.Fatalf("signed message size = %d, want %d", len(msg.Payload), opts.MessageSize)
+		}
+	}
+
+	// 改ざんされたメッセージや、別の鍵で署名されたメッセージは、検証に失敗する。
+	receiver := NewPubSubReceiver(nil, false, opts.HmacKey, 0)
+	payload := SignPayload(CreateHeaderPayload(MessageHeader{Key: "k"}, SignedBodySize(128)), opts.HmacKey)
+	receiver.Receive(&testMqttMessage{topic: BASE_TOPIC, payload: payload}, time.Now())
+	tampered := append([]byte(nil), payload...)
+	tampered[len(tampered)-PAYLOAD_SIGNATURE_LENGTH-1] ^= 1
+	receiver.Receive(&testMqttMessage{topic: BASE_TOPIC, payload: tampered}, time.Now())
+	receiver.Receive(&testMqttMessage{topic: BASE_TOPIC, payload: SignPayload(payload, []byte("other"))}, time.Now())
+	if receiver.Signatures.Verified != 1 || receiver.Signatures.Invalid != 2 {
+		t.Errorf("signatures = %+v, want 1 verified, 2 invalid", receiver.Signatures)
+	}
+}
+
+func TestPayloadBase64File(t *testing.T) {
+	// 改行で折り返した、Base64でエンコードされたバイナリのペイロード
+	decoded := []byte{0x00, 0x01, 0xfe, 0xff, 0x7f, 0x80, 0x0a, 0x0d, 0x00, 0x42}
+	encoded := base64.StdEncoding.EncodeToString(decoded)
+	path := filepath.Join(t.TempDir(), "payload.b64")
+	if err := os.WriteFile(path, []byte(encoded[:8]+"\n"+encoded[8:]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := LoadBase64Payload(path)
+	if err != nil || bytes.Equal(payload, decoded) == false {
+		t.Fatalf("payload = %x, %v, want %x", payload, err, decoded)
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.b64")
+	if err := os.WriteFile(invalid, []byte("not base64!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBase64Payload(invalid); err == nil || strings.Contains(err.Error(), "invalid base64 content") == false {
+		t.Errorf("invalid content error = %v", err)
+	}
+
+	// 終了する前にBrokerが受信するように、QoS 1で送信する。
+	broker := startTestBroker(t, &testBroker{})
+	status, output := runMainOutput(t, "-broker="+broker.URL, "-action=pub", "-clients=1", "-count=3", "-qos=1", "-pretime=0", "-payload-base64-file="+path)
+	if status != 0 {
+		t.Fatalf("exit status = %d :\n%s", status, output)
+	}
+	published := broker.Published()
+	if len(published) != 3 {
+		t.Fatalf("published %d, want 3", len(published))
+	}
+	for _, msg := range published {
+		if bytes.Equal(msg.Payload, decoded) == false {
+			t.Errorf("published payload = %x, want %x", msg.Payload, decoded)
+		}
+	}
+
+	// デコードできない場合は、接続する前にエラーで終了する。
+	if status := runMain(t, "-broker="+broker.URL, "-action=pub", "-payload-base64-file="+invalid); status != 1 {
+		t.Errorf("exit status with invalid content = %d, want 1", status)
+	}
+}
+
+func TestIncrementalPayloadSize(t *testing.T) {
+	for _, usePool := range []bool{false, true} {
+		opts := testExecOptions("tcp://127.0.0.1:1883")
+		opts.Count = 10
+		opts.SizeStart = 10
+		opts.SizeStep = 5
+		opts.SizeMax = 40
+		opts.UsePayloadPool = usePool
+
+		client := &testClient{}
+		PublishAllClient(context.Background(), []MQTT.Client{client}, opts, NewMetrics(), "")
+		payloads := client.Payloads()
+		if len(payloads) != opts.Count {
+			t.Fatalf("published %d, want %d", len(payloads), opts.Count)
+		}
+		// i番目のメッセージは start + i×step となり、最大サイズで頭打ちとなる。
+		for i, payload := range payloads {
+			expected := opts.SizeStart + i*opts.SizeStep
+			if expected > opts.SizeMax {
+				expected = opts.SizeMax
+			}
+			if len(payload) != expected {
+				t.Errorf("pool = %t : message %d size = %d, want %d", usePool, i, len(payload), expected)
+			}
+		}
+	}
+}
+
+func TestRandomizeSuffix(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.Count = 20
+	opts.MessageSize = 64
+	opts.RandomSuffix = 8
+
+	client := &testClient{}
+	PublishAllClient(context.Background(), []MQTT.Client{client}, opts, NewMetrics(), CreateFixedSizeMessage(opts.MessageSize))
+	payloads := client.Payloads()
+	if len(payloads) != opts.Count {
+		t.Fatalf("published %d, want %d", len(payloads), opts.Count)
+	}
+	prefix := CreateFixedSizeMessage(opts.MessageSize)[:opts.MessageSize-opts.RandomSuffix]
+	suffixes := make(map[string]bool)
+	for i, payload := range payloads {
+		if len(payload) != opts.MessageSize {
+			t.Fatalf("message %d size = %d", i, len(payload))
+		}
+		// 末尾以外は、全てのメッセージで同じ内容となる。
+		if string(payload[:len(prefix)]) != prefix {
+			t.Errorf("message %d prefix = %s", i, payload[:len(prefix)])
+		}
+		suffix := string(payload[len(prefix):])
+		if strings.Trim(suffix, RANDOM_SUFFIX_CHARS) != "" {
+			t.Errorf("message %d suffix = %q", i, suffix)
+		}
+		suffixes[suffix] = true
+	}
+	if len(suffixes) != opts.Count {
+		t.Errorf("distinct suffixes = %d, want %d", len(suffixes), opts.Count)
+	}
+
+	// プールのバッファを再利用し、Publish毎に確保しない。
+	pool := NewPayloadPool(0)
+	payload := []byte(prefix + "01234567")
+	var source interface{} = payload
+	allocs := testing.AllocsPerRun(100, func() {
+		buffer := pool.Get()
+		RandomizeSuffix(buffer, source, opts.RandomSuffix)
+		pool.Put(buffer)
+	})
+	if allocs > 0 {
+		t.Errorf("allocations per randomize = %.1f", allocs)
+	}
+	if string(payload) != prefix+"01234567" {
+		t.Errorf("source payload was modified : %s", payload)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// 接続済みのコネクションでCONNECTを送信し、CONNACKで接続が受け付けられたことを確認する。
+func probeMqttConnect(conn net.Conn, clientId string, username string, password string) error {
+	if _, err := conn.Write(CreateConnectPacket(clientId, username, password)); err != nil {
+		return err
+	}
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connack); err != nil {
+		return err
+	}
+
+	if connack[0] != 0x20 {
+		return fmt.Errorf("unexpected packet : 0x%02x", connack[0])
+	}
+	if connack[3] != 0 {
+		return errors.New("connection refused : return code " + strconv.Itoa(int(connack[3])))
+	}
+	return nil
+}
+
+// プローブ接続で利用するパスワードを返す。
+// パスワードの取得コマンドが指定されている場合は、ベンチマークの接続と同様に、接続毎に取得する。
+//   id : プローブ接続の連番（ClientIDの生成に利用する連番）
+func ProbePassword(opts ExecOptions, id int) (string, error) {
+	if opts.PasswordProvider != nil {
+		return opts.PasswordProvider(id)
+	}
+	return opts.Password, nil
+}
+
+// MQTT 3.1.1のCONNECTパケットを生成する（クリーンセッション、キープアライブ 10秒）。
+// pahoと同様に、パスワードはユーザー名が指定されている場合のみ設定する（ユーザー名のないパスワードは、仕様で禁止されている）。
+func CreateConnectPacket(clientId string, username string, password string) []byte {
+	var flags byte = 0x02 // clean session
+	payload := encodeMqttString(clientId)
+	if username != "" {
+		flags |= 0x80
+		payload = append(payload, encodeMqttString(username)...)
+		if password != "" {
+			flags |= 0x40
+			payload = append(payload, encodeMqttString(password)...)
+		}
+	}
+
+	body := append(encodeMqttString("MQTT"), 0x04, flags, 0x00, 0x0a)
+	body = append(body, payload...)
+
+	packet := []byte{0x10}
+	packet = append(packet, encodeRemainingLength(len(body))...)
+	return append(packet, body...)
+}
+
+// MQTTの文字列（2byteの長さと、UTF-8の文字列）にエンコードする。
+func encodeMqttString(text string) []byte {
+	encoded := []byte{byte(len(text) >> 8), byte(len(text))}
+	return append(encoded, text...)
+}
+
+// MQTTの残りの長さ（可変長）にエンコードする。
+func encodeRemainingLength(length int) []byte {
+	var encoded []byte
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		encoded = append(encoded, digit)
+		if length == 0 {
+			return encoded
+		}
+	}
+}
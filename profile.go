@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 名前付きのプリセット
+// フラグ名と値の組で定義し、明示的に指定されたフラグは上書きしない。
+var Profiles = map[string]map[string]string{
+	// 動作確認用（少数のクライアントで短時間）
+	"smoke": {
+		"clients": "1",
+		"count":   "10",
+		"pretime": "0",
+	},
+	// 標準的な計測
+	"standard": {
+		"clients": "10",
+		"count":   "1000",
+		"pretime": "3000",
+	},
+	// 長時間の計測（1クライアント当たり約100messages/secで、約17分）
+	"soak": {
+		"clients":      "50",
+		"count":        "100000",
+		"pretime":      "3000",
+		"intervaltime": "10",
+	},
+}
+
+// プリセットの名前の一覧を返す。
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// 全てのプリセットのフラグ名が、定義されたフラグであることを検証する。
+// フラグの名前を変更した場合に、プリセットの定義の修正漏れを検出するために利用する。
+func ValidateProfiles(flags *flag.FlagSet) error {
+	for _, name := range ProfileNames() {
+		keys := make([]string, 0, len(Profiles[name]))
+		for key := range Profiles[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if flags.Lookup(key) == nil {
+				return fmt.Errorf("profile %s has an undefined flag : %s", name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// プリセットを、明示的に指定されていないフラグに反映する。
+// flag.Parse の後に呼び出すこと。
+//   flags : フラグの定義
+//   name  : プリセットの名前
+func ApplyProfile(flags *flag.FlagSet, name string) error {
+	profile, ok := Profiles[name]
+	if ok == false {
+		return fmt.Errorf("unknown profile : %s (supported : %s)", name, strings.Join(ProfileNames(), ", "))
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for key, value := range profile {
+		if explicit[key] {
+			continue
+		}
+		if err := flags.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
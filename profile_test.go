@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// プリセットで利用するフラグを定義したFlagSetを生成する。
+func testProfileFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("profile", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Int("clients", 10, "")
+	flags.Int("count", 100, "")
+	flags.Int("pretime", 3000, "")
+	flags.Int("intervaltime", 0, "")
+	return flags
+}
+
+func TestApplyProfile(t *testing.T) {
+	// README に記載したプリセットの値
+	documented := map[string]map[string]string{
+		"smoke":    {"clients": "1", "count": "10", "pretime": "0", "intervaltime": "0"},
+		"standard": {"clients": "10", "count": "1000", "pretime": "3000", "intervaltime": "0"},
+		"soak":     {"clients": "50", "count": "100000", "pretime": "3000", "intervaltime": "10"}}
+	if len(documented) != len(Profiles) {
+		t.Errorf("profiles = %v, want %d profiles", ProfileNames(), len(documented))
+	}
+	for name, values := range documented {
+		flags := testProfileFlags()
+		if err := flags.Parse(nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := ApplyProfile(flags, name); err != nil {
+			t.Fatalf("ApplyProfile(%s) : %s", name, err)
+		}
+		for key, value := range values {
+			if actual := flags.Lookup(key).Value.String(); actual != value {
+				t.Errorf("profile %s : -%s = %s, want %s", name, key, actual, value)
+			}
+		}
+	}
+
+	// 明示的に指定されたフラグは、プリセットで上書きしない。
+	flags := testProfileFlags()
+	if err := flags.Parse([]string{"-clients=3", "-pretime=500"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyProfile(flags, "soak"); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string]string{"clients": "3", "pretime": "500", "count": "100000", "intervaltime": "10"} {
+		if actual := flags.Lookup(key).Value.String(); actual != value {
+			t.Errorf("-%s = %s, want %s", key, actual, value)
+		}
+	}
+
+	if err := ApplyProfile(testProfileFlags(), "unknown"); err == nil || strings.Contains(err.Error(), "smoke, soak, standard") == false {
+		t.Errorf("unknown profile error = %v", err)
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	if err := ValidateProfiles(testProfileFlags()); err != nil {
+		t.Errorf("ValidateProfiles : %s", err)
+	}
+
+	flags := flag.NewFlagSet("profile", flag.ContinueOnError)
+	flags.Int("clients", 10, "")
+	flags.Int("count", 100, "")
+	flags.Int("pretime", 3000, "")
+	if err := ValidateProfiles(flags); err == nil || strings.Contains(err.Error(), "soak") == false || strings.Contains(err.Error(), "intervaltime") == false {
+		t.Errorf("error with an undefined flag = %v", err)
+	}
+}
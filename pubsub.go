@@ -0,0 +1,506 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Publish/Subscribeを同時に行う場合の、受信待ちのデフォルトの最大時間
+const DEFAULT_PUBSUB_WAIT_TIME time.Duration = 10 * time.Second
+
+// Publish/Subscribeを同時に行う場合の、クライアント毎の受信結果
+type PubSubReceiver struct {
+	mutex      sync.Mutex
+	Count      int             // 受信メッセージ数
+	Duplicates int             // 受信済みの冪等性キーを持つメッセージの受信数
+	Invalid    int             // ヘッダーを解析できなかったメッセージの受信数
+	Signatures SignatureStats  // 署名の検証結果
+	OutOfOrder int             // 直前に受信したメッセージより前の連番で受信したメッセージ数
+	seenKeys   map[string]bool // 受信済みの冪等性キー
+	seenSeqs   map[int]int     // メッセージの連番毎の受信数
+	lastSeqs   map[[2]int]int  // 送信元と順序キー毎の、受信したメッセージの最大の連番
+	Arrivals   ArrivalTracker  // メッセージの到着間隔
+
+	latencies *LatencyRecorder      // 送信から受信までの時間の記録先（nil の場合は記録しない）
+	relative  bool                  // 送信元毎の最初のメッセージからの相対時間で記録するかどうか
+	offsets   map[int]time.Duration // 送信元毎の、最初のメッセージの送信から受信までの時間
+	hmacKey   []byte                // 署名を検証する共有鍵（nil の場合は検証しない）
+	keys      int                   // 順序キーの数（0の場合は送信元毎に順序を検証する）
+}
+
+// PubSubReceiverを生成する。
+//   latencies : 送信から受信までの時間の記録先（nil の場合は記録しない）
+//   relative  : 送信元毎の最初のメッセージからの相対時間で記録するかどうか
+//   hmacKey   : 署名を検証する共有鍵（nil の場合は検証しない）
+//   keys      : 順序キーの数（0の場合は送信元毎に順序を検証する）
+func NewPubSubReceiver(latencies *LatencyRecorder, relative bool, hmacKey []byte, keys int) *PubSubReceiver {
+	return &PubSubReceiver{
+		seenKeys:  make(map[string]bool),
+		seenSeqs:  make(map[int]int),
+		lastSeqs:  make(map[[2]int]int),
+		keys:      keys,
+		latencies: latencies,
+		relative:  relative,
+		offsets:   make(map[int]time.Duration),
+		hmacKey:   hmacKey}
+}
+
+// 受信したメッセージを記録する。
+func (r *PubSubReceiver) Receive(msg MQTT.Message, receivedAt time.Time) {
+	r.Arrivals.Observe(receivedAt)
+
+	header, err := ParseMessageHeader(msg.Payload())
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Count++
+	if r.hmacKey != nil {
+		if VerifyPayload(msg.Payload(), r.hmacKey) {
+			r.Signatures.Verified++
+		} else {
+			r.Signatures.Invalid++
+		}
+	}
+	if err != nil {
+		r.Invalid++
+		return
+	}
+	if r.seenKeys[header.Key] {
+		r.Duplicates++
+	}
+	r.seenKeys[header.Key] = true
+	r.seenSeqs[header.Seq]++
+
+	// 再送による同じ連番の受信は、順序の違反として扱わない。
+	// 順序キーを利用する場合は、異なるキー（異なるTopic）の間の順序は保証されないため、キー毎に検証する。
+	source := [2]int{header.ClientId, OrderingKey(header.Seq, r.keys)}
+	if last, ok := r.lastSeqs[source]; ok && header.Seq < last {
+		r.OutOfOrder++
+	} else {
+		r.lastSeqs[source] = header.Seq
+	}
+
+	if r.latencies != nil {
+		// 送信側と受信側の時計がずれている場合は、送信元毎の最初のメッセージとの差で、ずれを打ち消す。
+		latency := receivedAt.Sub(time.Unix(0, header.SentAt))
+		if r.relative {
+			offset, ok := r.offsets[header.ClientId]
+			if ok == false {
+				offset = latency
+				r.offsets[header.ClientId] = offset
+			}
+			latency -= offset
+		}
+		r.latencies.Record(msg.Qos(), latency)
+	}
+}
+
+// 同じ連番のメッセージを重複して受信した件数と、一意に受信したメッセージ数を返す。
+func (r *PubSubReceiver) SeqDeliveries() (duplicated int, unique int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, count := range r.seenSeqs {
+		unique++
+		duplicated += count - 1
+	}
+	return duplicated, unique
+}
+
+// QoS 2のexactly-onceの検証結果
+type ExactlyOnceStats struct {
+	Clients    int `json:"clients"`    // 検証したクライアント数
+	Published  int `json:"published"`  // 送信したメッセージ数
+	Duplicated int `json:"duplicated"` // 重複して受信したメッセージ数
+	Missing    int `json:"missing"`    // 受信しなかったメッセージ数
+}
+
+// exactly-onceの違反があるかどうかを返す。
+func (s *ExactlyOnceStats) Violated() bool {
+	return s.Duplicated > 0 || s.Missing > 0
+}
+
+// QoS 2で送受信したクライアントについて、各メッセージを1度だけ受信したことを検証する。
+//   receivers : クライアント毎の受信結果
+//   published : クライアント毎の送信メッセージ数
+//   qoss      : クライアント毎のQoS
+func VerifyExactlyOnce(receivers []*PubSubReceiver, published []int64, qoss []byte) *ExactlyOnceStats {
+	stats := &ExactlyOnceStats{}
+	for id, r := range receivers {
+		if qoss[id] != 2 {
+			continue
+		}
+		duplicated, unique := r.SeqDeliveries()
+		stats.Clients++
+		stats.Published += int(published[id])
+		stats.Duplicated += duplicated
+		if int(published[id]) > unique {
+			stats.Missing += int(published[id]) - unique
+		}
+	}
+	return stats
+}
+
+// QoS 0のメッセージの破棄の推定値
+type DropEstimate struct {
+	Sent     int     `json:"sent"`     // 送信したメッセージ数
+	Received int     `json:"received"` // 一意に受信したメッセージ数（連番で照合する）
+	Dropped  int     `json:"dropped"`  // 受信しなかったメッセージ数の推定値
+	Rate     float64 `json:"rate"`     // 破棄された割合(%)
+}
+
+// QoS 0で送受信したクライアントについて、送信したメッセージの連番と受信した連番を照合し、
+// 破棄されたメッセージ数を推定する。
+//   receivers : クライアント毎の受信結果
+//   published : クライアント毎の送信メッセージ数
+//   qoss      : クライアント毎のQoS
+func EstimateQos0Drops(receivers []*PubSubReceiver, published []int64, qoss []byte) *DropEstimate {
+	estimate := &DropEstimate{}
+	for id, r := range receivers {
+		if qoss[id] != 0 {
+			continue
+		}
+		_, unique := r.SeqDeliveries()
+		estimate.Sent += int(published[id])
+		estimate.Received += unique
+		if int(published[id]) > unique {
+			estimate.Dropped += int(published[id]) - unique
+		}
+	}
+	if estimate.Sent > 0 {
+		estimate.Rate = float64(estimate.Dropped) / float64(estimate.Sent) * 100
+	}
+	return estimate
+}
+
+// 受信メッセージ数を返す。
+func (r *PubSubReceiver) ReceivedCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.Count
+}
+
+// 指定された連番のメッセージが、直前のメッセージと同じ冪等性キーを持つ（重複させる）かどうかを返す。
+// 先頭から ratio の割合で均等に重複させる。
+//   seq   : クライアント内のメッセージの連番
+//   ratio : 重複させる割合(0-1)
+func IsDuplicateKey(seq int, ratio float64) bool {
+	if seq == 0 || ratio <= 0 {
+		return false
+	}
+	return int(float64(seq+1)*ratio) > int(float64(seq)*ratio)
+}
+
+// 再接続をまたいだ、または順序キー毎のメッセージの順序の検証結果
+type OrderingStats struct {
+	Reconnects int `json:"reconnects"`     // 送信の途中で行った再接続の回数
+	Keys       int `json:"keys,omitempty"` // 順序キーの数
+	Received   int `json:"received"`       // 検証したメッセージ数
+	OutOfOrder int `json:"out_of_order"`   // 順序が逆転したメッセージ数
+}
+
+// メッセージの連番から、順序キーを返す（順序キーを利用しない場合は0）。
+func OrderingKey(seq int, keys int) int {
+	if keys <= 0 {
+		return 0
+	}
+	return seq % keys
+}
+
+// 順序の違反があるかどうかを返す。
+func (s *OrderingStats) Violated() bool {
+	return s.OutOfOrder > 0
+}
+
+// 接続を強制的に切断してから再接続し、Subscribeし直す。
+// 永続セッション(cleanSession=false)の場合は、切断中のQoS>0のメッセージも再接続後に受信する。
+func Reconnect(client MQTT.Client, opts ExecOptions, clientId int, handler MQTT.MessageHandler) error {
+	ForceDisconnect(client)
+	if WaitDisconnected(client, RECONNECT_DISCONNECT_WAIT) == false {
+		return errors.New("disconnect timeout before reconnect")
+	}
+
+	token := client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	token = SubscribeClientTopic(client, opts, clientId, handler)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// クライアントがSubscribeする Topic Filter と、要求するQoSを返す。
+// ワイルドカードの負荷試験の場合は、生成した複数のTopic Filterとなり、QoSはSubscription毎に割り当てる。
+func ClientSubscriptions(opts ExecOptions, clientId int) map[string]byte {
+	filters := make(map[string]byte)
+	if opts.WildcardFilters > 0 {
+		for i, filter := range CreateWildcardFilters(opts, clientId) {
+			filters[filter] = SubscriptionQos(opts, clientId, i)
+		}
+		return filters
+	}
+	filters[CreateSubscribeTopic(opts, clientId)] = ClientQos(opts, clientId)
+	return filters
+}
+
+// クライアントのTopicをSubscribeする。
+// ワイルドカードの負荷試験の場合は、生成した複数のTopic Filterをまとめて Subscribe する。
+// 1つのメッセージが複数のTopic Filterに一致しても、pahoの中で重複してハンドラを呼び出さないようにする
+// （Brokerが一致したSubscription毎に配信する場合は、配信された件数だけ呼び出す）。
+func SubscribeClientTopic(client MQTT.Client, opts ExecOptions, clientId int, handler MQTT.MessageHandler) MQTT.Token {
+	if opts.WildcardFilters > 0 {
+		filters := CreateWildcardFilters(opts, clientId)
+		for _, filter := range filters {
+			client.AddRoute(filter, FirstMatchHandler(filters, filter, handler))
+		}
+		return client.SubscribeMultiple(ClientSubscriptions(opts, clientId), nil)
+	}
+	return client.Subscribe(CreateSubscribeTopic(opts, clientId), ClientQos(opts, clientId), handler)
+}
+
+// 冪等性キーの重複の検証結果
+type DuplicateStats struct {
+	Sent     int `json:"sent"`     // 重複した冪等性キーで送信したメッセージ数
+	Received int `json:"received"` // 重複した冪等性キーで受信したメッセージ数
+}
+
+// 全クライアントに対して、自身のTopicのSubscribeと、そのTopicへのPublishを同時に行う。
+// Brokerを経由して受信したメッセージ数を返す。
+func PubSubAllClient(ctx context.Context, clients []MQTT.Client, opts ExecOptions, metrics *Metrics, param ...string) int {
+	receivers := make([]*PubSubReceiver, len(clients))
+	handlers := make([]MQTT.MessageHandler, len(clients))
+	for id := 0; id < len(clients); id++ {
+		var latencies *LatencyRecorder = nil
+		if opts.WarnOnClockSkew || opts.RelativeLatency || opts.ReportE2EHistogram {
+			latencies = metrics.EndToEndLatency
+		}
+		receiver := NewPubSubReceiver(latencies, opts.RelativeLatency, opts.HmacKey, opts.OrderingKeys)
+		receivers[id] = receiver
+
+		var bucket *TokenBucket = nil
+		if opts.ConsumeRate > 0 {
+			bucket = NewTokenBucket(opts.ConsumeRate)
+		}
+
+		var filters []string = nil
+		for filter := range ClientSubscriptions(opts, id) {
+			filters = append(filters, filter)
+		}
+
+		var handler MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+			if bucket != nil {
+				bucket.Take()
+			}
+			receiver.Receive(msg, time.Now())
+			if metrics.TopicMatch != nil {
+				metrics.TopicMatch.Check(filters, msg.Topic())
+			}
+			metrics.AddProgress(1)
+			if Debug {
+				fmt.Printf("Received message : topic=%s\n", msg.Topic())
+			}
+
+			// 受信側の処理時間を模擬する。
+			if opts.ConsumerDelay > 0 {
+				time.Sleep(time.Duration(opts.ConsumerDelay) * time.Millisecond)
+			}
+		}
+
+		handlers[id] = handler
+
+		token := SubscribeClientTopic(clients[id], opts, id, handler)
+		if token.Wait() && token.Error() != nil {
+			fmt.Printf("Subscribe error: %s\n", token.Error())
+		}
+		RecordGrantedQos(metrics.QosGrants, token, ClientSubscriptions(opts, id))
+		metrics.Subscriptions.Record(clients[id], filters...)
+	}
+
+	var bucket *TokenBucket = nil
+	if opts.GlobalRate > 0 {
+		bucket = NewTokenBucket(opts.GlobalRate)
+	}
+
+	wg := new(sync.WaitGroup)
+	startTime := time.Now()
+	var publishedCount int64 = 0
+	clientPublished := make([]int64, len(clients))
+	clientQoss := make([]byte, len(clients))
+	var duplicateSent int64 = 0
+	var reconnects int64 = 0
+	for id := 0; id < len(clients); id++ {
+		wg.Add(1)
+
+		client := clients[id]
+
+		go func(clientId int) {
+			defer wg.Done()
+
+			qos := ClientQos(opts, clientId)
+			clientQoss[clientId] = qos
+			key := ""
+			errorCount := 0
+			var pacer *RatePacer = nil
+			if opts.PubRate > 0 {
+				pacer = NewRatePacer(opts.PubRate)
+			}
+			for index := 0; index < opts.Count; index++ {
+				if ctx.Err() != nil {
+					return
+				}
+				if bucket != nil {
+					bucket.Take()
+				}
+
+				// 送信の途中で再接続し、再接続をまたいだ順序を検証する。
+				if opts.VerifyOrdering && index > 0 && index == opts.Count/2 {
+					if err := Reconnect(client, opts, clientId, handlers[clientId]); err != nil {
+						fmt.Printf("Reconnect error: %s\n", err)
+						return
+					}
+					atomic.AddInt64(&reconnects, 1)
+				}
+
+				if IsDuplicateKey(index, opts.DuplicateKeyRatio) {
+					atomic.AddInt64(&duplicateSent, 1)
+				} else {
+					key = strconv.Itoa(clientId) + "-" + strconv.Itoa(index)
+				}
+
+				header := MessageHeader{
+					ClientId: clientId,
+					Seq:      index,
+					Key:      key,
+					SentAt:   time.Now().UnixNano()}
+				var payload []byte = nil
+				if opts.HmacKey != nil {
+					payload = SignPayload(CreateHeaderPayload(header, SignedBodySize(opts.MessageSize)), opts.HmacKey)
+				} else {
+					payload = CreateHeaderPayload(header, opts.MessageSize)
+				}
+				topic := CreateClientTopic(opts, clientId, index)
+
+				if Debug {
+					fmt.Printf("Publish : id=%d, count=%d, topic=%s\n", clientId, index, topic)
+				}
+				metrics.Bytes.Record(topic, payload, qos)
+				publishStart := time.Now()
+				metrics.Inflight.Add(1)
+				err := Publish(client, topic, qos, opts.Retain, payload, opts.PublishTimeout)
+				metrics.Inflight.Done(1)
+				if err == nil {
+					atomic.AddInt64(&publishedCount, 1)
+					clientPublished[clientId]++
+					metrics.AddProgress(1)
+				}
+				metrics.PublishLatency.Record(qos, time.Since(publishStart))
+				metrics.TopicLatency.Record(topic, time.Since(publishStart))
+				metrics.Outliers.Record(topic, clientId, index, time.Since(publishStart))
+				metrics.GcImpact.Record(time.Since(publishStart))
+				if err != nil {
+					metrics.AddErrors(1)
+				}
+
+				if err != nil && opts.DisconnectErrs > 0 {
+					errorCount++
+					if errorCount > opts.DisconnectErrs {
+						DropClient(client, clientId, errorCount, opts, metrics)
+						return
+					}
+				}
+
+				if opts.IntervalTime > 0 {
+					time.Sleep(time.Duration(opts.IntervalTime) * time.Millisecond)
+				}
+				if pacer != nil {
+					pacer.Wait()
+				}
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	for id := range clientPublished {
+		metrics.ClientRates.Record(int(clientPublished[id]), time.Since(startTime))
+	}
+
+	// 送信したメッセージを全て受信するまで待機する。
+	waitTime := DEFAULT_PUBSUB_WAIT_TIME
+	if opts.SubscribeTimeout > 0 {
+		waitTime = time.Duration(opts.SubscribeTimeout) * time.Millisecond
+	}
+	deadline := time.Now().Add(waitTime)
+	for ctx.Err() == nil && time.Now().Before(deadline) {
+		if ReceivedCount(receivers) >= int(atomic.LoadInt64(&publishedCount)) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// paho内にバッファされた未処理のメッセージを、受信メッセージ数に反映する。
+	if opts.DrainTimeout > 0 {
+		DrainReceived(func() int { return ReceivedCount(receivers) }, opts.DrainTimeout)
+	}
+
+	receivedCount := 0
+	duplicates := DuplicateStats{Sent: int(duplicateSent)}
+	signatures := SignatureStats{}
+	ordering := OrderingStats{Reconnects: int(reconnects), Keys: opts.OrderingKeys}
+	for _, r := range receivers {
+		r.mutex.Lock()
+		receivedCount += r.Count
+		ordering.Received += r.Count - r.Invalid
+		ordering.OutOfOrder += r.OutOfOrder
+		duplicates.Received += r.Duplicates
+		signatures.Verified += r.Signatures.Verified
+		signatures.Invalid += r.Signatures.Invalid
+		if r.Invalid > 0 {
+			fmt.Printf("Received invalid messages : count=%d\n", r.Invalid)
+		}
+		r.mutex.Unlock()
+		metrics.Arrivals = append(metrics.Arrivals, &r.Arrivals)
+	}
+	metrics.Published = int(publishedCount)
+	if opts.DuplicateKeyRatio > 0 {
+		metrics.Duplicates = &duplicates
+	}
+	if opts.HmacKey != nil {
+		metrics.Signatures = &signatures
+	}
+	if opts.VerifyOrdering || opts.OrderingKeys > 0 {
+		metrics.Ordering = &ordering
+	}
+	// 処理レートを制限した場合は、Broker側で破棄されたQoS 0のメッセージ数を算出する。
+	if opts.ConsumeRate > 0 || opts.ReportQos0Drops {
+		estimate := EstimateQos0Drops(receivers, clientPublished, clientQoss)
+		if opts.ConsumeRate > 0 {
+			metrics.Qos0Dropped = &estimate.Dropped
+		}
+		if opts.ReportQos0Drops {
+			metrics.Qos0DropEstimate = estimate
+		}
+	}
+	if opts.VerifyExactlyOnce {
+		metrics.ExactlyOnce = VerifyExactlyOnce(receivers, clientPublished, clientQoss)
+	}
+
+	return receivedCount
+}
+
+// 全クライアントの受信メッセージ数の合計を返す。
+func ReceivedCount(receivers []*PubSubReceiver) int {
+	total := 0
+	for _, r := range receivers {
+		total += r.ReceivedCount()
+	}
+	return total
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsDuplicateKey(t *testing.T) {
+	for _, ratio := range []float64{0, 0.1, 0.25, 0.5, 1} {
+		duplicated := 0
+		for seq := 0; seq < 100; seq++ {
+			if IsDuplicateKey(seq, ratio) {
+				duplicated++
+			}
+		}
+		// 先頭のメッセージは、重複させるキーが存在しない。
+		want := int(100 * ratio)
+		if ratio == 1 {
+			want = 99
+		}
+		if duplicated != want {
+			t.Errorf("duplicated keys with ratio %.2f = %d, want %d", ratio, duplicated, want)
+		}
+	}
+}
+
+func TestPubSubDuplicateKeys(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+
+	opts := testExecOptions(broker.URL)
+	opts.Count = 20
+	opts.MessageSize = 64
+	opts.DuplicateKeyRatio = 0.25
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil {
+		t.Fatalf("Execute failed : %s", output)
+	}
+	if result.Published != 40 || result.TotalCount != 40 {
+		t.Errorf("published = %d, received = %d, want 40", result.Published, result.TotalCount)
+	}
+	// Brokerは重複を排除しないため、重複したキーで送信したメッセージは全て重複して受信する。
+	if result.Duplicates == nil || result.Duplicates.Sent != 10 || result.Duplicates.Received != 10 {
+		t.Errorf("duplicates = %+v, want sent 10, received 10", result.Duplicates)
+	}
+
+	// Brokerが重複したキーのメッセージを破棄する場合は、抑止された件数となる。
+	broker = startTestBroker(t, &testBroker{
+		Drop: func(topic string, payload []byte) bool {
+			header, err := ParseMessageHeader(payload)
+			return err == nil && IsDuplicateKey(header.Seq, 0.25)
+		}})
+	opts.Broker = broker.URL
+	opts.SubscribeTimeout = 200
+	output = captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil {
+		t.Fatalf("Execute failed : %s", output)
+	}
+	if result.Duplicates == nil || result.Duplicates.Sent != 10 || result.Duplicates.Received != 0 {
+		t.Errorf("duplicates with the suppressing broker = %+v, want sent 10, received 0", result.Duplicates)
+	}
+}
+
+func TestVerifyExactlyOnce(t *testing.T) {
+	tests := []struct {
+		broker     *testBroker
+		duplicated int
+		missing    int
+	}{
+		{&testBroker{}, 0, 0},
+		{&testBroker{Duplicate: func(topic string, payload []byte) bool {
+			header, err := ParseMessageHeader(payload)
+			return err == nil && header.Seq == 3
+		}}, 2, 0},
+		{&testBroker{Drop: func(topic string, payload []byte) bool {
+			header, err := ParseMessageHeader(payload)
+			return err == nil && header.Seq%5 == 0
+		}}, 0, 4}}
+	for _, test := range tests {
+		broker := startTestBroker(t, test.broker)
+		opts := testExecOptions(broker.URL)
+		opts.Qos = 2
+		opts.MessageSize = 64
+		opts.VerifyExactlyOnce = true
+		opts.SubscribeTimeout = 200
+
+		var result *Result
+		output := captureStdout(t, func() {
+			result = Execute(PubSubAllClient, opts)
+		})
+		if result == nil || result.ExactlyOnce == nil {
+			t.Fatalf("no exactly-once result : %s", output)
+		}
+		stats := result.ExactlyOnce
+		if stats.Clients != 2 || stats.Published != 20 || stats.Duplicated != test.duplicated || stats.Missing != test.missing {
+			t.Errorf("exactly-once = %+v, want duplicated %d, missing %d", stats, test.duplicated, test.missing)
+		}
+		if stats.Violated() != (test.duplicated > 0 || test.missing > 0) {
+			t.Errorf("violated = %t : %+v", stats.Violated(), stats)
+		}
+	}
+}
+
+func TestPubRateAndConsumerDelay(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.MessageSize = 64
+	opts.PubRate = 50       // 20ms毎に送信する
+	opts.ConsumerDelay = 60 // 受信毎に60ms処理する
+	opts.ReportJitter = true
+
+	// Brokerが最初と最後のメッセージを受信した時刻から、送信にかかった時間を求める。
+	published := make(chan time.Duration, 1)
+	go func() {
+		var first time.Time
+		waitFor(5*time.Second, func() bool {
+			count := len(broker.Published())
+			if count > 0 && first.IsZero() {
+				first = time.Now()
+			}
+			return count >= opts.Count
+		})
+		published <- time.Since(first)
+	}()
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil || result.Jitter == nil {
+		t.Fatalf("Execute failed : %s", output)
+	}
+	if result.TotalCount != opts.Count {
+		t.Errorf("received = %d, want %d", result.TotalCount, opts.Count)
+	}
+
+	// 送信は受信側の処理時間に影響されず、送信レートに従う。
+	if elapsed := <-published; elapsed < 150*time.Millisecond || elapsed >= 450*time.Millisecond {
+		t.Errorf("publishing %d messages at 50 messages/sec took %s", opts.Count, elapsed)
+	}
+	// 受信は送信レートに関わらず、処理時間の間隔で行われる。
+	if result.Jitter.Mean < 55 {
+		t.Errorf("mean inter-arrival time = %.3fms, want >= the consumer delay 60ms", result.Jitter.Mean)
+	}
+}
+
+func TestClockSkewWarning(t *testing.T) {
+	// 送信側の時計が受信側より100ms進んでいる場合は、送信から受信までの時間が負の値となる。
+	now := time.Now()
+	receive := func(receiver *PubSubReceiver) {
+		for seq := 0; seq < 5; seq++ {
+			header := MessageHeader{ClientId: 0, Seq: seq, Key: "k", SentAt: now.Add(time.Duration(seq*10+100) * time.Millisecond).UnixNano()}
+			msg := &testMqttMessage{topic: BASE_TOPIC, qos: 1, payload: CreateHeaderPayload(header, 64)}
+			receiver.Receive(msg, now.Add(time.Duration(seq*10+5)*time.Millisecond))
+		}
+	}
+
+	latencies := NewLatencyRecorder()
+	receive(NewPubSubReceiver(latencies, false, nil, 0))
+	skew := DetectClockSkew(latencies.Durations())
+	if skew == nil || skew.Negative != 5 || math.Abs(skew.Min-(-95)) > 1e-6 {
+		t.Fatalf("clock skew = %+v, want 5 negatives with min -95ms", skew)
+	}
+	output := captureStdout(t, func() {
+		PrintResult(&Result{ClockSkew: skew})
+	})
+	if strings.Contains(output, "Warning : clock skew detected, 5 negative latencies (min=-95.000ms)") == false {
+		t.Errorf("no clock skew warning :\n%s", output)
+	}
+
+	// 相対時間の場合は、送信元毎の最初のメッセージとの差となり、ずれを打ち消す。
+	latencies = NewLatencyRecorder()
+	receive(NewPubSubReceiver(latencies, true, nil, 0))
+	if skew := DetectClockSkew(latencies.Durations()); skew != nil {
+		t.Errorf("clock skew with the relative latency = %+v", skew)
+	}
+
+	if skew := DetectClockSkew([]time.Duration{0, time.Millisecond}); skew != nil {
+		t.Errorf("clock skew without negative latencies = %+v", skew)
+	}
+}
+
+func TestVerifyOrderingAcrossReconnect(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.Qos = 1
+	opts.MessageSize = 64
+	opts.VerifyOrdering = true
+	opts.ConnectOptions = []ClientOptionSetter{func(o *MQTT.ClientOptions) { o.SetCleanSession(false) }}
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil || result.Ordering == nil {
+		t.Fatalf("no ordering result : %s", output)
+	}
+	ordering := result.Ordering
+	if ordering.Reconnects != 2 || ordering.Received != 20 || ordering.OutOfOrder != 0 || ordering.Violated() {
+		t.Errorf("ordering = %+v, want 2 reconnects, 20 received in order", ordering)
+	}
+	// 送信の途中で、各クライアントが再接続する。
+	if connects := len(broker.Connects()); connects != 4 {
+		t.Errorf("connects = %d, want 4", connects)
+	}
+
+	// 再送による同じ連番の受信は違反とせず、前の連番の受信は違反とする。
+	receiver := NewPubSubReceiver(nil, false, nil, 0)
+	for _, seq := range []int{0, 1, 2, 2, 4, 3, 5} {
+		payload := CreateHeaderPayload(MessageHeader{ClientId: 0, Seq: seq, Key: fmt.Sprint(seq)}, 64)
+		receiver.Receive(&testMqttMessage{topic: BASE_TOPIC, qos: 1, payload: payload}, time.Now())
+	}
+	if receiver.OutOfOrder != 1 {
+		t.Errorf("out of order = %d, want 1", receiver.OutOfOrder)
+	}
+}
+
+func TestConsumeRate(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.Count = 30
+	opts.MessageSize = 64
+	opts.ConsumeRate = 50
+	opts.SubscribeTimeout = 300
+	opts.ReportJitter = true
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil || result.Jitter == nil || result.Qos0Dropped == nil {
+		t.Fatalf("no consume rate result : %s", output)
+	}
+	// 受信は処理レートの間隔(20ms)で行われ、終了までに処理できなかったQoS 0のメッセージは破棄として数える。
+	if result.Jitter.Mean < 18 || result.Jitter.Mean > 30 {
+		t.Errorf("mean inter-arrival time = %.3fms, want about 20ms", result.Jitter.Mean)
+	}
+	if dropped := *result.Qos0Dropped; dropped <= 0 || dropped != result.Published-result.TotalCount {
+		t.Errorf("QoS 0 dropped = %d, published = %d, received = %d", dropped, result.Published, result.TotalCount)
+	}
+
+	// -action=both 以外では、送信数が分からないため算出しない。
+	opts.SubscribeTimeout = 50
+	output = captureStdout(t, func() {
+		result = Execute(SubscribeAllClient, opts)
+	})
+	if result == nil || result.Qos0Dropped != nil || strings.Contains(output, "QoS 0 dropped : N/A (only with -action=both)") == false {
+		t.Errorf("QoS 0 dropped on subscribe = %v :\n%s", result, output)
+	}
+}
+
+func TestReportQos0DropEstimate(t *testing.T) {
+	// 4件に1件のメッセージを、Subscriberに配信せずに破棄する。
+	var mutex sync.Mutex
+	published := 0
+	broker := startTestBroker(t, &testBroker{
+		Drop: func(topic string, payload []byte) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			published++
+			return published%4 == 0
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 2
+	opts.Count = 20
+	opts.ReportQos0Drops = true
+	opts.SubscribeTimeout = 300
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil || result.Qos0DropEstimate == nil {
+		t.Fatalf("no drop estimate : %s", output)
+	}
+	estimate := result.Qos0DropEstimate
+	sent := opts.ClientNum * opts.Count
+	if estimate.Sent != sent || estimate.Dropped != sent/4 || estimate.Received != sent-sent/4 || estimate.Rate != 25 {
+		t.Errorf("estimate = %+v", *estimate)
+	}
+	// -consume-rate を指定しない場合は、QoS 0の破棄数は出力しない。
+	if result.Qos0Dropped != nil {
+		t.Errorf("QoS 0 dropped = %d", *result.Qos0Dropped)
+	}
+}
+
+func TestQosPerSubscription(t *testing.T) {
+	// 要求されたQoSを記録し、QoS 2のSubscriptionには、QoS 1を付与する。
+	var mutex sync.Mutex
+	requested := make(map[string]byte)
+	broker := startTestBroker(t, &testBroker{
+		Grant: func(filter string, qos byte) byte {
+			mutex.Lock()
+			requested[filter] = qos
+			mutex.Unlock()
+			if qos == 2 {
+				return 1
+			}
+			return qos
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.Qos = 1
+	opts.WildcardFilters = 4
+	opts.QosPerSubscription = true
+	opts.ReportEffectiveQos = true
+	opts.SubscribeTimeout = 100
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil {
+		t.Fatalf("Execute failed : %s", output)
+	}
+	// Subscriptionの連番に従って、QoSを 0,1,2,0 の順に割り当てる。
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, filter := range CreateWildcardFilters(opts, 0) {
+		if qos, ok := requested[filter]; ok == false || qos != byte(i%3) {
+			t.Errorf("subscription %s : QoS = %d (%t), want %d", filter, qos, ok, i%3)
+		}
+	}
+	expected := []QosGrant{{0, 0, 2}, {1, 1, 1}, {2, 1, 1}}
+	if fmt.Sprint(result.EffectiveQos) != fmt.Sprint(expected) {
+		t.Errorf("effective QoS = %+v, want %+v", result.EffectiveQos, expected)
+	}
+}
+
+func TestOrderingKeys(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.Qos = 1
+	opts.MessageSize = 64
+	opts.OrderingKeys = 4
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil || result.Ordering == nil {
+		t.Fatalf("no ordering result : %s", output)
+	}
+	ordering := result.Ordering
+	if ordering.Keys != 4 || ordering.Received != 20 || ordering.OutOfOrder != 0 {
+		t.Errorf("ordering = %+v, want 4 keys, 20 received in order", ordering)
+	}
+	// 順序キー毎に、異なるTopicへ送信する。
+	for _, msg := range broker.Published() {
+		header, err := ParseMessageHeader(msg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := fmt.Sprintf("%s/%d/key%d", opts.Topic, header.ClientId, header.Seq%4); msg.Topic != expected {
+			t.Errorf("topic = %s, want %s", msg.Topic, expected)
+		}
+	}
+
+	// 異なるキーの間の逆転は違反とせず、同じキーの中の逆転のみを違反とする。
+	receiver := NewPubSubReceiver(nil, false, nil, 2)
+	for _, seq := range []int{1, 0, 3, 2, 4, 6, 5, 7, 9} {
+		payload := CreateHeaderPayload(MessageHeader{ClientId: 0, Seq: seq, Key: fmt.Sprint(seq)}, 64)
+		receiver.Receive(&testMqttMessage{topic: BASE_TOPIC, qos: 1, payload: payload}, time.Now())
+	}
+	// キー毎の順序（0,2,4,6 と 1,3,5,7,9）は保たれているため、違反はない。
+	if receiver.OutOfOrder != 0 {
+		t.Errorf("out of order across keys = %d, want 0", receiver.OutOfOrder)
+	}
+	receiver.Receive(&testMqttMessage{topic: BASE_TOPIC, qos: 1, payload: CreateHeaderPayload(MessageHeader{ClientId: 0, Seq: 2, Key: "x"}, 64)}, time.Now())
+	if receiver.OutOfOrder != 1 {
+		t.Errorf("out of order = %d, want 1", receiver.OutOfOrder)
+	}
+}
+
+func TestEndToEndLatencyHistogram(t *testing.T) {
+	// 1つおきのメッセージのみ、配信を40ms遅延させる。
+	var mutex sync.Mutex
+	routed := 0
+	broker := startTestBroker(t, &testBroker{
+		RouteDelay: func(topic string) time.Duration {
+			mutex.Lock()
+			defer mutex.Unlock()
+			routed++
+			if routed%2 == 0 {
+				return 40 * time.Millisecond
+			}
+			return 0
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 1
+	opts.Count = 10
+	opts.Qos = 1
+	opts.IntervalTime = 10
+	opts.SubscribeTimeout = 300
+	opts.DrainTimeout = time.Second
+	opts.ReportE2EHistogram = true
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil || result.E2ELatency == nil {
+		t.Fatalf("no end-to-end latency : %s", output)
+	}
+	histogram := result.E2EHistogram
+	if len(histogram) != HISTOGRAM_BUCKETS {
+		t.Fatalf("histogram = %+v", histogram)
+	}
+	// 遅延させなかったメッセージは前半の区間に、遅延させたメッセージは後半の区間に入る。
+	// 遅延させたメッセージの応答時間にもばらつきがあるため、個々の区間の件数は比較しない。
+	lower, upper := 0, 0
+	for i, bucket := range histogram {
+		if i < HISTOGRAM_BUCKETS/2 {
+			lower += bucket.Count
+		} else {
+			upper += bucket.Count
+		}
+	}
+	if histogram[0].Count == 0 || histogram[HISTOGRAM_BUCKETS-1].Count == 0 || lower != 5 || upper != 5 {
+		t.Errorf("histogram = %+v", histogram)
+	}
+	if histogram[0].Low != result.E2ELatency.Min || histogram[HISTOGRAM_BUCKETS-1].High != result.E2ELatency.Max ||
+		result.E2ELatency.Count != opts.Count || result.E2ELatency.Max < 40 {
+		t.Errorf("histogram range = %.3f - %.3f, latency = %s", histogram[0].Low, histogram[HISTOGRAM_BUCKETS-1].High, result.E2ELatency)
+	}
+	if strings.Contains(output, "End-to-end latency histogram :") == false {
+		t.Errorf("no histogram output : %s", output)
+	}
+}
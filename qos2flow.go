@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// QoS 2のフローの所要時間を計測する、プローブ接続で送受信するメッセージ数
+const QOS2_FLOW_MESSAGES int = 100
+
+// プローブ接続で、1つのパケットを待つ最大時間
+const QOS2_FLOW_TIMEOUT time.Duration = 10 * time.Second
+
+// Subscribe側のQoS 2のフローの所要時間
+type Qos2FlowStats struct {
+	Messages   int           `json:"messages"`   // 計測したメッセージ数
+	Delivery   *LatencyStats `json:"delivery"`   // PUBLISHの送信から、SubscriberがPUBLISHを受信するまでの時間
+	Completion *LatencyStats `json:"completion"` // SubscriberがPUBLISHを受信してから、PUBRELを受信するまでの時間(PUBREC/PUBRELの往復)
+}
+
+// QoS 2のフローの所要時間を、1行の文字列に整形する。
+func (s *Qos2FlowStats) String() string {
+	if s.Delivery == nil || s.Completion == nil {
+		return fmt.Sprintf("messages=%d", s.Messages)
+	}
+	return fmt.Sprintf("messages=%d, delivery : %s, completion : %s", s.Messages, s.Delivery, s.Completion)
+}
+
+// プローブ接続でQoS 2のメッセージを送受信し、Subscribe側のQoS 2のフローの所要時間を計測する。
+// pahoはPUBREC/PUBREL/PUBCOMPを内部で処理し、その時刻を通知しないため、
+// 別の接続でパケットを直接送受信して、配信(PUBLISHの受信)とフローの完了(PUBRELの受信)を分けて計測する。
+//   opts     : 実行オプション
+//   messages : 送受信するメッセージ数
+func ProbeQos2Flow(opts ExecOptions, messages int) (*Qos2FlowStats, error) {
+	uri, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+	if uri.Scheme == "ws" || uri.Scheme == "wss" {
+		return nil, errors.New("QoS 2 flow timing is not supported for websocket brokers")
+	}
+
+	var tlsConfig *tls.Config = nil
+	if IsTlsBroker(opts.Broker) {
+		tlsConfig = CreateTlsConfig(opts)
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = uri.Hostname()
+		}
+	}
+
+	// ポートが省略された場合は、pahoと同様にスキームの既定のポートへ接続する。
+	host := BrokerAddress(uri)
+	password, err := ProbePassword(opts, opts.ClientNum)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := opts.Topic + "/qos2flow"
+	subscriber, err := dialProbeConnection(host, tlsConfig, CreateClientId(opts.ClientNum)+"-qos2sub", opts.Username, password)
+	if err != nil {
+		return nil, err
+	}
+	defer subscriber.Close()
+	reader := bufio.NewReader(subscriber)
+	if err := probeSubscribeQos2(subscriber, reader, topic); err != nil {
+		return nil, err
+	}
+
+	publisher, err := dialProbeConnection(host, tlsConfig, CreateClientId(opts.ClientNum)+"-qos2pub", opts.Username, password)
+	if err != nil {
+		return nil, err
+	}
+	defer publisher.Close()
+
+	delivery := NewLatencyRecorder()
+	completion := NewLatencyRecorder()
+	done := make(chan error, 1)
+	go func() {
+		done <- receiveQos2Flow(subscriber, reader, messages, delivery, completion)
+	}()
+	if err := publishQos2Flow(publisher, topic, messages); err != nil {
+		return nil, err
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	// 切断を通知する(DISCONNECT)。
+	publisher.Write([]byte{0xe0, 0x00})
+	subscriber.Write([]byte{0xe0, 0x00})
+	return &Qos2FlowStats{
+		Messages:   messages,
+		Delivery:   delivery.Stats(),
+		Completion: completion.Stats()}, nil
+}
+
+// Brokerへ接続(TCP、TLSの場合はハンドシェイクを含む)し、CONNECTを送信したコネクションを返す。
+func dialProbeConnection(host string, tlsConfig *tls.Config, clientId string, username string, password string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", host, QOS2_FLOW_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(QOS2_FLOW_TIMEOUT))
+
+	if tlsConfig != nil {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if err := probeMqttConnect(conn, clientId, username, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// MQTTのパケットを1つ読み込み、固定ヘッダーの1byte目と、可変ヘッダー以降を返す。
+func readMqttPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+	multiplier := 1
+	for i := 0; ; i++ {
+		if i >= 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// パケットIDのみを持つパケット(PUBREC/PUBREL/PUBCOMP)を生成する。
+func createAckPacket(header byte, id uint16) []byte {
+	return []byte{header, 0x02, byte(id >> 8), byte(id)}
+}
+
+// TopicをQoS 2でSubscribeし、SUBACKでQoS 2が付与されたことを確認する。
+func probeSubscribeQos2(conn net.Conn, reader *bufio.Reader, topic string) error {
+	body := append([]byte{0x00, 0x01}, encodeMqttString(topic)...)
+	body = append(body, 0x02)
+	packet := append([]byte{0x82}, encodeRemainingLength(len(body))...)
+	if _, err := conn.Write(append(packet, body...)); err != nil {
+		return err
+	}
+
+	header, suback, err := readMqttPacket(reader)
+	if err != nil {
+		return err
+	}
+	if header != 0x90 || len(suback) < 3 {
+		return fmt.Errorf("unexpected packet : 0x%02x", header)
+	}
+	if suback[2] != 0x02 {
+		return fmt.Errorf("QoS 2 was not granted : return code 0x%02x", suback[2])
+	}
+	return nil
+}
+
+// QoS 2のメッセージを1件ずつPublishし、PUBREC/PUBREL/PUBCOMPのフローを完了させる。
+// ペイロードには、送信時刻(UnixNano)を埋め込む。
+func publishQos2Flow(conn net.Conn, topic string, messages int) error {
+	reader := bufio.NewReader(conn)
+	for i := 0; i < messages; i++ {
+		id := uint16(i%65535 + 1)
+		conn.SetDeadline(time.Now().Add(QOS2_FLOW_TIMEOUT))
+
+		body := append(encodeMqttString(topic), byte(id>>8), byte(id))
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		body = append(body, payload...)
+		packet := append([]byte{0x34}, encodeRemainingLength(len(body))...)
+		if _, err := conn.Write(append(packet, body...)); err != nil {
+			return err
+		}
+
+		if err := expectAckPacket(reader, 0x50, id); err != nil {
+			return err
+		}
+		if _, err := conn.Write(createAckPacket(0x62, id)); err != nil {
+			return err
+		}
+		if err := expectAckPacket(reader, 0x70, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 指定された種類とパケットIDの、応答のパケットを受信する。
+func expectAckPacket(reader *bufio.Reader, expected byte, id uint16) error {
+	header, body, err := readMqttPacket(reader)
+	if err != nil {
+		return err
+	}
+	if header != expected || len(body) < 2 || binary.BigEndian.Uint16(body) != id {
+		return fmt.Errorf("unexpected packet : 0x%02x", header)
+	}
+	return nil
+}
+
+// Subscriberとして、指定された件数のQoS 2のフローが完了するまでメッセージを受信する。
+// PUBLISHの受信時にPUBRECを、PUBRELの受信時にPUBCOMPを返し、それぞれの時刻から所要時間を記録する。
+func receiveQos2Flow(conn net.Conn, reader *bufio.Reader, messages int, delivery *LatencyRecorder, completion *LatencyRecorder) error {
+	received := make(map[uint16]time.Time)
+	completed := 0
+	for completed < messages {
+		conn.SetDeadline(time.Now().Add(QOS2_FLOW_TIMEOUT))
+		header, body, err := readMqttPacket(reader)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+
+		switch header >> 4 {
+		case 3: // PUBLISH
+			if (header>>1)&0x03 != 2 || len(body) < 2 {
+				return fmt.Errorf("unexpected packet : 0x%02x", header)
+			}
+			pos := 2 + int(binary.BigEndian.Uint16(body))
+			if len(body) < pos+2 {
+				return errors.New("malformed PUBLISH packet")
+			}
+			id := binary.BigEndian.Uint16(body[pos:])
+
+			// 再送(DUP)の場合は、最初の受信時刻を維持する。
+			if _, ok := received[id]; ok == false {
+				received[id] = now
+				if payload := body[pos+2:]; len(payload) >= 8 {
+					sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(payload)))
+					delivery.Record(2, now.Sub(sentAt))
+				}
+			}
+			if _, err := conn.Write(createAckPacket(0x50, id)); err != nil {
+				return err
+			}
+		case 6: // PUBREL
+			if len(body) < 2 {
+				return errors.New("malformed PUBREL packet")
+			}
+			id := binary.BigEndian.Uint16(body)
+			if receivedAt, ok := received[id]; ok {
+				completion.Record(2, now.Sub(receivedAt))
+				delete(received, id)
+				completed++
+			}
+			if _, err := conn.Write(createAckPacket(0x70, id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
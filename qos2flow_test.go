@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbeQos2Flow(t *testing.T) {
+	routeDelay := 5 * time.Millisecond
+	broker := startTestBroker(t, &testBroker{
+		RouteDelay: func(topic string) time.Duration { return routeDelay }})
+	opts := testExecOptions(broker.URL)
+	opts.Username = "user"
+	opts.PasswordProvider = func(id int) (string, error) {
+		return "token-" + CreateClientId(id), nil
+	}
+
+	stats, err := ProbeQos2Flow(opts, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Messages != 20 || stats.Delivery == nil || stats.Completion == nil {
+		t.Fatalf("stats = %s", stats)
+	}
+	if stats.Delivery.Count != 20 || stats.Completion.Count != 20 {
+		t.Errorf("delivery count = %d, completion count = %d, want 20", stats.Delivery.Count, stats.Completion.Count)
+	}
+	// 配信は、Brokerが配信を待機する時間を含む。
+	if stats.Delivery.Min < float64(routeDelay.Milliseconds()) || stats.Completion.Min < 0 {
+		t.Errorf("delivery = %s, completion = %s", stats.Delivery, stats.Completion)
+	}
+
+	// プローブ接続は、ベンチマークのクライアントと重ならないClientIDと、取得したパスワードで接続する。
+	connects := broker.Connects()
+	if len(connects) != 2 {
+		t.Fatalf("connects = %d, want 2", len(connects))
+	}
+	prefix := CreateClientId(opts.ClientNum)
+	for i, suffix := range []string{"-qos2sub", "-qos2pub"} {
+		if connects[i].ClientId != prefix+suffix || connects[i].Username != "user" || connects[i].Password != "token-"+prefix {
+			t.Errorf("connect %d = %+v", i, connects[i])
+		}
+	}
+	for _, msg := range broker.Published() {
+		if msg.Topic != opts.Topic+"/qos2flow" || msg.Qos != 2 {
+			t.Errorf("published = %s (QoS %d)", msg.Topic, msg.Qos)
+		}
+	}
+}
+
+func TestProbeQos2FlowNotGranted(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{
+		Grant: func(filter string, qos byte) byte { return 1 }})
+	opts := testExecOptions(broker.URL)
+	if _, err := ProbeQos2Flow(opts, 1); err == nil || strings.Contains(err.Error(), "QoS 2 was not granted") == false {
+		t.Errorf("error = %v", err)
+	}
+
+	opts.Broker = "ws://127.0.0.1:8080"
+	if _, err := ProbeQos2Flow(opts, 1); err == nil {
+		t.Error("websocket broker was accepted")
+	}
+}
+
+// QoS 2のPUBLISHパケットを生成する（ペイロードに送信時刻を埋め込む）。
+func createQos2PublishPacket(topic string, id uint16, sentAt time.Time, dup bool) []byte {
+	body := append(encodeMqttString(topic), byte(id>>8), byte(id))
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, uint64(sentAt.UnixNano()))
+	body = append(body, payload...)
+	var header byte = 0x34
+	if dup {
+		header |= 0x08
+	}
+	return append(append([]byte{header}, encodeRemainingLength(len(body))...), body...)
+}
+
+func TestReceiveQos2Flow(t *testing.T) {
+	client, broker := net.Pipe()
+	defer client.Close()
+	defer broker.Close()
+
+	delivery := NewLatencyRecorder()
+	completion := NewLatencyRecorder()
+	done := make(chan error, 1)
+	go func() {
+		done <- receiveQos2Flow(client, bufio.NewReader(client), 1, delivery, completion)
+	}()
+
+	reader := bufio.NewReader(broker)
+	sentAt := time.Now().Add(-30 * time.Millisecond)
+	broker.Write(createQos2PublishPacket("a/b", 7, sentAt, false))
+	if err := expectAckPacket(reader, 0x50, 7); err != nil {
+		t.Fatal(err)
+	}
+	// 再送(DUP)の場合も PUBREC を返し、最初の受信時刻から完了までを計測する。
+	time.Sleep(20 * time.Millisecond)
+	broker.Write(createQos2PublishPacket("a/b", 7, time.Now(), true))
+	if err := expectAckPacket(reader, 0x50, 7); err != nil {
+		t.Fatal(err)
+	}
+	broker.Write(createAckPacket(0x62, 7))
+	if err := expectAckPacket(reader, 0x70, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	deliveryStats := delivery.Stats()
+	completionStats := completion.Stats()
+	if deliveryStats == nil || deliveryStats.Count != 1 || deliveryStats.Min < 30 {
+		t.Errorf("delivery = %v", deliveryStats)
+	}
+	if completionStats == nil || completionStats.Count != 1 || completionStats.Min < 20 {
+		t.Errorf("completion = %v", completionStats)
+	}
+}
+
+func TestReadMqttPacket(t *testing.T) {
+	// 残りの長さが複数byteとなり、分割して届くパケットも読み込む。
+	body := make([]byte, 300)
+	body[299] = 0xab
+	packet := append(append([]byte{0x30}, encodeRemainingLength(len(body))...), body...)
+	client, broker := net.Pipe()
+	defer client.Close()
+	go func() {
+		for i := 0; i < len(packet); i += 100 {
+			end := i + 100
+			if end > len(packet) {
+				end = len(packet)
+			}
+			broker.Write(packet[i:end])
+		}
+		broker.Close()
+	}()
+
+	header, read, err := readMqttPacket(bufio.NewReaderSize(client, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != 0x30 || len(read) != len(body) || read[299] != 0xab {
+		t.Errorf("header = 0x%02x, length = %d", header, len(read))
+	}
+
+	if _, _, err := readMqttPacket(bufio.NewReader(strings.NewReader("\x30\x80\x80\x80\x80\x01"))); err == nil {
+		t.Error("malformed remaining length was accepted")
+	}
+	if _, _, err := readMqttPacket(bufio.NewReader(strings.NewReader("\x30\x05ab"))); err == nil {
+		t.Error("truncated packet was accepted")
+	}
+}
+
+func TestProbeRunsAfterConnectPhase(t *testing.T) {
+	// QoS 2のフローのプローブに時間がかかる場合も、接続のフェーズの所要時間に含めない。
+	broker := startTestBroker(t, &testBroker{
+		RouteDelay: func(topic string) time.Duration {
+			if strings.HasSuffix(topic, "/qos2flow") {
+				return 5 * time.Millisecond
+			}
+			return 0
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.ReportQos2Flow = true
+
+	b := NewBenchmark(PublishAllClient, opts)
+	defer b.Close()
+	if b.Connect() == false {
+		t.Fatal("Connect failed")
+	}
+	defer b.Teardown()
+	if b.qos2Flow != nil {
+		t.Fatal("QoS 2 flow was probed in the connect phase")
+	}
+	connectPhase := b.Phases.Connect
+
+	start := time.Now()
+	b.Probe()
+	if b.qos2Flow == nil || b.qos2Flow.Messages != QOS2_FLOW_MESSAGES {
+		t.Fatalf("QoS 2 flow = %v", b.qos2Flow)
+	}
+	if probe := ElapsedMillis(start); b.Phases.Connect != connectPhase || connectPhase >= probe {
+		t.Errorf("connect phase = %dms, probe = %dms", b.Phases.Connect, probe)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package main
+
+// race detector を有効にしてビルドしたかどうか
+// race detector の有効時は、sync.Pool が任意に要素を破棄するため、プールによる確保の削減を計測できない。
+const raceEnabled = true
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// スループットの時系列を、一定間隔で記録する。
+type ThroughputSampler struct {
+	Interval  time.Duration    // 記録する間隔
+	Output    io.Writer        // 記録の出力先(CSV、nil の場合は出力しない)
+	Errors    *int64           // エラー数のカウンター（nil の場合は、間隔毎のエラー数を出力しない）
+	Connected *int64           // 接続中の接続数（nil の場合は出力しない）
+	Latency   *LatencyRecorder // Publishの応答時間（nil の場合は、間隔毎のパーセンタイルを出力しない）
+	rates     []float64        // 間隔毎の瞬間スループット(messages/sec)
+	latencies []WindowLatency  // 間隔毎の応答時間のパーセンタイル
+}
+
+// 1間隔分の応答時間のパーセンタイル
+type WindowLatency struct {
+	Elapsed int64   `json:"elapsed_ms"` // 間隔の終了時点の経過時間(ms)
+	Count   int     `json:"count"`      // 間隔内のサンプル数
+	P50     float64 `json:"p50_ms"`     // 50パーセンタイル(ms)
+	P95     float64 `json:"p95_ms"`     // 95パーセンタイル(ms)
+	P99     float64 `json:"p99_ms"`     // 99パーセンタイル(ms)
+}
+
+// 間隔内の応答時間から、パーセンタイルを算出する（サンプルが存在しない場合は0）。
+//   elapsed   : 間隔の終了時点の経過時間(ms)
+//   durations : 間隔内の応答時間
+func CalcWindowLatency(elapsed int64, durations []time.Duration) WindowLatency {
+	window := WindowLatency{Elapsed: elapsed, Count: len(durations)}
+	if values := CalcPercentiles(durations, []float64{50, 95, 99}); values != nil {
+		window.P50 = values[0].Value
+		window.P95 = values[1].Value
+		window.P99 = values[2].Value
+	}
+	return window
+}
+
+// ThroughputSamplerを生成する。
+//   interval : 記録する間隔
+//   output   : 記録の出力先(CSV、nil の場合は出力しない)
+func NewThroughputSampler(interval time.Duration, output io.Writer) *ThroughputSampler {
+	return &ThroughputSampler{Interval: interval, Output: output}
+}
+
+// 進捗のカウンターを一定間隔で読み取り、時刻と直前の間隔の瞬間スループットを記録する。
+// エラー数のカウンターが指定されている場合は、直前の間隔のエラー数も出力する。
+// 接続数が指定されている場合は、その時点の接続数も出力する。
+// 応答時間が指定されている場合は、直前の間隔の応答時間のパーセンタイルも出力する。
+// ctx がキャンセルされるまで処理を継続する。
+//   progress : 進捗のカウンター
+func (s *ThroughputSampler) Sample(ctx context.Context, progress *int64) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	lastTime := start
+	lastCount := atomic.LoadInt64(progress)
+	var lastErrors int64 = 0
+	if s.Errors != nil {
+		lastErrors = atomic.LoadInt64(s.Errors)
+	}
+	lastLatency := 0
+	if s.Latency != nil {
+		_, lastLatency = s.Latency.DurationsSince(0)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			count := atomic.LoadInt64(progress)
+			throughput := float64(count-lastCount) / now.Sub(lastTime).Seconds() // messages/sec
+			s.rates = append(s.rates, throughput)
+			var window WindowLatency
+			if s.Latency != nil {
+				var durations []time.Duration
+				durations, lastLatency = s.Latency.DurationsSince(lastLatency)
+				window = CalcWindowLatency(ElapsedMillis(start), durations)
+				s.latencies = append(s.latencies, window)
+			}
+			if s.Output != nil {
+				fmt.Fprintf(s.Output, "%s,%d,%d,%.2f",
+					now.Format(time.RFC3339Nano), ElapsedMillis(start), count, throughput)
+				if s.Errors != nil {
+					errors := atomic.LoadInt64(s.Errors)
+					fmt.Fprintf(s.Output, ",%d", errors-lastErrors)
+					lastErrors = errors
+				}
+				if s.Connected != nil {
+					fmt.Fprintf(s.Output, ",%d", atomic.LoadInt64(s.Connected))
+				}
+				if s.Latency != nil {
+					fmt.Fprintf(s.Output, ",%.3f,%.3f,%.3f", window.P50, window.P95, window.P99)
+				}
+				fmt.Fprintf(s.Output, "\n")
+			}
+			lastTime = now
+			lastCount = count
+		}
+	}
+}
+
+// 間隔毎の瞬間スループットを返す。Sample の終了後に呼び出すこと。
+func (s *ThroughputSampler) Rates() []float64 {
+	return s.rates
+}
+
+// 間隔毎の応答時間のパーセンタイルを返す。Sample の終了後に呼び出すこと。
+func (s *ThroughputSampler) Latencies() []WindowLatency {
+	return s.latencies
+}
+
+// 1秒毎に処理したメッセージ数を集計する。
+type SecondBuckets struct {
+	counts []int64 // 1秒毎のメッセージ数
+	start  int64   // 集計を開始した時点の進捗のカウンター
+}
+
+// 集計を開始した時点の進捗のカウンターを記録し、SecondBucketsを生成する。
+// Collect のgoroutineの開始が遅れても開始時点から集計できるように、計測の開始前に呼び出すこと。
+//   progress : 進捗のカウンター
+func NewSecondBuckets(progress *int64) *SecondBuckets {
+	return &SecondBuckets{start: atomic.LoadInt64(progress)}
+}
+
+// 進捗のカウンターを1秒毎に読み取り、直前の1秒間のメッセージ数を記録する。
+// ctx がキャンセルされた時点で、最後の1秒未満の間隔のメッセージ数も記録するため、
+// バケット数は計測時間(秒)の切り上げ、合計は計測中に処理したメッセージ数と一致する。
+//   progress : 進捗のカウンター
+func (s *SecondBuckets) Collect(ctx context.Context, progress *int64) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastCount := s.start
+	for {
+		select {
+		case <-ctx.Done():
+			s.counts = append(s.counts, atomic.LoadInt64(progress)-lastCount)
+			return
+		case <-ticker.C:
+			count := atomic.LoadInt64(progress)
+			s.counts = append(s.counts, count-lastCount)
+			lastCount = count
+		}
+	}
+}
+
+// 1秒毎のメッセージ数を返す。Collect の終了後に呼び出すこと。
+func (s *SecondBuckets) Counts() []int64 {
+	return s.counts
+}
+
+// 出力する列に対応する、時系列のヘッダー行を返す。
+func (s *ThroughputSampler) Header() string {
+	header := "timestamp,elapsed_ms,count,throughput"
+	if s.Errors != nil {
+		header += ",errors"
+	}
+	if s.Connected != nil {
+		header += ",connected"
+	}
+	if s.Latency != nil {
+		header += ",p50_ms,p95_ms,p99_ms"
+	}
+	return header
+}
+
+// 時系列を追記するファイルを開く。
+// 新規のファイルの場合は、ヘッダー行を出力する。
+//   header : ヘッダー行
+func OpenTimeseriesFile(path string, header string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		fmt.Fprintf(file, "%s\n", header)
+	}
+	return file, nil
+}
+
+// 間隔毎のスループットの統計値
+type WindowThroughputStats struct {
+	Windows int     `json:"windows"`   // 間隔の数
+	Mean    float64 `json:"mean"`      // 平均(messages/sec)
+	Stddev  float64 `json:"stddev"`    // 標準偏差(messages/sec、不偏分散による)
+	CILow   float64 `json:"ci95_low"`  // 平均の95%信頼区間の下限(messages/sec)
+	CIHigh  float64 `json:"ci95_high"` // 平均の95%信頼区間の上限(messages/sec)
+}
+
+// 自由度1-30の、t分布の両側95%点
+var tDistribution95 = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042}
+
+// 間隔毎のスループットから、平均、標準偏差と、平均の95%信頼区間を算出する。
+// 信頼区間は、間隔が31以上の場合は正規分布で近似し、それ以下の場合はt分布で算出する。
+// 間隔が2未満の場合は nil を返す。
+func CalcWindowThroughputStats(rates []float64) *WindowThroughputStats {
+	n := len(rates)
+	if n < 2 {
+		return nil
+	}
+
+	mean := 0.0
+	for _, r := range rates {
+		mean += r
+	}
+	mean /= float64(n)
+
+	ss := 0.0
+	for _, r := range rates {
+		ss += (r - mean) * (r - mean)
+	}
+	stddev := math.Sqrt(ss / float64(n-1))
+
+	t := 1.96
+	if n-1 <= len(tDistribution95) {
+		t = tDistribution95[n-2]
+	}
+	margin := t * stddev / math.Sqrt(float64(n))
+	return &WindowThroughputStats{
+		Windows: n,
+		Mean:    mean,
+		Stddev:  stddev,
+		CILow:   mean - margin,
+		CIHigh:  mean + margin}
+}
+
+// 間隔毎のスループットの統計値を、1行の文字列に整形する。
+func (s *WindowThroughputStats) String() string {
+	return fmt.Sprintf("windows=%d, mean=%.2f, stddev=%.2f, 95%%CI=[%.2f, %.2f] messages/sec",
+		s.Windows, s.Mean, s.Stddev, s.CILow, s.CIHigh)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimeseriesFile(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.Count = 30
+	opts.IntervalTime = 5
+	opts.SampleInterval = 20 * time.Millisecond
+	opts.TimeseriesFile = filepath.Join(t.TempDir(), "timeseries.csv")
+
+	output := captureStdout(t, func() {
+		if Execute(PublishAllClient, opts) == nil {
+			t.Error("Execute failed")
+		}
+	})
+
+	file, err := os.Open(opts.TimeseriesFile)
+	if err != nil {
+		t.Fatalf("timeseries file is not written : %s\n%s", err, output)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 4 || rows[0][0] != "timestamp" || rows[0][3] != "throughput" {
+		t.Fatalf("timeseries = %v", rows)
+	}
+
+	var lastTime time.Time
+	lastElapsed, lastCount := -1, -1
+	for _, row := range rows[1:] {
+		timestamp, err := time.Parse(time.RFC3339Nano, row[0])
+		if err != nil {
+			t.Fatalf("invalid timestamp : %s", row[0])
+		}
+		elapsed, _ := strconv.Atoi(row[1])
+		count, _ := strconv.Atoi(row[2])
+		if timestamp.After(lastTime) == false || elapsed <= lastElapsed || count < lastCount {
+			t.Errorf("row %v is not after the previous row (timestamp=%s, elapsed=%d, count=%d)", row, lastTime, lastElapsed, lastCount)
+		}
+		if _, err := strconv.ParseFloat(row[3], 64); err != nil {
+			t.Errorf("invalid throughput : %s", row[3])
+		}
+		lastTime, lastElapsed, lastCount = timestamp, elapsed, count
+	}
+}
+
+func TestCalcWindowThroughputStats(t *testing.T) {
+	if stats := CalcWindowThroughputStats([]float64{10}); stats != nil {
+		t.Errorf("stats of a single window = %+v", *stats)
+	}
+
+	// 平均 14、不偏分散 10、自由度4のt分布の95%点 2.776
+	stats := CalcWindowThroughputStats([]float64{10, 12, 14, 16, 18})
+	margin := 2.776 * math.Sqrt(10) / math.Sqrt(5)
+	if stats == nil || stats.Windows != 5 || stats.Mean != 14 || math.Abs(stats.Stddev-math.Sqrt(10)) > 1e-9 ||
+		math.Abs(stats.CILow-(14-margin)) > 1e-9 || math.Abs(stats.CIHigh-(14+margin)) > 1e-9 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// 間隔が31以上の場合は、正規分布で近似する。
+	rates := make([]float64, 40)
+	for i := range rates {
+		rates[i] = float64(100 + i%2*10)
+	}
+	stats = CalcWindowThroughputStats(rates)
+	margin = 1.96 * stats.Stddev / math.Sqrt(40)
+	if stats.Mean != 105 || math.Abs(stats.CIHigh-stats.Mean-margin) > 1e-9 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestSecondBuckets(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 2
+	opts.Count = 30
+	opts.IntervalTime = 50
+	opts.ReportSecondBuckets = true
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PublishAllClient, opts)
+	})
+	if result == nil {
+		t.Fatalf("Execute failed : %s", output)
+	}
+	// 約1.5秒の実行のため、最後の1秒未満の間隔を含めて2つのバケットとなる。
+	seconds := int((result.Phases.Run + 999) / 1000)
+	if len(result.SecondBuckets) != seconds {
+		t.Errorf("buckets = %v, want %d for %dms", result.SecondBuckets, seconds, result.Phases.Run)
+	}
+	var sum int64 = 0
+	for _, count := range result.SecondBuckets {
+		sum += count
+	}
+	if sum != int64(result.TotalCount) || sum != int64(opts.ClientNum*opts.Count) {
+		t.Errorf("sum of buckets = %d, total = %d", sum, result.TotalCount)
+	}
+}
+
+func TestSamplerErrorsPerInterval(t *testing.T) {
+	var output bytes.Buffer
+	sampler := NewThroughputSampler(100*time.Millisecond, &output)
+	var progress, errors int64
+	sampler.Errors = &errors
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sampler.Sample(ctx, &progress)
+	}()
+	// 2番目の間隔の中程でのみ、エラーを発生させる。
+	time.Sleep(150 * time.Millisecond)
+	atomic.AddInt64(&errors, 7)
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	<-done
+
+	rows, err := csv.NewReader(&output).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 4 {
+		t.Fatalf("timeseries = %v", rows)
+	}
+	if header := sampler.Header(); header != "timestamp,elapsed_ms,count,throughput,errors" {
+		t.Errorf("header = %s", header)
+	}
+	for i, row := range rows {
+		expected := "0"
+		if i == 1 {
+			expected = "7"
+		}
+		if row[4] != expected {
+			t.Errorf("errors of interval %d = %s, want %s", i+1, row[4], expected)
+		}
+	}
+}
+
+func TestSamplerConnectedCount(t *testing.T) {
+	var output bytes.Buffer
+	sampler := NewThroughputSampler(100*time.Millisecond, &output)
+	var progress, connected int64
+	sampler.Connected = &connected
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sampler.Sample(ctx, &progress)
+	}()
+	// 間隔の中程で、接続と切断を繰り返す。
+	time.Sleep(50 * time.Millisecond)
+	expected := []string{}
+	for _, delta := range []int64{5, -2, 3, -6} {
+		atomic.AddInt64(&connected, delta)
+		expected = append(expected, strconv.FormatInt(atomic.LoadInt64(&connected), 10))
+		time.Sleep(100 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	rows, err := csv.NewReader(&output).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := sampler.Header(); header != "timestamp,elapsed_ms,count,throughput,connected" {
+		t.Errorf("header = %s", header)
+	}
+	if len(rows) < len(expected) {
+		t.Fatalf("timeseries = %v", rows)
+	}
+	for i := range expected {
+		if rows[i][4] != expected[i] {
+			t.Errorf("connected of interval %d = %s, want %s", i+1, rows[i][4], expected[i])
+		}
+	}
+}
+
+func TestSamplerWindowLatency(t *testing.T) {
+	var output bytes.Buffer
+	sampler := NewThroughputSampler(100*time.Millisecond, &output)
+	var progress int64
+	sampler.Latency = NewLatencyRecorder()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sampler.Sample(ctx, &progress)
+	}()
+	// 1番目の間隔は1-100ms、2番目の間隔は201-300msの応答時間を記録する。
+	time.Sleep(50 * time.Millisecond)
+	for _, d := range shuffledMillis(1, 100) {
+		sampler.Latency.Record(0, d)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, d := range shuffledMillis(201, 300) {
+		sampler.Latency.Record(0, d)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	// 間隔毎に、その間隔内のサンプルのみからパーセンタイルを算出する。
+	latencies := sampler.Latencies()
+	if len(latencies) < 2 {
+		t.Fatalf("latencies = %v", latencies)
+	}
+	expected := []WindowLatency{{Count: 100, P50: 50, P95: 95, P99: 99}, {Count: 100, P50: 250, P95: 295, P99: 299}}
+	for i, e := range expected {
+		w := latencies[i]
+		if w.Count != e.Count || w.P50 != e.P50 || w.P95 != e.P95 || w.P99 != e.P99 {
+			t.Errorf("window %d = %+v, want %+v", i+1, w, e)
+		}
+	}
+	if len(latencies) > 2 && latencies[2].Count != 0 {
+		t.Errorf("window 3 = %+v", latencies[2])
+	}
+
+	rows, err := csv.NewReader(&output).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := sampler.Header(); header != "timestamp,elapsed_ms,count,throughput,p50_ms,p95_ms,p99_ms" {
+		t.Errorf("header = %s", header)
+	}
+	if row := rows[1]; row[4] != "250.000" || row[5] != "295.000" || row[6] != "299.000" {
+		t.Errorf("row 2 = %v", row)
+	}
+}
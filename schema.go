@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+)
+
+// ペイロードの検証に利用するJSON Schema
+// 対応するキーワードは type、properties、required、items、enum のみとなる。
+type JsonSchema map[string]interface{}
+
+// JSON Schemaのファイルを読み込む。
+func LoadJsonSchema(path string) (JsonSchema, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schema JsonSchema
+	if err := json.Unmarshal(content, &schema); err != nil {
+		return nil, fmt.Errorf("invalid schema : %s", err)
+	}
+	return schema, nil
+}
+
+// ペイロードがJSONとして解析でき、スキーマに適合することを検証する。
+//   payload : ペイロード
+//   schema  : JSON Schema（nil の場合は、JSONとして解析できることのみ検証する）
+func ValidateJsonPayload(payload string, schema JsonSchema) error {
+	var value interface{}
+	if err := json.Unmarshal([]byte(payload), &value); err != nil {
+		return fmt.Errorf("payload is not a valid JSON : %s", err)
+	}
+	if schema == nil {
+		return nil
+	}
+	return validateJsonValue(value, schema, "$")
+}
+
+// 値がスキーマに適合することを検証する。
+//   path : エラーメッセージに出力する、値の位置（例 : $.device.id）
+func validateJsonValue(value interface{}, schema map[string]interface{}, path string) error {
+	if t, ok := schema["type"].(string); ok && jsonTypeMatches(value, t) == false {
+		return fmt.Errorf("%s : expected %s", path, t)
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		encoded, _ := json.Marshal(value)
+		for _, candidate := range enum {
+			if c, _ := json.Marshal(candidate); string(c) == string(encoded) {
+				found = true
+				break
+			}
+		}
+		if found == false {
+			return fmt.Errorf("%s : value is not in enum", path)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, key := range required {
+				name, _ := key.(string)
+				if _, ok := v[name]; ok == false {
+					return fmt.Errorf("%s : required field is missing : %s", path, name)
+				}
+			}
+		}
+		if properties, ok := schema["properties"].(map[string]interface{}); ok {
+			// エラーメッセージが実行毎に変わらないように、フィールド名の順に検証する。
+			names := make([]string, 0, len(properties))
+			for name := range properties {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				property, ok := properties[name].(map[string]interface{})
+				field, exists := v[name]
+				if ok == false || exists == false {
+					continue
+				}
+				if err := validateJsonValue(field, property, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateJsonValue(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 値がJSON Schemaの type に該当するかどうかを返す。
+func jsonTypeMatches(value interface{}, t string) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return t == "object"
+	case []interface{}:
+		return t == "array"
+	case string:
+		return t == "string"
+	case bool:
+		return t == "boolean"
+	case float64:
+		return t == "number" || (t == "integer" && v == float64(int64(v)))
+	case nil:
+		return t == "null"
+	}
+	return false
+}
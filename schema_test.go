@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateJsonPayload(t *testing.T) {
+	schemaFile := filepath.Join(t.TempDir(), "schema.json")
+	schemaJson := `{"type":"object","required":["id","tags"],"properties":{
+		"id":{"type":"integer"},
+		"state":{"enum":["on","off"]},
+		"tags":{"type":"array","items":{"type":"string"}}}}`
+	if err := ioutil.WriteFile(schemaFile, []byte(schemaJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+	schema, err := LoadJsonSchema(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		payload string
+		schema  JsonSchema
+		message string // 期待するエラーメッセージの一部（空の場合はエラーなし）
+	}{
+		{`{"id":1,`, nil, "not a valid JSON"},
+		{`[1,2]`, nil, ""},
+		{`{"id":1,"state":"on","tags":["a"]}`, schema, ""},
+		{`[]`, schema, "$ : expected object"},
+		{`{"id":1}`, schema, "required field is missing : tags"},
+		{`{"id":1.5,"tags":[]}`, schema, "$.id : expected integer"},
+		{`{"id":1,"state":"idle","tags":[]}`, schema, "$.state : value is not in enum"},
+		{`{"id":1,"tags":["a",2]}`, schema, "$.tags[1] : expected string"}}
+	for _, test := range tests {
+		err := ValidateJsonPayload(test.payload, test.schema)
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("ValidateJsonPayload(%s) = %s", test.payload, err)
+			}
+			continue
+		}
+		if err == nil || strings.Contains(err.Error(), test.message) == false {
+			t.Errorf("ValidateJsonPayload(%s) = %v, want %q", test.payload, err, test.message)
+		}
+	}
+}
+
+func TestInvalidJsonPayloadRejectedBeforeConnect(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	status, output := runMainOutput(t, "-broker="+broker.URL, "-action=pub", "-count=1", "-pretime=0",
+		`-payload-template={"id":{{.ClientId}},}`, "-payload-validate-json")
+	if status != 1 || strings.Contains(output, "Invalid payload : payload is not a valid JSON") == false {
+		t.Errorf("exit status = %d : %s", status, output)
+	}
+	// 接続する前にエラーとする。
+	if connects := len(broker.Connects()); connects != 0 {
+		t.Errorf("connects = %d", connects)
+	}
+
+	status, output = runMainOutput(t, "-broker="+broker.URL, "-action=pub", "-count=1", "-pretime=0", "-qos=1",
+		`-payload-template={"id":{{.ClientId}}}`, "-payload-validate-json")
+	if status != 0 || len(broker.Published()) == 0 {
+		t.Errorf("valid payload : exit status = %d, published = %d : %s", status, len(broker.Published()), output)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// シグナルによる中断時の、送信中のメッセージの処理結果
+type ShutdownStats struct {
+	Signal           string  `json:"signal"`             // 受信したシグナル
+	InflightAtSignal int64   `json:"inflight_at_signal"` // シグナルを受信した時点の送信中のメッセージ数
+	Undrained        int64   `json:"undrained"`          // タイムアウトまでに完了しなかった送信中のメッセージ数
+	DrainTime        float64 `json:"drain_ms"`           // シグナルの受信から、送信の終了までの時間(ms)
+}
+
+// 処理結果を、1行の文字列に整形する。
+func (s *ShutdownStats) String() string {
+	return fmt.Sprintf("signal=%s, inflight=%d, undrained=%d, drain=%.3fms",
+		s.Signal, s.InflightAtSignal, s.Undrained, s.DrainTime)
+}
+
+// 送信中のメッセージの完了待ちがタイムアウトした後に、処理の終了を待つ最大時間
+const SHUTDOWN_EXEC_WAIT time.Duration = 5 * time.Second
+
+// 処理を実行し、SIGINT または SIGTERM を受信した場合は、2段階で終了する。
+// まず cancel で新たな送信を止め、送信中のメッセージの完了を timeout まで待つ。
+// 処理の実行中に切断すると送信中の処理と競合するため、常に処理の終了を待ってから戻る。
+// timeout までに処理が終了しない場合は、完了しなかったメッセージ数を記録し、
+// さらに SHUTDOWN_EXEC_WAIT まで待っても終了しない場合は、プロセスを終了する。
+// 待機中に再度シグナルを受信した場合は、即座にプロセスを終了する。
+//   cancel   : 新たな送信を止める関数
+//   inflight : 送信中のメッセージ数
+//   timeout  : 送信中のメッセージの完了を待つ最大時間
+//   exec     : 実行する処理（処理したメッセージ数を返す）
+func RunWithGracefulShutdown(cancel context.CancelFunc, inflight *InflightGauge, timeout time.Duration, exec func() int) (count int, stats *ShutdownStats) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	done := make(chan int, 1)
+	go func() {
+		done <- exec()
+	}()
+
+	select {
+	case count = <-done:
+		return count, nil
+	case sig := <-signals:
+		signalTime := time.Now()
+		stats = &ShutdownStats{Signal: sig.String(), InflightAtSignal: inflight.Current()}
+		fmt.Printf("%s Received %s, draining %d inflight messages\n", signalTime, sig, stats.InflightAtSignal)
+		cancel()
+
+		go func() {
+			<-signals
+			fmt.Printf("Received the signal again, exit immediately\n")
+			os.Exit(1)
+		}()
+
+		select {
+		case count = <-done:
+		case <-time.After(timeout):
+			stats.Undrained = inflight.Current()
+			fmt.Printf("Drain timeout : %d inflight messages are not completed, waiting for the publishers to stop\n", stats.Undrained)
+			select {
+			case count = <-done:
+			case <-time.After(SHUTDOWN_EXEC_WAIT):
+				fmt.Printf("The publishers didn't stop within %s after the drain timeout, exit without the result\n", SHUTDOWN_EXEC_WAIT)
+				os.Exit(1)
+			}
+		}
+		stats.DrainTime = ToMillis(time.Since(signalTime))
+		return count, stats
+	}
+}
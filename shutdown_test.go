@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// 処理中に、自プロセスへ SIGINT を送信する。
+func interruptSelf(t *testing.T) {
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGracefulShutdownDrainsInflight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inflight := &InflightGauge{}
+	finished := false
+	var stats *ShutdownStats
+	var count int
+	captureStdout(t, func() {
+		count, stats = RunWithGracefulShutdown(cancel, inflight, time.Second, func() int {
+			inflight.Add(3)
+			interruptSelf(t)
+			<-ctx.Done()
+			// 新たな送信を止めた後に、送信中のメッセージが完了する。
+			time.Sleep(50 * time.Millisecond)
+			inflight.Done(3)
+			finished = true
+			return 7
+		})
+	})
+	if finished == false || count != 7 {
+		t.Fatalf("returned before the publishers stopped : finished = %t, count = %d", finished, count)
+	}
+	if stats == nil || stats.Signal != "interrupt" || stats.InflightAtSignal != 3 || stats.Undrained != 0 || stats.DrainTime < 50 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestGracefulShutdownWaitsForExecAfterTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	inflight := &InflightGauge{}
+	finished := false
+	var stats *ShutdownStats
+	var count int
+	output := captureStdout(t, func() {
+		count, stats = RunWithGracefulShutdown(cancel, inflight, 20*time.Millisecond, func() int {
+			inflight.Add(2)
+			interruptSelf(t)
+			<-ctx.Done()
+			time.Sleep(200 * time.Millisecond)
+			inflight.Done(2)
+			finished = true
+			return 5
+		})
+	})
+	// タイムアウトしても、処理の終了を待ってから戻る。
+	if finished == false || count != 5 {
+		t.Fatalf("returned before the publishers stopped : finished = %t, count = %d", finished, count)
+	}
+	if stats == nil || stats.Undrained != 2 || stats.DrainTime < 200 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if strings.Contains(output, "Drain timeout : 2 inflight messages are not completed") == false {
+		t.Errorf("output = %s", output)
+	}
+}
+
+func TestGracefulShutdownOnSignalMidRun(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{AckDelay: 20 * time.Millisecond})
+	opts := testExecOptions(broker.URL)
+	opts.Count = 1000
+	opts.Qos = 1
+	opts.DrainOnSignal = true
+	opts.DrainTimeoutOnSignal = 5 * time.Second
+
+	go func() {
+		if waitFor(5*time.Second, func() bool { return len(broker.Published()) >= 4 }) {
+			interruptSelf(t)
+		}
+	}()
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PublishAllClient, opts)
+	})
+	if result == nil || result.Shutdown == nil {
+		t.Fatalf("no shutdown result : %s", output)
+	}
+	if result.Shutdown.Undrained != 0 {
+		t.Errorf("shutdown = %s", result.Shutdown)
+	}
+	// 送信中だったメッセージも、切断の前に完了して処理数に含まれる。
+	published := len(broker.Published())
+	if result.TotalCount >= opts.ClientNum*opts.Count || result.TotalCount != published {
+		t.Errorf("total = %d, broker received = %d", result.TotalCount, published)
+	}
+}
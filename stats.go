@@ -0,0 +1,820 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 実行中に収集する計測情報
+type Metrics struct {
+	Progress         int64                 // 送受信したメッセージ数の進捗（atomicに更新する）
+	PublishLatency   *LatencyRecorder      // Publish毎の応答時間
+	Arrivals         []*ArrivalTracker     // Subscriber毎のメッセージの到着間隔
+	Published        int                   // Publish/Subscribeを同時に行う場合の、送信メッセージ数
+	Duplicates       *DuplicateStats       // 冪等性キーの重複の検証結果
+	ExactlyOnce      *ExactlyOnceStats     // QoS 2のexactly-onceの検証結果
+	EndToEndLatency  *LatencyRecorder      // 送信から受信までの時間
+	ConnectLatency   *LatencyRecorder      // 接続毎の接続(CONNACK)までの時間
+	SubscribeLatency *LatencyRecorder      // クライアント毎のSubscribe(SUBACK)までの時間
+	Signatures       *SignatureStats       // 受信したメッセージの署名の検証結果
+	DroppedClients   int64                 // エラーが閾値を超えたため切り離したクライアント数（atomicに更新する）
+	Ordering         *OrderingStats        // 再接続をまたいだメッセージの順序の検証結果
+	QosGrants        *QosGrantRecorder     // Subscribe時に要求したQoSと、付与されたQoS
+	Qos0Dropped      *int                  // Publish/Subscribeを同時に行う場合の、受信しなかったQoS 0のメッセージ数
+	Inflight         InflightGauge         // 送信中（完了待ち）のメッセージ数
+	Backlog          *BacklogStats         // 永続セッションに滞留したメッセージの、再接続後の配信結果
+	Qos0DropEstimate *DropEstimate         // 送信と受信の連番の照合による、QoS 0のメッセージの破棄の推定値
+	TopicLatency     *TopicLatencyRecorder // Topic毎のPublishの応答時間（nil の場合は記録しない）
+	Errors           int64                 // Publishのエラー数（atomicに更新する）
+	Connected        int64                 // 接続中の接続数（atomicに更新する）
+	Bytes            *ByteCounter          // Publishしたペイロードとプロトコルのオーバーヘッドのバイト数（nil の場合は記録しない）
+	Subscriptions    *SubscriptionTracker  // 接続毎にSubscribeしたTopic Filter（nil の場合は記録しない）
+	Auth             *AuthStats            // Publishせずに接続と切断を繰り返した結果
+	Outliers         *OutlierTracker       // 応答時間の遅い上位のPublish（nil の場合は記録しない）
+	GcImpact         *GcImpactRecorder     // GCの停止時間と、区間毎のPublishの最大の応答時間（nil の場合は記録しない）
+	TopicMatch       *TopicMatchStats      // 受信したメッセージのTopicと、Topic Filterの照合結果（nil の場合は照合しない）
+	ClientRates      *ClientRateRecorder   // クライアント毎の送受信レート（nil の場合は記録しない）
+	Calibration      *CalibrationStats     // 1クライアントでの、Broker経由の折り返しの応答時間
+}
+
+// 送受信したメッセージ数の進捗を加算する。
+func (m *Metrics) AddProgress(n int64) {
+	atomic.AddInt64(&m.Progress, n)
+}
+
+// Publishのエラー数を加算する。
+func (m *Metrics) AddErrors(n int64) {
+	atomic.AddInt64(&m.Errors, n)
+}
+
+// Metricsを生成する。
+func NewMetrics() *Metrics {
+	return &Metrics{
+		PublishLatency:   NewLatencyRecorder(),
+		EndToEndLatency:  NewLatencyRecorder(),
+		ConnectLatency:   NewLatencyRecorder(),
+		SubscribeLatency: NewLatencyRecorder(),
+		QosGrants:        NewQosGrantRecorder()}
+}
+
+// 応答時間の記録
+type LatencySample struct {
+	Qos      byte          // 送信時のQoS
+	Duration time.Duration // 応答時間
+}
+
+// 応答時間の記録方式
+const (
+	LATENCY_BACKEND_EXACT string = "exact" // 全てのサンプルを保持する
+	LATENCY_BACKEND_HDR   string = "hdr"   // HDRヒストグラムに計数する
+)
+
+// 複数のクライアントから並行して、応答時間を記録する。
+type LatencyRecorder struct {
+	mutex   sync.Mutex
+	samples []LatencySample
+	hdr     map[byte]*HdrHistogram // QoS毎のHDRヒストグラム（nil の場合は、サンプルを保持する）
+}
+
+// LatencyRecorderを生成する。
+func NewLatencyRecorder() *LatencyRecorder {
+	return &LatencyRecorder{}
+}
+
+// サンプルを保持せず、HDRヒストグラムに計数するLatencyRecorderを生成する。
+// メモリ使用量は件数に関わらず一定となるが、Durations などのサンプルを返すメソッドは
+// 空の結果を返すため、統計値は Stats などのメソッドで取得すること。
+func NewHdrLatencyRecorder() *LatencyRecorder {
+	return &LatencyRecorder{hdr: make(map[byte]*HdrHistogram)}
+}
+
+// 指定されたパーセンタイルの値
+type PercentileValue struct {
+	Percentile float64 `json:"percentile"` // パーセンタイル(0-100)
+	Value      float64 `json:"value_ms"`   // 値(ms)
+}
+
+// 指定された各パーセンタイルの値を算出する。
+// サンプルが存在しない場合は nil を返す。
+//   durations   : サンプル
+//   percentiles : パーセンタイルの一覧(0-100)
+func CalcPercentiles(durations []time.Duration, percentiles []float64) []PercentileValue {
+	if len(durations) == 0 || len(percentiles) == 0 {
+		return nil
+	}
+
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	values := make([]PercentileValue, len(percentiles))
+	for i, p := range percentiles {
+		values[i] = PercentileValue{Percentile: p, Value: ToMillis(Percentile(sorted, p))}
+	}
+	return values
+}
+
+// パーセンタイルの値の一覧を、1行の文字列に整形する（例 : p50=1.000ms, p99.9=5.000ms）。
+func FormatPercentiles(values []PercentileValue) string {
+	texts := make([]string, len(values))
+	for i, v := range values {
+		texts[i] = fmt.Sprintf("p%s=%.3fms", strconv.FormatFloat(v.Percentile, 'f', -1, 64), v.Value)
+	}
+	return strings.Join(texts, ", ")
+}
+
+// カンマ区切りのパーセンタイルの一覧を解析する（例 : 50,90,99,99.9）。
+func ParsePercentiles(list string) ([]float64, error) {
+	var percentiles []float64
+	for _, v := range strings.Split(list, ",") {
+		p, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		if p <= 0 || p > 100 {
+			return nil, fmt.Errorf("out of range : %s", v)
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
+
+// 応答時間を記録する。
+func (r *LatencyRecorder) Record(qos byte, duration time.Duration) {
+	r.mutex.Lock()
+	if r.hdr != nil {
+		histogram, ok := r.hdr[qos]
+		if ok == false {
+			histogram = NewHdrHistogram()
+			r.hdr[qos] = histogram
+		}
+		histogram.Record(duration)
+	} else {
+		r.samples = append(r.samples, LatencySample{Qos: qos, Duration: duration})
+	}
+	r.mutex.Unlock()
+}
+
+// 全てのQoSのHDRヒストグラムを合算して返す（ロックを取得して呼び出すこと）。
+func (r *LatencyRecorder) mergedHdr() *HdrHistogram {
+	merged := NewHdrHistogram()
+	for _, histogram := range r.hdr {
+		merged.Merge(histogram)
+	}
+	return merged
+}
+
+// 記録した応答時間の統計値を算出する。
+// 記録がない場合は nil を返す。
+func (r *LatencyRecorder) Stats() *LatencyStats {
+	if r.hdr == nil {
+		return CalcLatencyStats(r.Durations())
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.mergedHdr().Stats()
+}
+
+// 記録した応答時間の統計値を、QoS毎に算出する。
+func (r *LatencyRecorder) StatsByQos() map[byte]*LatencyStats {
+	stats := make(map[byte]*LatencyStats)
+	if r.hdr == nil {
+		for qos, durations := range r.DurationsByQos() {
+			stats[qos] = CalcLatencyStats(durations)
+		}
+		return stats
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for qos, histogram := range r.hdr {
+		stats[qos] = histogram.Stats()
+	}
+	return stats
+}
+
+// 記録した応答時間の、指定された各パーセンタイルの値を算出する。
+// 記録がない場合は nil を返す。
+//   percentiles : パーセンタイルの一覧(0-100)
+func (r *LatencyRecorder) Percentiles(percentiles []float64) []PercentileValue {
+	if r.hdr == nil {
+		return CalcPercentiles(r.Durations(), percentiles)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	merged := r.mergedHdr()
+	if merged.Count() == 0 || len(percentiles) == 0 {
+		return nil
+	}
+	values := make([]PercentileValue, len(percentiles))
+	for i, p := range percentiles {
+		values[i] = PercentileValue{Percentile: p, Value: ToMillis(merged.ValueAtPercentile(p))}
+	}
+	return values
+}
+
+// 記録した応答時間のうち、閾値を超えた件数を算出する。
+func (r *LatencyRecorder) Threshold(threshold time.Duration) *ThresholdStats {
+	if r.hdr == nil {
+		return CalcThresholdStats(r.Durations(), threshold)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	merged := r.mergedHdr()
+	stats := &ThresholdStats{
+		Threshold: ToMillis(threshold),
+		Exceeded:  merged.CountAbove(threshold),
+		Total:     merged.Count()}
+	if stats.Total > 0 {
+		stats.Percent = float64(stats.Exceeded) / float64(stats.Total) * 100
+	}
+	return stats
+}
+
+// 記録した全ての応答時間を返す。
+func (r *LatencyRecorder) Durations() []time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	durations := make([]time.Duration, len(r.samples))
+	for i, sample := range r.samples {
+		durations[i] = sample.Duration
+	}
+	return durations
+}
+
+// 指定された位置以降に記録した応答時間と、次に指定する位置を返す。
+// 位置を引き継いで呼び出すことで、前回以降に記録した応答時間のみを取得できる。
+//   from : 取得を開始する位置（最初は0）
+func (r *LatencyRecorder) DurationsSince(from int) ([]time.Duration, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if from > len(r.samples) {
+		from = len(r.samples)
+	}
+	durations := make([]time.Duration, len(r.samples)-from)
+	for i, sample := range r.samples[from:] {
+		durations[i] = sample.Duration
+	}
+	return durations, len(r.samples)
+}
+
+// 記録した応答時間を、QoS毎に分類して返す。
+func (r *LatencyRecorder) DurationsByQos() map[byte][]time.Duration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	durations := make(map[byte][]time.Duration)
+	for _, sample := range r.samples {
+		durations[sample.Qos] = append(durations[sample.Qos], sample.Duration)
+	}
+	return durations
+}
+
+// Topic毎の応答時間を記録する、Topicの最大数
+const TOPIC_LATENCY_MAX_TOPICS int = 1000
+
+// 記録するTopicの最大数を超えた、その他のTopicの応答時間をまとめるTopic名
+const TOPIC_LATENCY_OTHER string = "(other)"
+
+// 複数のクライアントから並行して、Topic毎の応答時間を記録する。
+// 記録するTopicの最大数を超えた後に初めて送信したTopicは、その他のTopicとしてまとめて記録する。
+type TopicLatencyRecorder struct {
+	mutex     sync.Mutex
+	maxTopics int
+	durations map[string][]time.Duration
+	other     []time.Duration
+}
+
+// TopicLatencyRecorderを生成する。
+//   maxTopics : 記録するTopicの最大数
+func NewTopicLatencyRecorder(maxTopics int) *TopicLatencyRecorder {
+	return &TopicLatencyRecorder{maxTopics: maxTopics, durations: make(map[string][]time.Duration)}
+}
+
+// Topicの応答時間を記録する（nil の場合は何もしない）。
+func (r *TopicLatencyRecorder) Record(topic string, duration time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.durations[topic]; ok || len(r.durations) < r.maxTopics {
+		r.durations[topic] = append(r.durations[topic], duration)
+		return
+	}
+	r.other = append(r.other, duration)
+}
+
+// Topic毎の応答時間の統計値
+type TopicLatencyStats struct {
+	Topic string `json:"topic"` // Topic
+	LatencyStats
+}
+
+// 送信数の多い順に、上位のTopicの応答時間の統計値を返す（送信数が同じ場合はTopicの昇順）。
+// その他のTopicとしてまとめて記録した応答時間がある場合は、最後に追加する。
+//   top : 出力するTopic数（その他のTopicを含まない）
+func (r *TopicLatencyRecorder) Stats(top int) []TopicLatencyStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	topics := make([]string, 0, len(r.durations))
+	for topic := range r.durations {
+		topics = append(topics, topic)
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		if len(r.durations[topics[i]]) != len(r.durations[topics[j]]) {
+			return len(r.durations[topics[i]]) > len(r.durations[topics[j]])
+		}
+		return topics[i] < topics[j]
+	})
+	if len(topics) > top {
+		topics = topics[:top]
+	}
+
+	stats := make([]TopicLatencyStats, len(topics))
+	for i, topic := range topics {
+		stats[i] = TopicLatencyStats{Topic: topic, LatencyStats: *CalcLatencyStats(r.durations[topic])}
+	}
+	if len(r.other) > 0 {
+		stats = append(stats, TopicLatencyStats{Topic: TOPIC_LATENCY_OTHER, LatencyStats: *CalcLatencyStats(r.other)})
+	}
+	return stats
+}
+
+// クライアント毎の送受信レートを記録する
+type ClientRateRecorder struct {
+	mutex sync.Mutex
+	rates []float64
+}
+
+// クライアントの送受信レート(messages/sec)を記録する（nil の場合は何もしない）。
+//   count    : 送受信したメッセージ数
+//   duration : 送受信に要した時間
+func (r *ClientRateRecorder) Record(count int, duration time.Duration) {
+	if r == nil || duration <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	r.rates = append(r.rates, float64(count)/duration.Seconds())
+	r.mutex.Unlock()
+}
+
+// 記録した送受信レートのヒストグラムを返す。
+func (r *ClientRateRecorder) Histogram(buckets int) []HistogramBucket {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return CalcValueHistogram(r.rates, buckets)
+}
+
+// 応答時間の統計値
+type LatencyStats struct {
+	Count int     `json:"count"`  // サンプル数
+	Min   float64 `json:"min_ms"` // 最小値(ms)
+	Avg   float64 `json:"avg_ms"` // 平均値(ms)
+	P50   float64 `json:"p50_ms"` // 50パーセンタイル(ms)
+	P95   float64 `json:"p95_ms"` // 95パーセンタイル(ms)
+	P99   float64 `json:"p99_ms"` // 99パーセンタイル(ms)
+	Max   float64 `json:"max_ms"` // 最大値(ms)
+}
+
+// 応答時間の統計値を算出する。
+// サンプルが存在しない場合は nil を返す。
+func CalcLatencyStats(durations []time.Duration) *LatencyStats {
+	if len(durations) == 0 {
+		return nil
+	}
+
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum time.Duration = 0
+	for _, d := range sorted {
+		sum += d
+	}
+
+	return &LatencyStats{
+		Count: len(sorted),
+		Min:   ToMillis(sorted[0]),
+		Avg:   ToMillis(sum / time.Duration(len(sorted))),
+		P50:   ToMillis(Percentile(sorted, 50)),
+		P95:   ToMillis(Percentile(sorted, 95)),
+		P99:   ToMillis(Percentile(sorted, 99)),
+		Max:   ToMillis(sorted[len(sorted)-1])}
+}
+
+// ソート済みの値から、指定されたパーセンタイルの値を返す（nearest-rank法）。
+//   sorted     : 昇順にソート済みの値
+//   percentile : パーセンタイル(0-100、99.9 のような小数も可)
+func Percentile(sorted []time.Duration, percentile float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	// 99.9 などの小数は2進数で正確に表せないため、誤差で順位が1つずれないように丸める。
+	rank := int(math.Ceil(percentile/100*float64(len(sorted)) - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// 応答時間の中央絶対偏差
+type MadStats struct {
+	Count  int     `json:"count"`     // サンプル数
+	Median float64 `json:"median_ms"` // 中央値(ms)
+	Mad    float64 `json:"mad_ms"`    // 中央値からの偏差の絶対値の中央値(ms)
+}
+
+// 中央絶対偏差を、1行の文字列に整形する。
+func (s *MadStats) String() string {
+	return fmt.Sprintf("count=%d, median=%.3fms, mad=%.3fms", s.Count, s.Median, s.Mad)
+}
+
+// 応答時間の中央絶対偏差(MAD)を算出する。
+// 標準偏差と異なり、外れ値の影響を受けにくい散らばりの指標となる。
+// サンプル数が偶数の場合、中央値は中央の2つの平均値とする。サンプルが存在しない場合は nil を返す。
+func CalcMedianAbsoluteDeviation(durations []time.Duration) *MadStats {
+	if len(durations) == 0 {
+		return nil
+	}
+
+	values := make([]float64, len(durations))
+	for i, d := range durations {
+		values[i] = ToMillis(d)
+	}
+	median := medianOf(values)
+
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - median)
+	}
+	return &MadStats{Count: len(values), Median: median, Mad: medianOf(deviations)}
+}
+
+// 中央値を返す（values は並び替える）。
+func medianOf(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// Durationをミリ秒に変換する。
+func ToMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// 応答時間の統計値を、1行の文字列に整形する。
+func (s *LatencyStats) String() string {
+	return fmt.Sprintf("count=%d, min=%.3fms, avg=%.3fms, p50=%.3fms, p95=%.3fms, p99=%.3fms, max=%.3fms",
+		s.Count, s.Min, s.Avg, s.P50, s.P95, s.P99, s.Max)
+}
+
+// 応答時間が閾値を超えた件数
+type ThresholdStats struct {
+	Threshold float64 `json:"threshold_ms"` // 閾値(ms)
+	Exceeded  int     `json:"exceeded"`     // 閾値を超えた件数
+	Total     int     `json:"total"`        // 全件数
+	Percent   float64 `json:"percent"`      // 閾値を超えた割合(%)
+}
+
+// 応答時間が閾値を超えた件数と割合を算出する。
+// 閾値ちょうどの応答時間は、超えていないものとして扱う。
+func CalcThresholdStats(durations []time.Duration, threshold time.Duration) *ThresholdStats {
+	exceeded := 0
+	for _, d := range durations {
+		if d > threshold {
+			exceeded++
+		}
+	}
+
+	stats := &ThresholdStats{
+		Threshold: ToMillis(threshold),
+		Exceeded:  exceeded,
+		Total:     len(durations)}
+	if len(durations) > 0 {
+		stats.Percent = float64(exceeded) / float64(len(durations)) * 100
+	}
+	return stats
+}
+
+// 閾値を超えた件数を、1行の文字列に整形する。
+func (s *ThresholdStats) String() string {
+	return fmt.Sprintf("threshold=%.3fms, exceeded=%d/%d (%.2f%%)", s.Threshold, s.Exceeded, s.Total, s.Percent)
+}
+
+// メッセージの到着間隔を記録する（ゼロ値で利用できる）。
+// 到着間隔の平均と分散は、Welford法で逐次計算する。
+type ArrivalTracker struct {
+	mutex sync.Mutex
+	last  time.Time     // 直前の到着時刻
+	count int           // 到着間隔の件数
+	mean  float64       // 到着間隔の平均(ms)
+	m2    float64       // 到着間隔の偏差平方和(ms^2)
+	gap   time.Duration // 最大の到着間隔
+	gapAt time.Time     // 最大の到着間隔の後に、メッセージが到着した時刻
+}
+
+// メッセージの到着を記録する。
+func (t *ArrivalTracker) Observe(arrival time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.last.IsZero() == false {
+		interval := ToMillis(arrival.Sub(t.last))
+		t.count++
+		delta := interval - t.mean
+		t.mean += delta / float64(t.count)
+		t.m2 += delta * (interval - t.mean)
+		if gap := arrival.Sub(t.last); gap > t.gap {
+			t.gap = gap
+			t.gapAt = arrival
+		}
+	}
+	t.last = arrival
+}
+
+// 最大の到着間隔（配信の停滞）
+type ReceiveGapStats struct {
+	Gap        float64 `json:"max_gap_ms"` // 最大の到着間隔(ms)
+	Subscriber int     `json:"subscriber"` // 停滞したSubscriberの連番
+	StartedAt  string  `json:"started_at"` // 停滞の直前にメッセージが到着した時刻(RFC3339)
+	EndedAt    string  `json:"ended_at"`   // 停滞の後にメッセージが到着した時刻(RFC3339)
+}
+
+// 最大の到着間隔を、1行の文字列に整形する。
+func (s *ReceiveGapStats) String() string {
+	return fmt.Sprintf("max=%.3fms, subscriber=%d, from=%s, to=%s", s.Gap, s.Subscriber, s.StartedAt, s.EndedAt)
+}
+
+// 複数のSubscriberのうち、最も長い到着間隔を返す。
+// 到着間隔が存在しない場合は nil を返す。
+func CalcReceiveGap(trackers []*ArrivalTracker) *ReceiveGapStats {
+	var stats *ReceiveGapStats = nil
+	var max time.Duration = 0
+	for i, t := range trackers {
+		t.mutex.Lock()
+		if t.count > 0 && (stats == nil || t.gap > max) {
+			max = t.gap
+			stats = &ReceiveGapStats{
+				Gap:        ToMillis(t.gap),
+				Subscriber: i,
+				StartedAt:  t.gapAt.Add(-t.gap).Format(time.RFC3339Nano),
+				EndedAt:    t.gapAt.Format(time.RFC3339Nano)}
+		}
+		t.mutex.Unlock()
+	}
+	return stats
+}
+
+// 到着間隔のばらつき（ジッター）
+type JitterStats struct {
+	Count  int     `json:"count"`     // 到着間隔の件数
+	Mean   float64 `json:"mean_ms"`   // 到着間隔の平均(ms)
+	Stddev float64 `json:"stddev_ms"` // 到着間隔の標準偏差(ms)
+}
+
+// 複数のSubscriberの到着間隔を合算し、ジッターを算出する。
+// 到着間隔が存在しない場合は nil を返す。
+func CalcJitterStats(trackers []*ArrivalTracker) *JitterStats {
+	count := 0
+	mean := 0.0
+	m2 := 0.0
+	for _, t := range trackers {
+		t.mutex.Lock()
+		if t.count > 0 {
+			// 2つの集合の平均と偏差平方和を合成する（Chanらの方法）。
+			total := count + t.count
+			delta := t.mean - mean
+			mean += delta * float64(t.count) / float64(total)
+			m2 += t.m2 + delta*delta*float64(count)*float64(t.count)/float64(total)
+			count = total
+		}
+		t.mutex.Unlock()
+	}
+
+	if count == 0 {
+		return nil
+	}
+	return &JitterStats{
+		Count:  count,
+		Mean:   mean,
+		Stddev: math.Sqrt(m2 / float64(count))}
+}
+
+// ジッターを、1行の文字列に整形する。
+func (s *JitterStats) String() string {
+	return fmt.Sprintf("intervals=%d, mean=%.3fms, stddev(jitter)=%.3fms", s.Count, s.Mean, s.Stddev)
+}
+
+// 接続と接続断の発生を記録する。
+// 自動再接続を行う場合の、接続の安定性を算出するために利用する。
+type ConnectionTracker struct {
+	mutex       sync.Mutex
+	connectedAt map[int]time.Time // 接続中の接続毎の接続時刻
+	connects    int               // 接続（再接続を含む）の回数
+	drops       int               // 接続断の回数
+	lifetime    time.Duration     // 接続断となった接続の、接続時間の合計
+}
+
+// ConnectionTrackerを生成する。
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{connectedAt: make(map[int]time.Time)}
+}
+
+// 接続（再接続を含む）を記録する。
+func (t *ConnectionTracker) OnConnect(id int, at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.connects++
+	t.connectedAt[id] = at
+}
+
+// 接続断を記録する。
+func (t *ConnectionTracker) OnLost(id int, at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.drops++
+	if connectedAt, ok := t.connectedAt[id]; ok {
+		t.lifetime += at.Sub(connectedAt)
+		delete(t.connectedAt, id)
+	}
+}
+
+// 接続の安定性
+type ConnectionStats struct {
+	Connections  int     `json:"connections"`      // 接続数
+	Reconnects   int     `json:"reconnects"`       // 再接続の回数
+	Drops        int     `json:"drops"`            // 接続断の回数
+	ReuseRatio   float64 `json:"reuse_ratio"`      // 接続の再利用率（接続数 / 再接続を含む接続の回数、1の場合は再接続なし）
+	MeanLifetime float64 `json:"mean_lifetime_ms"` // 接続の平均接続時間(ms)
+}
+
+// 接続の安定性を算出する。
+// 接続中の接続は、終了時刻まで接続していたものとして扱う。
+//   connections : 接続数
+//   end         : 終了時刻
+func (t *ConnectionTracker) Stats(connections int, end time.Time) *ConnectionStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := &ConnectionStats{
+		Connections: connections,
+		Drops:       t.drops}
+	if t.connects > connections {
+		stats.Reconnects = t.connects - connections
+	}
+	if t.connects > 0 {
+		stats.ReuseRatio = float64(connections) / float64(t.connects)
+	}
+
+	lifetime := t.lifetime
+	for _, connectedAt := range t.connectedAt {
+		lifetime += end.Sub(connectedAt)
+	}
+	if count := t.drops + len(t.connectedAt); count > 0 {
+		stats.MeanLifetime = ToMillis(lifetime / time.Duration(count))
+	}
+	return stats
+}
+
+// 接続の安定性を、1行の文字列に整形する。
+func (s *ConnectionStats) String() string {
+	return fmt.Sprintf("connections=%d, reconnects=%d, drops=%d, reuseRatio=%.3f, meanLifetime=%.3fms",
+		s.Connections, s.Reconnects, s.Drops, s.ReuseRatio, s.MeanLifetime)
+}
+
+// 時計のずれの検出結果
+type ClockSkewStats struct {
+	Negative int     `json:"negative"` // 負の値となった送信から受信までの時間の件数
+	Min      float64 `json:"min_ms"`   // 送信から受信までの時間の最小値(ms)
+}
+
+// 送信から受信までの時間に負の値があれば、送信側と受信側の時計がずれているとみなす。
+// 負の値がない場合は nil を返す。
+func DetectClockSkew(latencies []time.Duration) *ClockSkewStats {
+	var stats *ClockSkewStats = nil
+	for _, d := range latencies {
+		if d >= 0 {
+			continue
+		}
+		if stats == nil {
+			stats = &ClockSkewStats{Min: ToMillis(d)}
+		}
+		stats.Negative++
+		if ToMillis(d) < stats.Min {
+			stats.Min = ToMillis(d)
+		}
+	}
+	return stats
+}
+
+// Subscribe時に要求したQoSと、SUBACKで付与されたQoSの組み合わせ毎の件数
+type QosGrant struct {
+	Requested byte `json:"requested"` // 要求したQoS
+	Granted   byte `json:"granted"`   // 付与されたQoS(0x80 : 失敗)
+	Count     int  `json:"count"`     // Subscription数
+}
+
+// SUBACKの失敗を表す戻り値
+const SUBACK_FAILURE byte = 0x80
+
+// 要求したQoSと付与されたQoSの組み合わせを、複数のクライアントから並行して記録する。
+type QosGrantRecorder struct {
+	mutex  sync.Mutex
+	counts map[[2]byte]int
+}
+
+// QosGrantRecorderを生成する。
+func NewQosGrantRecorder() *QosGrantRecorder {
+	return &QosGrantRecorder{counts: make(map[[2]byte]int)}
+}
+
+// 要求したQoSと、付与されたQoSを記録する。
+func (r *QosGrantRecorder) Record(requested byte, granted byte) {
+	r.mutex.Lock()
+	r.counts[[2]byte{requested, granted}]++
+	r.mutex.Unlock()
+}
+
+// 組み合わせ毎の件数を、要求したQoS、付与されたQoSの順に並べて返す。
+// 記録がない場合は nil を返す。
+func (r *QosGrantRecorder) Summary() []QosGrant {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var grants []QosGrant = nil
+	for key, count := range r.counts {
+		grants = append(grants, QosGrant{Requested: key[0], Granted: key[1], Count: count})
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Requested != grants[j].Requested {
+			return grants[i].Requested < grants[j].Requested
+		}
+		return grants[i].Granted < grants[j].Granted
+	})
+	return grants
+}
+
+// 組み合わせ毎の件数を、1行の文字列に整形する（例 : requested 2, granted 1 on 30 subs）。
+func FormatQosGrants(grants []QosGrant) string {
+	texts := make([]string, len(grants))
+	for i, g := range grants {
+		granted := strconv.Itoa(int(g.Granted))
+		if g.Granted == SUBACK_FAILURE {
+			granted = "failure"
+		}
+		texts[i] = fmt.Sprintf("requested %d, granted %s on %d subs", g.Requested, granted, g.Count)
+	}
+	return strings.Join(texts, "; ")
+}
+
+// 送信中（完了待ち）のメッセージ数と、その最大値を記録する。
+type InflightGauge struct {
+	current int64 // 送信中のメッセージ数（atomicに更新する）
+	peak    int64 // 送信中のメッセージ数の最大値（atomicに更新する）
+}
+
+// 送信中のメッセージ数を加算し、最大値を更新する。
+func (g *InflightGauge) Add(n int64) {
+	current := atomic.AddInt64(&g.current, n)
+	for {
+		peak := atomic.LoadInt64(&g.peak)
+		if current <= peak || atomic.CompareAndSwapInt64(&g.peak, peak, current) {
+			return
+		}
+	}
+}
+
+// 送信中のメッセージ数を減算する。
+func (g *InflightGauge) Done(n int64) {
+	atomic.AddInt64(&g.current, -n)
+}
+
+// 送信中のメッセージ数を返す。
+func (g *InflightGauge) Current() int64 {
+	return atomic.LoadInt64(&g.current)
+}
+
+// 送信中のメッセージ数の最大値を返す。
+func (g *InflightGauge) Peak() int64 {
+	return atomic.LoadInt64(&g.peak)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// from ms から to ms までの1ms毎の応答時間を、ランダムな順序で生成する。
+func shuffledMillis(from int, to int) []time.Duration {
+	durations := make([]time.Duration, 0, to-from+1)
+	for i := from; i <= to; i++ {
+		durations = append(durations, time.Duration(i)*time.Millisecond)
+	}
+	rand.Shuffle(len(durations), func(i, j int) { durations[i], durations[j] = durations[j], durations[i] })
+	return durations
+}
+
+func TestStatsByQos(t *testing.T) {
+	recorder := NewLatencyRecorder()
+	qos0 := shuffledMillis(1, 100)
+	qos1 := shuffledMillis(101, 200)
+	for i := range qos0 {
+		recorder.Record(0, qos0[i])
+		recorder.Record(1, qos1[i])
+	}
+
+	stats := recorder.StatsByQos()
+	if len(stats) != 2 {
+		t.Fatalf("QoS levels = %d, want 2", len(stats))
+	}
+	expected := map[byte]LatencyStats{
+		0: {Count: 100, Min: 1, Avg: 50.5, P50: 50, P95: 95, P99: 99, Max: 100},
+		1: {Count: 100, Min: 101, Avg: 150.5, P50: 150, P95: 195, P99: 199, Max: 200}}
+	for qos, want := range expected {
+		if got := stats[qos]; got == nil || *got != want {
+			t.Errorf("QoS %d stats = %+v, want %+v", qos, got, want)
+		}
+	}
+}
+
+func TestThresholdStats(t *testing.T) {
+	threshold := 10 * time.Millisecond
+	durations := []time.Duration{
+		9 * time.Millisecond,
+		threshold - time.Nanosecond,
+		threshold, // 閾値ちょうどは超えていない
+		threshold + time.Nanosecond,
+		11 * time.Millisecond,
+		50 * time.Millisecond,
+		time.Millisecond,
+		2 * time.Millisecond}
+
+	recorder := NewLatencyRecorder()
+	for _, d := range durations {
+		recorder.Record(1, d)
+	}
+	stats := recorder.Threshold(threshold)
+	if stats.Exceeded != 3 || stats.Total != len(durations) {
+		t.Errorf("exceeded = %d/%d, want 3/%d", stats.Exceeded, stats.Total, len(durations))
+	}
+	if stats.Percent != 37.5 || stats.Threshold != 10 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	if empty := CalcThresholdStats(nil, threshold); empty.Exceeded != 0 || empty.Total != 0 || empty.Percent != 0 {
+		t.Errorf("empty stats = %+v", empty)
+	}
+}
+
+func TestJitterStats(t *testing.T) {
+	start := time.Now()
+	arrive := func(tracker *ArrivalTracker, millis ...int) {
+		for _, ms := range millis {
+			tracker.Observe(start.Add(time.Duration(ms) * time.Millisecond))
+		}
+	}
+
+	// 到着間隔は 10, 20, 30ms と 40ms となる。
+	first := &ArrivalTracker{}
+	arrive(first, 0, 10, 30, 60)
+	second := &ArrivalTracker{}
+	arrive(second, 100, 140)
+	empty := &ArrivalTracker{}
+	arrive(empty, 200)
+
+	stats := CalcJitterStats([]*ArrivalTracker{first, empty, second})
+	if stats == nil {
+		t.Fatal("no jitter stats")
+	}
+	if stats.Count != 4 || math.Abs(stats.Mean-25) > 1e-9 || math.Abs(stats.Stddev-math.Sqrt(125)) > 1e-9 {
+		t.Errorf("jitter = %+v, want count 4, mean 25ms, stddev %.3fms", stats, math.Sqrt(125))
+	}
+
+	// 一定間隔で到着する場合は、ジッターは0となる。
+	steady := &ArrivalTracker{}
+	arrive(steady, 0, 5, 10, 15, 20)
+	if stats := CalcJitterStats([]*ArrivalTracker{steady}); stats == nil || stats.Count != 4 || stats.Mean != 5 || stats.Stddev != 0 {
+		t.Errorf("steady jitter = %+v", stats)
+	}
+
+	if stats := CalcJitterStats([]*ArrivalTracker{empty}); stats != nil {
+		t.Errorf("jitter without intervals = %+v", stats)
+	}
+}
+
+func TestCalcReceiveGap(t *testing.T) {
+	start := time.Now()
+	arrive := func(tracker *ArrivalTracker, millis ...int) {
+		for _, ms := range millis {
+			tracker.Observe(start.Add(time.Duration(ms) * time.Millisecond))
+		}
+	}
+
+	// 2番目のSubscriberの 30ms - 280ms に、250msの停滞を入れる。
+	first := &ArrivalTracker{}
+	arrive(first, 0, 10, 20, 120, 130)
+	second := &ArrivalTracker{}
+	arrive(second, 0, 10, 30, 280, 290)
+	empty := &ArrivalTracker{}
+	arrive(empty, 0)
+
+	stats := CalcReceiveGap([]*ArrivalTracker{first, second, empty})
+	if stats == nil || stats.Gap != 250 || stats.Subscriber != 1 {
+		t.Fatalf("gap = %+v", stats)
+	}
+	if from := start.Add(30 * time.Millisecond).Format(time.RFC3339Nano); stats.StartedAt != from {
+		t.Errorf("started at %s, want %s", stats.StartedAt, from)
+	}
+	if to := start.Add(280 * time.Millisecond).Format(time.RFC3339Nano); stats.EndedAt != to {
+		t.Errorf("ended at %s, want %s", stats.EndedAt, to)
+	}
+
+	if stats := CalcReceiveGap([]*ArrivalTracker{empty}); stats != nil {
+		t.Errorf("gap without intervals = %+v", stats)
+	}
+}
+
+func TestConnectionTrackerStats(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	// クライアント0は2回切断して再接続し、クライアント1は終了まで接続を維持する。
+	tracker := NewConnectionTracker()
+	tracker.OnConnect(0, at(0))
+	tracker.OnConnect(1, at(0))
+	tracker.OnLost(0, at(100))
+	tracker.OnConnect(0, at(150))
+	tracker.OnLost(0, at(350))
+	tracker.OnConnect(0, at(400))
+
+	// 接続時間は 100, 200, 600, 1000ms となる。
+	stats := tracker.Stats(2, at(1000))
+	if stats.Connections != 2 || stats.Reconnects != 2 || stats.Drops != 2 || stats.ReuseRatio != 0.5 {
+		t.Errorf("stats = %+v, want 2 reconnects, 2 drops, reuse ratio 0.5", stats)
+	}
+	if math.Abs(stats.MeanLifetime-475) > 1e-9 {
+		t.Errorf("mean lifetime = %.3fms, want 475ms", stats.MeanLifetime)
+	}
+
+	// 接続断がない場合は、再利用率は1となり、接続時間は終了時刻までとなる。
+	tracker = NewConnectionTracker()
+	tracker.OnConnect(0, at(0))
+	stats = tracker.Stats(1, at(500))
+	if stats.Reconnects != 0 || stats.Drops != 0 || stats.ReuseRatio != 1 || math.Abs(stats.MeanLifetime-500) > 1e-9 {
+		t.Errorf("stats without drops = %+v", stats)
+	}
+}
+
+func TestTopicLatencyRecorder(t *testing.T) {
+	recorder := NewTopicLatencyRecorder(3)
+	record := func(topic string, count int, duration time.Duration) {
+		for i := 0; i < count; i++ {
+			recorder.Record(topic, duration)
+		}
+	}
+	record("a", 2, 10*time.Millisecond)
+	record("b", 4, 20*time.Millisecond)
+	record("c", 1, 30*time.Millisecond)
+	// 最大数を超えた後に初めて送信したTopicは、その他のTopicとしてまとめる。
+	record("d", 5, 40*time.Millisecond)
+	record("e", 1, 50*time.Millisecond)
+	record("a", 1, 10*time.Millisecond)
+
+	stats := recorder.Stats(2)
+	// 送信数の多い順に上位2つのTopicと、その他のTopicとなる。
+	expected := []struct {
+		topic string
+		count int
+		avg   float64
+	}{
+		{"b", 4, 20},
+		{"a", 3, 10},
+		{TOPIC_LATENCY_OTHER, 6, 250.0 / 6}}
+	if len(stats) != len(expected) {
+		t.Fatalf("stats = %+v", stats)
+	}
+	for i := range expected {
+		if stats[i].Topic != expected[i].topic || stats[i].Count != expected[i].count || math.Abs(stats[i].Avg-expected[i].avg) > 1e-3 {
+			t.Errorf("stats %d = %+v, want %+v", i, stats[i], expected[i])
+		}
+	}
+}
+
+func TestCalcPercentiles(t *testing.T) {
+	percentiles, err := ParsePercentiles("50, 90,99,99.9,100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1msから1000msまでの1000サンプルでは、nearest-rank法のpNは N×10 ms となる。
+	values := CalcPercentiles(shuffledMillis(1, 1000), percentiles)
+	expected := []float64{500, 900, 990, 999, 1000}
+	if len(values) != len(expected) {
+		t.Fatalf("values = %v", values)
+	}
+	for i, v := range values {
+		if v.Percentile != percentiles[i] || v.Value != expected[i] {
+			t.Errorf("p%v = %.3f, want %.3f", v.Percentile, v.Value, expected[i])
+		}
+	}
+	if text := FormatPercentiles(values[2:4]); text != "p99=990.000ms, p99.9=999.000ms" {
+		t.Errorf("format = %s", text)
+	}
+
+	for _, list := range []string{"0", "100.1", "abc", "50,"} {
+		if _, err := ParsePercentiles(list); err == nil {
+			t.Errorf("ParsePercentiles(%q) was accepted", list)
+		}
+	}
+	if CalcPercentiles(nil, percentiles) != nil {
+		t.Error("empty samples returned percentiles")
+	}
+}
+
+func TestClientRateHistogram(t *testing.T) {
+	var recorder *ClientRateRecorder
+	recorder.Record(1, time.Second) // nil の場合は何もしない
+
+	recorder = &ClientRateRecorder{}
+	// 平均的なクライアントに、遅いクライアントと速いクライアントが1つずつ混ざる。
+	for _, count := range []int{100, 100, 110, 95, 10, 200} {
+		recorder.Record(count, time.Second)
+	}
+	recorder.Record(100, 0) // 所要時間が0の場合は記録しない
+	histogram := recorder.Histogram(5)
+	expected := []HistogramBucket{
+		{Low: 10, High: 48, Count: 1},
+		{Low: 48, High: 86, Count: 0},
+		{Low: 86, High: 124, Count: 4},
+		{Low: 124, High: 162, Count: 0},
+		{Low: 162, High: 200, Count: 1}}
+	if len(histogram) != len(expected) {
+		t.Fatalf("histogram = %+v", histogram)
+	}
+	for i := range expected {
+		if math.Abs(histogram[i].Low-expected[i].Low) > 1e-9 || math.Abs(histogram[i].High-expected[i].High) > 1e-9 ||
+			histogram[i].Count != expected[i].Count {
+			t.Errorf("bucket %d = %+v, want %+v", i, histogram[i], expected[i])
+		}
+	}
+}
+
+func TestCalcMedianAbsoluteDeviation(t *testing.T) {
+	if stats := CalcMedianAbsoluteDeviation(nil); stats != nil {
+		t.Errorf("empty = %+v", stats)
+	}
+
+	// 10ms - 18ms の中央値は14ms、偏差は 0,1,1,2,2,3,3,4,4ms となる。
+	durations := shuffledMillis(10, 18)
+	stats := CalcMedianAbsoluteDeviation(durations)
+	if stats.Count != 9 || stats.Median != 14 || stats.Mad != 2 {
+		t.Fatalf("stats = %s", stats)
+	}
+
+	// 大きい方の2つを外れ値に置き換えても、中央値とMADは変わらない。
+	for i, d := range durations {
+		switch d {
+		case 17 * time.Millisecond:
+			durations[i] = 5 * time.Second
+		case 18 * time.Millisecond:
+			durations[i] = 9 * time.Second
+		}
+	}
+	if outliers := CalcMedianAbsoluteDeviation(durations); outliers.Median != 14 || outliers.Mad != 2 {
+		t.Errorf("with outliers = %s", outliers)
+	}
+
+	// サンプル数が偶数の場合は、中央の2つの平均値とする。
+	if even := CalcMedianAbsoluteDeviation(shuffledMillis(1, 4)); even.Median != 2.5 || even.Mad != 1 {
+		t.Errorf("even = %s", even)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// TLSのセッション再開を確認する、プローブ接続の回数
+const TLS_RESUMPTION_PROBES int = 10
+
+// TLSのセッション再開の確認結果
+type TlsResumptionStats struct {
+	Probes  int     `json:"probes"`  // プローブ接続の回数
+	Resumed int     `json:"resumed"` // セッションが再開されたプローブ接続の数
+	Rate    float64 `json:"rate"`    // 2回目以降のプローブ接続のうち、セッションが再開された割合(%)
+	Results []bool  `json:"results"` // プローブ接続毎の、セッションが再開されたかどうか
+}
+
+// 確認結果を、1行の文字列に整形する。
+func (s *TlsResumptionStats) String() string {
+	return fmt.Sprintf("probes=%d, resumed=%d (%.2f%%)", s.Probes, s.Resumed, s.Rate)
+}
+
+// セッションキャッシュを共有したプローブ接続を繰り返し、BrokerのTLSのセッション再開の状況を確認する。
+// pahoからは接続のTLSの状態を参照できないため、ベンチマークの接続とは別のプローブ接続で確認する
+// （ベンチマークの接続は、セッションキャッシュを利用しない）。
+// 最初の接続は必ず完全なハンドシェイクとなるため、再開の割合は2回目以降の接続から算出する。
+// Brokerからの再ネゴシエーションの要求は受け付け、接続を継続する。
+//   opts   : 実行オプション
+//   probes : プローブ接続の回数
+func ProbeTlsResumption(opts ExecOptions, probes int) (*TlsResumptionStats, error) {
+	uri, err := url.Parse(opts.Broker)
+	if err != nil {
+		return nil, err
+	}
+	if IsTlsBroker(opts.Broker) == false || uri.Scheme == "wss" {
+		return nil, errors.New("TLS resumption test is supported only for TLS brokers (not websocket)")
+	}
+
+	config := CreateTlsConfig(opts)
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.ServerName == "" {
+		config.ServerName = uri.Hostname()
+	}
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	config.Renegotiation = tls.RenegotiateFreelyAsClient
+
+	stats := &TlsResumptionStats{}
+	for i := 0; i < probes; i++ {
+		clientId := CreateClientId(opts.ClientNum+i) + "-tls"
+		password, err := ProbePassword(opts, opts.ClientNum+i)
+		if err != nil {
+			return nil, err
+		}
+		resumed, err := probeTlsSession(BrokerAddress(uri), config, clientId, opts.Username, password)
+		if err != nil {
+			return nil, err
+		}
+		stats.Probes++
+		stats.Results = append(stats.Results, resumed)
+		if resumed {
+			stats.Resumed++
+		}
+	}
+	if stats.Probes > 1 {
+		stats.Rate = float64(stats.Resumed) / float64(stats.Probes-1) * 100
+	}
+	return stats, nil
+}
+
+// 1回分のプローブ接続を行い、TLSのセッションが再開されたかどうかを返す。
+// TLS 1.3ではセッションチケットがハンドシェイク後に送られるため、CONNACKを受信してから切断する。
+func probeTlsSession(host string, config *tls.Config, clientId string, username string, password string) (bool, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", host, config)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if err := probeMqttConnect(conn, clientId, username, password); err != nil {
+		return false, err
+	}
+
+	// 切断を通知する(DISCONNECT)。
+	conn.Write([]byte{0xe0, 0x00})
+	return conn.ConnectionState().DidResume, nil
+}
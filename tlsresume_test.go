@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestProbeTlsResumption(t *testing.T) {
+	cert := newTestCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	for _, disabled := range []bool{false, true} {
+		broker := startTestBroker(t, &testBroker{
+			TlsConfig: &tls.Config{Certificates: []tls.Certificate{cert.Certificate}, SessionTicketsDisabled: disabled}})
+		opts := testExecOptions(broker.URL)
+		opts.CertConfig = ServerCertConfig{ServerCertFile: cert.CertFile}
+		opts.Username = "user"
+		opts.PasswordProvider = func(id int) (string, error) { return "refreshed", nil }
+
+		stats, err := ProbeTlsResumption(opts, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 最初のプローブは完全なハンドシェイクとなり、以降はセッションチケットにより再開する。
+		expected := TlsResumptionStats{Probes: 4, Resumed: 3, Rate: 100, Results: []bool{false, true, true, true}}
+		if disabled {
+			expected = TlsResumptionStats{Probes: 4, Resumed: 0, Rate: 0, Results: []bool{false, false, false, false}}
+		}
+		if stats.Probes != expected.Probes || stats.Resumed != expected.Resumed || stats.Rate != expected.Rate {
+			t.Errorf("tickets disabled = %t : stats = %s", disabled, stats)
+		}
+		for i, resumed := range stats.Results {
+			if resumed != expected.Results[i] {
+				t.Errorf("tickets disabled = %t : probe %d resumed = %t", disabled, i, resumed)
+			}
+		}
+
+		// プローブ接続でも、パスワードを取得して認証する。
+		for _, connect := range broker.Connects() {
+			if connect.Username != "user" || connect.Password != "refreshed" {
+				t.Errorf("probe %s : username = %s, password = %s", connect.ClientId, connect.Username, connect.Password)
+			}
+		}
+	}
+
+	if _, err := ProbeTlsResumption(testExecOptions("tcp://127.0.0.1:1883"), 1); err == nil {
+		t.Error("TCP broker was accepted")
+	}
+}
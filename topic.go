@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Topicの最大長(byte)
+const MAX_TOPIC_LENGTH int = 65535
+
+// クライアントの連番とメッセージの連番から、クライアントのTopicを生成する。
+// クライアント毎のTopic数が指定されている場合は、{topic}/{クライアントの連番}/{Topicの連番} となり、
+// メッセージの連番に従って順に切り替える。
+// 順序キーを利用する場合は、{topic}/{クライアントの連番}/key{順序キー} となる。
+func CreateClientTopic(opts ExecOptions, clientId int, seq int) string {
+	topic := fmt.Sprintf(opts.Topic+"/%d", clientId)
+	if opts.TopicsPerClient > 0 {
+		topic = fmt.Sprintf("%s/%d", topic, seq%opts.TopicsPerClient)
+	}
+	if opts.OrderingKeys > 0 {
+		topic = fmt.Sprintf("%s/key%d", topic, OrderingKey(seq, opts.OrderingKeys))
+	}
+	if opts.WildcardFilters > 0 {
+		topic += "/" + strings.Join(WildcardTopicLevels(opts.WildcardDepth), "/")
+	}
+	return topic
+}
+
+// ワイルドカードの負荷試験で利用する、深い階層のTopicのレベルを生成する（l0, l1, ...）。
+func WildcardTopicLevels(depth int) []string {
+	levels := make([]string, depth)
+	for i := range levels {
+		levels[i] = fmt.Sprintf("l%d", i)
+	}
+	return levels
+}
+
+// 深い階層のクライアントのTopicに一致する、'+' を様々なレベルに含むTopic Filterを生成する。
+// i番目のTopic Filterは、(i+1)のビットが立っているレベルを '+' に置き換えたものとなるため、
+// 最大で 2^depth-1 個の異なるTopic Filterを生成できる。
+//   opts     : 実行オプション（WildcardFilters、WildcardDepth）
+//   clientId : クライアントの連番
+func CreateWildcardFilters(opts ExecOptions, clientId int) []string {
+	base := fmt.Sprintf(opts.Topic+"/%d", clientId)
+	filters := make([]string, opts.WildcardFilters)
+	for i := range filters {
+		mask := i + 1
+		levels := WildcardTopicLevels(opts.WildcardDepth)
+		for j := range levels {
+			if mask&(1<<uint(j)) != 0 {
+				levels[j] = "+"
+			}
+		}
+		filters[i] = base + "/" + strings.Join(levels, "/")
+	}
+	return filters
+}
+
+// 複数のTopic Filterの内、メッセージのTopicに一致する最初のTopic Filterのハンドラとしてのみ、
+// handler を呼び出すハンドラを生成する。
+// pahoは、メッセージに一致する全てのTopic Filterのハンドラを呼び出すため、重複して処理しないように利用する。
+//   filters : クライアントがSubscribeするTopic Filterの一覧（一致を判定する順）
+//   filter  : ハンドラを登録するTopic Filter
+func FirstMatchHandler(filters []string, filter string, handler MQTT.MessageHandler) MQTT.MessageHandler {
+	return func(client MQTT.Client, msg MQTT.Message) {
+		for _, f := range filters {
+			if TopicMatches(f, msg.Topic()) {
+				if f == filter {
+					handler(client, msg)
+				}
+				return
+			}
+		}
+	}
+}
+
+// ワイルドカードの負荷試験で、指定された深さで生成できるTopic Filterの最大数を返す。
+func MaxWildcardFilters(depth int) int {
+	if depth >= 16 {
+		return 1<<16 - 1
+	}
+	return 1<<uint(depth) - 1
+}
+
+// Publishするメッセージのペイロードから、送信先のTopicを生成する。
+//   opts     : 実行オプション
+//   clientId : クライアントの連番
+//   seq      : クライアント内のメッセージの連番
+//   payload  : 送信するペイロード
+func CreatePublishTopic(opts ExecOptions, clientId int, seq int, payload interface{}) (string, error) {
+	topic := CreateClientTopic(opts, clientId, seq)
+	if opts.TopicFromJson != "" {
+		// ペイロードとTopicを一致させるため、ペイロードのフィールドの値をTopicに利用する。
+		text, ok := payload.(string)
+		if ok == false {
+			return "", errors.New("payload is not a text for -topic-from-json")
+		}
+		value, err := JsonFieldValue(text, opts.TopicFromJson)
+		if err != nil {
+			return "", err
+		}
+		topic = opts.Topic + "/" + value
+	}
+	if opts.UniqueTopicSuffix {
+		topic = AppendUniqueTopicSuffix(topic)
+	}
+	return topic, nil
+}
+
+// Subscribeする、クライアントのTopicを生成する。
+// クライアント毎のTopic数、または順序キーが指定されている場合は、全てのTopicに一致するTopic Filterとなる。
+func CreateSubscribeTopic(opts ExecOptions, clientId int) string {
+	topic := fmt.Sprintf(opts.Topic+"/%d", clientId)
+	if opts.TopicsPerClient > 0 || opts.OrderingKeys > 0 {
+		topic += "/+"
+	}
+	return topic
+}
+
+// MQTTのTopicの規則に従っているかを検証する。
+//   topic     : 検証するTopic
+//   subscribe : Subscribe用のTopic Filterとして検証する場合はtrue（ワイルドカードを許容する）
+func ValidateTopic(topic string, subscribe bool) error {
+	if topic == "" {
+		return errors.New("topic must not be empty")
+	}
+	if len(topic) > MAX_TOPIC_LENGTH {
+		return fmt.Errorf("topic is too long : %d bytes", len(topic))
+	}
+	if utf8.ValidString(topic) == false {
+		return errors.New("topic must be a valid UTF-8 string")
+	}
+	if strings.ContainsRune(topic, 0) {
+		return errors.New("topic must not contain a null character")
+	}
+
+	levels := strings.Split(topic, "/")
+	for i, level := range levels {
+		// 先頭の "/" による空のレベルは許容するが、それ以外の空のレベルはテンプレートの誤りとみなす。
+		if level == "" && i > 0 {
+			return fmt.Errorf("topic must not contain an empty level : %s", topic)
+		}
+
+		if strings.ContainsAny(level, "+#") == false {
+			continue
+		}
+		if subscribe == false {
+			return fmt.Errorf("wildcards are not allowed in a publish topic : %s", topic)
+		}
+		if level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("multi-level wildcard '#' must be the last level : %s", topic)
+		}
+		if level != "+" && level != "#" {
+			return fmt.Errorf("wildcards must occupy an entire level : %s", topic)
+		}
+	}
+	return nil
+}
+
+// 各クライアントが最初に利用するTopicを生成し、MQTTのTopicの規則に従っているかを検証する。
+//   opts      : 実行オプション
+//   subscribe : Subscribeの場合はtrue
+//   message   : 固定サイズのメッセージ
+func ValidateClientTopics(opts ExecOptions, subscribe bool, message string) error {
+	for id := 0; id < opts.ClientNum; id++ {
+		var topic string
+		if subscribe {
+			topic = CreateSubscribeTopic(opts, id)
+		} else {
+			var payload interface{} = message
+			if opts.PayloadTemplate != nil {
+				rendered, err := RenderPayload(opts.PayloadTemplate, id, 0)
+				if err != nil {
+					return err
+				}
+				payload = rendered
+			}
+
+			t, err := CreatePublishTopic(opts, id, 0, payload)
+			if err != nil {
+				return err
+			}
+			topic = t
+		}
+
+		if err := ValidateTopic(topic, subscribe); err != nil {
+			return fmt.Errorf("client %d : %s", id, err)
+		}
+	}
+	return nil
+}
+
+// 受信したメッセージのTopicと、Subscribeした Topic Filter の照合結果
+type TopicMatchStats struct {
+	Checked    int64  `json:"checked"`           // 照合したメッセージ数（atomicに更新する）
+	Mismatched int64  `json:"mismatched"`        // どのTopic Filterにも一致しなかったメッセージ数（atomicに更新する）
+	Example    string `json:"example,omitempty"` // 一致しなかった最初のTopic
+	exampleSet int32  // 一致しなかった最初のTopicを記録したかどうか（atomicに更新する）
+}
+
+// 受信したメッセージのTopicが、Subscribeしたいずれかの Topic Filter に一致するかを照合する。
+// 複数のクライアントから並行して呼び出せる。一致しなかった場合は false を返す。
+func (s *TopicMatchStats) Check(filters []string, topic string) bool {
+	atomic.AddInt64(&s.Checked, 1)
+	for _, filter := range filters {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	atomic.AddInt64(&s.Mismatched, 1)
+	if atomic.CompareAndSwapInt32(&s.exampleSet, 0, 1) {
+		s.Example = topic
+	}
+	return false
+}
+
+// 照合結果を加算する。
+func (s *TopicMatchStats) Add(other *TopicMatchStats) {
+	atomic.AddInt64(&s.Checked, atomic.LoadInt64(&other.Checked))
+	atomic.AddInt64(&s.Mismatched, atomic.LoadInt64(&other.Mismatched))
+	if other.Example != "" && atomic.CompareAndSwapInt32(&s.exampleSet, 0, 1) {
+		s.Example = other.Example
+	}
+}
+
+// Topic FilterにTopicが一致するかを、MQTTのTopicの一致規則に従って判定する。
+//   filter : Topic Filter（ワイルドカード '+' '#' を含んでもよい）
+//   topic  : Topic
+func TopicMatches(filter string, topic string) bool {
+	// '$' で始まるTopicは、先頭レベルのワイルドカードには一致しない。
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			// "a/#" は "a" 自体にも一致する。
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
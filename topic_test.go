@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopicFromJsonField(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 2
+	opts.Count = 3
+	opts.TopicFromJson = "device.id"
+	tmpl, err := ParsePayloadTemplate(`{"device":{"id":"dev-{{.ClientId}}-{{.Seq}}"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.PayloadTemplate = tmpl
+	opts.PayloadEncoding = PAYLOAD_ENCODING_RAW
+
+	clients := []*testClient{{}, {}}
+	PublishAllClient(context.Background(), []MQTT.Client{clients[0], clients[1]}, opts, NewMetrics(), "")
+
+	for id, client := range clients {
+		topics := client.Topics()
+		payloads := client.Payloads()
+		if len(topics) != opts.Count {
+			t.Fatalf("client %d published %d, want %d", id, len(topics), opts.Count)
+		}
+		for i := range topics {
+			var payload struct {
+				Device struct {
+					Id string `json:"id"`
+				} `json:"device"`
+			}
+			if err := json.Unmarshal(payloads[i], &payload); err != nil {
+				t.Fatal(err)
+			}
+			if expected := opts.Topic + "/" + payload.Device.Id; topics[i] != expected {
+				t.Errorf("topic = %s, want %s", topics[i], expected)
+			}
+		}
+	}
+}
+
+func TestTopicFromJsonMissingField(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.TopicFromJson = "device.id"
+	if _, err := CreatePublishTopic(opts, 0, 0, `{"device":{}}`); err == nil || strings.Contains(err.Error(), "not found") == false {
+		t.Errorf("missing field error = %v", err)
+	}
+	if _, err := CreatePublishTopic(opts, 0, 0, []byte(`{"device":{"id":"a"}}`)); err == nil {
+		t.Error("binary payload was accepted")
+	}
+}
+
+func TestValidateTopic(t *testing.T) {
+	tests := []struct {
+		topic     string
+		subscribe bool
+		message   string // 期待するエラーメッセージの一部（空の場合はエラーなし）
+	}{
+		{"/mqtt-bench/benchmark/0", false, ""},
+		{"a/+/b", true, ""},
+		{"a/#", true, ""},
+		{"", false, "must not be empty"},
+		{"a/+/b", false, "wildcards are not allowed in a publish topic"},
+		{"a/#", false, "wildcards are not allowed in a publish topic"},
+		{"a//b", false, "must not contain an empty level"},
+		{"a/b/", true, "must not contain an empty level"},
+		{"a/#/b", true, "'#' must be the last level"},
+		{"a/b+/c", true, "must occupy an entire level"},
+		{"a/\x00", false, "null character"},
+		{"a/\xff", false, "valid UTF-8"},
+		{strings.Repeat("a", MAX_TOPIC_LENGTH+1), false, "too long"}}
+	for _, test := range tests {
+		err := ValidateTopic(test.topic, test.subscribe)
+		if test.message == "" {
+			if err != nil {
+				t.Errorf("ValidateTopic(%q, %t) = %s", test.topic, test.subscribe, err)
+			}
+			continue
+		}
+		if err == nil || strings.Contains(err.Error(), test.message) == false {
+			t.Errorf("ValidateTopic(%q, %t) = %v, want %q", test.topic, test.subscribe, err, test.message)
+		}
+	}
+}
+
+func TestValidateClientTopics(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.Topic = "a//b"
+	err := ValidateClientTopics(opts, false, "message")
+	if err == nil || strings.HasPrefix(err.Error(), "client 0 : ") == false {
+		t.Errorf("ValidateClientTopics = %v", err)
+	}
+}
+
+func TestTopicsPerClient(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 3
+	opts.Count = 10
+	opts.TopicsPerClient = 4
+
+	clients := []*testClient{{}, {}, {}}
+	PublishAllClient(context.Background(), []MQTT.Client{clients[0], clients[1], clients[2]}, opts, NewMetrics(), CreateFixedSizeMessage(opts.MessageSize))
+
+	distinct := make(map[string]bool)
+	for id, client := range clients {
+		topics := client.Topics()
+		if len(topics) != opts.Count {
+			t.Fatalf("client %d published %d, want %d", id, len(topics), opts.Count)
+		}
+		filter := CreateSubscribeTopic(opts, id)
+		for seq, topic := range topics {
+			// メッセージの連番に従って、クライアントのTopicを順に切り替える。
+			if expected := fmt.Sprintf("%s/%d/%d", opts.Topic, id, seq%opts.TopicsPerClient); topic != expected {
+				t.Errorf("topic = %s, want %s", topic, expected)
+			}
+			if TopicMatches(filter, topic) == false {
+				t.Errorf("topic %s doesn't match the subscribe filter %s", topic, filter)
+			}
+			distinct[topic] = true
+		}
+	}
+	if len(distinct) != opts.ClientNum*opts.TopicsPerClient {
+		t.Errorf("distinct topics = %d, want %d", len(distinct), opts.ClientNum*opts.TopicsPerClient)
+	}
+}
+
+func TestCreateWildcardFilters(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.WildcardFilters = 3
+	expected := []string{
+		opts.Topic + "/0/+/l1/l2/l3",
+		opts.Topic + "/0/l0/+/l2/l3",
+		opts.Topic + "/0/+/+/l2/l3"}
+	filters := CreateWildcardFilters(opts, 0)
+	if strings.Join(filters, ",") != strings.Join(expected, ",") {
+		t.Fatalf("filters = %v, want %v", filters, expected)
+	}
+	topic := CreateClientTopic(opts, 0, 0)
+	for _, filter := range filters {
+		if TopicMatches(filter, topic) == false {
+			t.Errorf("topic %s doesn't match the filter %s", topic, filter)
+		}
+	}
+	if n := MaxWildcardFilters(opts.WildcardDepth); n != 15 {
+		t.Errorf("MaxWildcardFilters(4) = %d, want 15", n)
+	}
+}
+
+func TestFirstMatchHandler(t *testing.T) {
+	filters := []string{"a/+/c", "a/#", "x/#"}
+	calls := make(map[string]int)
+	var handlers []MQTT.MessageHandler
+	for _, filter := range filters {
+		handlers = append(handlers, FirstMatchHandler(filters, filter, func(filter string) MQTT.MessageHandler {
+			return func(client MQTT.Client, msg MQTT.Message) { calls[filter]++ }
+		}(filter)))
+	}
+	// pahoと同様に、一致する全てのTopic Filterのハンドラを呼び出す。
+	for _, topic := range []string{"a/b/c", "a/b", "x/y"} {
+		for i, filter := range filters {
+			if TopicMatches(filter, topic) {
+				handlers[i](nil, &testMqttMessage{topic: topic})
+			}
+		}
+	}
+	if calls["a/+/c"] != 1 || calls["a/#"] != 1 || calls["x/#"] != 1 {
+		t.Errorf("calls = %v", calls)
+	}
+}
+
+func TestPubSubWildcardFilters(t *testing.T) {
+	for _, perSubscription := range []bool{false, true} {
+		broker := startTestBroker(t, &testBroker{PerSubscription: perSubscription})
+		opts := testExecOptions(broker.URL)
+		opts.ClientNum = 1
+		opts.Count = 10
+		opts.Qos = 1
+		opts.WildcardFilters = 3
+		opts.SubscribeTimeout = 300
+		opts.DrainTimeout = time.Second
+
+		var result *Result
+		output := captureStdout(t, func() {
+			result = Execute(PubSubAllClient, opts)
+		})
+		if result == nil {
+			t.Fatalf("no result : %s", output)
+		}
+		// pahoの中では1回だけ数え、Brokerが一致したSubscription毎に配信した場合は、その件数を数える。
+		expected := result.Published
+		if perSubscription {
+			expected *= opts.WildcardFilters
+		}
+		if result.Published != opts.Count || result.TotalCount != expected {
+			t.Errorf("per subscription = %t : published = %d, received = %d, want %d",
+				perSubscription, result.Published, result.TotalCount, expected)
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/b/c", false},
+		{"+/+", "/b", true}, // 空のレベルにも一致する
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true}, // 親のレベル自体にも一致する
+		{"a/#", "b/c", false},
+		{"#", "a/b", true},
+		{"#", "$SYS/broker", false}, // '$' で始まるTopicは、先頭のワイルドカードに一致しない
+		{"+/broker", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true}}
+	for _, test := range tests {
+		if match := TopicMatches(test.filter, test.topic); match != test.match {
+			t.Errorf("TopicMatches(%q, %q) = %t, want %t", test.filter, test.topic, match, test.match)
+		}
+	}
+}
+
+func TestTopicMatchStats(t *testing.T) {
+	filters := []string{"a/+/c", "x/#"}
+	stats := &TopicMatchStats{}
+	for _, topic := range []string{"a/b/c", "x/y/z", "a/b/d", "a/c", "x"} {
+		stats.Check(filters, topic)
+	}
+	// 一致しなかったメッセージ数と、最初の一致しなかったTopicを記録する。
+	if stats.Checked != 5 || stats.Mismatched != 2 || stats.Example != "a/b/d" {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	total := &TopicMatchStats{}
+	total.Add(&TopicMatchStats{Checked: 3})
+	total.Add(stats)
+	if total.Checked != 8 || total.Mismatched != 2 || total.Example != "a/b/d" {
+		t.Errorf("total = %+v", total)
+	}
+}
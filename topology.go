@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// トポロジーでの受信待ちのデフォルトの最大時間
+const DEFAULT_TOPOLOGY_WAIT_TIME time.Duration = 10 * time.Second
+
+// Publish/Subscribeの構成定義
+type Topology struct {
+	Publishers  []TopologyPublisher  `json:"publishers"`  // Publisherの一覧
+	Subscribers []TopologySubscriber `json:"subscribers"` // Subscriberの一覧
+}
+
+// トポロジーのPublisher
+type TopologyPublisher struct {
+	Name   string   `json:"name"`   // 名前
+	Topics []string `json:"topics"` // 送信先のTopicの一覧
+	Count  int      `json:"count"`  // Topic当たりのメッセージ数
+	Qos    byte     `json:"qos"`    // QoS
+}
+
+// トポロジーのSubscriber
+type TopologySubscriber struct {
+	Name    string   `json:"name"`    // 名前
+	Filters []string `json:"filters"` // Topic Filterの一覧
+	Qos     byte     `json:"qos"`     // QoS
+}
+
+// Subscriber毎の受信結果
+type TopologyDelivery struct {
+	Name           string `json:"name"`                      // Subscriberの名前
+	Expected       int    `json:"expected"`                  // 受信が期待されるメッセージ数
+	Received       int64  `json:"received"`                  // 受信したメッセージ数
+	SubscribeError string `json:"subscribe_error,omitempty"` // Subscribeのエラー
+}
+
+// トポロジーでの配信の検証結果
+type TopologyStats struct {
+	Delivered   bool               `json:"delivered"`   // 全てのSubscriberがSubscribeに成功し、期待されるメッセージ数を受信したかどうか
+	Subscribers []TopologyDelivery `json:"subscribers"` // Subscriber毎の受信結果
+}
+
+// トポロジーの定義ファイル(JSON)を読み込む。
+func LoadTopology(filePath string) (*Topology, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	topology := &Topology{}
+	if err := json.Unmarshal(data, topology); err != nil {
+		return nil, err
+	}
+	if err := topology.Validate(); err != nil {
+		return nil, err
+	}
+	return topology, nil
+}
+
+// トポロジーの定義を検証する。
+func (t *Topology) Validate() error {
+	if len(t.Publishers) == 0 {
+		return errors.New("topology has no publishers")
+	}
+	for i, p := range t.Publishers {
+		if p.Count < 1 || p.Qos > 2 || len(p.Topics) == 0 {
+			return fmt.Errorf("invalid publisher : index=%d, name=%s", i, p.Name)
+		}
+		for _, topic := range p.Topics {
+			if err := ValidateTopic(topic, false); err != nil {
+				return fmt.Errorf("publisher %s : %s", p.Name, err)
+			}
+		}
+	}
+	for i, s := range t.Subscribers {
+		if s.Qos > 2 || len(s.Filters) == 0 {
+			return fmt.Errorf("invalid subscriber : index=%d, name=%s", i, s.Name)
+		}
+		for _, filter := range s.Filters {
+			if err := ValidateTopic(filter, true); err != nil {
+				return fmt.Errorf("subscriber %s : %s", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Subscriberが受信すると期待されるメッセージ数を返す。
+// 1つのメッセージが複数のTopic Filterに一致する場合も、1件として数える。
+func (t *Topology) ExpectedCount(subscriber TopologySubscriber) int {
+	expected := 0
+	for _, p := range t.Publishers {
+		for _, topic := range p.Topics {
+			for _, filter := range subscriber.Filters {
+				if TopicMatches(filter, topic) {
+					expected += p.Count
+					break
+				}
+			}
+		}
+	}
+	return expected
+}
+
+// トポロジーに従って、Publish/Subscribeを実行し、配信されたメッセージ数を検証する。
+// 実行結果を返す（接続エラーの場合は nil を返す）。
+// 配信の検証結果は、実行結果の Topology に格納する。
+func ExecuteTopology(opts ExecOptions, topology *Topology) *Result {
+	message := CreateFixedSizeMessage(opts.MessageSize)
+
+	// Subscriber、Publisherの順に、連番を割り振って接続する。
+	clientNum := len(topology.Subscribers) + len(topology.Publishers)
+	DefaultHandlerResults = make([]*SubscribeResult, clientNum)
+	clients := make([]MQTT.Client, 0, clientNum)
+	var batcher *ConnectBatcher = nil
+	if opts.ConnectBatchSize > 0 {
+		batcher = NewConnectBatcher(opts.ConnectBatchSize, opts.ConnectBatchPause)
+	}
+	for i := 0; i < clientNum; i++ {
+		if batcher != nil {
+			batcher.Before(i)
+		}
+		SleepConnectJitter(opts.ConnectJitter)
+		client, err := Connect(i, opts, nil, nil)
+		if err != nil {
+			if batcher != nil {
+				batcher.Failed(i)
+				fmt.Printf("Connect batches : %s\n", batcher.Stats())
+			}
+			AsyncDisconnect(clients, opts.DisconnectTimeout)
+			return nil
+		}
+		clients = append(clients, client)
+	}
+	subscribers := clients[:len(topology.Subscribers)]
+	publishers := clients[len(topology.Subscribers):]
+
+	deliveries := make([]*TopologyDelivery, len(topology.Subscribers))
+	for i, s := range topology.Subscribers {
+		delivery := &TopologyDelivery{
+			Name:     s.Name,
+			Expected: topology.ExpectedCount(s)}
+		deliveries[i] = delivery
+
+		var handler MQTT.MessageHandler = func(client MQTT.Client, msg MQTT.Message) {
+			atomic.AddInt64(&delivery.Received, 1)
+			if Debug {
+				fmt.Printf("Received message : subscriber=%s, topic=%s\n", delivery.Name, msg.Topic())
+			}
+		}
+
+		// pahoは、メッセージに一致する全てのTopic Filterのハンドラを呼び出すため、
+		// 最初に一致したTopic Filterのハンドラのみで数える。
+		filters := make(map[string]byte)
+		for _, filter := range s.Filters {
+			filters[filter] = s.Qos
+			subscribers[i].AddRoute(filter, FirstMatchHandler(s.Filters, filter, handler))
+		}
+
+		token := subscribers[i].SubscribeMultiple(filters, nil)
+		if token.Wait() && token.Error() != nil {
+			fmt.Printf("Subscribe error: %s\n", token.Error())
+			delivery.SubscribeError = token.Error().Error()
+		} else if subscribeToken, ok := token.(*MQTT.SubscribeToken); ok {
+			// 拒否されたTopic Filterがある場合も、Subscribeの失敗とする。
+			for filter, granted := range subscribeToken.Result() {
+				if granted == SUBACK_FAILURE {
+					fmt.Printf("Subscribe error: subscription refused : subscriber=%s, filter=%s\n", s.Name, filter)
+					delivery.SubscribeError = "subscription refused : " + filter
+				}
+			}
+		}
+	}
+
+	// 安定させるために、一定時間待機する。
+	time.Sleep(time.Duration(opts.PreTime) * time.Millisecond)
+
+	fmt.Printf("%s Start benchmark\n", time.Now())
+	startTime := time.Now()
+
+	wg := new(sync.WaitGroup)
+	var totalCount int64 = 0
+	for i, p := range topology.Publishers {
+		wg.Add(1)
+		go func(client MQTT.Client, publisher TopologyPublisher) {
+			defer wg.Done()
+			for index := 0; index < publisher.Count; index++ {
+				for _, topic := range publisher.Topics {
+					if Debug {
+						fmt.Printf("Publish : publisher=%s, count=%d, topic=%s\n", publisher.Name, index, topic)
+					}
+					if err := Publish(client, topic, publisher.Qos, opts.Retain, message, opts.PublishTimeout); err == nil {
+						atomic.AddInt64(&totalCount, 1)
+					}
+				}
+			}
+		}(publishers[i], p)
+	}
+	wg.Wait()
+
+	// 全てのSubscriberが期待されるメッセージ数を受信するまで待機する。
+	waitTime := DEFAULT_TOPOLOGY_WAIT_TIME
+	if opts.SubscribeTimeout > 0 {
+		waitTime = time.Duration(opts.SubscribeTimeout) * time.Millisecond
+	}
+	deadline := time.Now().Add(waitTime)
+	for IsTopologyDelivered(deliveries) == false && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	endTime := time.Now()
+	fmt.Printf("%s End benchmark\n", time.Now())
+
+	AsyncDisconnect(clients, opts.DisconnectTimeout)
+
+	duration := (endTime.Sub(startTime)).Nanoseconds() / int64(1000000) // nanosecond -> millisecond
+	throughput := CalcThroughput(totalCount, endTime.Sub(startTime))    // messages/sec
+	result := Result{
+		SchemaVersion: RESULT_SCHEMA_VERSION,
+		CorrelationId: CorrelationId,
+		Broker:        opts.Broker,
+		ClientNum:     clientNum,
+		MessageSize:   opts.MessageSize,
+		TotalCount:    int(totalCount),
+		Duration:      duration,
+		Throughput:    throughput,
+		Topology:      CreateTopologyStats(deliveries)}
+
+	fmt.Printf("\nResult : broker=%s, clients=%d, totalCount=%d, duration=%dms, throughput=%.2fmessages/sec\n",
+		result.Broker, result.ClientNum, result.TotalCount, result.Duration, result.Throughput)
+	PrintTopologyDeliveries(deliveries)
+
+	return &result
+}
+
+// Subscriber毎の受信結果から、配信の検証結果を生成する。
+// Subscribeに失敗したSubscriberがある場合も、検証の失敗とする。
+func CreateTopologyStats(deliveries []*TopologyDelivery) *TopologyStats {
+	stats := &TopologyStats{
+		Delivered:   IsTopologyDelivered(deliveries),
+		Subscribers: make([]TopologyDelivery, len(deliveries))}
+	for i, d := range deliveries {
+		stats.Subscribers[i] = TopologyDelivery{
+			Name:           d.Name,
+			Expected:       d.Expected,
+			Received:       atomic.LoadInt64(&d.Received),
+			SubscribeError: d.SubscribeError}
+		if d.SubscribeError != "" {
+			stats.Delivered = false
+		}
+	}
+	return stats
+}
+
+// 全てのSubscriberが、期待されるメッセージ数を受信したかどうかを返す。
+func IsTopologyDelivered(deliveries []*TopologyDelivery) bool {
+	for _, d := range deliveries {
+		if atomic.LoadInt64(&d.Received) < int64(d.Expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscriber毎の受信結果を出力する。
+func PrintTopologyDeliveries(deliveries []*TopologyDelivery) {
+	fmt.Printf("\nDelivery :\n")
+	for _, d := range deliveries {
+		received := atomic.LoadInt64(&d.Received)
+		status := "OK"
+		if d.SubscribeError != "" {
+			status = "SUBSCRIBE ERROR"
+		} else if received < int64(d.Expected) {
+			status = "MISSING"
+		}
+		fmt.Printf("  subscriber=%s, expected=%d, received=%d, %s\n", d.Name, d.Expected, received, status)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// テスト用のトポロジーの定義
+const testTopologyJson string = `{
+  "publishers": [
+    {"name": "sensor", "topics": ["home/kitchen/temp", "home/living/temp"], "count": 3, "qos": 1},
+    {"name": "door", "topics": ["home/door"], "count": 2, "qos": 0}
+  ],
+  "subscribers": [
+    {"name": "all", "filters": ["home/#", "home/+/temp"], "qos": 1},
+    {"name": "kitchen", "filters": ["home/kitchen/+"], "qos": 0}
+  ]
+}`
+
+// トポロジーの定義をファイルに書き出し、読み込む。
+func loadTestTopology(t *testing.T, content string) (*Topology, error) {
+	path := filepath.Join(t.TempDir(), "topology.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadTopology(path)
+}
+
+func TestLoadTopology(t *testing.T) {
+	topology, err := loadTestTopology(t, testTopologyJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(topology.Publishers) != 2 || len(topology.Subscribers) != 2 {
+		t.Fatalf("topology = %+v", topology)
+	}
+
+	// 複数のTopic Filterに一致するメッセージも、1件として数える。
+	if expected := topology.ExpectedCount(topology.Subscribers[0]); expected != 8 {
+		t.Errorf("expected count of all = %d, want 8", expected)
+	}
+	if expected := topology.ExpectedCount(topology.Subscribers[1]); expected != 3 {
+		t.Errorf("expected count of kitchen = %d, want 3", expected)
+	}
+
+	invalids := []string{
+		`{"publishers": []}`,
+		`{"publishers": [{"name": "p", "topics": ["a"], "count": 0}]}`,
+		`{"publishers": [{"name": "p", "topics": ["a/#"], "count": 1}]}`,
+		`{"publishers": [{"name": "p", "topics": ["a"], "count": 1, "qos": 3}]}`,
+		`{"publishers": [{"name": "p", "topics": ["a"], "count": 1}], "subscribers": [{"name": "s", "filters": []}]}`,
+		`{"publishers": [{"name": "p", "topics": ["a"], "count": 1}], "subscribers": [{"name": "s", "filters": ["a/#/b"]}]}`,
+		`{"publishers": `}
+	for _, content := range invalids {
+		if _, err := loadTestTopology(t, content); err == nil {
+			t.Errorf("LoadTopology(%s) succeeded", content)
+		}
+	}
+}
+
+func TestExecuteTopology(t *testing.T) {
+	topology, err := loadTestTopology(t, testTopologyJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := startTestBroker(t, &testBroker{})
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = ExecuteTopology(testExecOptions(broker.URL), topology)
+	})
+	if result == nil {
+		t.Fatalf("ExecuteTopology failed : %s", output)
+	}
+	if result.ClientNum != 4 || result.TotalCount != 8 {
+		t.Errorf("result = clients %d, totalCount %d, want 4, 8", result.ClientNum, result.TotalCount)
+	}
+	if result.Topology == nil || result.Topology.Delivered == false || len(result.Topology.Subscribers) != 2 {
+		t.Errorf("topology = %+v", result.Topology)
+	}
+
+	published := make(map[string]int)
+	for _, msg := range broker.Published() {
+		published[msg.Topic]++
+	}
+	if published["home/kitchen/temp"] != 3 || published["home/living/temp"] != 3 || published["home/door"] != 2 {
+		t.Errorf("published = %v", published)
+	}
+
+	// 重複するTopic Filterに一致するメッセージも、1件として数える。
+	for _, line := range []string{
+		"subscriber=all, expected=8, received=8, OK",
+		"subscriber=kitchen, expected=3, received=3, OK"} {
+		if strings.Contains(output, line) == false {
+			t.Errorf("output has no %q :\n%s", line, output)
+		}
+	}
+}
+
+func TestExecuteTopologyMissingDelivery(t *testing.T) {
+	topology, err := loadTestTopology(t, testTopologyJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kitchenのTopicのメッセージは、Subscriberに配信しない。
+	broker := startTestBroker(t, &testBroker{
+		Drop: func(topic string, payload []byte) bool { return topic == "home/kitchen/temp" }})
+	opts := testExecOptions(broker.URL)
+	opts.SubscribeTimeout = 200
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = ExecuteTopology(opts, topology)
+	})
+	if result == nil || result.Topology == nil {
+		t.Fatalf("ExecuteTopology failed : %s", output)
+	}
+	if result.Topology.Delivered {
+		t.Error("missing delivery was reported as delivered")
+	}
+	expected := []TopologyDelivery{
+		{Name: "all", Expected: 8, Received: 5},
+		{Name: "kitchen", Expected: 3, Received: 0}}
+	if len(result.Topology.Subscribers) != len(expected) {
+		t.Fatalf("subscribers = %+v", result.Topology.Subscribers)
+	}
+	for i, e := range expected {
+		if result.Topology.Subscribers[i] != e {
+			t.Errorf("subscriber %d = %+v, want %+v", i, result.Topology.Subscribers[i], e)
+		}
+	}
+	if strings.Contains(output, "subscriber=kitchen, expected=3, received=0, MISSING") == false {
+		t.Errorf("output has no MISSING line :\n%s", output)
+	}
+
+	// 検証結果は、JSON形式の実行結果にも含める。
+	body, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), `"topology":{"delivered":false,"subscribers":[{"name":"all","expected":8,"received":5}`) == false {
+		t.Errorf("JSON = %s", body)
+	}
+}
+
+func TestExecuteTopologySubscribeRefused(t *testing.T) {
+	topology, err := loadTestTopology(t, testTopologyJson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := startTestBroker(t, &testBroker{
+		Grant: func(filter string, qos byte) byte {
+			if filter == "home/kitchen/+" {
+				return SUBACK_FAILURE
+			}
+			return qos
+		}})
+	opts := testExecOptions(broker.URL)
+	opts.SubscribeTimeout = 200
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = ExecuteTopology(opts, topology)
+	})
+	if result == nil || result.Topology == nil {
+		t.Fatalf("ExecuteTopology failed : %s", output)
+	}
+	kitchen := result.Topology.Subscribers[1]
+	if result.Topology.Delivered || strings.Contains(kitchen.SubscribeError, "home/kitchen/+") == false {
+		t.Errorf("topology = %+v", result.Topology)
+	}
+	if strings.Contains(output, "subscriber=kitchen, expected=3, received=0, SUBSCRIBE ERROR") == false {
+		t.Errorf("output has no SUBSCRIBE ERROR line :\n%s", output)
+	}
+}
+
+func TestMainTopologyExitStatus(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topology.json")
+	if err := ioutil.WriteFile(path, []byte(testTopologyJson), 0644); err != nil {
+		t.Fatal(err)
+	}
+	broker := startTestBroker(t, &testBroker{})
+	dropping := startTestBroker(t, &testBroker{
+		Drop: func(topic string, payload []byte) bool { return topic == "home/door" }})
+
+	// 全てのメッセージが配信された場合のみ成功とする。
+	if status, output := runMainOutput(t, "-broker="+broker.URL, "-topology-file="+path, "-pretime=0"); status != 0 {
+		t.Errorf("exit status = %d, want 0 :\n%s", status, output)
+	}
+	if status, output := runMainOutput(t, "-broker="+dropping.URL, "-topology-file="+path, "-pretime=0", "-subscribe-timeout=200"); status != 1 {
+		t.Errorf("exit status with a missing delivery = %d, want 1 :\n%s", status, output)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"sync"
+	"time"
+)
+
+// 終了時のUnsubscribeの、接続毎の完了待ちのタイムアウト
+const UNSUBSCRIBE_TIMEOUT time.Duration = 10 * time.Second
+
+// 複数のクライアントから並行して、接続毎にSubscribeしたTopic Filterを記録する。
+type SubscriptionTracker struct {
+	mutex   sync.Mutex
+	clients []MQTT.Client            // 記録した順の接続
+	filters map[MQTT.Client][]string // 接続毎のTopic Filter
+}
+
+// SubscriptionTrackerを生成する。
+func NewSubscriptionTracker() *SubscriptionTracker {
+	return &SubscriptionTracker{filters: make(map[MQTT.Client][]string)}
+}
+
+// SubscribeしたTopic Filterを記録する（nil の場合は何もしない）。
+// 接続を共有する論理クライアントのTopic Filterは、同じ接続にまとめて記録する。
+func (t *SubscriptionTracker) Record(client MQTT.Client, filters ...string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.filters[client]; ok == false {
+		t.clients = append(t.clients, client)
+	}
+	t.filters[client] = append(t.filters[client], filters...)
+}
+
+// 記録した全てのTopic Filterを、接続毎にまとめてUnsubscribeする。
+// Unsubscribeしたフィルター数と、失敗したフィルター数を返す。
+func (t *SubscriptionTracker) UnsubscribeAll() (unsubscribed int, failed int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	wg := new(sync.WaitGroup)
+	results := make([]error, len(t.clients))
+	for i, client := range t.clients {
+		wg.Add(1)
+		go func(i int, client MQTT.Client) {
+			defer wg.Done()
+			results[i] = Unsubscribe(client, t.filters[client], UNSUBSCRIBE_TIMEOUT)
+		}(i, client)
+	}
+	wg.Wait()
+
+	for i, client := range t.clients {
+		if results[i] != nil {
+			fmt.Printf("Unsubscribe error: %s\n", results[i])
+			failed += len(t.filters[client])
+		} else {
+			unsubscribed += len(t.filters[client])
+		}
+	}
+	return unsubscribed, failed
+}
+
+// Topic FilterをまとめてUnsubscribeし、UNSUBACKを待つ。
+//   timeout : 完了待ちのタイムアウト（0の場合はタイムアウトしない）
+func Unsubscribe(client MQTT.Client, filters []string, timeout time.Duration) error {
+	token := client.Unsubscribe(filters...)
+	if timeout > 0 {
+		if token.WaitTimeout(timeout) == false {
+			return fmt.Errorf("unsubscribe timeout : filters=%d", len(filters))
+		}
+	} else {
+		token.Wait()
+	}
+	return token.Error()
+}
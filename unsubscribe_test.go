@@ -0,0 +1,74 @@
+package main
+
+import (
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionTracker(t *testing.T) {
+	var tracker *SubscriptionTracker
+	tracker.Record(&testClient{}, "a") // nil の場合は何もしない
+
+	clients := []*testClient{{}, {}}
+	tracker = NewSubscriptionTracker()
+	tracker.Record(clients[0], "a/0")
+	tracker.Record(clients[1], "a/1", "b/1")
+	tracker.Record(clients[0], "b/0") // 接続を共有する論理クライアント
+
+	unsubscribed, failed := tracker.UnsubscribeAll()
+	if unsubscribed != 4 || failed != 0 {
+		t.Errorf("unsubscribed = %d, failed = %d", unsubscribed, failed)
+	}
+	if filters := strings.Join(clients[0].Unsubscribed(), ","); filters != "a/0,b/0" {
+		t.Errorf("client 0 unsubscribed %s", filters)
+	}
+	if filters := strings.Join(clients[1].Unsubscribed(), ","); filters != "a/1,b/1" {
+		t.Errorf("client 1 unsubscribed %s", filters)
+	}
+}
+
+func TestUnsubscribeOnExit(t *testing.T) {
+	broker := startTestBroker(t, &testBroker{})
+	opts := testExecOptions(broker.URL)
+	opts.ClientNum = 2
+	opts.Count = 5
+	opts.Qos = 1
+	opts.WildcardFilters = 2
+	opts.SubscribeTimeout = 300
+	opts.DrainTimeout = time.Second
+	opts.UnsubscribeOnExit = true
+	// 永続セッションでは、Unsubscribeしない限りBroker側にSubscriptionが残る。
+	opts.ConnectOptions = append(opts.ConnectOptions, func(clientOpts *MQTT.ClientOptions) {
+		clientOpts.SetCleanSession(false)
+	})
+
+	var result *Result
+	output := captureStdout(t, func() {
+		result = Execute(PubSubAllClient, opts)
+	})
+	if result == nil {
+		t.Fatalf("no result : %s", output)
+	}
+
+	var expected []string
+	for id := 0; id < opts.ClientNum; id++ {
+		for filter := range ClientSubscriptions(opts, id) {
+			expected = append(expected, filter)
+		}
+		if subs := broker.Subscriptions(CreateClientId(id)); len(subs) != 0 {
+			t.Errorf("client %d : subscriptions left %v", id, subs)
+		}
+	}
+	unsubscribed := broker.Unsubscribed()
+	sort.Strings(expected)
+	sort.Strings(unsubscribed)
+	if strings.Join(unsubscribed, ",") != strings.Join(expected, ",") {
+		t.Errorf("unsubscribed = %v, want %v", unsubscribed, expected)
+	}
+	if strings.Contains(output, "Unsubscribed : filters=4, failed=0") == false {
+		t.Errorf("no unsubscribe summary : %s", output)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 安定したかを判定する、直近の間隔の数
+const STABILITY_WINDOWS int = 5
+
+// ウォームアップ中にPublishが失敗した場合の、再送までの最初の待機時間
+const WARMUP_ERROR_BACKOFF_MIN time.Duration = 10 * time.Millisecond
+
+// ウォームアップ中にPublishが連続して失敗した場合の、再送までの最大の待機時間
+const WARMUP_ERROR_BACKOFF_MAX time.Duration = 1 * time.Second
+
+// 直近の間隔のスループットの変動係数(標準偏差/平均)から、スループットが安定したかを判定する。
+type StabilityDetector struct {
+	Windows   int       // 判定に利用する、直近の間隔の数
+	Threshold float64   // 安定したとみなす変動係数の閾値
+	rates     []float64 // 直近の間隔のスループット(messages/sec)
+	cv        float64   // 直近の判定での変動係数
+}
+
+// StabilityDetectorを生成する。
+//   windows   : 判定に利用する、直近の間隔の数
+//   threshold : 安定したとみなす変動係数の閾値
+func NewStabilityDetector(windows int, threshold float64) *StabilityDetector {
+	return &StabilityDetector{Windows: windows, Threshold: threshold}
+}
+
+// 間隔のスループットを追加し、安定したかどうかを返す。
+// 間隔の数が足りない場合や、スループットが0の場合は、安定していないとみなす。
+func (d *StabilityDetector) Observe(rate float64) bool {
+	d.rates = append(d.rates, rate)
+	if len(d.rates) > d.Windows {
+		d.rates = d.rates[1:]
+	}
+	if len(d.rates) < d.Windows {
+		return false
+	}
+
+	stats := CalcWindowThroughputStats(d.rates)
+	if stats == nil || stats.Mean <= 0 {
+		return false
+	}
+	d.cv = stats.Stddev / stats.Mean
+	return d.cv < d.Threshold
+}
+
+// 直近の判定での変動係数を返す。
+func (d *StabilityDetector) CV() float64 {
+	return d.cv
+}
+
+// スループットが安定するまで、計測の対象外のメッセージをPublishし続ける。
+// 安定した場合は true を、最大時間内に安定しなかった場合や中断された場合は false を返す。
+//   clients : 論理クライアント毎の接続
+//   opts    : 実行オプション（WarmupThreshold、WarmupMaxTime、SampleInterval）
+//   message : 送信するメッセージ
+func WarmupUntilStable(ctx context.Context, clients []MQTT.Client, opts ExecOptions, message string) bool {
+	stop := make(chan struct{})
+	var count int64 = 0
+
+	wg := new(sync.WaitGroup)
+	for id := 0; id < len(clients); id++ {
+		wg.Add(1)
+		go func(clientId int) {
+			defer wg.Done()
+			client := clients[clientId]
+			qos := ClientQos(opts, clientId)
+			backoff := time.Duration(0)
+			for index := 0; ; index++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// 計測の対象外のため、Retainは付与しない。
+				if err := Publish(client, CreateClientTopic(opts, clientId, index), qos, false, message, opts.PublishTimeout); err == nil {
+					atomic.AddInt64(&count, 1)
+					backoff = 0
+					continue
+				}
+
+				// 接続断などで失敗し続ける場合に空回りしないように、待機時間を倍にしながら再送する。
+				backoff *= 2
+				if backoff < WARMUP_ERROR_BACKOFF_MIN {
+					backoff = WARMUP_ERROR_BACKOFF_MIN
+				}
+				if backoff > WARMUP_ERROR_BACKOFF_MAX {
+					backoff = WARMUP_ERROR_BACKOFF_MAX
+				}
+				select {
+				case <-stop:
+					return
+				case <-time.After(backoff):
+				}
+			}
+		}(id)
+	}
+
+	detector := NewStabilityDetector(STABILITY_WINDOWS, opts.WarmupThreshold)
+	ticker := time.NewTicker(opts.SampleInterval)
+	deadline := time.After(opts.WarmupMaxTime)
+	start := time.Now()
+	lastTime := start
+	var lastCount int64 = 0
+	stable := false
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-deadline:
+			break loop
+		case now := <-ticker.C:
+			current := atomic.LoadInt64(&count)
+			rate := float64(current-lastCount) / now.Sub(lastTime).Seconds()
+			lastTime = now
+			lastCount = current
+			if detector.Observe(rate) {
+				stable = true
+				break loop
+			}
+		}
+	}
+	ticker.Stop()
+	close(stop)
+	wg.Wait()
+
+	if stable {
+		fmt.Printf("Warmup : stable after %s (cv=%.4f, messages=%d)\n", time.Since(start), detector.CV(), atomic.LoadInt64(&count))
+	} else {
+		fmt.Printf("Warmup : not stable within %s (cv=%.4f, messages=%d)\n", time.Since(start), detector.CV(), atomic.LoadInt64(&count))
+	}
+	return stable
+}
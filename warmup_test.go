@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"testing"
+	"time"
+)
+
+func TestStabilityDetector(t *testing.T) {
+	detector := NewStabilityDetector(3, 0.05)
+	// 変動の大きい間隔の後に、安定した間隔が続く。
+	rates := []float64{100, 500, 200, 900, 1000, 1010, 990, 1000}
+	stableAt := -1
+	for i, rate := range rates {
+		if detector.Observe(rate) {
+			stableAt = i
+			break
+		}
+	}
+	// 直近の3間隔が 1000, 1010, 990 となった時点で、初めて安定したとみなす。
+	if stableAt != 6 {
+		t.Errorf("stable at window %d, want 6 (cv=%.4f)", stableAt, detector.CV())
+	}
+
+	idle := NewStabilityDetector(3, 0.05)
+	for i := 0; i < 5; i++ {
+		if idle.Observe(0) {
+			t.Fatal("zero throughput was stable")
+		}
+	}
+}
+
+func TestWarmupUntilStableBacksOffOnErrors(t *testing.T) {
+	opts := testExecOptions("tcp://127.0.0.1:1883")
+	opts.ClientNum = 1
+	opts.WarmupThreshold = 0.05
+	opts.WarmupMaxTime = 300 * time.Millisecond
+	opts.SampleInterval = 50 * time.Millisecond
+
+	client := &testClient{OnPublish: func(index int, topic string) MQTT.Token {
+		return newTestToken(errors.New("not connected"))
+	}}
+	var stable bool
+	captureStdout(t, func() {
+		stable = WarmupUntilStable(context.Background(), []MQTT.Client{client}, opts, "m")
+	})
+	if stable {
+		t.Error("warmup was stable without any publish")
+	}
+	// 10ms, 20ms, 40ms ... と待機するため、300msの間の再送は数回に留まる。
+	if published := len(client.Topics()); published > 10 {
+		t.Errorf("published %d times while failing", published)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// 進捗が止まった実行を検知し、診断情報を出力する。
+type StallWatchdog struct {
+	Timeout time.Duration      // 進捗が止まったとみなす時間
+	Output  io.Writer          // goroutineのスタックの出力先
+	abort   context.CancelFunc // 検知した場合に実行を中断する関数（nil の場合は中断しない）
+	stalled int32              // 進捗が止まったことを検知したかどうか(1 : 検知した)
+}
+
+// StallWatchdogを生成する。
+//   timeout : 進捗が止まったとみなす時間
+//   output  : goroutineのスタックの出力先
+//   abort   : 検知した場合に実行を中断する関数（nil の場合は中断しない）
+func NewStallWatchdog(timeout time.Duration, output io.Writer, abort context.CancelFunc) *StallWatchdog {
+	return &StallWatchdog{Timeout: timeout, Output: output, abort: abort}
+}
+
+// 進捗のカウンターを監視する。ctx がキャンセルされるまで処理を継続する。
+// カウンターが Timeout の間変化しなかった場合に、全goroutineのスタックを出力する
+// （進捗が再開するまでは、再度出力しない）。
+//   progress : 進捗のカウンター
+func (w *StallWatchdog) Watch(ctx context.Context, progress *int64) {
+	interval := w.Timeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := atomic.LoadInt64(progress)
+	lastChanged := time.Now()
+	dumped := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			current := atomic.LoadInt64(progress)
+			if current != last {
+				last = current
+				lastChanged = now
+				dumped = false
+				continue
+			}
+			if dumped || now.Sub(lastChanged) < w.Timeout {
+				continue
+			}
+
+			dumped = true
+			atomic.StoreInt32(&w.stalled, 1)
+			fmt.Fprintf(w.Output, "\nStall detected : no progress for %s (count=%d)\n", now.Sub(lastChanged), current)
+			fmt.Fprintf(w.Output, "%s\n", DumpGoroutines())
+			if w.abort != nil {
+				w.abort()
+			}
+		}
+	}
+}
+
+// 進捗が止まったことを検知したかどうかを返す。
+func (w *StallWatchdog) Stalled() bool {
+	return atomic.LoadInt32(&w.stalled) == 1
+}
+
+// 全goroutineのスタックを返す。
+func DumpGoroutines() []byte {
+	buffer := make([]byte, 1024*1024)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			return buffer[:n]
+		}
+		buffer = make([]byte, len(buffer)*2)
+	}
+}
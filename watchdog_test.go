@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 複数のgoroutineから書き込まれる出力先
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestStallWatchdogDumpsStacks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	output := &syncBuffer{}
+	var aborted int32 = 0
+	watchdog := NewStallWatchdog(100*time.Millisecond, output, func() { atomic.StoreInt32(&aborted, 1) })
+	var progress int64 = 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		watchdog.Watch(ctx, &progress)
+	}()
+
+	// 進捗している間は、検知しない。
+	for i := 0; i < 10; i++ {
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&progress, 1)
+	}
+	start := time.Now()
+	if watchdog.Stalled() || output.String() != "" {
+		t.Fatalf("stall detected while progressing : %s", output.String())
+	}
+
+	// 進捗が止まると、タイムアウト後にスタックを出力して中断する。
+	waitUntil(t, 2*time.Second, watchdog.Stalled)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("stall detected before the timeout : %s", elapsed)
+	}
+	waitUntil(t, time.Second, func() bool { return atomic.LoadInt32(&aborted) == 1 })
+	dump := output.String()
+	if strings.Contains(dump, "Stall detected : no progress for") == false || strings.Contains(dump, "goroutine ") == false ||
+		strings.Contains(dump, "TestStallWatchdogDumpsStacks") == false {
+		t.Errorf("stack dump = %s", dump)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestStallAbortReleasesBlockedPublishers(t *testing.T) {
+	// PUBACKを返さない間に、進捗が止まったとして中断させる。
+	broker := startTestBroker(t, &testBroker{AckDelay: time.Second})
+	opts := testExecOptions(broker.URL)
+	opts.Qos = 1
+	opts.StallTimeout = 100 * time.Millisecond
+	opts.StallAbort = true
+
+	start := time.Now()
+	var result *Result
+	captureStdout(t, func() {
+		result = Execute(PublishAllClient, opts)
+	})
+	if result != nil {
+		t.Errorf("Execute returned a result after a stall : %+v", result)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("publishers waiting for PUBACK were not released : %s", elapsed)
+	}
+}